@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/benchtiming"
+)
+
+// benchTiming runs the bench-timing subcommand and returns the exit code
+func benchTiming(args []string) int {
+	fs := flag.NewFlagSet("bench-timing", flag.ExitOnError)
+	duration := fs.Duration("duration", 30*time.Second, "how long to measure, longer runs catch rarer stalls")
+	write := fs.String("write", "", "env file to write the suggested buffers to, for example .env, optional")
+	mumbleFrame := fs.Duration("to-mumble-frame", lookupEnvOrDuration("TO_MUMBLE_FRAME", 10*time.Millisecond), "TO_MUMBLE_FRAME, [10ms, 20ms, 40ms, 60ms] duration of the audio frames sent to Mumble, as configured for the bridge, optional, (default 10ms)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mumble-discord-bridge bench-timing [options]")
+		fmt.Fprintln(fs.Output(), "Measures the wake drift of the audio loops on this host and suggests jitter buffer sizes.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !validMumbleFrame(*mumbleFrame) {
+		fmt.Fprintln(os.Stderr, "TO_MUMBLE_FRAME must be 10ms, 20ms, 40ms or 60ms, got", *mumbleFrame)
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	fmt.Printf("Measuring audio loop timing for %v, interrupt to stop early\n\n", *duration)
+	r := benchtiming.Run(ctx, nil, *duration, *mumbleFrame)
+
+	fmt.Printf("Measured %v\n", r.Duration.Round(time.Millisecond))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "loop\tinterval\twakes\tmissed\tp50\tp95\tp99\tp99.9\tmax")
+	for _, l := range r.Loops {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", l.Name, l.Interval, l.Wakes, l.Missed,
+			round(l.P50), round(l.P95), round(l.P99), round(l.P999), round(l.Max))
+	}
+	w.Flush()
+
+	rec := r.Recommend()
+	fmt.Printf("\nSuggested jitter buffers, the p99.9 drift of each path plus %v for network jitter:\n", benchtiming.NetworkAllowance)
+	for _, kv := range rec.Env() {
+		fmt.Printf("%v=%v\n", kv[0], kv[1])
+	}
+
+	if *write != "" {
+		if err := benchtiming.WriteConfig(*write, rec); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write config:", err)
+			return 1
+		}
+		fmt.Printf("\nWrote the suggested buffers to %v\n", *write)
+	}
+	return 0
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //BridgeConfig holds configuration information set at startup
@@ -41,10 +42,41 @@ func lookupEnvOrBool(key string, defaultVal bool) bool {
 	return defaultVal
 }
 
+func lookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := time.ParseDuration(val)
+		if err != nil {
+			log.Fatalf("LookupEnvOrDuration[%s]: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
+// validMumbleFrame reports whether d is a supported TO_MUMBLE_FRAME duration
+func validMumbleFrame(d time.Duration) bool {
+	switch d {
+	case 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond:
+		return true
+	}
+	return false
+}
+
+// secretFlags are masked in the logged config
+var secretFlags = map[string]bool{
+	"api-token":       true,
+	"discord-token":   true,
+	"mumble-password": true,
+}
+
 func getConfig(fs *flag.FlagSet) []string {
 	cfg := make([]string, 0, 10)
 	fs.VisitAll(func(f *flag.Flag) {
-		cfg = append(cfg, fmt.Sprintf("%s:%q", f.Name, f.Value.String()))
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "***"
+		}
+		cfg = append(cfg, fmt.Sprintf("%s:%q", f.Name, value))
 	})
 
 	return cfg
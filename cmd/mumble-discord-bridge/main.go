@@ -15,9 +15,12 @@ import (
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/stieneee/gumble/gumble"
 	"github.com/stieneee/gumble/gumbleutil"
 	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
 )
 
 var (
@@ -28,13 +31,15 @@ var (
 )
 
 func main() {
-	var err error
+	if len(os.Args) > 1 && os.Args[1] == "bench-timing" {
+		os.Exit(benchTiming(os.Args[2:]))
+	}
 
-	fmt.Println("Mumble-Discord-Bridge")
-	fmt.Println(version + " " + commit + " " + date)
+	var err error
 
 	godotenv.Load()
 
+	bridgeName := flag.String("bridge-name", lookupEnvOrString("BRIDGE_NAME", "default"), "BRIDGE_NAME, name used to identify this bridge in logs and metrics, optional, (default default)")
 	mumbleAddr := flag.String("mumble-address", lookupEnvOrString("MUMBLE_ADDRESS", ""), "MUMBLE_ADDRESS, mumble server address, example example.com, required")
 	mumblePort := flag.Int("mumble-port", lookupEnvOrInt("MUMBLE_PORT", 64738), "MUMBLE_PORT, mumble port, (default 64738)")
 	mumbleUsername := flag.String("mumble-username", lookupEnvOrString("MUMBLE_USERNAME", "Discord"), "MUMBLE_USERNAME, mumble username, (default: discord)")
@@ -54,79 +59,208 @@ func main() {
 	discordSpamChannel := flag.String("discord-spam-channel", lookupEnvOrString("DISCORD_SPAM_CHANNEL", ""), "DISOCRD_SPAM_CHANNEL, select channel for spamming mumble users, optional")
 	discordDisableBotStatus := flag.Bool("discord-disable-bot-status", lookupEnvOrBool("DISCORD_DISABLE_BOT_STATUS", false), "DISCORD_DISABLE_BOT_STATUS, disable updating bot status, (default false)")
 	mode := flag.String("mode", lookupEnvOrString("MODE", "constant"), "MODE, [constant, manual, auto] determine which mode the bridge starts in, (default constant)")
+	idlePause := flag.Bool("idle-pause", lookupEnvOrBool("IDLE_PAUSE", true), "IDLE_PAUSE, pause the audio loops while no audio is bridged instead of ticking every 10ms, optional, (default true)")
+	timerCatchUp := flag.String("timer-catch-up", lookupEnvOrString("TIMER_CATCH_UP", "burst"), "TIMER_CATCH_UP, [burst, skip, resync] how the audio loops recover from late wakes, optional, (default burst)")
+	timerResyncThreshold := flag.Duration("timer-resync-threshold", lookupEnvOrDuration("TIMER_RESYNC_THRESHOLD", 100*time.Millisecond), "TIMER_RESYNC_THRESHOLD, lag at which the resync catch-up policy restarts the loop timing, optional, (default 100ms)")
 	nice := flag.Bool("nice", lookupEnvOrBool("NICE", false), "NICE, whether the bridge should automatically try to 'nice' itself, (default false)")
 	debug := flag.Int("debug-level", lookupEnvOrInt("DEBUG", 1), "DEBUG_LEVEL, Discord debug level, optional, (default 1)")
+	logLevel := flag.String("log-level", lookupEnvOrString("LOG_LEVEL", "info"), "LOG_LEVEL, [debug, info, warn, error] minimum level of log entries, optional, (default info)")
+	logFormat := flag.String("log-format", lookupEnvOrString("LOG_FORMAT", "text"), "LOG_FORMAT, [text, json] log output format, optional, (default text)")
 	promEnable := flag.Bool("prometheus-enable", lookupEnvOrBool("PROMETHEUS_ENABLE", false), "PROMETHEUS_ENABLE, Enable prometheus metrics")
 	promPort := flag.Int("prometheus-port", lookupEnvOrInt("PROMETHEUS_PORT", 9559), "PROMETHEUS_PORT, Prometheus metrics port, optional, (default 9559)")
+	healthPort := flag.Int("health-port", lookupEnvOrInt("HEALTH_PORT", 0), "HEALTH_PORT, port serving /healthz and /readyz, 0 disables, optional, (default 0)")
+	healthTickTimeout := flag.Duration("health-tick-timeout", lookupEnvOrDuration("HEALTH_TICK_TIMEOUT", 10*time.Second), "HEALTH_TICK_TIMEOUT, max time since the last audio loop tick before the bridge is unhealthy, 0 disables, optional, (default 10s)")
+	healthMaxStartFailures := flag.Int("health-max-start-failures", lookupEnvOrInt("HEALTH_MAX_START_FAILURES", 5), "HEALTH_MAX_START_FAILURES, consecutive bridge start failures in constant mode before the bridge is unhealthy, 0 disables, optional, (default 5)")
+	dataDir := flag.String("data-dir", lookupEnvOrString("DATA_DIR", ""), "DATA_DIR, directory for local data such as the daily user statistics, optional")
+	userMetrics := flag.Bool("user-metrics", lookupEnvOrBool("USER_METRICS", false), "USER_METRICS, expose per user audio statistics as prometheus metrics, optional, (default false)")
+	userMetricsLimit := flag.Int("user-metrics-limit", lookupEnvOrInt("USER_METRICS_LIMIT", 50), "USER_METRICS_LIMIT, max number of users labelled in the per user metrics, further users are counted as other, optional, (default 50)")
+	systemdNotify := flag.Bool("systemd-notify", lookupEnvOrBool("SYSTEMD_NOTIFY", true), "SYSTEMD_NOTIFY, report readiness, status and watchdog pings when run as a systemd notify service, optional, (default true)")
+	recordDir := flag.String("record-dir", lookupEnvOrString("RECORD_DIR", ""), "RECORD_DIR, directory for session recordings and clips, enables the record commands, optional")
+	replayBuffer := flag.Duration("replay-buffer", lookupEnvOrDuration("REPLAY_BUFFER", 0), "REPLAY_BUFFER, length of the mixed audio kept in memory for the clip command, requires RECORD_DIR, 0 disables, optional, (default 0)")
+	soundboardDir := flag.String("soundboard-dir", lookupEnvOrString("SOUNDBOARD_DIR", ""), "SOUNDBOARD_DIR, directory of WAV, Ogg/Opus and FLAC files for the sound command, optional")
+	duck := flag.String("duck", lookupEnvOrString("DUCK", "none"), "DUCK, [none, mumble, discord, both] side whose speakers lower the audio relayed from the other side, optional, (default none)")
+	duckVolume := flag.Int("duck-volume", lookupEnvOrInt("DUCK_VOLUME", 25), "DUCK_VOLUME, volume of the ducked audio in percent, optional, (default 25)")
+	duckAttack := flag.Duration("duck-attack", lookupEnvOrDuration("DUCK_ATTACK", 50*time.Millisecond), "DUCK_ATTACK, time to lower the relayed audio once a user speaks, optional, (default 50ms)")
+	duckRelease := flag.Duration("duck-release", lookupEnvOrDuration("DUCK_RELEASE", 500*time.Millisecond), "DUCK_RELEASE, time to restore the relayed audio after users stop speaking, optional, (default 500ms)")
+	priorityDiscord := flag.String("priority-discord", lookupEnvOrString("PRIORITY_DISCORD", ""), "PRIORITY_DISCORD, comma separated Discord user or role IDs of priority speakers, optional")
+	priorityMumble := flag.String("priority-mumble", lookupEnvOrString("PRIORITY_MUMBLE", ""), "PRIORITY_MUMBLE, comma separated registered Mumble user IDs or ACL group names of priority speakers, optional")
+	priorityVolume := flag.Int("priority-volume", lookupEnvOrInt("PRIORITY_VOLUME", 0), "PRIORITY_VOLUME, volume of the other speakers in percent while a priority speaker speaks, optional, (default 0)")
+	gateThreshold := flag.Int("gate-threshold", lookupEnvOrInt("GATE_THRESHOLD", 0), "GATE_THRESHOLD, level in dBFS below which relayed streams are gated, for example -45, 0 disables, optional, (default 0)")
+	gateHold := flag.Duration("gate-hold", lookupEnvOrDuration("GATE_HOLD", 200*time.Millisecond), "GATE_HOLD, time the gate stays open after the level drops below the threshold, optional, (default 200ms)")
+	gateRelease := flag.Duration("gate-release", lookupEnvOrDuration("GATE_RELEASE", 100*time.Millisecond), "GATE_RELEASE, time the gate takes to close after the hold, optional, (default 100ms)")
+	gateMumble := flag.Bool("gate-mumble", lookupEnvOrBool("GATE_MUMBLE", false), "GATE_MUMBLE, also gate the Mumble streams, optional, (default false)")
+	agcTarget := flag.Int("agc-target", lookupEnvOrInt("AGC_TARGET", 0), "AGC_TARGET, speech level in dBFS the automatic gain control levels each speaker to, for example -20, 0 disables, optional, (default 0)")
+	agcMaxGain := flag.Int("agc-max-gain", lookupEnvOrInt("AGC_MAX_GAIN", 12), "AGC_MAX_GAIN, max gain or attenuation in dB of the automatic gain control, optional, (default 12)")
+	agcAdapt := flag.Duration("agc-adapt", lookupEnvOrDuration("AGC_ADAPT", 3*time.Second), "AGC_ADAPT, time the automatic gain control takes to adapt to a speaker, optional, (default 3s)")
+	mumbleFrame := flag.Duration("to-mumble-frame", lookupEnvOrDuration("TO_MUMBLE_FRAME", 10*time.Millisecond), "TO_MUMBLE_FRAME, [10ms, 20ms, 40ms, 60ms] duration of the audio frames sent to Mumble, longer frames add latency but wake the bridge less often, optional, (default 10ms)")
+	backpressureFromDiscord := flag.String("backpressure-from-discord", lookupEnvOrString("BACKPRESSURE_FROM_DISCORD", "drop-newest"), "BACKPRESSURE_FROM_DISCORD, [drop-newest, drop-oldest, time-compress] what the full buffer of a Discord user does with new audio, optional, (default drop-newest)")
+	backpressureFromMumble := flag.String("backpressure-from-mumble", lookupEnvOrString("BACKPRESSURE_FROM_MUMBLE", "drop-newest"), "BACKPRESSURE_FROM_MUMBLE, [drop-newest, drop-oldest, time-compress] what the full buffer of a Mumble user does with new audio, optional, (default drop-newest)")
+	backpressureToDiscord := flag.String("backpressure-to-discord", lookupEnvOrString("BACKPRESSURE_TO_DISCORD", "drop-newest"), "BACKPRESSURE_TO_DISCORD, [drop-newest, drop-oldest, time-compress] what the full queue toward Discord does with new audio, optional, (default drop-newest)")
+	backpressureToMumble := flag.String("backpressure-to-mumble", lookupEnvOrString("BACKPRESSURE_TO_MUMBLE", "drop-newest"), "BACKPRESSURE_TO_MUMBLE, [drop-newest, drop-oldest, time-compress] what the full queue toward Mumble does with new audio, optional, (default drop-newest)")
+	discordTimeout := flag.Duration("discord-timeout", lookupEnvOrDuration("DISCORD_TIMEOUT", 2500*time.Millisecond), "DISCORD_TIMEOUT, time the queue toward Discord may stay full before the bridge reconnects, 0 disables, optional, (default 2.5s)")
+	discordHangover := flag.Duration("to-discord-hangover", lookupEnvOrDuration("TO_DISCORD_HANGOVER", 100*time.Millisecond), "TO_DISCORD_HANGOVER, silence sent to Discord after the audio stops before the bot stops speaking, optional, (default 100ms)")
+	mumbleHangover := flag.Duration("to-mumble-hangover", lookupEnvOrDuration("TO_MUMBLE_HANGOVER", 50*time.Millisecond), "TO_MUMBLE_HANGOVER, silence sent to Mumble after the audio stops before the bot stops speaking, optional, (default 50ms)")
+	speakingHold := flag.Duration("speaking-hold", lookupEnvOrDuration("SPEAKING_HOLD", 0), "SPEAKING_HOLD, minimum time the bot keeps speaking once it starts, optional, (default 0)")
+	comfortNoise := flag.Int("comfort-noise", lookupEnvOrInt("COMFORT_NOISE", 0), "COMFORT_NOISE, level in dBFS of the noise sent instead of silence during the hangover and hold, for example -70, 0 sends silence, optional, (default 0)")
+	mixMaxSpeakers := flag.Int("mix-max-speakers", lookupEnvOrInt("MIX_MAX_SPEAKERS", 0), "MIX_MAX_SPEAKERS, max number of streams mixed at once, the loudest are kept, 0 mixes all, optional, (default 0)")
+	direction := flag.String("direction", lookupEnvOrString("DIRECTION", "both"), "DIRECTION, [both, mumble-to-discord, discord-to-mumble] which way audio is bridged, optional, (default both)")
+	oneWayMute := flag.Bool("one-way-mute", lookupEnvOrBool("ONE_WAY_MUTE", true), "ONE_WAY_MUTE, in a one-way direction show the bot muted where it does not speak and deafened on Discord when it does not listen, optional, (default true)")
+	chimeJoin := flag.String("chime-join", lookupEnvOrString("CHIME_JOIN", ""), "CHIME_JOIN, WAV, Ogg/Opus or FLAC file played into the other side when a user joins, optional")
+	chimeLeave := flag.String("chime-leave", lookupEnvOrString("CHIME_LEAVE", ""), "CHIME_LEAVE, WAV, Ogg/Opus or FLAC file played into the other side when a user leaves, optional")
+	chimeTTS := flag.String("chime-tts", lookupEnvOrString("CHIME_TTS", ""), "CHIME_TTS, command writing spoken audio to stdout for join and leave events, {text}, {name} and {event} are replaced, optional")
+	chimeVolume := flag.Int("chime-volume", lookupEnvOrInt("CHIME_VOLUME", 100), "CHIME_VOLUME, volume of the chimes and speech in percent, optional, (default 100)")
+	apiPort := flag.Int("api-port", lookupEnvOrInt("API_PORT", 0), "API_PORT, port serving the control API, 0 disables, optional, (default 0)")
+	apiBind := flag.String("api-bind", lookupEnvOrString("API_BIND", "127.0.0.1"), "API_BIND, address the control API listens on, optional, (default 127.0.0.1)")
+	apiToken := flag.String("api-token", lookupEnvOrString("API_TOKEN", ""), "API_TOKEN, bearer token required by the control API, optional")
+	healthIdleModes := flag.String("health-idle-modes", lookupEnvOrString("HEALTH_IDLE_MODES", "auto,manual"), "HEALTH_IDLE_MODES, comma separated modes that are ready while the bridge is not connected, optional, (default auto,manual)")
 
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to `file`")
 
 	flag.Parse()
-	log.Printf("app.config %v\n", getConfig(flag.CommandLine))
+
+	lvl, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	format, err := logger.ParseFormat(*logFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	lg := logger.New(os.Stdout, format, lvl).With("bridge", *bridgeName)
+
+	// Route the standard logger and discordgo through the structured logger
+	log.SetFlags(0)
+	log.SetOutput(lg.Writer(logger.LevelInfo))
+	discordgo.Logger = func(msgL, caller int, format string, a ...interface{}) {
+		l := logger.LevelDebug
+		switch msgL {
+		case discordgo.LogError:
+			l = logger.LevelError
+		case discordgo.LogWarning:
+			l = logger.LevelWarn
+		case discordgo.LogInformational:
+			l = logger.LevelInfo
+		}
+		lg.Log(l, fmt.Sprintf(format, a...), "side", "discord", "source", "discordgo")
+	}
+
+	fatal := func(msg string, kv ...interface{}) {
+		lg.Error(msg, kv...)
+		os.Exit(1)
+	}
+
+	lg.Info("Mumble-Discord-Bridge", "version", version, "commit", commit, "date", date)
+	lg.Info("app.config", "config", getConfig(flag.CommandLine))
 
 	if *mumbleAddr == "" {
-		log.Fatalln("missing mumble address")
+		fatal("missing mumble address")
 	}
 	if *mumbleUsername == "" {
-		log.Fatalln("missing mumble username")
+		fatal("missing mumble username")
 	}
 
 	if *discordToken == "" {
-		log.Fatalln("missing discord bot token")
+		fatal("missing discord bot token")
 	}
 	if *discordGID == "" {
-		log.Fatalln("missing discord gid")
+		fatal("missing discord gid")
 	}
 	if *discordCID == "" {
-		log.Fatalln("missing discord cid")
+		fatal("missing discord cid")
 	}
 	if *mode == "" {
-		log.Fatalln("missing mode set")
+		fatal("missing mode set")
+	}
+	var idleModes []bridge.BridgeMode
+	for _, m := range strings.Split(*healthIdleModes, ",") {
+		if strings.TrimSpace(m) == "" {
+			continue
+		}
+		bm, err := bridge.ParseBridgeMode(m)
+		if err != nil {
+			fatal("invalid health idle mode", "err", err)
+		}
+		idleModes = append(idleModes, bm)
+	}
+	bridgeDirection, err := bridge.ParseBridgeDirection(*direction)
+	if err != nil {
+		fatal("invalid bridge direction", "err", err)
+	}
+	if *mixMaxSpeakers < 0 {
+		fatal("MIX_MAX_SPEAKERS must not be negative")
+	}
+	if !validMumbleFrame(*mumbleFrame) {
+		fatal("TO_MUMBLE_FRAME must be 10ms, 20ms, 40ms or 60ms", "frame", *mumbleFrame)
+	}
+	var backpressure bridge.Backpressure
+	for _, q := range []struct {
+		name   string
+		value  string
+		policy *bridge.BackpressurePolicy
+	}{
+		{"BACKPRESSURE_FROM_DISCORD", *backpressureFromDiscord, &backpressure.FromDiscord},
+		{"BACKPRESSURE_FROM_MUMBLE", *backpressureFromMumble, &backpressure.FromMumble},
+		{"BACKPRESSURE_TO_DISCORD", *backpressureToDiscord, &backpressure.ToDiscord},
+		{"BACKPRESSURE_TO_MUMBLE", *backpressureToMumble, &backpressure.ToMumble},
+	} {
+		if *q.policy, err = bridge.ParseBackpressurePolicy(q.value); err != nil {
+			fatal("invalid "+q.name, "err", err)
+		}
+	}
+	if *discordTimeout < 0 {
+		fatal("DISCORD_TIMEOUT must not be negative")
+	}
+	if *discordHangover < 0 || *mumbleHangover < 0 || *speakingHold < 0 {
+		fatal("TO_DISCORD_HANGOVER, TO_MUMBLE_HANGOVER and SPEAKING_HOLD must not be negative")
+	}
+	if *comfortNoise > 0 {
+		fatal("COMFORT_NOISE must be below 0 dBFS")
+	}
+	catchUp, err := sleepct.ParseCatchUp(*timerCatchUp)
+	if err != nil {
+		fatal("invalid timer catch-up policy", "err", err)
 	}
 	if *nice {
 		err := syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), -5)
 		if err != nil {
-			log.Println("Unable to set priority. ", err)
+			lg.Warn("Unable to set priority", "err", err)
 		}
 	}
 
-	if *promEnable {
-		go bridge.StartPromServer(*promPort)
-	}
-
 	// Optional CPU Profiling
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal("could not create CPU profile: ", err)
+			fatal("could not create CPU profile", "err", err)
 		}
 		defer f.Close() // error handling omitted for example
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal("could not start CPU profile: ", err)
+			fatal("could not start CPU profile", "err", err)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
-	// Buffer Math
-	if *discordSendBuffer < 10 {
-		*discordSendBuffer = 10
+	// Buffer Math, a jitter buffer holds at least one frame
+	if *discordSendBuffer < 20 {
+		*discordSendBuffer = 20
 	}
 
-	if *mumbleSendBuffer < 10 {
-		*mumbleSendBuffer = 10
+	if ms := int(*mumbleFrame / time.Millisecond); *mumbleSendBuffer < ms {
+		*mumbleSendBuffer = ms
 	}
 
 	var discordStartStreamingCount int = int(math.Round(float64(*discordSendBuffer) / 10.0))
-	log.Println("To Discord Jitter Buffer: ", discordStartStreamingCount*10, " ms")
+	lg.Info("To Discord Jitter Buffer", "ms", discordStartStreamingCount*10)
 
 	var mumbleStartStreamCount int = int(math.Round(float64(*mumbleSendBuffer) / 10.0))
-	log.Println("To Mumble Jitter Buffer: ", mumbleStartStreamCount*10, " ms")
+	lg.Info("To Mumble Jitter Buffer", "ms", mumbleStartStreamCount*10)
 
 	// BRIDGE SETUP
 
 	Bridge := &bridge.BridgeState{
 		BridgeConfig: &bridge.BridgeConfig{
 			// MumbleConfig:   config,
+			Name:                       *bridgeName,
 			MumbleAddr:                 *mumbleAddr + ":" + strconv.Itoa(*mumblePort),
 			MumbleInsecure:             *mumbleInsecure,
 			MumbleCertificate:          *mumbleCertificate,
@@ -141,8 +275,27 @@ func main() {
 			DiscordDmSpamming:          *discordDmSpamming,
 			DiscordSpamChannel:         *discordSpamChannel,
 			DiscordDisableBotStatus:    *discordDisableBotStatus,
+			IdlePause:                  *idlePause,
+			MixMaxSpeakers:             *mixMaxSpeakers,
+			MumbleFrame:                *mumbleFrame,
+			DiscordHangover:            *discordHangover,
+			MumbleHangover:             *mumbleHangover,
+			SpeakingHold:               *speakingHold,
+			Backpressure:               backpressure,
+			DiscordTimeout:             *discordTimeout,
+			ComfortNoise:               float64(*comfortNoise),
+			TimerCatchUp:               catchUp,
+			TimerResyncThreshold:       *timerResyncThreshold,
 			Version:                    version,
+			HealthTickTimeout:          *healthTickTimeout,
+			HealthMaxStartFailures:     *healthMaxStartFailures,
+			HealthIdleModes:            idleModes,
+			Direction:                  bridgeDirection,
+			OneWayMute:                 *oneWayMute,
 		},
+		Log:               lg,
+		Metrics:           bridge.NewMetrics(*bridgeName),
+		UserStats:         bridge.NewUserStats(),
 		Connected:         false,
 		DiscordUsers:      make(map[string]bridge.DiscordUser),
 		DiscordUserVolume: make(map[string]float64),
@@ -150,103 +303,195 @@ func main() {
 		MumbleUsers:       make(map[string]bool),
 	}
 
-	bridge.PromApplicationStartTime.SetToCurrentTime()
+	Bridge.Metrics.ApplicationStartTime.SetToCurrentTime()
+	if *recordDir != "" {
+		Bridge.Recorder = bridge.NewRecorder(*recordDir, nil, lg)
+	}
+	if *replayBuffer > 0 {
+		if *recordDir == "" {
+			fatal("REPLAY_BUFFER requires RECORD_DIR for the clips")
+		}
+		Bridge.Replay = bridge.NewReplayBuffer(*recordDir, *replayBuffer, nil)
+	}
+	if *soundboardDir != "" {
+		if info, err := os.Stat(*soundboardDir); err != nil || !info.IsDir() {
+			fatal("SOUNDBOARD_DIR is not a directory", "dir", *soundboardDir)
+		}
+		Bridge.Soundboard = bridge.NewSoundboard(*soundboardDir)
+	}
+	if *chimeJoin != "" || *chimeLeave != "" || *chimeTTS != "" {
+		if *chimeVolume < 0 || *chimeVolume > 200 {
+			fatal("CHIME_VOLUME must be between 0 and 200")
+		}
+		chimes, err := bridge.NewChimes(*chimeJoin, *chimeLeave, *chimeTTS, float64(*chimeVolume)/100, lg)
+		if err != nil {
+			fatal("failed to load chimes", "err", err)
+		}
+		Bridge.Chimes = chimes
+	}
+	if *duck != "none" {
+		if *duckVolume < 0 || *duckVolume > 100 {
+			fatal("DUCK_VOLUME must be between 0 and 100")
+		}
+		ducker, err := bridge.NewDucker(*duck, float64(*duckVolume)/100, *duckAttack, *duckRelease)
+		if err != nil {
+			fatal("invalid ducking", "err", err)
+		}
+		Bridge.Ducker = ducker
+	}
+	if *priorityDiscord != "" || *priorityMumble != "" {
+		if *priorityVolume < 0 || *priorityVolume > 100 {
+			fatal("PRIORITY_VOLUME must be between 0 and 100")
+		}
+		Bridge.Priority = bridge.NewPrioritySpeakers(*priorityDiscord, *priorityMumble, float64(*priorityVolume)/100)
+	}
+	if *gateThreshold < 0 {
+		Bridge.NoiseGate = &bridge.NoiseGate{
+			Threshold: float64(*gateThreshold),
+			Hold:      *gateHold,
+			Release:   *gateRelease,
+			Mumble:    *gateMumble,
+		}
+	} else if *gateThreshold > 0 {
+		fatal("GATE_THRESHOLD must be below 0 dBFS")
+	}
+	if *agcTarget < 0 {
+		if *agcMaxGain < 0 {
+			fatal("AGC_MAX_GAIN must not be negative")
+		}
+		Bridge.AGC = &bridge.AGC{Target: float64(*agcTarget), MaxGain: float64(*agcMaxGain), Adapt: *agcAdapt}
+	} else if *agcTarget > 0 {
+		fatal("AGC_TARGET must be below 0 dBFS")
+	}
+	if *promEnable && *userMetrics {
+		Bridge.UserStats.EnableMetrics(Bridge.Metrics, *userMetricsLimit)
+	}
+	if *promEnable {
+		Bridge.Metrics.Registry().MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		go bridge.StartPromServer(*promPort, Bridge.Metrics.Handler(), lg)
+	}
 
 	// MUMBLE SETUP
 	Bridge.BridgeConfig.MumbleConfig = gumble.NewConfig()
 	Bridge.BridgeConfig.MumbleConfig.Username = *mumbleUsername
 	Bridge.BridgeConfig.MumbleConfig.Password = *mumblePassword
-	Bridge.BridgeConfig.MumbleConfig.AudioInterval = time.Millisecond * 10
+	Bridge.BridgeConfig.MumbleConfig.AudioInterval = *mumbleFrame
+	Bridge.BridgeConfig.MumbleConfig.AudioDataBytes = gumble.AudioDefaultDataBytes * int(*mumbleFrame/gumble.AudioDefaultInterval)
 
 	Bridge.MumbleListener = &bridge.MumbleListener{
 		Bridge: Bridge,
 	}
 
 	Bridge.BridgeConfig.MumbleConfig.Attach(gumbleutil.Listener{
-		Connect:     Bridge.MumbleListener.MumbleConnect,
-		UserChange:  Bridge.MumbleListener.MumbleUserChange,
-		TextMessage: Bridge.MumbleListener.MumbleTextMessage,
+		Connect:          Bridge.MumbleListener.MumbleConnect,
+		UserChange:       Bridge.MumbleListener.MumbleUserChange,
+		TextMessage:      Bridge.MumbleListener.MumbleTextMessage,
+		ACL:              Bridge.MumbleListener.MumbleACL,
+		PermissionDenied: Bridge.MumbleListener.MumblePermissionDenied,
 		// ChannelChange: Bridge.MumbleListener.MumbleChannelChange,
 	})
 
 	// DISCORD SETUP
 
 	//Connect to discord
-	Bridge.DiscordSession, err = discordgo.New("Bot " + *discordToken)
+	dg, err := discordgo.New("Bot " + *discordToken)
 	if err != nil {
-		log.Println(err)
+		lg.Error("Failed to create Discord session", "err", err)
 		return
 	}
 
-	Bridge.DiscordSession.LogLevel = *debug
-	Bridge.DiscordSession.StateEnabled = true
-	Bridge.DiscordSession.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsAllWithoutPrivileged)
-	Bridge.DiscordSession.ShouldReconnectOnError = true
+	dg.LogLevel = *debug
+	dg.StateEnabled = true
+	dg.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsAllWithoutPrivileged)
+	dg.ShouldReconnectOnError = true
+	Bridge.DiscordSession = bridge.NewDiscordSession(dg)
 	// register handlers
 	Bridge.DiscordListener = &bridge.DiscordListener{
 		Bridge: Bridge,
 	}
-	Bridge.DiscordSession.AddHandler(Bridge.DiscordListener.MessageCreate)
-	Bridge.DiscordSession.AddHandler(Bridge.DiscordListener.GuildCreate)
-	Bridge.DiscordSession.AddHandler(Bridge.DiscordListener.VoiceUpdate)
+	dg.AddHandler(Bridge.DiscordListener.MessageCreate)
+	dg.AddHandler(Bridge.DiscordListener.GuildCreate)
+	dg.AddHandler(Bridge.DiscordListener.VoiceUpdate)
 
 	// Open Discord websocket
-	err = Bridge.DiscordSession.Open()
+	err = dg.Open()
 	if err != nil {
-		log.Println(err)
+		lg.Error("Failed to open Discord session", "err", err)
 		return
 	}
-	defer Bridge.DiscordSession.Close()
+	defer dg.Close()
 
-	log.Println("Discord Bot Connected")
-	log.Printf("Discord bot looking for command !%v", *discordCommand)
+	lg.Info("Discord Bot Connected")
+	lg.Info("Discord bot looking for command", "command", "!"+*discordCommand)
 
 	switch *mode {
 	case "auto":
-		log.Println("bridge starting in automatic mode")
+		lg.Info("bridge starting in automatic mode")
 		Bridge.AutoChanDie = make(chan bool)
 		Bridge.Mode = bridge.BridgeModeAuto
 		Bridge.DiscordChannelID = Bridge.BridgeConfig.CID
 		go Bridge.AutoBridge()
 	case "manual":
-		log.Println("bridge starting in manual mode")
+		lg.Info("bridge starting in manual mode")
 		Bridge.Mode = bridge.BridgeModeManual
 	case "constant":
-		log.Println("bridge starting in constant mode")
+		lg.Info("bridge starting in constant mode")
 		Bridge.Mode = bridge.BridgeModeConstant
 		Bridge.DiscordChannelID = Bridge.BridgeConfig.CID
 		go func() {
 			for {
 				Bridge.StartBridge()
-				log.Println("Bridge died")
+				lg.Warn("Bridge died")
 				time.Sleep(5 * time.Second)
-				log.Println("Restarting")
+				lg.Info("Restarting")
 			}
 		}()
 	default:
-		Bridge.DiscordSession.Close()
-		log.Fatalln("invalid bridge mode set")
+		dg.Close()
+		fatal("invalid bridge mode set", "mode", *mode)
+	}
+
+	if *healthPort > 0 {
+		go bridge.StartHealthServer(*healthPort, Bridge)
+	}
+	if *apiPort > 0 {
+		go bridge.StartAPIServer(*apiBind, *apiPort, *apiToken, Bridge)
 	}
 
 	go Bridge.DiscordStatusUpdate()
 
+	shutdown := make(chan struct{})
+	if *systemdNotify {
+		go Bridge.SystemdNotify(shutdown)
+	}
+
+	rollupDone := make(chan struct{})
+	go func() {
+		Bridge.RollupLoop(*dataDir, shutdown)
+		close(rollupDone)
+	}()
+
 	// Shutdown on OS signal
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	<-sc
 
-	log.Println("OS Signal. Bot shutting down")
+	lg.Info("OS Signal. Bot shutting down")
+	close(shutdown)
 
 	time.AfterFunc(30*time.Second, func() {
 		os.Exit(99)
 	})
 
 	// Wait or the bridge to exit cleanly
-	Bridge.BridgeMutex.Lock()
-	if Bridge.Connected {
-		//TODO BridgeDie occasionally panics on send to closed channel
-		Bridge.BridgeDie <- true
+	if Bridge.StopBridge() {
 		Bridge.WaitExit.Wait()
 	}
-	Bridge.BridgeMutex.Unlock()
+
+	// Finish the tracks and manifest of a running recording
+	if _, err := Bridge.Recorder.Stop(); err != nil && err != bridge.ErrNotRecording && err != bridge.ErrRecorderDisabled {
+		lg.Error("Failed to stop recording", "err", err)
+	}
+
+	<-rollupDone
 }
@@ -0,0 +1,156 @@
+// Package benchtiming measures the scheduler jitter of the host with the timed loops of the bridge
+// and suggests jitter buffer sizes.
+package benchtiming
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
+)
+
+// NetworkAllowance is added to the host drift in the suggested buffers to absorb network jitter
+const NetworkAllowance = 30 * time.Millisecond
+
+// bufferStep is the increment of the jitter buffer settings
+const bufferStep = 10 * time.Millisecond
+
+// Loop names, matching the loop label of the timer metrics
+const (
+	LoopDiscordSend  = "discord_send"
+	LoopDiscordMixer = "discord_mixer"
+	LoopMumbleMixer  = "mumble_mixer"
+)
+
+// loop is a timed loop of a running bridge
+type loop struct {
+	name     string
+	interval time.Duration
+}
+
+// loops returns the timed loops of a bridge sending frames of mumbleFrame to Mumble.
+// The Discord mixer ticks once per Mumble frame, Discord frames are always 20ms.
+func loops(mumbleFrame time.Duration) []loop {
+	if mumbleFrame <= 0 {
+		mumbleFrame = 10 * time.Millisecond
+	}
+	return []loop{
+		{LoopDiscordSend, 20 * time.Millisecond},
+		{LoopDiscordMixer, mumbleFrame},
+		{LoopMumbleMixer, 10 * time.Millisecond},
+	}
+}
+
+// LoopResult is the wake drift distribution of one loop
+type LoopResult struct {
+	Name     string
+	Interval time.Duration
+	Wakes    int
+	Missed   uint64
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+	P999     time.Duration
+	Max      time.Duration
+}
+
+// Result is the outcome of a timing benchmark
+type Result struct {
+	Duration time.Duration
+	Loops    []LoopResult
+}
+
+// Recommendation holds the suggested jitter buffers
+type Recommendation struct {
+	ToDiscordBuffer time.Duration
+	ToMumbleBuffer  time.Duration
+}
+
+// Run runs the loops of the bridge concurrently on c for the duration d, or until ctx is cancelled.
+// mumbleFrame is the TO_MUMBLE_FRAME of the bridge, 10ms when not set.
+func Run(ctx context.Context, c clock.Clock, d, mumbleFrame time.Duration) Result {
+	c = clock.OrReal(c)
+	start := c.Now()
+	ls := loops(mumbleFrame)
+	results := make([]LoopResult, len(ls))
+
+	var wg sync.WaitGroup
+	for i, l := range ls {
+		wg.Add(1)
+		go func(i int, name string, interval time.Duration) {
+			defer wg.Done()
+			s := sleepct.SleepCT{Clock: c}
+			s.Start(interval)
+			drifts := make([]time.Duration, 0, int(d/interval)+1)
+			for c.Now().Sub(start) < d && ctx.Err() == nil {
+				drifts = append(drifts, time.Duration(s.SleepNextTarget(ctx, false))*time.Microsecond)
+			}
+			results[i] = summarize(name, interval, drifts, s.Stats().Missed)
+		}(i, l.name, l.interval)
+	}
+	wg.Wait()
+
+	return Result{Duration: c.Now().Sub(start), Loops: results}
+}
+
+func summarize(name string, interval time.Duration, drifts []time.Duration, missed uint64) LoopResult {
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i] < drifts[j] })
+	r := LoopResult{
+		Name:     name,
+		Interval: interval,
+		Wakes:    len(drifts),
+		Missed:   missed,
+		P50:      percentile(drifts, 500),
+		P95:      percentile(drifts, 950),
+		P99:      percentile(drifts, 990),
+		P999:     percentile(drifts, 999),
+	}
+	if len(drifts) > 0 {
+		r.Max = drifts[len(drifts)-1]
+	}
+	return r
+}
+
+// percentile returns the nearest rank quantile of the sorted drifts, given in permille
+func percentile(sorted []time.Duration, permille int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (permille*len(sorted) + 999) / 1000
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Loop returns the result of the named loop
+func (r Result) Loop(name string) LoopResult {
+	for _, l := range r.Loops {
+		if l.Name == name {
+			return l
+		}
+	}
+	return LoopResult{Name: name}
+}
+
+// Recommend suggests jitter buffers that cover the p99.9 drift of the loops on each path plus NetworkAllowance.
+// Audio to Discord passes the Mumble mixer and the Discord send loop, audio to Mumble passes the Discord mixer.
+// The buffer to Mumble holds at least one frame, like the bridge requires.
+func (r Result) Recommend() Recommendation {
+	mixer := r.Loop(LoopDiscordMixer)
+	toMumble := roundUp(mixer.P999 + NetworkAllowance)
+	if toMumble < mixer.Interval {
+		toMumble = mixer.Interval
+	}
+	return Recommendation{
+		ToDiscordBuffer: roundUp(r.Loop(LoopMumbleMixer).P999 + r.Loop(LoopDiscordSend).P999 + NetworkAllowance),
+		ToMumbleBuffer:  toMumble,
+	}
+}
+
+func roundUp(d time.Duration) time.Duration {
+	return (d + bufferStep - 1) / bufferStep * bufferStep
+}
@@ -0,0 +1,54 @@
+package benchtiming
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Env returns the recommendation as the environment options of the bridge, buffers are in milliseconds
+func (r Recommendation) Env() [][2]string {
+	return [][2]string{
+		{"TO_DISCORD_BUFFER", strconv.FormatInt(r.ToDiscordBuffer.Milliseconds(), 10)},
+		{"TO_MUMBLE_BUFFER", strconv.FormatInt(r.ToMumbleBuffer.Milliseconds(), 10)},
+	}
+}
+
+// WriteConfig sets the recommended buffers in the env file at path.
+// Existing assignments are replaced in place, other lines are kept. A missing file is created.
+func WriteConfig(path string, r Recommendation) error {
+	mode := os.FileMode(0600) // env files hold the bot token
+	var lines []string
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		content := strings.TrimSuffix(string(data), "\n")
+		if content != "" {
+			lines = strings.Split(content, "\n")
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	for _, kv := range r.Env() {
+		assignment := kv[0] + "=" + kv[1]
+		key := regexp.MustCompile(`^\s*(export\s+)?` + kv[0] + `\s*=`)
+		found := false
+		for i, l := range lines {
+			if key.MatchString(l) {
+				lines[i] = assignment
+				found = true
+			}
+		}
+		if !found {
+			lines = append(lines, assignment)
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), mode)
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"math"
+	"time"
+)
+
+// agcLimit is the peak the limiter of the automatic gain control allows (about -1 dBFS)
+const agcLimit = 29000
+
+// AGC levels each relayed speaker to the same loudness.
+// The gain of a stream slowly follows the level of its speech, within MaxGain up or down, and a limiter keeps the peaks from clipping.
+// Frames below the speaking threshold keep the gain, so pauses and background noise are not amplified.
+// A nil *AGC is valid and leaves the levels alone.
+type AGC struct {
+	Target  float64       // RMS level of speech in dBFS
+	MaxGain float64       // dB
+	Adapt   time.Duration // time constant of the gain
+}
+
+// agc is the automatic gain control of one stream, a nil *agc leaves the levels alone
+type agc struct {
+	target  float64 // dBFS
+	maxGain float64 // dB
+	rate    float64 // share of the gain error corrected per 10ms frame
+
+	gain    float64 // dB
+	applied float64 // linear gain of the last frame, including the limiter
+}
+
+// newAGC returns the gain control of a new stream
+func (a *AGC) newAGC() *agc {
+	if a == nil {
+		return nil
+	}
+	return &agc{
+		target:  a.Target,
+		maxGain: a.MaxGain,
+		rate:    rampStep(1, a.Adapt),
+		applied: 1,
+	}
+}
+
+// process applies the gain to a 10ms frame in place
+func (g *agc) process(frame []int16) {
+	if g == nil {
+		return
+	}
+	peak := 0
+	for _, v := range frame {
+		x := int(v)
+		if x < 0 {
+			x = -x
+		}
+		if x > peak {
+			peak = x
+		}
+	}
+	if level := rms(frame); level >= speakingThreshold {
+		want := math.Max(-g.maxGain, math.Min(g.maxGain, g.target-dBFS(level)))
+		g.gain += (want - g.gain) * g.rate
+	}
+	gain := math.Pow(10, g.gain/20)
+	// Limiter
+	if peak > 0 && float64(peak)*gain > agcLimit {
+		gain = agcLimit / float64(peak)
+	}
+
+	from := g.applied
+	g.applied = gain
+	if from == 1 && gain == 1 {
+		return
+	}
+	// Ramp from the gain of the last frame
+	n := float64(len(frame))
+	for i, v := range frame {
+		x := math.Round(float64(v) * (from + (gain-from)*float64(i+1)/n))
+		if x > math.MaxInt16 {
+			x = math.MaxInt16
+		} else if x < math.MinInt16 {
+			x = math.MinInt16
+		}
+		frame[i] = int16(x)
+	}
+}
@@ -0,0 +1,229 @@
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/sound"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type clipResponse struct {
+	File    string  `json:"file"`
+	Seconds float64 `json:"seconds"`
+}
+
+type soundsResponse struct {
+	Files []string         `json:"files"`
+	Queue []SoundboardItem `json:"queue"`
+}
+
+type playResponse struct {
+	SoundboardItem
+	Position int `json:"position"`
+}
+
+type stopResponse struct {
+	Stopped int `json:"stopped"`
+}
+
+type directionResponse struct {
+	Direction string `json:"direction"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiStatus maps the errors of the controls to HTTP status codes
+func apiStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRecorderDisabled), errors.Is(err, ErrReplayDisabled),
+		errors.Is(err, ErrSoundboardDisabled), errors.Is(err, ErrSoundNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrRecording), errors.Is(err, ErrNotRecording),
+		errors.Is(err, ErrNotConnected), errors.Is(err, ErrNothingPlaying), errors.Is(err, ErrSoundQueueFull),
+		errors.Is(err, ErrDirection):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidSound):
+		return http.StatusBadRequest
+	case errors.Is(err, sound.ErrFormat):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusInternalServerError
+}
+
+// APIHandler serves the control API. Requests need the bearer token when token is set.
+//
+//	GET  /recording        recorder status
+//	POST /recording/start  start recording, returns the status
+//	POST /recording/stop   stop recording, returns the manifest
+//	POST /clip             save the replay buffer, the optional seconds parameter limits the length
+//	GET  /sounds           soundboard files and queue
+//	POST /sounds/play      queue the file parameter, optional to (discord, mumble, both) and volume in percent
+//	POST /sounds/skip      skip the playing sound
+//	POST /sounds/stop      stop playing and clear the queue
+//	GET  /direction        direction of the bridge
+//	POST /direction        change the direction to the set parameter, a running bridge reconnects
+func (b *BridgeState) APIHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recording", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use GET"})
+			return
+		}
+		writeJSON(w, http.StatusOK, b.Recorder.Status())
+	})
+	mux.HandleFunc("/recording/start", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use POST"})
+			return
+		}
+		st, err := b.StartRecording("API")
+		if err != nil {
+			writeJSON(w, apiStatus(err), apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	})
+	mux.HandleFunc("/recording/stop", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use POST"})
+			return
+		}
+		m, err := b.StopRecording("API")
+		if err != nil {
+			writeJSON(w, apiStatus(err), apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+	})
+	mux.HandleFunc("/clip", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use POST"})
+			return
+		}
+		var d time.Duration
+		if s := req.FormValue("seconds"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, apiError{"invalid seconds"})
+				return
+			}
+			d = time.Duration(n) * time.Second
+		}
+		path, d, err := b.SaveClip(d, "API")
+		if err != nil {
+			writeJSON(w, apiStatus(err), apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, clipResponse{File: path, Seconds: d.Seconds()})
+	})
+	mux.HandleFunc("/sounds", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use GET"})
+			return
+		}
+		files, err := b.Soundboard.Files()
+		if err != nil {
+			writeJSON(w, apiStatus(err), apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, soundsResponse{Files: files, Queue: b.Soundboard.Queue()})
+	})
+	mux.HandleFunc("/sounds/play", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use POST"})
+			return
+		}
+		to, volume := TargetBoth, 1.0
+		if s := req.FormValue("to"); s != "" {
+			to = s
+		}
+		if s := req.FormValue("volume"); s != "" {
+			percent, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, apiError{"invalid volume"})
+				return
+			}
+			volume = percent / 100
+		}
+		item, position, err := b.PlaySound(req.FormValue("file"), to, volume, "API")
+		if err != nil {
+			writeJSON(w, apiStatus(err), apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, playResponse{SoundboardItem: item, Position: position})
+	})
+	mux.HandleFunc("/sounds/skip", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use POST"})
+			return
+		}
+		item, err := b.Soundboard.Skip()
+		if err != nil {
+			writeJSON(w, apiStatus(err), apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, item)
+	})
+	mux.HandleFunc("/sounds/stop", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use POST"})
+			return
+		}
+		if b.Soundboard == nil {
+			writeJSON(w, apiStatus(ErrSoundboardDisabled), apiError{ErrSoundboardDisabled.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, stopResponse{Stopped: b.Soundboard.Stop()})
+	})
+
+	mux.HandleFunc("/direction", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			d, err := ParseBridgeDirection(req.FormValue("set"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+				return
+			}
+			b.SetDirection(d, "API")
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use GET or POST"})
+			return
+		}
+		writeJSON(w, http.StatusOK, directionResponse{Direction: b.Direction().String()})
+	})
+
+	if token == "" {
+		return mux
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			writeJSON(w, http.StatusUnauthorized, apiError{"invalid token"})
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// StartAPIServer serves the control API on the given address and port
+func StartAPIServer(bind string, port int, token string, b *BridgeState) {
+	b.Log.Info("Starting API Server", "bind", bind, "port", port)
+	if err := http.ListenAndServe(net.JoinHostPort(bind, strconv.Itoa(port)), b.APIHandler(token)); err != nil {
+		b.Log.Error("API Server stopped", "err", err)
+	}
+}
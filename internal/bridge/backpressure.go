@@ -0,0 +1,231 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+)
+
+// BackpressurePolicy selects what a full audio queue does with a new frame
+type BackpressurePolicy int
+
+const (
+	// DropNewest drops the new frame
+	DropNewest BackpressurePolicy = iota
+	// DropOldest drops the frame that has waited the longest
+	DropOldest
+	// TimeCompress crossfades the two oldest frames into one, playing the queued audio slightly faster
+	TimeCompress
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case TimeCompress:
+		return "time-compress"
+	}
+	return "unknown"
+}
+
+// ParseBackpressurePolicy converts a policy name (drop-newest, drop-oldest, time-compress) to a BackpressurePolicy
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch strings.TrimSpace(s) {
+	case "drop-newest":
+		return DropNewest, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	case "time-compress":
+		return TimeCompress, nil
+	}
+	return DropNewest, fmt.Errorf("invalid backpressure policy %q", s)
+}
+
+// Backpressure selects the policy of each audio queue
+type Backpressure struct {
+	FromDiscord BackpressurePolicy // buffer of each Discord user
+	FromMumble  BackpressurePolicy // buffer of each Mumble user
+	ToDiscord   BackpressurePolicy // mixed audio waiting for the Discord send loop
+	ToMumble    BackpressurePolicy // mixed audio waiting for the Mumble client
+}
+
+// Audio queue names used as the queue label
+const (
+	queueFromDiscord = "from_discord"
+	queueFromMumble  = "from_mumble"
+	queueToDiscord   = "to_discord"
+	queueToMumble    = "to_mumble"
+)
+
+// audioQueue is a bounded ring of PCM frames between two parts of the audio path.
+// A full queue applies its backpressure policy, counts the lost frames and logs rate limited warnings.
+// The queue owns the frames it holds, lost frames go back to its pool.
+type audioQueue struct {
+	name     string
+	policy   BackpressurePolicy
+	size     int
+	pool     *framePool
+	lost     prometheus.Counter
+	legacy   prometheus.Counter // per-direction drop counter kept for existing dashboards, optional
+	notifyCh chan struct{}
+
+	mu       sync.Mutex
+	frames   [][]int16 // ring of size frames, count frames from head
+	head     int
+	count    int
+	overflow int // consecutive pushes to a full queue
+	log      *logger.Limiter
+}
+
+func newAudioQueue(name string, size int, policy BackpressurePolicy, pool *framePool, log *logger.Logger, m *Metrics) *audioQueue {
+	if size < 2 {
+		size = 2
+	}
+	q := &audioQueue{
+		name:     name,
+		policy:   policy,
+		size:     size,
+		pool:     pool,
+		lost:     m.queueLost.WithLabelValues(name, policy.String()),
+		notifyCh: make(chan struct{}, 1),
+		frames:   make([][]int16, size),
+	}
+	q.setLog(log)
+	return q
+}
+
+// setLog changes the logger of the queue, for streams whose user becomes known
+func (q *audioQueue) setLog(log *logger.Logger) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.log = log.With("queue", q.name, "policy", q.policy).Every(5 * time.Second)
+}
+
+// at returns the i-th frame from the head, q.mu must be held
+func (q *audioQueue) at(i int) []int16 {
+	return q.frames[(q.head+i)%q.size]
+}
+
+// add appends a frame to a queue with room, q.mu must be held
+func (q *audioQueue) add(frame []int16) {
+	q.frames[(q.head+q.count)%q.size] = frame
+	q.count++
+}
+
+// shift removes the oldest frame, q.mu must be held
+func (q *audioQueue) shift() []int16 {
+	f := q.frames[q.head]
+	q.frames[q.head] = nil
+	q.head = (q.head + 1) % q.size
+	q.count--
+	return f
+}
+
+// push adds a frame, it returns false if the queue was full and audio was lost.
+// The queue takes ownership of the frame in both cases.
+func (q *audioQueue) push(frame []int16) bool {
+	var dropped []int16
+	q.mu.Lock()
+	ok := q.count < q.size
+	if ok {
+		if q.overflow > 0 {
+			q.log.Info("Audio queue recovered", "lost", q.overflow)
+			q.overflow = 0
+		}
+		q.add(frame)
+	} else {
+		if q.overflow == 0 {
+			q.log.Warn("Audio queue full")
+		}
+		q.overflow++
+		switch {
+		case q.policy == DropNewest:
+			dropped = frame
+		case q.policy == TimeCompress && len(q.at(0)) == len(q.at(1)):
+			crossfade(q.at(0), q.at(1))
+			dropped = q.shift()
+			q.add(frame)
+		default:
+			dropped = q.shift()
+			q.add(frame)
+		}
+	}
+	q.mu.Unlock()
+
+	if !ok {
+		q.pool.put(dropped)
+		q.lost.Inc()
+		if q.legacy != nil {
+			q.legacy.Inc()
+		}
+	}
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+	return ok
+}
+
+// pop removes the oldest frame, nil if the queue is empty. The caller owns the frame.
+func (q *audioQueue) pop() []int16 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count == 0 {
+		return nil
+	}
+	return q.shift()
+}
+
+func (q *audioQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// overflowing is the time of audio lost to consecutive pushes to the full queue
+func (q *audioQueue) overflowing(frame time.Duration) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Duration(q.overflow) * frame
+}
+
+// drain sends the frames on out until ctx is done.
+// The Mumble client encodes a frame once it received the next one, so a frame goes back to the pool after two later frames were sent.
+func (q *audioQueue) drain(ctx context.Context, out chan<- gumble.AudioBuffer) {
+	var sent [2][]int16
+	for {
+		f := q.pop()
+		if f == nil {
+			select {
+			case <-q.notifyCh:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case out <- f:
+			q.pool.put(sent[0])
+			sent[0], sent[1] = sent[1], f
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// crossfade fades from a into b over one frame, compressing the two frames into b
+func crossfade(a, b []int16) {
+	n := float64(len(a))
+	for i := range b {
+		w := float64(i) / n
+		b[i] = int16(float64(a[i])*(1-w) + float64(b[i])*w)
+	}
+}
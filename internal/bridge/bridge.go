@@ -4,23 +4,22 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
-	"net"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
 )
 
 type DiscordUser struct {
 	username string
 	seen     bool
-	dm       *discordgo.Channel
+	dm       string // private channel ID, empty if unavailable
 }
 
 type BridgeMode int
@@ -31,7 +30,33 @@ const (
 	BridgeModeConstant
 )
 
+func (m BridgeMode) String() string {
+	switch m {
+	case BridgeModeAuto:
+		return "auto"
+	case BridgeModeManual:
+		return "manual"
+	case BridgeModeConstant:
+		return "constant"
+	}
+	return "unknown"
+}
+
+// ParseBridgeMode converts a mode name (auto, manual, constant) to a BridgeMode
+func ParseBridgeMode(s string) (BridgeMode, error) {
+	switch strings.TrimSpace(s) {
+	case "auto":
+		return BridgeModeAuto, nil
+	case "manual":
+		return BridgeModeManual, nil
+	case "constant":
+		return BridgeModeConstant, nil
+	}
+	return BridgeModeConstant, fmt.Errorf("invalid bridge mode %q", s)
+}
+
 type BridgeConfig struct {
+	Name                       string
 	MumbleConfig               *gumble.Config
 	MumbleAddr                 string
 	MumbleInsecure             bool
@@ -47,7 +72,25 @@ type BridgeConfig struct {
 	DiscordDmSpamming          bool
 	DiscordSpamChannel         string
 	DiscordDisableBotStatus    bool
+	IdlePause                  bool          // audio loops wait for audio instead of ticking while idle
+	MixMaxSpeakers             int           // streams mixed per tick, the loudest are kept, 0 mixes all
+	MumbleFrame                time.Duration // duration of the audio frames sent to Mumble, 10ms when not set
+	DiscordHangover            time.Duration // silence sent to Discord after the audio stops before the speaking state drops
+	MumbleHangover             time.Duration // silence sent to Mumble after the audio stops before the speaking state drops
+	SpeakingHold               time.Duration // minimum time of a speaking state
+	Backpressure               Backpressure  // policies of the full audio queues
+	DiscordTimeout             time.Duration // time the queue toward Discord may stay full before the session restarts, 0 disables
+	ComfortNoise               float64       // level of the noise sent instead of silence in dBFS, 0 sends silence
+	Direction                  BridgeDirection
+	OneWayMute                 bool // in a one-way direction the bot appears muted where it does not speak
+	TimerCatchUp               sleepct.CatchUp
+	TimerResyncThreshold       time.Duration
 	Version                    string
+
+	// Health rules
+	HealthTickTimeout      time.Duration // max age of the last audio loop tick, 0 disables the check
+	HealthMaxStartFailures int           // consecutive start failures before liveness fails in constant mode, 0 disables
+	HealthIdleModes        []BridgeMode  // modes that are healthy without a running bridge
 }
 
 // BridgeState manages dynamic information about the bridge during runtime
@@ -55,8 +98,38 @@ type BridgeState struct {
 	// The configuration data for this bridge
 	BridgeConfig *BridgeConfig
 
-	// External requests to kill the bridge
-	BridgeDie chan bool
+	// Structured logger, carries the bridge name field
+	Log *logger.Logger
+
+	// Prometheus metrics of this bridge
+	Metrics *Metrics
+
+	// Per user audio statistics, optional
+	UserStats *UserStats
+
+	// Session recorder, optional
+	Recorder *Recorder
+
+	// Replay buffer of the mixes for clips, optional
+	Replay *ReplayBuffer
+
+	// Soundboard of local audio files, optional
+	Soundboard *Soundboard
+
+	// Join and leave chimes, optional
+	Chimes *Chimes
+
+	// Cross-side ducking, optional
+	Ducker *Ducker
+
+	// Priority speakers that talk over everyone, optional
+	Priority *PrioritySpeakers
+
+	// Noise gate of the relayed streams, optional
+	NoiseGate *NoiseGate
+
+	// Automatic gain control of the relayed streams, optional
+	AGC *AGC
 
 	// Lock to only allow one bridge session at a time
 	lock sync.Mutex
@@ -70,17 +143,33 @@ type BridgeState struct {
 	// Bridge connection
 	Connected bool
 
+	// Stops the running bridge, nil while not connected
+	stop context.CancelFunc
+
+	// Time the current bridge connected and the number of failed start attempts since the last success
+	connectedAt   time.Time
+	startFailures int
+
+	// Direction of the current bridge, changes apply when it reconnects
+	sessionDirection BridgeDirection
+
 	// The bridge mode constant, auto, manual. Default is constant.
 	Mode BridgeMode
 
 	// Discord session. This is created and outside the bridge state
-	DiscordSession *discordgo.Session
+	DiscordSession DiscordSession
 
 	// Discord voice connection. Empty if not connected.
-	DiscordVoice *discordgo.VoiceConnection
+	DiscordVoice DiscordVoice
 
 	// Mumble client. Empty if not connected.
-	MumbleClient *gumble.Client
+	MumbleClient MumbleClient
+
+	// Connects the Mumble client, DialMumble if nil
+	MumbleDialer MumbleDialer
+
+	// Time source of the audio loops, the real clock if nil
+	Clock clock.Clock
 
 	// Map of Discord users tracked by this bridge.
 	DiscordUsers      map[string]DiscordUser
@@ -118,18 +207,14 @@ type BridgeState struct {
 	messagechannel string
 }
 
-func (b *BridgeState) DiscordChannels(s *discordgo.Session) {
-	channels, _ := s.GuildChannels(b.BridgeConfig.GID)
+func (b *BridgeState) DiscordChannels() {
+	channels, _ := b.DiscordSession.VoiceChannels(b.BridgeConfig.GID)
 	message := "<br/>Current channels in discord:<br/>"
 	f := func(r rune) bool {
 		return r < 'A' || r > 'z'
 	}
 
 	for _, c := range channels {
-		// Check if channel is a guild voice channel
-		if c.Type != discordgo.ChannelTypeGuildVoice {
-			continue
-		}
 		if strings.IndexFunc(c.Name, f) != -1 {
 			c.Name = regexp.MustCompile(`[^a-öA-Ö0-9 ]+`).ReplaceAllString(c.Name, "")
 		}
@@ -143,9 +228,6 @@ func (b *BridgeState) StartBridge() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.BridgeDie = make(chan bool)
-	defer close(b.BridgeDie)
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -154,32 +236,42 @@ func (b *BridgeState) StartBridge() {
 
 	var err error
 
-	promBridgeStarts.Inc()
-	promBridgeStartTime.SetToCurrentTime()
+	b.Metrics.bridgeStarts.Inc()
+	b.Metrics.bridgeStartTime.SetToCurrentTime()
 
 	// DISCORD Connect Voice
-	log.Println("Attempting to join Discord voice channel")
+	dlog := b.Log.With("side", "discord")
 	if b.DiscordChannelID == "" {
-		log.Println("Tried to start bridge but no Discord channel specified")
+		dlog.Error("Tried to start bridge but no Discord channel specified")
+		b.startFailed()
 		return
 	}
-	b.DiscordVoice, err = b.DiscordSession.ChannelVoiceJoin(b.BridgeConfig.GID, b.DiscordChannelID, false, false)
+	dlog.Info("Attempting to join Discord voice channel", "channel", b.DiscordChannelID)
+	// The direction is fixed for the session, changing it reconnects
+	direction := b.Direction()
+	oneWayMute := b.BridgeConfig.OneWayMute && direction != DirectionBoth
+	discordMute := oneWayMute && !direction.plays(sideDiscord)
+	discordDeaf := oneWayMute && !direction.plays(sideMumble)
+	b.DiscordVoice, err = b.DiscordSession.JoinVoice(b.BridgeConfig.GID, b.DiscordChannelID, discordMute, discordDeaf, b.DiscordListener.VoiceSpeakingUpdate)
 
 	if err != nil {
-		log.Println(err)
-		b.DiscordVoice.Disconnect()
+		dlog.Error("Failed to join Discord voice channel", "err", err)
+		b.startFailed()
 		return
 	}
-	b.DiscordVoice.AddHandler(b.DiscordListener.VoiceSpeakingUpdate)
 	defer b.DiscordVoice.Disconnect()
 	defer b.DiscordVoice.Speaking(false)
-	log.Println("Discord Voice Connected")
+	dlog.Info("Discord Voice Connected")
 
 	// MUMBLE Connect
 
-	b.MumbleStream = NewMumbleDuplex()
-	det := b.BridgeConfig.MumbleConfig.AudioListeners.Attach(b.MumbleStream)
-	defer det.Detach()
+	mlog := b.Log.With("side", "mumble")
+	b.MumbleStream = NewMumbleDuplex(b, mlog)
+	if direction.plays(sideDiscord) {
+		// Mumble audio is only received when it is bridged
+		det := b.BridgeConfig.MumbleConfig.AudioListeners.Attach(b.MumbleStream)
+		defer det.Detach()
+	}
 
 	var tlsConfig tls.Config
 	if b.BridgeConfig.MumbleInsecure {
@@ -189,80 +281,120 @@ func (b *BridgeState) StartBridge() {
 	if b.BridgeConfig.MumbleCertificate != "" {
 		keyFile := b.BridgeConfig.MumbleCertificate
 		if certificate, err := tls.LoadX509KeyPair(keyFile, keyFile); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+			mlog.Error("Failed to load Mumble certificate", "file", keyFile, "err", err)
 			os.Exit(1)
 		} else {
 			tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
 		}
 	}
 
-	log.Println("Attempting to join Mumble")
-	b.MumbleClient, err = gumble.DialWithDialer(new(net.Dialer), b.BridgeConfig.MumbleAddr, b.BridgeConfig.MumbleConfig, &tlsConfig)
+	mlog.Info("Attempting to join Mumble", "addr", b.BridgeConfig.MumbleAddr)
+	dial := b.MumbleDialer
+	if dial == nil {
+		dial = DialMumble
+	}
+	b.MumbleClient, err = dial(b.BridgeConfig.MumbleAddr, b.BridgeConfig.MumbleConfig, &tlsConfig)
 
 	if err != nil {
-		log.Println(err)
+		mlog.Error("Failed to connect to Mumble", "err", err)
 		b.DiscordVoice.Disconnect()
+		b.startFailed()
 		return
 	}
 	defer b.MumbleClient.Disconnect()
-	log.Println("Mumble Connected")
+	mlog.Info("Mumble Connected")
+	if oneWayMute && !direction.plays(sideMumble) {
+		b.MumbleClient.SetSelfMuted(true)
+	}
 
-	// Shared Channels
-	// Shared channels pass PCM information in 10ms chunks [480]int16
-	// These channels are internal and are not added to the bridge state.
+	// Shared Queues
+	// The queue toward Discord passes PCM information in 10ms blocks [480]int16, the queue toward Mumble whole Mumble frames
+	// These queues are internal and are not added to the bridge state.
 	var toMumble = b.MumbleClient.AudioOutgoing()
-	var toDiscord = make(chan []int16, 100)
-
-	defer close(toDiscord)
 	defer close(toMumble)
+	mumbleBlocks := frameBlocks(b.BridgeConfig.MumbleFrame, blockDuration)
+	// At least 100ms of Mumble frames, newAudioQueue keeps two frames for the longest ones
+	toMumbleQueue := newAudioQueue(queueToMumble, (10+mumbleBlocks-1)/mumbleBlocks, b.BridgeConfig.Backpressure.ToMumble, newFramePool(mumbleBlocks*blockSize), mlog, b.Metrics)
+	toMumbleQueue.legacy = b.Metrics.toMumbleDropped
+	toDiscord := newAudioQueue(queueToDiscord, 100, b.BridgeConfig.Backpressure.ToDiscord, blockPool, dlog, b.Metrics)
+	toDiscord.legacy = b.Metrics.toDiscordDropped
 
 	// From Discord
-	b.DiscordStream = NewDiscordDuplex(b)
+	b.DiscordStream = NewDiscordDuplex(b, dlog)
 
-	// Start Passing Between
+	// Wake the paused mixers when a sound starts
+	dd, md := b.DiscordStream, b.MumbleStream
+	wake := func() {
+		dd.discordReceiveSleepTick.Notify()
+		md.mumbleSleepTick.Notify()
+	}
+	b.Soundboard.setWake(wake, direction)
+	b.Chimes.setWake(wake, direction)
 
-	// From Mumble
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		b.MumbleStream.fromMumbleMixer(ctx, cancel, toDiscord)
-	}()
+	// Speaking activity of the last session is stale
+	b.Ducker.reset(b.Clock)
+	b.Priority.reset()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		b.DiscordStream.discordReceivePCM(ctx, cancel)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		b.DiscordStream.fromDiscordMixer(ctx, toMumble)
-	}()
+	// Start Passing Between
+	// A one-way direction does not run the loops of the other direction
+
+	if direction.plays(sideDiscord) {
+		// From Mumble
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.MumbleStream.fromMumbleMixer(ctx, cancel, toDiscord, b.DiscordStream.discordSendSleepTick.Notify, b.BridgeConfig.DiscordTimeout)
+		}()
+
+		// To Discord
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.DiscordStream.discordSendPCM(ctx, cancel, toDiscord)
+		}()
+	}
 
-	// To Discord
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		b.DiscordStream.discordSendPCM(ctx, cancel, toDiscord)
-	}()
+	if direction.plays(sideMumble) {
+		// From Discord
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.DiscordStream.discordReceivePCM(ctx, cancel)
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.DiscordStream.fromDiscordMixer(ctx, toMumbleQueue)
+		}()
+
+		// To Mumble
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			toMumbleQueue.drain(ctx, toMumble)
+		}()
+	}
 
 	// Monitor
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		ticker := time.NewTicker(500 * time.Millisecond)
+		timers := b.loopTimers()
 		for {
 			select {
 			case <-ticker.C:
-				if b.MumbleClient == nil || b.MumbleClient.State() != 2 {
+				b.Metrics.observeTimers(timers)
+				if b.MumbleClient == nil || b.MumbleClient.State() != gumble.StateSynced {
 					if b.MumbleClient != nil {
-						log.Println("Lost mumble connection " + strconv.Itoa(int(b.MumbleClient.State())))
+						mlog.Warn("Lost mumble connection", "state", int(b.MumbleClient.State()))
 					} else {
-						log.Println("Lost mumble connection due to bridge dieing")
+						mlog.Warn("Lost mumble connection due to bridge dieing")
 					}
 					cancel()
 				}
 			case <-ctx.Done():
+				b.Metrics.observeTimers(timers)
 				return
 			}
 		}
@@ -270,23 +402,30 @@ func (b *BridgeState) StartBridge() {
 
 	b.BridgeMutex.Lock()
 	b.Connected = true
-	b.BridgeMutex.Unlock()
-
-	// Hold until cancelled or external die request
-	select {
-	case <-ctx.Done():
-		log.Println("Bridge internal context cancel")
-	case <-b.BridgeDie:
-		log.Println("Bridge die request received")
+	b.stop = func() {
+		b.Log.Info("Bridge stop requested")
 		cancel()
 	}
+	b.connectedAt = time.Now()
+	b.sessionDirection = direction
+	b.startFailures = 0
+	b.BridgeMutex.Unlock()
+
+	// Hold until cancelled internally or by StopBridge
+	<-ctx.Done()
+	b.Log.Info("Bridge context cancelled")
 
 	b.BridgeMutex.Lock()
 	b.Connected = false
+	b.stop = nil
 	b.BridgeMutex.Unlock()
 
 	wg.Wait()
-	log.Println("Terminating Bridge")
+	b.Soundboard.setWake(nil, direction)
+	b.Soundboard.Stop()
+	b.Chimes.setWake(nil, direction)
+	b.Chimes.stop()
+	b.Log.Info("Terminating Bridge")
 	b.MumbleUsersMutex.Lock()
 	b.MumbleUsers = make(map[string]bool)
 	b.MumbleUsersMutex.Unlock()
@@ -295,6 +434,28 @@ func (b *BridgeState) StartBridge() {
 	b.DiscordUserVolume = make(map[string]float64)
 }
 
+// StopBridge stops the running bridge without waiting for it to exit, it reports if a bridge was running
+func (b *BridgeState) StopBridge() bool {
+	b.BridgeMutex.Lock()
+	defer b.BridgeMutex.Unlock()
+	return b.stopLocked()
+}
+
+// stopLocked is StopBridge for callers holding BridgeMutex
+func (b *BridgeState) stopLocked() bool {
+	if b.stop == nil {
+		return false
+	}
+	b.stop()
+	return true
+}
+
+func (b *BridgeState) startFailed() {
+	b.BridgeMutex.Lock()
+	b.startFailures++
+	b.BridgeMutex.Unlock()
+}
+
 func (b *BridgeState) DiscordStatusUpdate() {
 	m, _ := time.ParseDuration("30s")
 	for {
@@ -303,11 +464,13 @@ func (b *BridgeState) DiscordStatusUpdate() {
 		status := ""
 
 		if err != nil {
-			log.Printf("error pinging mumble server %v\n", err)
-			b.DiscordSession.UpdateListeningStatus("an error pinging mumble")
+			b.Log.Warn("Error pinging mumble server", "side", "mumble", "err", err)
+			if !b.BridgeConfig.DiscordDisableBotStatus {
+				b.DiscordSession.UpdateListeningStatus("an error pinging mumble")
+			}
 		} else {
 
-			promMumblePing.Set(float64(resp.Ping.Milliseconds()))
+			b.Metrics.mumblePing.Set(float64(resp.Ping.Milliseconds()))
 
 			b.MumbleUsersMutex.Lock()
 			b.BridgeMutex.Lock()
@@ -331,9 +494,9 @@ func (b *BridgeState) DiscordStatusUpdate() {
 			}
 		}
 
-		discordHeartBeat := b.DiscordSession.LastHeartbeatAck.Sub(b.DiscordSession.LastHeartbeatSent).Milliseconds()
+		discordHeartBeat := b.DiscordSession.HeartbeatLatency().Milliseconds()
 		if discordHeartBeat > 0 {
-			promDiscordHeartBeat.Set(float64(discordHeartBeat))
+			b.Metrics.discordHeartBeat.Set(float64(discordHeartBeat))
 		}
 
 	}
@@ -343,14 +506,14 @@ func (b *BridgeState) DiscordStatusUpdate() {
 // when there is at least one user on both, starts up the bridge
 // when there are no users on either side, kills the bridge
 func (b *BridgeState) AutoBridge() {
-	log.Println("Beginning auto mode")
+	b.Log.Info("Beginning auto mode")
 	ticker := time.NewTicker(3 * time.Second)
 
 	for {
 		select {
 		case <-ticker.C:
 		case <-b.AutoChanDie:
-			log.Println("Ending automode")
+			b.Log.Info("Ending automode")
 			return
 		}
 
@@ -359,12 +522,12 @@ func (b *BridgeState) AutoBridge() {
 		b.BridgeMutex.Lock()
 
 		if !b.Connected && b.MumbleUserCount > 0 && len(b.DiscordUsers) > 0 {
-			log.Println("Users detected in mumble and discord, bridging")
+			b.Log.Info("Users detected in mumble and discord, bridging")
 			go b.StartBridge()
 		}
 		if b.Connected && b.MumbleUserCount == 0 && len(b.DiscordUsers) <= 1 {
-			log.Println("No one online, killing bridge")
-			b.BridgeDie <- true
+			b.Log.Info("No one online, killing bridge")
+			b.stopLocked()
 		}
 
 		b.BridgeMutex.Unlock()
@@ -373,6 +536,26 @@ func (b *BridgeState) AutoBridge() {
 	}
 }
 
+// discordUsername returns the name of a tracked Discord user, or empty if unknown
+func (b *BridgeState) discordUsername(id string) string {
+	if id == "" {
+		return ""
+	}
+	b.DiscordUsersMutex.Lock()
+	defer b.DiscordUsersMutex.Unlock()
+	return b.DiscordUsers[id].username
+}
+
+// announce sends msg to the Discord text channels and to the Mumble channel while connected
+func (b *BridgeState) announce(msg string) {
+	b.discordSendMessageAll(msg)
+	b.BridgeMutex.Lock()
+	if b.Connected && !b.BridgeConfig.MumbleDisableText {
+		b.MumbleClient.SendChannel(msg)
+	}
+	b.BridgeMutex.Unlock()
+}
+
 func (b *BridgeState) discordSendMessageAll(msg string) {
 	if b.BridgeConfig.DiscordDisableText {
 		return
@@ -382,8 +565,8 @@ func (b *BridgeState) discordSendMessageAll(msg string) {
 		b.DiscordUsersMutex.Lock()
 		for id := range b.DiscordUsers {
 			du := b.DiscordUsers[id]
-			if du.dm != nil {
-				b.DiscordSession.ChannelMessageSend(du.dm.ID, msg)
+			if du.dm != "" {
+				b.DiscordSession.ChannelMessageSend(du.dm, msg)
 			}
 		}
 		b.DiscordUsersMutex.Unlock()
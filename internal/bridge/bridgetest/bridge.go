@@ -0,0 +1,116 @@
+package bridgetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/gumble/gumbleutil"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+)
+
+// Test IDs used by NewBridge
+const (
+	GuildID        = "guild"
+	VoiceChannelID = "voice"
+	TextChannelID  = "text"
+	BotID          = "bot"
+	MumbleName     = "bridge"
+)
+
+// Bridge is a bridge wired to fake Discord and Mumble platforms
+type Bridge struct {
+	*bridge.BridgeState
+	Discord *Discord
+	Mumble  *Mumble
+
+	wg sync.WaitGroup
+}
+
+// NewBridge returns a bridge in constant mode using fakes for both platforms.
+// The Discord guild has a voice channel VoiceChannelID and a text channel TextChannelID.
+func NewBridge(log *logger.Logger) *Bridge {
+	d := NewDiscord(BotID)
+	d.AddChannel(GuildID, VoiceChannelID, "Voice", discordgo.ChannelTypeGuildVoice)
+	d.AddChannel(GuildID, TextChannelID, "text", discordgo.ChannelTypeGuildText)
+	m := NewMumble(MumbleName)
+
+	b := &bridge.BridgeState{
+		BridgeConfig: &bridge.BridgeConfig{
+			Name:                       "test",
+			MumbleAddr:                 "mumble.test:64738",
+			MumbleConfig:               gumble.NewConfig(),
+			MumbleStartStreamCount:     2,
+			Command:                    "mumble-discord",
+			GID:                        GuildID,
+			CID:                        VoiceChannelID,
+			DiscordStartStreamingCount: 2,
+			DiscordHangover:            100 * time.Millisecond,
+			MumbleHangover:             50 * time.Millisecond,
+			DiscordTimeout:             2500 * time.Millisecond,
+			Version:                    "test",
+		},
+		Log:               log,
+		Metrics:           bridge.NewMetrics("test"),
+		UserStats:         bridge.NewUserStats(),
+		Mode:              bridge.BridgeModeConstant,
+		DiscordSession:    d,
+		MumbleDialer:      m.Dial,
+		DiscordChannelID:  VoiceChannelID,
+		DiscordUsers:      make(map[string]bridge.DiscordUser),
+		DiscordUserVolume: make(map[string]float64),
+		DiscordUserSSRC:   make(map[uint32]string),
+		MumbleUsers:       make(map[string]bool),
+	}
+	b.DiscordListener = &bridge.DiscordListener{Bridge: b}
+	b.MumbleListener = &bridge.MumbleListener{Bridge: b}
+	b.BridgeConfig.MumbleConfig.Username = MumbleName
+	b.BridgeConfig.MumbleConfig.AudioInterval = 10 * time.Millisecond
+	b.BridgeConfig.MumbleConfig.Attach(gumbleutil.Listener{
+		Connect:          b.MumbleListener.MumbleConnect,
+		UserChange:       b.MumbleListener.MumbleUserChange,
+		TextMessage:      b.MumbleListener.MumbleTextMessage,
+		ACL:              b.MumbleListener.MumbleACL,
+		PermissionDenied: b.MumbleListener.MumblePermissionDenied,
+	})
+
+	return &Bridge{BridgeState: b, Discord: d, Mumble: m}
+}
+
+// Start runs StartBridge in the background and waits until it is connected
+func (b *Bridge) Start(timeout time.Duration) bool {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.StartBridge()
+	}()
+	return b.WaitConnected(true, timeout)
+}
+
+// Stop drops the Mumble connection, which makes the bridge exit, and waits for it
+func (b *Bridge) Stop() {
+	b.BridgeMutex.Lock()
+	c := b.MumbleClient
+	b.BridgeMutex.Unlock()
+	if c != nil {
+		c.Disconnect()
+	}
+	b.wg.Wait()
+}
+
+// WaitConnected waits until the bridge connection state equals connected
+func (b *Bridge) WaitConnected(connected bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		b.BridgeMutex.Lock()
+		c := b.Connected
+		b.BridgeMutex.Unlock()
+		if c == connected {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,355 @@
+// Package bridgetest provides in-memory fakes of the Discord and Mumble platforms and a local Mumble server for testing the bridge
+package bridgetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+)
+
+// Message is a text message sent by the bridge
+type Message struct {
+	ChannelID string
+	Content   string
+}
+
+// Discord is an in-memory bridge.DiscordSession
+type Discord struct {
+	mu          sync.Mutex
+	botID       string
+	users       map[string]string   // user ID to username
+	roles       map[string][]string // user ID to role IDs
+	channels    map[string]*discordgo.Channel
+	voiceStates map[string][]*discordgo.VoiceState // by guild ID
+	messages    []Message
+	status      string
+	gateway     bool
+	voice       *Voice
+	joinErr     error
+}
+
+// NewDiscord returns a connected fake Discord session with the given bot user ID
+func NewDiscord(botID string) *Discord {
+	return &Discord{
+		botID:       botID,
+		users:       make(map[string]string),
+		roles:       make(map[string][]string),
+		channels:    make(map[string]*discordgo.Channel),
+		voiceStates: make(map[string][]*discordgo.VoiceState),
+		gateway:     true,
+	}
+}
+
+// AddUser registers a Discord user
+func (d *Discord) AddUser(id, username string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users[id] = username
+}
+
+// SetRoles sets the role IDs of a user
+func (d *Discord) SetRoles(userID string, roles ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roles[userID] = roles
+}
+
+// AddChannel registers a channel of a guild
+func (d *Discord) AddChannel(guildID, channelID, name string, t discordgo.ChannelType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.channels[channelID] = &discordgo.Channel{ID: channelID, GuildID: guildID, Name: name, Type: t}
+}
+
+// SetVoiceState moves a user into a voice channel, an empty channel ID removes the user from voice
+func (d *Discord) SetVoiceState(guildID, userID, channelID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	states := d.voiceStates[guildID][:0:0]
+	for _, vs := range d.voiceStates[guildID] {
+		if vs.UserID != userID {
+			states = append(states, vs)
+		}
+	}
+	if channelID != "" {
+		states = append(states, &discordgo.VoiceState{GuildID: guildID, UserID: userID, ChannelID: channelID})
+	}
+	d.voiceStates[guildID] = states
+}
+
+// SetGatewayReady sets the gateway connection state
+func (d *Discord) SetGatewayReady(ready bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gateway = ready
+}
+
+// FailJoin makes the following voice joins fail with err, nil restores joining
+func (d *Discord) FailJoin(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.joinErr = err
+}
+
+// Messages returns the text messages sent so far
+func (d *Discord) Messages() []Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Message(nil), d.messages...)
+}
+
+// Status returns the last listening status
+func (d *Discord) Status() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// Voice returns the last joined voice connection, nil if none
+func (d *Discord) Voice() *Voice {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.voice
+}
+
+func (d *Discord) ChannelMessageSend(channelID, content string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = append(d.messages, Message{ChannelID: channelID, Content: content})
+	return nil
+}
+
+func (d *Discord) GatewayReady() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gateway
+}
+
+func (d *Discord) HeartbeatLatency() time.Duration {
+	return time.Millisecond
+}
+
+func (d *Discord) UpdateListeningStatus(status string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+	return nil
+}
+
+func (d *Discord) BotUserID() string {
+	return d.botID
+}
+
+func (d *Discord) Username(userID string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.users[userID]
+	if !ok {
+		return "", errors.New("unknown user " + userID)
+	}
+	return u, nil
+}
+
+func (d *Discord) MemberRoles(guildID, userID string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.roles[userID], nil
+}
+
+// DMChannel returns "dm:" followed by the user ID
+func (d *Discord) DMChannel(userID string) (string, error) {
+	return "dm:" + userID, nil
+}
+
+func (d *Discord) ChannelGuild(channelID string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.channels[channelID]
+	if !ok {
+		return "", errors.New("unknown channel " + channelID)
+	}
+	return c.GuildID, nil
+}
+
+func (d *Discord) VoiceStates(guildID string) ([]*discordgo.VoiceState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*discordgo.VoiceState(nil), d.voiceStates[guildID]...), nil
+}
+
+func (d *Discord) VoiceChannels(guildID string) ([]*discordgo.Channel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var res []*discordgo.Channel
+	for _, c := range d.channels {
+		if c.GuildID == guildID && c.Type == discordgo.ChannelTypeGuildVoice {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+func (d *Discord) JoinVoice(guildID, channelID string, mute, deaf bool, onSpeaking func(ssrc uint32, userID string)) (bridge.DiscordVoice, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.joinErr != nil {
+		return nil, d.joinErr
+	}
+	d.voice = NewVoice(guildID, channelID, onSpeaking)
+	d.voice.Mute, d.voice.Deaf = mute, deaf
+	if deaf {
+		// As with discordgo a deafened connection has no receive channel
+		d.voice.Recv = nil
+	}
+	return d.voice, nil
+}
+
+// Voice is an in-memory bridge.DiscordVoice.
+// Packets written to Recv are received by the bridge, opus frames sent by the bridge are delivered on Sent.
+// Recv is nil when the bridge joined deafened.
+type Voice struct {
+	GuildID   string
+	ChannelID string
+	Mute      bool // voice state the bridge joined with
+	Deaf      bool
+	Recv      chan *discordgo.Packet
+	Sent      chan []byte
+
+	mu           sync.Mutex
+	ready        bool
+	speaking     bool
+	speakingSets int
+	disconnected bool
+	onSpeaking   func(ssrc uint32, userID string)
+}
+
+// NewVoice returns a ready voice connection
+func NewVoice(guildID, channelID string, onSpeaking func(ssrc uint32, userID string)) *Voice {
+	return &Voice{
+		GuildID:    guildID,
+		ChannelID:  channelID,
+		Recv:       make(chan *discordgo.Packet, 100),
+		Sent:       make(chan []byte, 1000),
+		ready:      true,
+		onSpeaking: onSpeaking,
+	}
+}
+
+// Speak announces the SSRC of a user as Discord does when the user starts speaking
+func (v *Voice) Speak(ssrc uint32, userID string) {
+	if v.onSpeaking != nil {
+		v.onSpeaking(ssrc, userID)
+	}
+}
+
+// SetReady sets the connection state, as seen during a voice reconnect
+func (v *Voice) SetReady(ready bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.ready = ready
+}
+
+// IsSpeaking returns the current speaking state and how often it was set
+func (v *Voice) IsSpeaking() (speaking bool, sets int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.speaking, v.speakingSets
+}
+
+// Disconnected reports if the bridge has left the voice channel
+func (v *Voice) Disconnected() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.disconnected
+}
+
+func (v *Voice) SendReady() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.ready && !v.disconnected
+}
+
+func (v *Voice) SendOpus(ctx context.Context, opus []byte) bool {
+	if !v.SendReady() {
+		return false
+	}
+	select {
+	case v.Sent <- opus:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+func (v *Voice) OpusRecv() (<-chan *discordgo.Packet, bool) {
+	if !v.SendReady() || v.Recv == nil {
+		return nil, false
+	}
+	return v.Recv, true
+}
+
+func (v *Voice) Speaking(speaking bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.speaking = speaking
+	v.speakingSets++
+	return nil
+}
+
+func (v *Voice) Disconnect() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.disconnected = true
+	return nil
+}
+
+// Stream sends pcm as a user speaking on Discord, one 20ms opus packet per 20ms starting at start.
+// It returns once the last packet has been queued.
+func (v *Voice) Stream(ssrc uint32, pcm []int16, start time.Time) error {
+	const frameSize = 960
+	enc, err := gopus.NewEncoder(SampleRate, 1, gopus.Audio)
+	if err != nil {
+		return err
+	}
+	for i := 0; (i+1)*frameSize <= len(pcm); i++ {
+		opus, err := enc.Encode(pcm[i*frameSize:(i+1)*frameSize], frameSize, frameSize*4)
+		if err != nil {
+			return err
+		}
+		pace(start, i, 20*time.Millisecond)
+		v.Recv <- &discordgo.Packet{
+			SSRC:      ssrc,
+			Sequence:  uint16(i),
+			Timestamp: uint32(i * frameSize),
+			Opus:      opus,
+		}
+	}
+	return nil
+}
+
+// Capture decodes the opus frames sent by the bridge for the duration d
+func (v *Voice) Capture(d time.Duration) ([]Frame, error) {
+	dec, err := gopus.NewDecoder(SampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	var frames []Frame
+	timeout := time.After(d)
+	for {
+		select {
+		case opus := <-v.Sent:
+			// Room for the longest opus packet, 120ms
+			pcm, err := dec.Decode(opus, 5760, false)
+			if err != nil {
+				return frames, err
+			}
+			frames = append(frames, Frame{At: time.Now(), PCM: pcm})
+		case <-timeout:
+			return frames, nil
+		}
+	}
+}
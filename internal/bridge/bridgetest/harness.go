@@ -0,0 +1,32 @@
+package bridgetest
+
+import (
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+)
+
+// Harness is a bridge connected to a fake Discord and a local MumbleServer through the production gumble client
+type Harness struct {
+	*Bridge
+	Server *MumbleServer
+}
+
+// NewHarness starts a local Mumble server and configures a bridge to connect to it.
+// Start the bridge with Start and release everything with Close.
+func NewHarness(log *logger.Logger) (*Harness, error) {
+	srv, err := NewMumbleServer()
+	if err != nil {
+		return nil, err
+	}
+	b := NewBridge(log)
+	b.Mumble = nil
+	b.MumbleDialer = nil
+	b.BridgeConfig.MumbleAddr = srv.Addr()
+	b.BridgeConfig.MumbleInsecure = true
+	return &Harness{Bridge: b, Server: srv}, nil
+}
+
+// Close stops the bridge and the server
+func (h *Harness) Close() {
+	h.Stop()
+	h.Server.Close()
+}
@@ -0,0 +1,194 @@
+package bridgetest
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+)
+
+// Mumble is an in-memory Mumble server holding a single bridge client
+type Mumble struct {
+	mu       sync.Mutex
+	name     string
+	users    []string
+	self     uint32 // channel ID of the bridge, the root channel by default
+	client   *MumbleClient
+	dials    int
+	acls     int
+	channel  []string
+	userMsgs map[uint32][]string
+	dialErr  error
+}
+
+// NewMumble returns a fake Mumble server, the bridge connects as name
+func NewMumble(name string) *Mumble {
+	return &Mumble{
+		name:     name,
+		userMsgs: make(map[uint32][]string),
+	}
+}
+
+// Dial is a bridge.MumbleDialer connecting to the fake server
+func (m *Mumble) Dial(addr string, config *gumble.Config, tlsConfig *tls.Config) (bridge.MumbleClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dialErr != nil {
+		return nil, m.dialErr
+	}
+	m.dials++
+	m.client = &MumbleClient{
+		server: m,
+		audio:  make(chan gumble.AudioBuffer, 1000),
+		state:  gumble.StateSynced,
+	}
+	return m.client, nil
+}
+
+// FailDial makes the following dials fail with err, nil restores dialing
+func (m *Mumble) FailDial(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialErr = err
+}
+
+// Dials returns the number of successful connections
+func (m *Mumble) Dials() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dials
+}
+
+// Client returns the last connected client, nil if none
+func (m *Mumble) Client() *MumbleClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.client
+}
+
+// SetUsers sets the users in the bridge's channel, excluding the bridge
+func (m *Mumble) SetUsers(names ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users = append([]string(nil), names...)
+}
+
+// SetSelfChannel moves the bridge to the channel with the given ID
+func (m *Mumble) SetSelfChannel(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.self = id
+}
+
+// ACLRequests returns the number of ACL requests of the bridge
+func (m *Mumble) ACLRequests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acls
+}
+
+// ChannelMessages returns the messages sent to the bridge's channel
+func (m *Mumble) ChannelMessages() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.channel...)
+}
+
+// UserMessages returns the private messages sent to the user with the given session
+func (m *Mumble) UserMessages(session uint32) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.userMsgs[session]...)
+}
+
+// MumbleClient is an in-memory bridge.MumbleClient.
+// Audio sent by the bridge is delivered on Audio, the bridge closes the channel when it stops.
+type MumbleClient struct {
+	server *Mumble
+	audio  chan gumble.AudioBuffer
+	state  gumble.State
+	muted  bool
+}
+
+// Audio returns the audio sent by the bridge
+func (c *MumbleClient) Audio() <-chan gumble.AudioBuffer {
+	return c.audio
+}
+
+// SetState changes the connection state, the bridge stops when it is no longer synced
+func (c *MumbleClient) SetState(state gumble.State) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.state = state
+}
+
+// AudioOutgoing copies the frames onto Audio, the bridge reuses the frames it sent
+func (c *MumbleClient) AudioOutgoing() chan<- gumble.AudioBuffer {
+	ch := make(chan gumble.AudioBuffer)
+	go func() {
+		for f := range ch {
+			c.audio <- append(gumble.AudioBuffer(nil), f...)
+		}
+		close(c.audio)
+	}()
+	return ch
+}
+
+func (c *MumbleClient) SendChannel(message string) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.channel = append(c.server.channel, message)
+}
+
+func (c *MumbleClient) SendUser(session uint32, message string) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.userMsgs[session] = append(c.server.userMsgs[session], message)
+}
+
+func (c *MumbleClient) State() gumble.State {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.state
+}
+
+func (c *MumbleClient) SelfName() string {
+	return c.server.name
+}
+
+func (c *MumbleClient) SetSelfMuted(muted bool) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.muted = muted
+}
+
+// SelfMuted reports if the bridge muted itself
+func (c *MumbleClient) SelfMuted() bool {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.muted
+}
+
+func (c *MumbleClient) Disconnect() error {
+	c.SetState(gumble.StateDisconnected)
+	return nil
+}
+
+func (c *MumbleClient) ChannelUsers() []string {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return append([]string(nil), c.server.users...)
+}
+
+func (c *MumbleClient) SelfChannelID() (uint32, bool) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.server.self, true
+}
+
+func (c *MumbleClient) RequestACL() {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.acls++
+}
@@ -0,0 +1,415 @@
+package bridgetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/gumble/gumble/MumbleProto"
+	"github.com/stieneee/gumble/gumble/varint"
+)
+
+// Mumble control message types
+const (
+	msgVersion      = 0
+	msgUDPTunnel    = 1
+	msgAuthenticate = 2
+	msgPing         = 3
+	msgTextMessage  = 11
+)
+
+// audioOpus is the Mumble audio packet type of Opus frames
+const audioOpus = 4
+
+// TextMessage is a text message received by the Mumble server
+type TextMessage struct {
+	Actor    uint32
+	Sessions []uint32
+	Channels []uint32
+	Message  string
+}
+
+// ReceivedAudio is an Opus frame received by the Mumble server
+type ReceivedAudio struct {
+	Session  uint32
+	Sequence int64
+	Opus     []byte
+	Final    bool
+	At       time.Time
+}
+
+// MumbleServer is a local stand-in for a Mumble server.
+// It speaks enough of the Mumble protocol over TLS for gumble clients to connect, exchange text and
+// tunnel Opus audio over the control connection. All users are in the root channel.
+// Virtual users only exist on the server, their audio and messages are generated by the test.
+type MumbleServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	clients map[*serverClient]bool
+	users   map[uint32]string // virtual users by session
+	next    uint32
+	texts   []TextMessage
+	dropped int
+	closed  bool
+
+	audio chan ReceivedAudio
+}
+
+type serverClient struct {
+	conn    *gumble.Conn
+	session uint32
+	name    string
+}
+
+// NewMumbleServer starts a Mumble server on a random local port
+func NewMumbleServer() (*MumbleServer, error) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	s := &MumbleServer{
+		ln:      ln,
+		clients: make(map[*serverClient]bool),
+		users:   make(map[uint32]string),
+		next:    1,
+		audio:   make(chan ReceivedAudio, 1000),
+	}
+	go s.accept()
+	return s, nil
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mumble.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Addr returns the host:port the server listens on
+func (s *MumbleServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and disconnects all clients
+func (s *MumbleServer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.ln.Close()
+}
+
+// Audio returns the Opus frames sent by clients.
+// Frames are dropped when the channel is full, see Dropped.
+func (s *MumbleServer) Audio() <-chan ReceivedAudio {
+	return s.audio
+}
+
+// Dropped returns the number of received audio frames dropped because Audio was not read
+func (s *MumbleServer) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// TextMessages returns the text messages sent by clients
+func (s *MumbleServer) TextMessages() []TextMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TextMessage(nil), s.texts...)
+}
+
+// Clients returns the number of synchronized clients
+func (s *MumbleServer) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// AddUser connects a virtual user to the root channel and returns its session
+func (s *MumbleServer) AddUser(name string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.next
+	s.next++
+	s.users[session] = name
+	s.broadcast(userState(session, name))
+	return session
+}
+
+// RemoveUser disconnects a virtual user
+func (s *MumbleServer) RemoveUser(session uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, session)
+	s.broadcast(&MumbleProto.UserRemove{Session: proto.Uint32(session)})
+}
+
+// SendText sends a text message from a virtual user to the root channel
+func (s *MumbleServer) SendText(from uint32, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcast(&MumbleProto.TextMessage{
+		Actor:     proto.Uint32(from),
+		ChannelId: []uint32{0},
+		Message:   proto.String(message),
+	})
+}
+
+// SendAudio sends an Opus frame from a virtual user to all clients
+func (s *MumbleServer) SendAudio(from uint32, sequence int64, opus []byte, final bool) {
+	var header [1 + varint.MaxVarintLen*3]byte
+	header[0] = audioOpus << 5
+	n := 1
+	n += varint.Encode(header[n:], int64(from))
+	n += varint.Encode(header[n:], sequence)
+	l := int64(len(opus))
+	if final {
+		l |= 0x2000
+	}
+	n += varint.Encode(header[n:], l)
+	packet := append(header[:n:n], opus...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.WritePacket(msgUDPTunnel, packet)
+	}
+}
+
+// Stream sends pcm as a virtual user speaking, one frameSize Opus frame per frame duration starting at start.
+// It returns once the last frame has been sent.
+func (s *MumbleServer) Stream(from uint32, pcm []int16, frameSize int, start time.Time) error {
+	enc, err := gopus.NewEncoder(SampleRate, 1, gopus.Voip)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(frameSize) * time.Second / SampleRate
+	frames := len(pcm) / frameSize
+	for i := 0; i < frames; i++ {
+		opus, err := enc.Encode(pcm[i*frameSize:(i+1)*frameSize], frameSize, frameSize*4)
+		if err != nil {
+			return err
+		}
+		pace(start, i, interval)
+		s.SendAudio(from, int64(i), opus, i == frames-1)
+	}
+	return nil
+}
+
+// Capture decodes the audio sent by clients for the duration d
+func (s *MumbleServer) Capture(d time.Duration) ([]Frame, error) {
+	decoders := make(map[uint32]*gopus.Decoder)
+	var frames []Frame
+	timeout := time.After(d)
+	for {
+		select {
+		case a := <-s.audio:
+			dec, ok := decoders[a.Session]
+			if !ok {
+				var err error
+				if dec, err = gopus.NewDecoder(SampleRate, 1); err != nil {
+					return frames, err
+				}
+				decoders[a.Session] = dec
+			}
+			pcm, err := dec.Decode(a.Opus, gumble.AudioMaximumFrameSize, false)
+			if err != nil {
+				return frames, err
+			}
+			frames = append(frames, Frame{At: a.At, PCM: pcm})
+		case <-timeout:
+			return frames, nil
+		}
+	}
+}
+
+func userState(session uint32, name string) *MumbleProto.UserState {
+	return &MumbleProto.UserState{
+		Session:   proto.Uint32(session),
+		Name:      proto.String(name),
+		ChannelId: proto.Uint32(0),
+	}
+}
+
+// broadcast sends a message to all synchronized clients, s.mu must be held
+func (s *MumbleServer) broadcast(msg proto.Message) {
+	for c := range s.clients {
+		c.conn.WriteProto(msg)
+	}
+}
+
+func (s *MumbleServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(gumble.NewConn(conn))
+	}
+}
+
+func (s *MumbleServer) serve(conn *gumble.Conn) {
+	c := &serverClient{conn: conn}
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		if s.clients[c] {
+			delete(s.clients, c)
+			s.broadcast(&MumbleProto.UserRemove{Session: proto.Uint32(c.session)})
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		pType, data, err := conn.ReadPacket()
+		if err != nil {
+			return
+		}
+		switch pType {
+		case msgAuthenticate:
+			var packet MumbleProto.Authenticate
+			if err := proto.Unmarshal(data, &packet); err != nil {
+				return
+			}
+			if err := s.sync(c, packet.GetUsername()); err != nil {
+				return
+			}
+		case msgPing:
+			var packet MumbleProto.Ping
+			if err := proto.Unmarshal(data, &packet); err != nil {
+				return
+			}
+			conn.WriteProto(&MumbleProto.Ping{Timestamp: packet.Timestamp})
+		case msgUDPTunnel:
+			if err := s.receiveAudio(c, data); err != nil {
+				return
+			}
+		case msgTextMessage:
+			var packet MumbleProto.TextMessage
+			if err := proto.Unmarshal(data, &packet); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.texts = append(s.texts, TextMessage{
+				Actor:    c.session,
+				Sessions: packet.Session,
+				Channels: packet.ChannelId,
+				Message:  packet.GetMessage(),
+			})
+			s.mu.Unlock()
+		}
+	}
+}
+
+// sync sends the server state to an authenticated client
+func (s *MumbleServer) sync(c *serverClient, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("server closed")
+	}
+
+	c.session = s.next
+	c.name = name
+	s.next++
+
+	msgs := []proto.Message{
+		&MumbleProto.Version{Version: proto.Uint32(gumble.ClientVersion), Release: proto.String("bridgetest")},
+		&MumbleProto.CodecVersion{
+			Alpha:       proto.Int32(-2147483637),
+			Beta:        proto.Int32(0),
+			PreferAlpha: proto.Bool(true),
+			Opus:        proto.Bool(true),
+		},
+		&MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Name: proto.String("Root")},
+	}
+	for session, name := range s.users {
+		msgs = append(msgs, userState(session, name))
+	}
+	for other := range s.clients {
+		msgs = append(msgs, userState(other.session, other.name))
+	}
+	msgs = append(msgs,
+		userState(c.session, name),
+		&MumbleProto.ServerSync{Session: proto.Uint32(c.session), MaxBandwidth: proto.Uint32(128000)},
+	)
+	for _, msg := range msgs {
+		if err := c.conn.WriteProto(msg); err != nil {
+			return err
+		}
+	}
+
+	s.broadcast(userState(c.session, name))
+	s.clients[c] = true
+	return nil
+}
+
+// receiveAudio parses a tunneled audio packet from a client
+func (s *MumbleServer) receiveAudio(c *serverClient, data []byte) error {
+	if len(data) < 1 || data[0]>>5 != audioOpus {
+		return errors.New("unsupported audio packet")
+	}
+	buf := data[1:]
+	sequence, n := varint.Decode(buf)
+	if n <= 0 {
+		return errors.New("invalid audio sequence")
+	}
+	buf = buf[n:]
+	length, n := varint.Decode(buf)
+	if n <= 0 {
+		return errors.New("invalid audio length")
+	}
+	buf = buf[n:]
+	size := int(length &^ 0x2000)
+	if size > len(buf) {
+		return errors.New("short audio packet")
+	}
+
+	a := ReceivedAudio{
+		Session:  c.session,
+		Sequence: sequence,
+		Opus:     append([]byte(nil), buf[:size]...),
+		Final:    length&0x2000 != 0,
+		At:       time.Now(),
+	}
+	select {
+	case s.audio <- a:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+	return nil
+}
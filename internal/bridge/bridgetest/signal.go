@@ -0,0 +1,119 @@
+package bridgetest
+
+import (
+	"math"
+	"time"
+)
+
+// SampleRate of the bridge audio
+const SampleRate = 48000
+
+// Frame is a decoded audio frame captured on one side of the bridge
+type Frame struct {
+	At  time.Time
+	PCM []int16
+}
+
+// Tone returns n samples of a sine tone, offset is the index of the first sample
+func Tone(freq, amplitude float64, offset, n int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = int16(amplitude * math.Sin(2*math.Pi*freq*float64(offset+i)/SampleRate))
+	}
+	return pcm
+}
+
+// PCM concatenates the captured frames
+func PCM(frames []Frame) []int16 {
+	var pcm []int16
+	for _, f := range frames {
+		pcm = append(pcm, f.PCM...)
+	}
+	return pcm
+}
+
+// FirstActive returns the capture time of the first frame with an RMS level above threshold
+func FirstActive(frames []Frame, threshold float64) (time.Time, bool) {
+	for _, f := range frames {
+		if RMS(f.PCM) > threshold {
+			return f.At, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Active returns the frames with an RMS level above threshold
+func Active(frames []Frame, threshold float64) []Frame {
+	var res []Frame
+	for _, f := range frames {
+		if RMS(f.PCM) > threshold {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// RMS returns the root mean square level of the samples
+func RMS(pcm []int16) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range pcm {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+// Peak returns the largest absolute sample
+func Peak(pcm []int16) int {
+	p := 0
+	for _, v := range pcm {
+		x := int(v)
+		if x < 0 {
+			x = -x
+		}
+		if x > p {
+			p = x
+		}
+	}
+	return p
+}
+
+// MaxStep returns the largest difference between adjacent samples.
+// Mixing without saturation wraps around the int16 range, which shows up as a step close to 65536.
+func MaxStep(pcm []int16) int {
+	m := 0
+	for i := 1; i < len(pcm); i++ {
+		d := int(pcm[i]) - int(pcm[i-1])
+		if d < 0 {
+			d = -d
+		}
+		if d > m {
+			m = d
+		}
+	}
+	return m
+}
+
+// ToneLevel estimates the amplitude of the frequency freq in the samples using the Goertzel algorithm
+func ToneLevel(pcm []int16, freq float64) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+	w := 2 * math.Pi * freq / SampleRate
+	coeff := 2 * math.Cos(w)
+	var s1, s2 float64
+	for _, v := range pcm {
+		s := float64(v) + coeff*s1 - s2
+		s2 = s1
+		s1 = s
+	}
+	power := s1*s1 + s2*s2 - coeff*s1*s2
+	return 2 * math.Sqrt(math.Max(power, 0)) / float64(len(pcm))
+}
+
+// pace sleeps until the i-th interval d after start
+func pace(start time.Time, i int, d time.Duration) {
+	time.Sleep(time.Until(start.Add(time.Duration(i) * d)))
+}
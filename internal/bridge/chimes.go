@@ -0,0 +1,168 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/sound"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+)
+
+// Chime events
+const (
+	ChimeJoin  = "join"
+	ChimeLeave = "leave"
+)
+
+// chimeMaxQueue bounds the chimes waiting to play, for example when many users join at once
+const chimeMaxQueue = 5
+
+// chimeTTSTimeout bounds the run time of the TTS command
+const chimeTTSTimeout = 10 * time.Second
+
+// Chimes plays short sounds and optionally speaks the user name into the voice of the other side when users join or leave.
+// A nil *Chimes is valid and plays nothing.
+type Chimes struct {
+	log    *logger.Logger
+	sounds map[string][]int16 // by event
+	tts    []string
+	volume float64
+
+	ttsMu   sync.Mutex // runs one event at a time so chimes and speech stay in order
+	pending int32      // events waiting for ttsMu or running
+	queue   soundQueue
+}
+
+// NewChimes loads the join and leave chime files, either can be empty.
+// tts is a command writing a WAV, Ogg/Opus or FLAC file to stdout, split on spaces.
+// In its arguments {name} is replaced by the user name, {event} by join or leave and {text} by a sentence such as "alice joined Discord".
+func NewChimes(join, leave, tts string, volume float64, log *logger.Logger) (*Chimes, error) {
+	c := &Chimes{
+		log:    log,
+		sounds: make(map[string][]int16),
+		tts:    strings.Fields(tts),
+		volume: volume,
+	}
+	for event, path := range map[string]string{ChimeJoin: join, ChimeLeave: leave} {
+		if path == "" {
+			continue
+		}
+		pcm, err := sound.Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("%v chime: %w", event, err)
+		}
+		c.sounds[event] = pcm
+	}
+	return c, nil
+}
+
+// Event plays the chime of event and speaks the name of the user who joined or left side into the other side.
+// Events are ignored while the bridge is not running or does not play to the other side.
+func (c *Chimes) Event(event, side, name string) {
+	if c == nil {
+		return
+	}
+	to := sideDiscord
+	if side == sideDiscord {
+		to = sideMumble
+	}
+	pcm := c.sounds[event]
+	if (pcm == nil && len(c.tts) == 0) || !c.queue.active(to) {
+		return
+	}
+	// Events waiting for the TTS command count against the queue limit too
+	if c.queue.full(chimeMaxQueue) {
+		c.log.Debug("Chime queue full, dropping event", "event", event, "user", name)
+		return
+	}
+	if atomic.AddInt32(&c.pending, 1) > chimeMaxQueue {
+		atomic.AddInt32(&c.pending, -1)
+		c.log.Debug("Chime queue full, dropping event", "event", event, "user", name)
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&c.pending, -1)
+		c.ttsMu.Lock()
+		defer c.ttsMu.Unlock()
+		if pcm != nil {
+			c.play(event, to, pcm)
+		}
+		if len(c.tts) == 0 {
+			return
+		}
+		if strings.HasPrefix(name, "-") {
+			// The command could read the name as an option
+			c.log.Warn("Not speaking a user name starting with -", "user", name)
+			return
+		}
+		speech, err := c.speak(event, side, name)
+		if err != nil {
+			c.log.Warn("Chime TTS command failed", "user", name, "err", err)
+			return
+		}
+		c.play("tts", to, speech)
+	}()
+}
+
+func (c *Chimes) play(file, to string, pcm []int16) {
+	q := &queuedSound{
+		SoundboardItem: SoundboardItem{File: file, To: to, Volume: c.volume, Seconds: float64(len(pcm)) / sound.SampleRate},
+		pcm:            pcm,
+	}
+	if _, ok := c.queue.add(q, chimeMaxQueue); !ok {
+		c.log.Debug("Chime queue full, dropping chime", "chime", file)
+	}
+}
+
+// speak runs the TTS command and decodes its output
+func (c *Chimes) speak(event, side, name string) ([]int16, error) {
+	verb := "joined"
+	if event == ChimeLeave {
+		verb = "left"
+	}
+	where := "Discord"
+	if side == sideMumble {
+		where = "Mumble"
+	}
+	r := strings.NewReplacer("{name}", name, "{event}", event, "{text}", fmt.Sprintf("%v %v %v", name, verb, where))
+	args := make([]string, len(c.tts))
+	for i, a := range c.tts {
+		args[i] = r.Replace(a)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chimeTTSTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return sound.Decode(bytes.NewReader(out))
+}
+
+func (c *Chimes) setWake(wake func(), direction BridgeDirection) {
+	if c != nil {
+		c.queue.setWake(wake, direction)
+	}
+}
+
+func (c *Chimes) frame(side string) []int16 {
+	if c == nil {
+		return nil
+	}
+	return c.queue.frame(side)
+}
+
+func (c *Chimes) stop() {
+	if c != nil {
+		c.queue.clear()
+	}
+}
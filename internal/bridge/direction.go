@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// BridgeDirection selects which way audio is bridged
+type BridgeDirection int
+
+const (
+	DirectionBoth BridgeDirection = iota
+	// DirectionMumbleToDiscord broadcasts Mumble to Discord only
+	DirectionMumbleToDiscord
+	// DirectionDiscordToMumble relays Discord to Mumble only
+	DirectionDiscordToMumble
+)
+
+// ErrDirection is returned for audio to a side the bridge does not play to in its direction
+var ErrDirection = errors.New("the bridge does not play to that side in its direction")
+
+func (d BridgeDirection) String() string {
+	switch d {
+	case DirectionBoth:
+		return "both"
+	case DirectionMumbleToDiscord:
+		return "mumble-to-discord"
+	case DirectionDiscordToMumble:
+		return "discord-to-mumble"
+	}
+	return "unknown"
+}
+
+// ParseBridgeDirection converts a direction name (both, mumble-to-discord, discord-to-mumble) to a BridgeDirection
+func ParseBridgeDirection(s string) (BridgeDirection, error) {
+	switch strings.TrimSpace(s) {
+	case "both":
+		return DirectionBoth, nil
+	case "mumble-to-discord":
+		return DirectionMumbleToDiscord, nil
+	case "discord-to-mumble":
+		return DirectionDiscordToMumble, nil
+	}
+	return DirectionBoth, fmt.Errorf("invalid bridge direction %q", s)
+}
+
+// plays reports if audio flows to side, discord, mumble or both
+func (d BridgeDirection) plays(side string) bool {
+	switch side {
+	case sideDiscord:
+		return d != DirectionDiscordToMumble
+	case sideMumble:
+		return d != DirectionMumbleToDiscord
+	}
+	return side == TargetBoth
+}
+
+// Direction returns the direction of the bridge
+func (b *BridgeState) Direction() BridgeDirection {
+	b.BridgeMutex.Lock()
+	defer b.BridgeMutex.Unlock()
+	return b.BridgeConfig.Direction
+}
+
+// SetDirection changes the direction of the bridge and reconnects a running bridge to apply it
+func (b *BridgeState) SetDirection(d BridgeDirection, by string) {
+	b.BridgeMutex.Lock()
+	changed := b.BridgeConfig.Direction != d
+	b.BridgeConfig.Direction = d
+	connected := b.Connected
+	b.BridgeMutex.Unlock()
+	if !changed {
+		return
+	}
+	b.Log.Info("Bridge direction changed", "direction", d.String(), "by", by)
+	b.announce(withBy("Bridge direction set to "+d.String(), by))
+	if connected {
+		b.restart()
+	}
+}
+
+// restart reconnects the running bridge so it picks up new settings, constant and auto mode reconnect on their own
+func (b *BridgeState) restart() {
+	if !b.StopBridge() {
+		// The bridge went down on its own meanwhile
+		return
+	}
+	if b.Mode == BridgeModeManual {
+		go b.StartBridge()
+	}
+}
+
+// directionCommand runs the direction chat command and returns the reply
+func (b *BridgeState) directionCommand(arg, by string) string {
+	if arg == "" {
+		return "Direction: " + b.Direction().String()
+	}
+	d, err := ParseBridgeDirection(arg)
+	if err != nil {
+		return "Usage: direction [both|mumble-to-discord|discord-to-mumble]"
+	}
+	b.SetDirection(d, by)
+	return "Direction: " + d.String()
+}
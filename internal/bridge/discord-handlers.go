@@ -2,11 +2,11 @@ package bridge
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
 )
 
 // DiscordListener holds references to the current BridgeConf
@@ -15,34 +15,42 @@ type DiscordListener struct {
 	Bridge *BridgeState
 }
 
-func (l *DiscordListener) GuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
-	log.Println("CREATE event registered")
+func (l *DiscordListener) log() *logger.Logger {
+	return l.Bridge.Log.With("side", "discord")
+}
+
+// The handlers keep the discordgo signatures for AddHandler but only use the session through l.Bridge.DiscordSession
+
+func (l *DiscordListener) GuildCreate(_ *discordgo.Session, event *discordgo.GuildCreate) {
+	l.log().Debug("CREATE event registered", "guild", event.ID)
 
 	if event.ID != l.Bridge.BridgeConfig.GID {
-		log.Println("Received GuildCreate from a guild not in config")
+		l.log().Warn("Received GuildCreate from a guild not in config", "guild", event.ID)
 		return
 	}
 
 	for _, vs := range event.VoiceStates {
 		if vs.ChannelID == l.Bridge.DiscordChannelID {
-			if s.State.User.ID == vs.UserID {
+			if l.Bridge.DiscordSession.BotUserID() == vs.UserID {
 				// Ignore bot
 				continue
 			}
 
-			u, err := s.User(vs.UserID)
+			username, err := l.Bridge.DiscordSession.Username(vs.UserID)
 			if err != nil {
-				log.Println("Error looking up username")
+				l.log().Error("Error looking up username", "user", vs.UserID, "err", err)
+				continue
 			}
 
-			dm, err := s.UserChannelCreate(u.ID)
+			dm, err := l.Bridge.DiscordSession.DMChannel(vs.UserID)
 			if err != nil {
-				log.Println("Error creating private channel for", u.Username)
+				l.log().Warn("Error creating private channel", "user", username, "err", err)
 			}
+			l.lookupRoles(vs.UserID, username)
 
 			l.Bridge.DiscordUsersMutex.Lock()
 			l.Bridge.DiscordUsers[vs.UserID] = DiscordUser{
-				username: u.Username,
+				username: username,
 				seen:     true,
 				dm:       dm,
 			}
@@ -51,37 +59,78 @@ func (l *DiscordListener) GuildCreate(s *discordgo.Session, event *discordgo.Gui
 			// If connected to mumble inform users of Discord users
 			l.Bridge.BridgeMutex.Lock()
 			if l.Bridge.Connected && !l.Bridge.BridgeConfig.MumbleDisableText {
-				l.Bridge.MumbleClient.Do(func() {
-					l.Bridge.MumbleClient.Self.Channel.Send(fmt.Sprintf("%v has joined Discord\n", u.Username), false)
-				})
+				l.Bridge.MumbleClient.SendChannel(fmt.Sprintf("%v has joined Discord\n", username))
 			}
 			l.Bridge.BridgeMutex.Unlock()
+			l.Bridge.Chimes.Event(ChimeJoin, sideDiscord, username)
 
 		}
 	}
 }
 
-func (l *DiscordListener) MessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (l *DiscordListener) MessageCreate(_ *discordgo.Session, m *discordgo.MessageCreate) {
+	session := l.Bridge.DiscordSession
 
 	// Ignore all messages created by the bot itself
-	if m.Author.ID == s.State.User.ID {
+	if m.Author.ID == session.BotUserID() {
 		return
 	}
-	// Find the channel that the message came from.
-	c, err := s.State.Channel(m.ChannelID)
+	// Find the guild of the channel that the message came from.
+	guildID, err := session.ChannelGuild(m.ChannelID)
 	if err != nil {
 		// Could not find channel.
 		return
 	}
 
-	// Find the guild for that channel.
-	g, err := s.State.Guild(c.GuildID)
+	voiceStates, err := session.VoiceStates(guildID)
 	if err != nil {
 		// Could not find guild.
 		return
 	}
 	prefix := "!" + l.Bridge.BridgeConfig.Command
 
+	// Status commands are available in every mode
+	if strings.HasPrefix(m.Content, prefix+" stats") {
+		if guildID != l.Bridge.BridgeConfig.GID {
+			return
+		}
+		l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, l.Bridge.UserStats.Summary(10, "\n"))
+		return
+	}
+	// Commands changing the bridge are limited to the users of the bridged voice channel
+	for _, c := range []string{" record", " clip", " direction", " sound"} {
+		if !strings.HasPrefix(m.Content, prefix+c) {
+			continue
+		}
+		if guildID != l.Bridge.BridgeConfig.GID {
+			return
+		}
+		if !inChannel(voiceStates, m.Author.ID, l.Bridge.DiscordChannelID) {
+			l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, "Join the bridged voice channel to use this command")
+			return
+		}
+	}
+	if strings.HasPrefix(m.Content, prefix+" record") {
+		arg := strings.TrimSpace(strings.TrimPrefix(m.Content, prefix+" record"))
+		l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, l.Bridge.recordCommand(arg, m.Author.Username))
+		return
+	}
+	if strings.HasPrefix(m.Content, prefix+" clip") {
+		arg := strings.TrimSpace(strings.TrimPrefix(m.Content, prefix+" clip"))
+		l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, l.Bridge.clipCommand(arg, m.Author.Username))
+		return
+	}
+	if strings.HasPrefix(m.Content, prefix+" direction") {
+		arg := strings.TrimSpace(strings.TrimPrefix(m.Content, prefix+" direction"))
+		l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, l.Bridge.directionCommand(arg, m.Author.Username))
+		return
+	}
+	if strings.HasPrefix(m.Content, prefix+" sound") {
+		args := strings.Fields(strings.TrimPrefix(m.Content, prefix+" sound"))
+		l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, l.Bridge.soundCommand(args, m.Author.Username, "\n"))
+		return
+	}
+
 	if l.Bridge.Mode == BridgeModeConstant && strings.HasPrefix(m.Content, prefix) {
 		l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, "Constant mode enabled, manual commands can not be entered")
 		return
@@ -93,13 +142,13 @@ func (l *DiscordListener) MessageCreate(s *discordgo.Session, m *discordgo.Messa
 
 	if strings.HasPrefix(m.Content, prefix+" link") {
 		// Look for the message sender in that guild's current voice states.
-		for _, vs := range g.VoiceStates {
+		for _, vs := range voiceStates {
 			if bridgeConnected {
 				l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, "Bridge already running, unlink first")
 				return
 			}
 			if vs.UserID == m.Author.ID {
-				log.Printf("Trying to join GID %v and VID %v\n", g.ID, vs.ChannelID)
+				l.log().Info("Trying to join voice channel", "guild", guildID, "channel", vs.ChannelID)
 				l.Bridge.DiscordChannelID = vs.ChannelID
 				go l.Bridge.StartBridge()
 				return
@@ -113,10 +162,10 @@ func (l *DiscordListener) MessageCreate(s *discordgo.Session, m *discordgo.Messa
 			l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, "Bridge is not currently running")
 			return
 		}
-		for _, vs := range g.VoiceStates {
+		for _, vs := range voiceStates {
 			if vs.UserID == m.Author.ID && vs.ChannelID == l.Bridge.DiscordChannelID {
-				log.Printf("Trying to leave GID %v and VID %v\n", g.ID, vs.ChannelID)
-				l.Bridge.BridgeDie <- true
+				l.log().Info("Trying to leave voice channel", "guild", guildID, "channel", vs.ChannelID)
+				l.Bridge.StopBridge()
 				return
 			}
 		}
@@ -128,10 +177,10 @@ func (l *DiscordListener) MessageCreate(s *discordgo.Session, m *discordgo.Messa
 			l.Bridge.DiscordSession.ChannelMessageSend(m.ChannelID, "Bridge is not currently running")
 			return
 		}
-		for _, vs := range g.VoiceStates {
+		for _, vs := range voiceStates {
 			if vs.UserID == m.Author.ID {
-				log.Printf("Trying to refresh GID %v and VID %v\n", g.ID, vs.ChannelID)
-				l.Bridge.BridgeDie <- true
+				l.log().Info("Trying to refresh voice channel", "guild", guildID, "channel", vs.ChannelID)
+				l.Bridge.StopBridge()
 
 				time.Sleep(5 * time.Second)
 
@@ -156,15 +205,16 @@ func (l *DiscordListener) MessageCreate(s *discordgo.Session, m *discordgo.Messa
 	}
 }
 
-func (l *DiscordListener) VoiceUpdate(s *discordgo.Session, event *discordgo.VoiceStateUpdate) {
+func (l *DiscordListener) VoiceUpdate(_ *discordgo.Session, event *discordgo.VoiceStateUpdate) {
+	session := l.Bridge.DiscordSession
 	l.Bridge.DiscordUsersMutex.Lock()
 	defer l.Bridge.DiscordUsersMutex.Unlock()
 
 	if event.GuildID == l.Bridge.BridgeConfig.GID {
 
-		g, err := s.State.Guild(l.Bridge.BridgeConfig.GID)
+		voiceStates, err := session.VoiceStates(l.Bridge.BridgeConfig.GID)
 		if err != nil {
-			log.Println("Error finding guild")
+			l.log().Error("Error finding guild", "guild", l.Bridge.BridgeConfig.GID, "err", err)
 			panic(err)
 		}
 
@@ -175,38 +225,38 @@ func (l *DiscordListener) VoiceUpdate(s *discordgo.Session, event *discordgo.Voi
 		}
 
 		// Sync the channel voice states to the local discordUsersMap
-		for _, vs := range g.VoiceStates {
+		for _, vs := range voiceStates {
 			if vs.ChannelID == l.Bridge.DiscordChannelID {
-				if s.State.User.ID == vs.UserID {
+				if session.BotUserID() == vs.UserID {
 					// Ignore bot
 					continue
 				}
 
 				if _, ok := l.Bridge.DiscordUsers[vs.UserID]; !ok {
 
-					u, err := s.User(vs.UserID)
+					username, err := session.Username(vs.UserID)
 					if err != nil {
-						log.Println("Error looking up username")
+						l.log().Error("Error looking up username", "user", vs.UserID, "err", err)
 						continue
 					}
 
-					log.Println("User joined Discord " + u.Username)
-					dm, err := s.UserChannelCreate(u.ID)
+					l.log().Info("User joined Discord", "user", username, "id", vs.UserID)
+					dm, err := session.DMChannel(vs.UserID)
 					if err != nil {
-						log.Println("Error creating private channel for", u.Username)
+						l.log().Warn("Error creating private channel", "user", username, "err", err)
 					}
+					l.lookupRoles(vs.UserID, username)
 					l.Bridge.DiscordUsers[vs.UserID] = DiscordUser{
-						username: u.Username,
+						username: username,
 						seen:     true,
 						dm:       dm,
 					}
 					l.Bridge.BridgeMutex.Lock()
 					if l.Bridge.Connected && !l.Bridge.BridgeConfig.MumbleDisableText {
-						l.Bridge.MumbleClient.Do(func() {
-							l.Bridge.MumbleClient.Self.Channel.Send(fmt.Sprintf("%v has joined Discord\n", u.Username), false)
-						})
+						l.Bridge.MumbleClient.SendChannel(fmt.Sprintf("%v has joined Discord\n", username))
 					}
 					l.Bridge.BridgeMutex.Unlock()
+					l.Bridge.Chimes.Event(ChimeJoin, sideDiscord, username)
 				} else {
 					du := l.Bridge.DiscordUsers[vs.UserID]
 					du.seen = true
@@ -219,26 +269,49 @@ func (l *DiscordListener) VoiceUpdate(s *discordgo.Session, event *discordgo.Voi
 		// Remove users that are no longer connected
 		for id := range l.Bridge.DiscordUsers {
 			if !l.Bridge.DiscordUsers[id].seen {
-				log.Println("User left Discord channel " + l.Bridge.DiscordUsers[id].username)
+				l.log().Info("User left Discord channel", "user", l.Bridge.DiscordUsers[id].username, "id", id)
 				l.Bridge.BridgeMutex.Lock()
 				if l.Bridge.Connected && !l.Bridge.BridgeConfig.MumbleDisableText {
-					l.Bridge.MumbleClient.Do(func() {
-						l.Bridge.MumbleClient.Self.Channel.Send(fmt.Sprintf("%v has left Discord channel\n", l.Bridge.DiscordUsers[id].username), false)
-					})
+					l.Bridge.MumbleClient.SendChannel(fmt.Sprintf("%v has left Discord channel\n", l.Bridge.DiscordUsers[id].username))
 				}
+				l.Bridge.Chimes.Event(ChimeLeave, sideDiscord, l.Bridge.DiscordUsers[id].username)
 				delete(l.Bridge.DiscordUsers, id)
+				l.Bridge.Priority.removeDiscordUser(id)
 				l.Bridge.BridgeMutex.Unlock()
 			}
 		}
 
 		l.Bridge.BridgeMutex.Lock()
-		promDiscordUsers.Set(float64(len(l.Bridge.DiscordUsers)))
+		l.Bridge.Metrics.discordUsers.Set(float64(len(l.Bridge.DiscordUsers)))
 		l.Bridge.BridgeMutex.Unlock()
 	}
 }
 
-func (l *DiscordListener) VoiceSpeakingUpdate(vc *discordgo.VoiceConnection, event *discordgo.VoiceSpeakingUpdate) {
+// inChannel reports if the user is in the voice channel
+func inChannel(voiceStates []*discordgo.VoiceState, userID, channelID string) bool {
+	for _, vs := range voiceStates {
+		if vs.UserID == userID && vs.ChannelID == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupRoles records the roles of a Discord user in the voice channel when priority speakers are configured
+func (l *DiscordListener) lookupRoles(userID, username string) {
+	if l.Bridge.Priority == nil {
+		return
+	}
+	roles, err := l.Bridge.DiscordSession.MemberRoles(l.Bridge.BridgeConfig.GID, userID)
+	if err != nil {
+		l.log().Warn("Error looking up roles", "user", username, "err", err)
+	}
+	l.Bridge.Priority.setDiscordRoles(userID, roles)
+}
+
+// VoiceSpeakingUpdate maps the SSRC of a speaking Discord user to the user ID
+func (l *DiscordListener) VoiceSpeakingUpdate(ssrc uint32, userID string) {
 	l.Bridge.DiscordUserSSRCMutex.Lock()
 	defer l.Bridge.DiscordUserSSRCMutex.Unlock()
-	l.Bridge.DiscordUserSSRC[uint32(event.SSRC)] = event.UserID
+	l.Bridge.DiscordUserSSRC[ssrc] = userID
 }
@@ -2,126 +2,143 @@ package bridge
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/stieneee/gopus"
-	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
 	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
 )
 
+// opusMaxFrameSize is the number of samples of the longest opus packet, 120ms
+const opusMaxFrameSize = 5760
+
+// discordFrame is the duration of the frames sent to Discord.
+// discordgo sends one packet every 20ms and advances the RTP timestamp by 20ms, so other durations break the pacing.
+const discordFrame = 20 * time.Millisecond
+
 type fromDiscord struct {
 	decoder       *gopus.Decoder
-	pcm           chan []int16
+	pcm           *audioQueue
 	receiving     bool // is used to to track the assumption that we are streaming a continuos stream form discord
 	streaming     bool // The buffer streaming is streaming out
 	lastSequence  uint16
 	lastTimeStamp uint32
-	userID				string
+	userID        string
+	username      string
+	stream        string // "ssrc:" and the SSRC, the recorder track of the stream
+	log           *logger.Logger
+	gate          *gate
+	agc           *agc
+	speaker       *speakerState
+	splitter      *blockSplitter
+}
+
+// statID identifies the stream in the user statistics, streams without a known user are tracked by SSRC
+func (f *fromDiscord) statID() string {
+	if f.userID != "" {
+		return f.userID
+	}
+	return f.stream
 }
 
 // DiscordDuplex Handle discord voice stream
 type DiscordDuplex struct {
 	Bridge *BridgeState
 
+	log          *logger.Logger
+	metrics      *Metrics
+	clock        clock.Clock
+	mumbleLog    *logger.Limiter
+	shortLog     *logger.Limiter
+	shortSendLog *logger.Limiter
+
 	discordMutex            sync.Mutex
 	fromDiscordMap          map[uint32]fromDiscord
 	discordSendSleepTick    sleepct.SleepCT
 	discordReceiveSleepTick sleepct.SleepCT
+
+	sendTick  loopTick
+	mixerTick loopTick
+
+	// scratch slices of mixBlock, reused every block
+	mixFrames   [][]int16
+	mixPriority []bool
+	mixSpeakers []*speakerState
+	mixSounds   [][]int16
 }
 
-func NewDiscordDuplex(b *BridgeState) *DiscordDuplex {
+func NewDiscordDuplex(b *BridgeState, log *logger.Logger) *DiscordDuplex {
 	return &DiscordDuplex{
 		Bridge:                  b,
+		log:                     log,
+		metrics:                 b.Metrics,
+		clock:                   clock.OrReal(b.Clock),
+		mumbleLog:               log.Every(5 * time.Second),
+		shortLog:                log.Every(5 * time.Second),
+		shortSendLog:            log.Every(5 * time.Second),
 		fromDiscordMap:          make(map[uint32]fromDiscord),
-		discordSendSleepTick:    sleepct.SleepCT{},
-		discordReceiveSleepTick: sleepct.SleepCT{},
-	}
-}
-
-// OnError gets called by dgvoice when an error is encountered.
-// By default logs to STDERR
-var OnError = func(str string, err error) {
-	prefix := "dgVoice: " + str
-
-	if err != nil {
-		log.Println(prefix + ": " + err.Error())
-	} else {
-		log.Println(prefix)
+		discordSendSleepTick:    sleepct.SleepCT{Clock: b.Clock, CatchUp: b.BridgeConfig.TimerCatchUp, ResyncThreshold: b.BridgeConfig.TimerResyncThreshold},
+		discordReceiveSleepTick: sleepct.SleepCT{Clock: b.Clock, CatchUp: b.BridgeConfig.TimerCatchUp, ResyncThreshold: b.BridgeConfig.TimerResyncThreshold},
 	}
 }
 
 // SendPCM will receive on the provied channel encode
 // received PCM data with Opus then send that to Discordgo
-func (dd *DiscordDuplex) discordSendPCM(ctx context.Context, cancel context.CancelFunc, pcm <-chan []int16) {
+func (dd *DiscordDuplex) discordSendPCM(ctx context.Context, cancel context.CancelFunc, pcm *audioQueue) {
 	const channels int = 1
-	const frameRate int = 48000              // audio sampling rate
-	const frameSize int = 960                // uint16 size of each audio frame
-	const maxBytes int = (frameSize * 2) * 2 // max size of opus data
+	const frameRate int = 48000 // audio sampling rate
 
-	streaming := false
+	config := dd.Bridge.BridgeConfig
+	const blocks = int(discordFrame / blockDuration)
+	const frameSize int = blocks * blockSize // uint16 size of each audio frame
+	const maxBytes int = (frameSize * 2) * 2 // max size of opus data
 
 	opusEncoder, err := gopus.NewEncoder(frameRate, channels, gopus.Audio)
 	if err != nil {
-		OnError("NewEncoder Error", err)
+		dd.log.Error("NewEncoder Error", "err", err)
 		panic(err)
 	}
 
 	// Generate Opus Silence Frame
 	opusSilence := []byte{0xf8, 0xff, 0xfe}
 
-	dd.discordSendSleepTick.Start(20 * time.Millisecond)
+	speaking := newSpeakingState(dd.clock, discordFrame, config.DiscordHangover, config.SpeakingHold, config.ComfortNoise, dd.metrics.toDiscordToggles)
+
+	dd.discordSendSleepTick.Start(discordFrame)
 
 	lastReady := true
-	var readyTimeout *time.Timer
-	var speakingStart time.Time
-
-	// Spy on the PCM channel to notify
-	// TODO determine a method to notify a paused sleepct
-	// pcm := make(chan []int16, 10)
-	// go func() {
-	// 	for {
-	// 		t, ok := <-pcmIn
-	// 		if !ok {
-	// 			close(pcm)
-	// 			return
-	// 		} else {
-	// 			dd.discordSendSleepTick.Notify()
-	// 			pcm <- t
-	// 		}
-	// 	}
-	// }()
+	var readyTimeout clock.Timer
+
+	// Reused every frame
+	frame := make([]int16, frameSize)
+	var noise []int16
+	speakingDone := make(chan bool, 1)
+	var speakingTimeout clock.Timer
 
 	internalSend := func(opus []byte) {
-		dd.Bridge.DiscordVoice.RWMutex.RLock()
-		if !dd.Bridge.DiscordVoice.Ready || dd.Bridge.DiscordVoice.OpusSend == nil {
+		if !dd.Bridge.DiscordVoice.SendReady() {
 			if lastReady {
-				OnError(fmt.Sprintf("Discordgo not ready for opus packets. %+v : %+v", dd.Bridge.DiscordVoice.Ready, dd.Bridge.DiscordVoice.OpusSend), nil)
-				readyTimeout = time.AfterFunc(30*time.Second, func() {
-					log.Println("Debug: Set ready timeout")
+				dd.log.Warn("Discordgo not ready for opus packets")
+				readyTimeout = dd.clock.AfterFunc(30*time.Second, func() {
+					dd.log.Error("Discordgo send ready timeout")
 					cancel()
 				})
 				lastReady = false
 			}
 		} else if !lastReady {
-			fmt.Println("Discordgo ready to send opus packets")
+			dd.log.Info("Discordgo ready to send opus packets")
 			lastReady = true
 			readyTimeout.Stop()
-		} else {
-			select {
-			case dd.Bridge.DiscordVoice.OpusSend <- opus:
-			case <-ctx.Done():
-			}
-
-			promDiscordSentPackets.Inc()
+		} else if dd.Bridge.DiscordVoice.SendOpus(ctx, opus) {
+			dd.metrics.discordSentPackets.Inc()
 		}
-		dd.Bridge.DiscordVoice.RWMutex.RUnlock()
 	}
 
-	defer log.Println("Stopping Discord send PCM")
+	defer dd.log.Info("Stopping Discord send PCM")
 
 	for {
 		select {
@@ -130,66 +147,76 @@ func (dd *DiscordDuplex) discordSendPCM(ctx context.Context, cancel context.Canc
 		default:
 		}
 
-		// if we are not streaming try to pause
-		// promTimerDiscordSend.Observe(float64(dd.discordSendSleepTick.SleepNextTarget(ctx, !streaming)))
-		promTimerDiscordSend.Observe(float64(dd.discordSendSleepTick.SleepNextTarget(ctx, false)))
+		// if we are not streaming try to pause, the mumble mixer notifies when it queues audio
+		dd.metrics.timerDiscordSend.Observe(float64(dd.discordSendSleepTick.SleepNextTarget(ctx, !speaking.speaking && dd.Bridge.BridgeConfig.IdlePause)))
+		dd.sendTick.tick()
+		speaking.update()
 
-		if (len(pcm) > 1 && streaming) || (len(pcm) > dd.Bridge.BridgeConfig.DiscordStartStreamingCount && !streaming) {
-			if !streaming {
-				speakingStart = time.Now()
-				done := make(chan bool, 1)
+		if queued := pcm.len(); queued >= blocks && (speaking.speaking || queued > dd.Bridge.BridgeConfig.DiscordStartStreamingCount) {
+			if speaking.audio() {
 				go func() {
 					// This call will prevent discordSendPCM from exiting if the discord connection is lost
 					dd.Bridge.DiscordVoice.Speaking(true)
-					done <- true
+					speakingDone <- true
 				}()
+				speakingTimeout = resetTimer(dd.clock, speakingTimeout, 5*time.Second)
 				select {
-				case <-done:
-				case <-time.After(5 * time.Second):
-					fmt.Println("Discord speaking timeout :(")
+				case <-speakingDone:
+					stopTimer(speakingTimeout)
+				case <-speakingTimeout.C():
+					dd.log.Error("Discord speaking timeout")
 					cancel()
 					return
 				case <-ctx.Done():
+					speakingTimeout.Stop()
 					return
 				}
-				streaming = true
 			}
 
-			r1 := <-pcm
-			r2 := <-pcm
+			for i := 0; i < blocks; i++ {
+				block := pcm.pop()
+				copy(frame[i*blockSize:], block)
+				blockPool.put(block)
+			}
 
 			// try encoding pcm frame with Opus
-			opus, err := opusEncoder.Encode(append(r1, r2...), frameSize, maxBytes)
+			opus, err := opusEncoder.Encode(frame, frameSize, maxBytes)
 			if err != nil {
-				OnError("Encoding Error", err)
+				dd.log.Error("Encoding Error", "err", err)
 				continue
 			}
 
 			internalSend(opus)
 
-		} else {
-			if streaming {
-				// Check to see if there is a short speaking cycle.
-				// It is possible that short speaking cycle is the result of a short input to mumble (Not a problem). ie a quick tap of push to talk button.
-				// Or when timing delays are introduced via network, hardware or kernel delays (Problem).
-				// The problem delays result in choppy or stuttering sounds, especially when the silence frames are introduced into the opus frames below.
-				// Multiple short cycle delays can result in a discord rate limiter being trigger due to of multiple JSON speaking/not-speaking state changes
-				if time.Since(speakingStart).Milliseconds() < 50 {
-					log.Println("Warning: Short Mumble to Discord speaking cycle. Consider increaseing the size of the to Discord jitter buffer.")
-				}
-
-				// Send silence as suggested by Discord Documentation.
-				// We want to do this after alerting the user of possible short speaking cycles
-				for i := 0; i < 5; i++ {
-					internalSend(opusSilence)
-					// promTimerDiscordSend.Observe(float64(dd.discordSendSleepTick.SleepNextTarget(ctx, true)))
-					promTimerDiscordSend.Observe(float64(dd.discordSendSleepTick.SleepNextTarget(ctx, false)))
-
+		} else if speaking.speaking {
+			// Send silence as suggested by Discord Documentation, or comfort noise, until the hangover and hold times end.
+			// Audio returning in that time continues the speaking state.
+			if speaking.silence() {
+				opus := opusSilence
+				if speaking.noise != 0 {
+					if noise == nil {
+						noise = make([]int16, frameSize)
+					}
+					speaking.fill(noise)
+					if opus, err = opusEncoder.Encode(noise, frameSize, maxBytes); err != nil {
+						dd.log.Error("Encoding Error", "err", err)
+						continue
+					}
 				}
+				internalSend(opus)
+				continue
+			}
 
-				dd.Bridge.DiscordVoice.Speaking(false)
-				streaming = false
+			// Check to see if there is a short speaking cycle.
+			// It is possible that short speaking cycle is the result of a short input to mumble (Not a problem). ie a quick tap of push to talk button.
+			// Or when timing delays are introduced via network, hardware or kernel delays (Problem).
+			// The problem delays result in choppy or stuttering sounds, especially when the silence frames are introduced into the opus frames.
+			// Multiple short cycle delays can result in a discord rate limiter being trigger due to of multiple JSON speaking/not-speaking state changes
+			if ms := speaking.spoken().Milliseconds(); ms < 50 {
+				dd.shortSendLog.Warn("Short Mumble to Discord speaking cycle. Consider increaseing the size of the to Discord jitter buffer or the hangover.", "ms", ms)
 			}
+
+			dd.Bridge.DiscordVoice.Speaking(false)
 		}
 	}
 }
@@ -200,44 +227,47 @@ func (dd *DiscordDuplex) discordReceivePCM(ctx context.Context, cancel context.C
 	var err error
 
 	lastReady := true
-	var readyTimeout *time.Timer
-
-	var zeros [480]int16
-	for i := 0; i < 480; i++ {
-		zeros[i] = 0
-	}
+	var readyTimeout clock.Timer
+	var wait clock.Timer
 
 	for {
-		dd.Bridge.DiscordVoice.RWMutex.RLock()
-		if !dd.Bridge.DiscordVoice.Ready || dd.Bridge.DiscordVoice.OpusRecv == nil {
+		opusRecv, ready := dd.Bridge.DiscordVoice.OpusRecv()
+		if !ready {
 			if lastReady {
-				OnError(fmt.Sprintf("Discordgo not to receive opus packets. %+v : %+v", dd.Bridge.DiscordVoice.Ready, dd.Bridge.DiscordVoice.OpusSend), nil)
-				readyTimeout = time.AfterFunc(30*time.Second, func() {
-					log.Println("Debug: Set ready timeout")
+				dd.log.Warn("Discordgo not ready to receive opus packets")
+				readyTimeout = dd.clock.AfterFunc(30*time.Second, func() {
+					dd.log.Error("Discordgo receive ready timeout")
 					cancel()
 				})
 				lastReady = false
 			}
+			wait = resetTimer(dd.clock, wait, 10*time.Millisecond)
+			select {
+			case <-ctx.Done():
+				wait.Stop()
+				dd.log.Info("Stopping Discord receive PCM")
+				return
+			case <-wait.C():
+			}
 			continue
 		} else if !lastReady {
-			fmt.Println("Discordgo ready to receive packets")
+			dd.log.Info("Discordgo ready to receive packets")
 			lastReady = true
 			readyTimeout.Stop()
 		}
-		dd.Bridge.DiscordVoice.RWMutex.RUnlock()
 
 		var ok bool
 		var p *discordgo.Packet
 
 		select {
 		case <-ctx.Done():
-			log.Println("Stopping Discord receive PCM")
+			dd.log.Info("Stopping Discord receive PCM")
 			return
-		case p, ok = <-dd.Bridge.DiscordVoice.OpusRecv:
+		case p, ok = <-opusRecv:
 		}
 
 		if !ok {
-			log.Println("Opus not ok")
+			dd.log.Warn("Opus receive channel closed")
 			continue
 		}
 
@@ -247,13 +277,21 @@ func (dd *DiscordDuplex) discordReceivePCM(ctx context.Context, cancel context.C
 		_, ok = dd.fromDiscordMap[p.SSRC]
 		if !ok {
 			newStream := fromDiscord{}
-			newStream.pcm = make(chan []int16, 100)
 			newStream.receiving = false
 			newStream.streaming = false
 			newStream.userID = dd.Bridge.DiscordUserSSRC[p.SSRC]
+			newStream.stream = "ssrc:" + strconv.FormatUint(uint64(p.SSRC), 10)
+			newStream.log = dd.log.With("ssrc", p.SSRC, "user", newStream.userID)
+			newStream.pcm = newAudioQueue(queueFromDiscord, 100, dd.Bridge.BridgeConfig.Backpressure.FromDiscord, blockPool, newStream.log, dd.metrics)
+			newStream.username = dd.Bridge.discordUsername(newStream.userID)
+			newStream.gate = dd.Bridge.NoiseGate.newGate(sideDiscord)
+			newStream.agc = dd.Bridge.AGC.newAGC()
+			newStream.speaker = &speakerState{}
+			newStream.splitter = &blockSplitter{}
 			newStream.decoder, err = gopus.NewDecoder(48000, 1) // Decode into mono
 			if err != nil {
-				OnError("error creating opus decoder", err)
+				newStream.log.Error("Error creating opus decoder", "err", err)
+				dd.Bridge.DiscordUserSSRCMutex.RUnlock()
 				dd.discordMutex.Unlock()
 				continue
 			}
@@ -263,6 +301,11 @@ func (dd *DiscordDuplex) discordReceivePCM(ctx context.Context, cancel context.C
 		if len(dd.fromDiscordMap[p.SSRC].userID) == 0 {
 			s := dd.fromDiscordMap[p.SSRC]
 			s.userID = dd.Bridge.DiscordUserSSRC[p.SSRC]
+			if len(s.userID) > 0 {
+				s.username = dd.Bridge.discordUsername(s.userID)
+				s.log = dd.log.With("ssrc", p.SSRC, "user", s.userID)
+				s.pcm.setLog(s.log)
+			}
 			dd.fromDiscordMap[p.SSRC] = s
 		}
 		dd.Bridge.DiscordUserSSRCMutex.RUnlock()
@@ -277,9 +320,8 @@ func (dd *DiscordDuplex) discordReceivePCM(ctx context.Context, cancel context.C
 		// oldReceiving := s.receiving
 
 		if !s.receiving || deltaT < 1 || deltaT > 960*10 {
-			// First packet assume deltaT
-			// fmt.Println("replacing", deltaT, 960)
-			deltaT = 960
+			// First packet, allow the longest opus frame
+			deltaT = opusMaxFrameSize
 			s.receiving = true
 		}
 
@@ -291,33 +333,37 @@ func (dd *DiscordDuplex) discordReceivePCM(ctx context.Context, cancel context.C
 
 		p.PCM, err = s.decoder.Decode(p.Opus, deltaT, false)
 		if err != nil {
-			OnError("Error decoding opus data", err)
+			s.log.Warn("Error decoding opus data", "err", err)
 			continue
 		}
 
 		// fmt.Println(p.SSRC, p.Type, deltaT, p.Sequence, p.Sequence-s.lastSequence, oldReceiving, s.streaming, len(p.Opus), len(p.PCM))
 
-		promDiscordReceivedPackets.Inc()
+		dd.metrics.discordReceivedPackets.Inc()
+		statID := s.statID()
+		dd.Bridge.UserStats.Packet(sideDiscord, statID, s.username)
 
-		// Push data into pcm channel in 10ms chunks of mono pcm data
+		// Push data into pcm channel in 10ms blocks of mono pcm data
 		dd.discordMutex.Lock()
-		for l := 0; l < len(p.PCM); l = l + 480 {
-			var next []int16
-			u := l + 480
-
-			next = p.PCM[l:u]
+		for _, next := range s.splitter.split(p.PCM) {
+			dd.Bridge.UserStats.Frame(sideDiscord, statID, s.username, next, blockDuration)
+			dd.Bridge.Recorder.Frame(sideDiscord, s.stream, s.userID, s.username, next)
+
+			// Gain stage: noise gate, automatic gain control and the manual volume on top
+			if !s.gate.process(next) {
+				dd.metrics.discordGated.Add(blockDuration.Seconds())
+				blockPool.put(next)
+				continue
+			}
+			s.agc.process(next)
 			dd.Bridge.DiscordUserVolumeMutex.RLock()
-			for i := 0; i < len(next); i++ {
-				if volume, ok := dd.Bridge.DiscordUserVolume[dd.fromDiscordMap[p.SSRC].userID]; ok {
-					next[i] = int16(float64(next[i]) * volume)
-				}
+			if volume, ok := dd.Bridge.DiscordUserVolume[dd.fromDiscordMap[p.SSRC].userID]; ok {
+				scale(next, volume)
 			}
 			dd.Bridge.DiscordUserVolumeMutex.RUnlock()
 
-			select {
-			case dd.fromDiscordMap[p.SSRC].pcm <- next:
-			default:
-				log.Println("From Discord buffer full. Dropping packet")
+			if !s.pcm.push(next) {
+				dd.Bridge.UserStats.Drop(sideDiscord, statID, s.username)
 			}
 		}
 		dd.discordMutex.Unlock()
@@ -326,112 +372,165 @@ func (dd *DiscordDuplex) discordReceivePCM(ctx context.Context, cancel context.C
 	}
 }
 
-func (dd *DiscordDuplex) fromDiscordMixer(ctx context.Context, toMumble chan<- gumble.AudioBuffer) {
-	mumbleSilence := gumble.AudioBuffer{}
-	for i := 3; i < 480; i++ {
-		mumbleSilence = append(mumbleSilence, 0x00)
-	}
-	var speakingStart time.Time
+func (dd *DiscordDuplex) fromDiscordMixer(ctx context.Context, toMumble *audioQueue) {
+	config := dd.Bridge.BridgeConfig
+	blocks := frameBlocks(config.MumbleFrame, blockDuration)
+	speaking := newSpeakingState(dd.clock, blockDuration, config.MumbleHangover, config.SpeakingHold, config.ComfortNoise, dd.metrics.toMumbleToggles)
 
-	dd.discordReceiveSleepTick.Start(10 * time.Millisecond)
+	dd.discordReceiveSleepTick.Start(time.Duration(blocks) * blockDuration)
 
 	sendAudio := false
-	toMumbleStreaming := false
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Stopping from Discord mixer")
+			dd.log.Info("Stopping from Discord mixer")
 			return
 		default:
 		}
 
-		// if didn't send audio try to pause
-		// promTimerDiscordMixer.Observe(float64(dd.discordReceiveSleepTick.SleepNextTarget(ctx, !sendAudio)))
-		// TODO Additional pause testing
-		promTimerDiscordMixer.Observe(float64(dd.discordReceiveSleepTick.SleepNextTarget(ctx, false)))
-
-		dd.discordMutex.Lock()
+		// if didn't send audio try to pause, discordReceivePCM notifies when it queues audio
+		dd.metrics.timerDiscordMixer.Observe(float64(dd.discordReceiveSleepTick.SleepNextTarget(ctx, !sendAudio && !speaking.speaking && dd.Bridge.BridgeConfig.IdlePause)))
+		dd.mixerTick.tick()
+		speaking.update()
 
+		// Each wake mixes the blocks of one Mumble frame into a frame of the queue pool
 		sendAudio = false
-		internalMixerArr := make([][]int16, 0)
-		streamingCount := 0
-
-		// Work through each channel
-		for i := range dd.fromDiscordMap {
-			bufferLength := len(dd.fromDiscordMap[i].pcm)
-			isStreaming := dd.fromDiscordMap[i].streaming
-			if (bufferLength > 0 && isStreaming) || (bufferLength > dd.Bridge.BridgeConfig.MumbleStartStreamCount && !isStreaming) {
-				if !toMumbleStreaming {
-					speakingStart = time.Now()
-					toMumbleStreaming = true
-				}
+		var frame []int16
+		n := 0
+		for i := 0; i < blocks; i++ {
+			outBuf := dd.mixBlock()
+			if outBuf == nil && !speaking.speaking {
+				continue
+			}
+			if frame == nil {
+				frame = toMumble.pool.get()
+			}
+			if outBuf != nil {
 				sendAudio = true
-
-				if !isStreaming {
-					x := dd.fromDiscordMap[i]
-					x.streaming = true
-					dd.fromDiscordMap[i] = x
-				}
-
-				streamingCount++
-				x1 := (<-dd.fromDiscordMap[i].pcm)
-				internalMixerArr = append(internalMixerArr, x1)
-			} else {
-				if dd.fromDiscordMap[i].streaming {
-					x := dd.fromDiscordMap[i]
-					x.streaming = false
-					x.receiving = false // toggle this here is not optimal but there is no better location atm.
-					dd.fromDiscordMap[i] = x
-				}
+				speaking.audio()
+				copy(frame[n:], outBuf)
+				blockPool.put(outBuf)
+				n += blockSize
+			} else if speaking.silence() {
+				// Send silence, or comfort noise, to mumble until the hangover and hold times end
+				speaking.fill(frame[n : n+blockSize])
+				n += blockSize
+			} else if ms := speaking.spoken().Milliseconds(); ms < 50 {
+				// See note above about jitter buffer warning
+				dd.shortLog.Warn("Short Discord to Mumble speaking cycle. Consider increaseing the size of the to Mumble jitter buffer or the hangover.", "ms", ms)
 			}
 		}
 
-		promDiscordArraySize.Set(float64(len(dd.fromDiscordMap)))
-		promDiscordStreaming.Set(float64(streamingCount))
+		if n == 0 {
+			toMumble.pool.put(frame)
+		} else {
+			// Mumble frames are whole, a stream ending within the frame is padded with silence
+			zero(frame[n:])
+			if toMumble.push(frame) {
+				dd.metrics.sentMumblePackets.Inc()
+			}
+		}
+	}
+}
 
-		dd.discordMutex.Unlock()
+// mixBlock mixes one block of the discord streams and the sounds into a pooled block, it returns nil without audio
+func (dd *DiscordDuplex) mixBlock() []int16 {
+	dd.discordMutex.Lock()
 
-		mumbleTimeoutSend := func(outBuf []int16) {
-			timeout := make(chan bool, 1)
-			go func() {
-				time.Sleep(10 * time.Millisecond)
-				timeout <- true
-			}()
+	sendAudio := false
+	internalMixerArr := dd.mixFrames[:0]
+	priorityArr := dd.mixPriority[:0]
+	speakerArr := dd.mixSpeakers[:0]
+	prioritySpeaking := false
+	streamingCount := 0
+
+	// Work through each channel
+	for i := range dd.fromDiscordMap {
+		bufferLength := dd.fromDiscordMap[i].pcm.len()
+		isStreaming := dd.fromDiscordMap[i].streaming
+		if (bufferLength > 0 && isStreaming) || (bufferLength > dd.Bridge.BridgeConfig.MumbleStartStreamCount && !isStreaming) {
+			sendAudio = true
+
+			if !isStreaming {
+				x := dd.fromDiscordMap[i]
+				x.streaming = true
+				dd.fromDiscordMap[i] = x
+			}
 
-			select {
-			case toMumble <- outBuf:
-				promSentMumblePackets.Inc()
-			case <-timeout:
-				log.Println("To Mumble timeout. Dropping packet")
-				promToMumbleDropped.Inc()
+			streamingCount++
+			x1 := dd.fromDiscordMap[i].pcm.pop()
+			internalMixerArr = append(internalMixerArr, x1)
+			priority := dd.Bridge.Priority.Discord(dd.fromDiscordMap[i].userID)
+			priorityArr = append(priorityArr, priority)
+			speakerArr = append(speakerArr, dd.fromDiscordMap[i].speaker)
+			prioritySpeaking = prioritySpeaking || priority
+		} else {
+			dd.fromDiscordMap[i].speaker.decay()
+			if dd.fromDiscordMap[i].streaming {
+				x := dd.fromDiscordMap[i]
+				x.streaming = false
+				x.receiving = false // toggle this here is not optimal but there is no better location atm.
+				dd.fromDiscordMap[i] = x
 			}
 		}
+	}
 
-		if sendAudio {
-			// Regular send mixed audio
-			outBuf := make([]int16, 480)
+	dd.metrics.discordArraySize.Set(float64(len(dd.fromDiscordMap)))
+	dd.metrics.discordStreaming.Set(float64(streamingCount))
 
-			for j := 0; j < len(internalMixerArr); j++ {
-				for i := 0; i < len(internalMixerArr[j]); i++ {
-					outBuf[i] += (internalMixerArr[j])[i]
-				}
-			}
+	dd.mixFrames, dd.mixPriority, dd.mixSpeakers = internalMixerArr, priorityArr, speakerArr
+	popped := internalMixerArr
 
-			mumbleTimeoutSend(outBuf)
-		} else if !sendAudio && toMumbleStreaming {
-			// Send opus silence to mumble
-			// See note above about jitter buffer warning
-			if time.Since(speakingStart).Milliseconds() < 50 {
-				log.Println("Warning: Short Discord to Mumble speaking cycle. Consider increaseing the size of the to Mumble jitter buffer.", time.Since(speakingStart).Milliseconds())
-			}
+	// Only the loudest streams are mixed, the others are still counted as streaming
+	internalMixerArr, priorityArr, unmixed := selectSpeakers(internalMixerArr, priorityArr, speakerArr, dd.Bridge.BridgeConfig.MixMaxSpeakers)
+	dd.metrics.discordUnmixed.Add(float64(unmixed))
 
-			for i := 0; i < 5; i++ {
-				mumbleTimeoutSend(mumbleSilence)
-				promTimerDiscordMixer.Observe(float64(dd.discordReceiveSleepTick.SleepNextTarget(ctx, false)))
-			}
+	dd.discordMutex.Unlock()
+
+	gain := dd.Bridge.Priority.gain(sideDiscord, prioritySpeaking)
+	applyGain(internalMixerArr, priorityArr, gain)
+	dd.Bridge.Ducker.Speaking(sideDiscord, len(internalMixerArr) > 0)
 
-			toMumbleStreaming = false
+	// Soundboard and chimes, lowered like the other speakers while a priority speaker talks
+	sounds := dd.Bridge.soundFrames(sideMumble, dd.mixSounds[:0])
+	applyGainAll(sounds, gain)
+	if len(sounds) > 0 {
+		sendAudio = true
+	}
+
+	var outBuf []int16
+	if sendAudio {
+		// Regular send mixed audio
+		outBuf = blockPool.get()
+		mix(outBuf, internalMixerArr)
+		// Discord speakers are ducked while Mumble users speak, sounds are not
+		dd.Bridge.Ducker.apply(sideMumble, outBuf)
+		if len(sounds) > 0 {
+			dd.mixSounds = append(sounds, outBuf)
+			mix(outBuf, dd.mixSounds)
 		}
+		dd.Bridge.Recorder.mixFrame(sideMumble, outBuf)
+		dd.Bridge.Replay.Frame(sideMumble, outBuf)
+	}
+
+	blockPool.putAll(popped)
+	blockPool.putAll(sounds)
+	return outBuf
+}
+
+// resetTimer starts t again to fire after d, or a new timer if t is nil. t must be stopped with its channel drained, or fired and received.
+func resetTimer(c clock.Clock, t clock.Timer, d time.Duration) clock.Timer {
+	if t == nil {
+		return c.NewTimer(d)
+	}
+	t.Reset(d)
+	return t
+}
+
+// stopTimer stops t and drains its channel so it can be reset
+func stopTimer(t clock.Timer) {
+	if !t.Stop() {
+		<-t.C()
 	}
 }
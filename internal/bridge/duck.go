@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+)
+
+// Ducker lowers the audio relayed into a side while users speak on that side, so a presenter stays intelligible over the chatter of the other side.
+// The mixers report the speaking activity of their side and duck their output with it.
+// The mixers only duck blocks with audio and pause while idle, so the ramps follow the clock between blocks.
+// A nil *Ducker is valid and ducks nothing.
+type Ducker struct {
+	duck        map[string]bool // sides whose speakers duck the audio relayed into them
+	depth       float64         // attenuation while fully ducked, 1 - volume
+	attackStep  float64         // attenuation change per 10ms frame
+	releaseStep float64
+
+	mu        sync.Mutex
+	clock     clock.Clock
+	speaking  map[string]bool
+	reduction map[string]float64   // current attenuation of the audio relayed to a side
+	at        map[string]time.Time // time the reduction was last moved to
+}
+
+// NewDucker returns a ducker for priority, mumble, discord or both, the side whose speakers duck the other side.
+// The relayed audio drops to volume within attack once a priority user speaks and recovers within release after they stop.
+func NewDucker(priority string, volume float64, attack, release time.Duration) (*Ducker, error) {
+	d := &Ducker{
+		duck:      make(map[string]bool),
+		depth:     1 - volume,
+		clock:     clock.Real,
+		speaking:  make(map[string]bool),
+		reduction: make(map[string]float64),
+		at:        make(map[string]time.Time),
+	}
+	switch priority {
+	case sideMumble, sideDiscord:
+		d.duck[priority] = true
+	case TargetBoth:
+		d.duck[sideMumble] = true
+		d.duck[sideDiscord] = true
+	default:
+		return nil, fmt.Errorf("invalid ducking priority %q", priority)
+	}
+	d.attackStep = rampStep(d.depth, attack)
+	d.releaseStep = rampStep(d.depth, release)
+	return d, nil
+}
+
+// rampStep returns the change per 10ms frame to cover depth within d
+func rampStep(depth float64, d time.Duration) float64 {
+	frames := float64(d) / float64(blockDuration)
+	if frames <= 1 {
+		return depth
+	}
+	return depth / frames
+}
+
+// Speaking records if users speak on side, called by the mixer of the side every tick
+func (d *Ducker) Speaking(side string, active bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if active != d.speaking[side] {
+		// The ramp up to now followed the previous state
+		d.settle(side, d.clock.Now())
+	}
+	d.speaking[side] = active
+	d.mu.Unlock()
+}
+
+// reset clears the state of the last session, the ramps follow c
+func (d *Ducker) reset(c clock.Clock) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.clock = clock.OrReal(c)
+	d.speaking = make(map[string]bool)
+	d.reduction = make(map[string]float64)
+	d.at = make(map[string]time.Time)
+	d.mu.Unlock()
+}
+
+// ramp returns the reduction of side moved toward its target by a number of 10ms blocks, d.mu must be held
+func (d *Ducker) ramp(side string, blocks float64) float64 {
+	r := d.reduction[side]
+	target := 0.0
+	if d.duck[side] && d.speaking[side] {
+		target = d.depth
+	}
+	if r < target {
+		return math.Min(r+d.attackStep*blocks, target)
+	}
+	if r > target {
+		return math.Max(r-d.releaseStep*blocks, target)
+	}
+	return r
+}
+
+// settle moves the reduction of side along its ramp for the time since it was last moved, d.mu must be held
+func (d *Ducker) settle(side string, now time.Time) {
+	at := d.at[side]
+	if !at.IsZero() && now.After(at) {
+		d.reduction[side] = d.ramp(side, float64(now.Sub(at))/float64(blockDuration))
+	}
+	if now.After(at) {
+		d.at[side] = now
+	}
+}
+
+// apply ducks a 10ms frame of audio relayed to side, ramping the gain over the frame
+func (d *Ducker) apply(to string, frame []int16) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.settle(to, d.clock.Now())
+	from := d.reduction[to]
+	next := d.ramp(to, 1)
+	d.reduction[to] = next
+	// The frame covers the next 10ms of the ramp
+	d.at[to] = d.at[to].Add(blockDuration)
+	d.mu.Unlock()
+
+	if from == 0 && next == 0 {
+		return
+	}
+	n := float64(len(frame))
+	for i, v := range frame {
+		gain := 1 - (from + (next-from)*float64(i+1)/n)
+		frame[i] = int16(math.Round(float64(v) * gain))
+	}
+}
+
+// Ducked returns the current attenuation of the audio relayed to side, from 0 to 1
+func (d *Ducker) Ducked(side string) float64 {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.settle(side, d.clock.Now())
+	return d.reduction[side]
+}
@@ -0,0 +1,78 @@
+package bridge
+
+import (
+	"math"
+	"time"
+)
+
+// NoiseGate removes the quiet parts of relayed streams, such as keyboard noise and room hum from open mics.
+// A stream opens as soon as a 10ms frame reaches Threshold, stays open for Hold after it drops below and then fades out over Release.
+// Frames of a closed stream are not relayed at all, so the mixers see the stream as silent.
+// A nil *NoiseGate is valid and passes all audio.
+type NoiseGate struct {
+	Threshold float64 // RMS level in dBFS
+	Hold      time.Duration
+	Release   time.Duration
+	Mumble    bool // also gate Mumble streams, Discord streams are always gated
+}
+
+// gate is the state of the noise gate of one stream, a nil *gate passes all audio
+type gate struct {
+	threshold   float64 // RMS level as a sample value
+	holdFrames  int
+	releaseStep float64
+
+	hold int     // frames left to hold
+	gain float64 // 0 while closed
+}
+
+// newGate returns the gate of a new stream from side, nil if the side is not gated
+func (n *NoiseGate) newGate(side string) *gate {
+	if n == nil || (side == sideMumble && !n.Mumble) {
+		return nil
+	}
+	return &gate{
+		threshold:   32768 * math.Pow(10, n.Threshold/20), // inverse of dBFS
+		holdFrames:  int(n.Hold / blockDuration),
+		releaseStep: rampStep(1, n.Release),
+	}
+}
+
+// process gates a 10ms frame in place and reports if it is relayed
+func (g *gate) process(frame []int16) bool {
+	if g == nil {
+		return true
+	}
+	if rms(frame) >= g.threshold {
+		g.gain = 1
+		g.hold = g.holdFrames
+		return true
+	}
+	if g.hold > 0 {
+		g.hold--
+		return g.gain > 0
+	}
+	if g.gain <= 0 {
+		return false
+	}
+	from := g.gain
+	g.gain = math.Max(from-g.releaseStep, 0)
+	n := float64(len(frame))
+	for i, v := range frame {
+		gain := from + (g.gain-from)*float64(i+1)/n
+		frame[i] = int16(math.Round(float64(v) * gain))
+	}
+	return true
+}
+
+// rms returns the root mean square of a frame
+func rms(frame []int16) float64 {
+	if len(frame) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range frame {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum / float64(len(frame)))
+}
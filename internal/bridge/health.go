@@ -0,0 +1,210 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
+)
+
+// loopTick records the last time an audio loop completed an iteration.
+// It is written from the loop and read by the health checks.
+type loopTick struct {
+	last int64 // unix nano
+}
+
+func (t *loopTick) tick() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// age returns the time since the last tick, or false if the loop never ticked.
+func (t *loopTick) age() (time.Duration, bool) {
+	last := atomic.LoadInt64(&t.last)
+	if last == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, last)), true
+}
+
+// HealthCheck is the result of a single health rule
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReport is the response body of the health endpoints
+type HealthReport struct {
+	OK        bool          `json:"ok"`
+	Mode      string        `json:"mode"`
+	Connected bool          `json:"connected"`
+	Checks    []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, ok bool, detail string) {
+	r.Checks = append(r.Checks, HealthCheck{Name: name, OK: ok, Detail: detail})
+	if !ok {
+		r.OK = false
+	}
+}
+
+func (b *BridgeState) healthBase() (HealthReport, bool) {
+	b.BridgeMutex.Lock()
+	connected := b.Connected
+	b.BridgeMutex.Unlock()
+
+	return HealthReport{
+		OK:        true,
+		Mode:      b.Mode.String(),
+		Connected: connected,
+		Checks:    []HealthCheck{},
+	}, connected
+}
+
+// idleOK reports if the current mode is considered healthy without a running bridge
+func (b *BridgeState) idleOK() bool {
+	for _, m := range b.BridgeConfig.HealthIdleModes {
+		if m == b.Mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BridgeState) checkLoops(r *HealthReport, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	loops := []struct {
+		name string
+		to   string // side the loop plays to
+		t    *loopTick
+		s    *sleepct.SleepCT
+	}{
+		{"discord_send_loop", sideDiscord, &b.DiscordStream.sendTick, &b.DiscordStream.discordSendSleepTick},
+		{"from_discord_mixer_loop", sideMumble, &b.DiscordStream.mixerTick, &b.DiscordStream.discordReceiveSleepTick},
+		{"from_mumble_mixer_loop", sideDiscord, &b.MumbleStream.mixerTick, &b.MumbleStream.mumbleSleepTick},
+	}
+	b.BridgeMutex.Lock()
+	direction := b.sessionDirection
+	b.BridgeMutex.Unlock()
+	for _, l := range loops {
+		// A one-way bridge does not run the loops of the other direction
+		if !direction.plays(l.to) {
+			r.add(l.name, true, "not running in "+direction.String())
+			continue
+		}
+		// An idle loop waiting for audio does not tick
+		if l.s.Paused() {
+			r.add(l.name, true, "paused")
+			continue
+		}
+		age, started := l.t.age()
+		if !started {
+			// Loops are given the same timeout to produce their first tick
+			b.BridgeMutex.Lock()
+			age = time.Since(b.connectedAt)
+			b.BridgeMutex.Unlock()
+		}
+		r.add(l.name, age < timeout, "last tick "+age.Round(time.Millisecond).String()+" ago")
+	}
+}
+
+func (b *BridgeState) checkStartFailures(r *HealthReport) {
+	max := b.BridgeConfig.HealthMaxStartFailures
+	if max <= 0 || b.Mode != BridgeModeConstant {
+		return
+	}
+	b.BridgeMutex.Lock()
+	failures := b.startFailures
+	b.BridgeMutex.Unlock()
+	r.add("bridge_start", failures < max, strconv.Itoa(failures)+" consecutive start failures")
+}
+
+// Liveness reports if the process is working.
+// It fails when a running bridge has stalled audio loops or when the bridge repeatedly fails to start in constant mode.
+func (b *BridgeState) Liveness() HealthReport {
+	return b.liveness(b.BridgeConfig.HealthTickTimeout)
+}
+
+func (b *BridgeState) liveness(tickTimeout time.Duration) HealthReport {
+	r, connected := b.healthBase()
+	if connected {
+		b.checkLoops(&r, tickTimeout)
+	}
+	b.checkStartFailures(&r)
+	return r
+}
+
+// Readiness reports if the bridge is able to pass audio.
+// Modes listed in HealthIdleModes are ready without a running bridge as long as the Discord gateway is connected.
+func (b *BridgeState) Readiness() HealthReport {
+	r, connected := b.healthBase()
+
+	r.add("discord_gateway", b.DiscordSession.GatewayReady(), "")
+
+	if !connected {
+		if !b.idleOK() {
+			r.add("bridge", false, "bridge not connected")
+		}
+		b.checkStartFailures(&r)
+		return r
+	}
+
+	// A one-way bridge only needs the side of the voice connection it uses, a deafened connection does not receive
+	b.BridgeMutex.Lock()
+	direction := b.sessionDirection
+	b.BridgeMutex.Unlock()
+	voiceReady := !direction.plays(sideDiscord) || b.DiscordVoice.SendReady()
+	if direction.plays(sideMumble) {
+		_, recvReady := b.DiscordVoice.OpusRecv()
+		voiceReady = voiceReady && recvReady
+	}
+	r.add("discord_voice", voiceReady, "")
+
+	state := b.MumbleClient.State()
+	r.add("mumble", state == gumble.StateSynced, "state "+strconv.Itoa(int(state)))
+
+	b.checkLoops(&r, b.BridgeConfig.HealthTickTimeout)
+	b.checkStartFailures(&r)
+	return r
+}
+
+func healthHandler(check func() HealthReport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := check()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.OK {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(r)
+	})
+}
+
+// LivenessHandler serves Liveness as JSON, 200 when healthy and 503 otherwise
+func (b *BridgeState) LivenessHandler() http.Handler {
+	return healthHandler(b.Liveness)
+}
+
+// ReadinessHandler serves Readiness as JSON, 200 when ready and 503 otherwise
+func (b *BridgeState) ReadinessHandler() http.Handler {
+	return healthHandler(b.Readiness)
+}
+
+// StartHealthServer serves /healthz and /readyz on the given port
+func StartHealthServer(port int, b *BridgeState) {
+	b.Log.Info("Starting Health Server", "port", port)
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", b.LivenessHandler())
+	mux.Handle("/readyz", b.ReadinessHandler())
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), mux); err != nil {
+		b.Log.Error("Health Server stopped", "err", err)
+	}
+}
@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"math"
+	"time"
+)
+
+// The mixers work on blocks of 10ms of 48kHz mono PCM, frames sent to either side are made of whole blocks
+const (
+	blockDuration = 10 * time.Millisecond
+	blockSize     = 480
+)
+
+// frameBlocks returns the number of blocks in a frame of duration d, def if d is not set
+func frameBlocks(d, def time.Duration) int {
+	if d <= 0 {
+		d = def
+	}
+	n := int(d / blockDuration)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// blockSplitter splits PCM of any length into pooled blocks, keeping the rest for the next packet
+type blockSplitter struct {
+	rest   []int16 // pooled block, filled up to its length
+	blocks [][]int16
+}
+
+// split returns the whole blocks of pcm. The caller owns the blocks, the returned slice is reused by the next call.
+func (b *blockSplitter) split(pcm []int16) [][]int16 {
+	b.blocks = b.blocks[:0]
+	if b.rest != nil {
+		n := copy(b.rest[len(b.rest):blockSize], pcm)
+		b.rest = b.rest[:len(b.rest)+n]
+		pcm = pcm[n:]
+		if len(b.rest) < blockSize {
+			return b.blocks
+		}
+		b.blocks = append(b.blocks, b.rest)
+		b.rest = nil
+	}
+	for len(pcm) >= blockSize {
+		f := blockPool.get()
+		copy(f, pcm)
+		b.blocks = append(b.blocks, f)
+		pcm = pcm[blockSize:]
+	}
+	if len(pcm) > 0 {
+		b.rest = blockPool.get()[:len(pcm)]
+		copy(b.rest, pcm)
+	}
+	return b.blocks
+}
+
+// clamp saturates a sample to the int16 range
+func clamp(v int32) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// mix sums the frames into out. Loud streams clip instead of wrapping around.
+func mix(out []int16, frames [][]int16) {
+	for i := range out {
+		var sum int32
+		for _, f := range frames {
+			if i < len(f) {
+				sum += int32(f[i])
+			}
+		}
+		out[i] = clamp(sum)
+	}
+}
+
+// scale applies a gain to a frame in place
+func scale(frame []int16, gain float64) {
+	for i, v := range frame {
+		x := math.Round(float64(v) * gain)
+		if x > math.MaxInt16 {
+			x = math.MaxInt16
+		} else if x < math.MinInt16 {
+			x = math.MinInt16
+		}
+		frame[i] = int16(x)
+	}
+}
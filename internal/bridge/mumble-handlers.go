@@ -1,14 +1,13 @@
 package bridge
 
 import (
-	"fmt"
-	"log"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
 )
 
 // MumbleListener Handle mumble events
@@ -16,18 +15,42 @@ type MumbleListener struct {
 	Bridge *BridgeState
 }
 
+func (l *MumbleListener) log() *logger.Logger {
+	return l.Bridge.Log.With("side", "mumble")
+}
+
+// sendUser sends a private message to a Mumble user.
+// Events can arrive while the client is still being dialed, in which case the message is dropped.
+func (l *MumbleListener) sendUser(user *gumble.User, message string) {
+	if c := l.Bridge.MumbleClient; c != nil {
+		c.SendUser(user.Session, message)
+	}
+}
+
+// inChannel reports if the user is in the bridge's channel
+func (l *MumbleListener) inChannel(user *gumble.User) bool {
+	c := l.Bridge.MumbleClient
+	if c == nil || user.Channel == nil {
+		return false
+	}
+	id, ok := c.SelfChannelID()
+	return ok && user.Channel.ID == id
+}
+
 func (l *MumbleListener) updateUsers() {
+	c := l.Bridge.MumbleClient
+	if c == nil {
+		return
+	}
 	l.Bridge.MumbleUsersMutex.Lock()
 	l.Bridge.MumbleUsers = make(map[string]bool)
-	for _, user := range l.Bridge.MumbleClient.Self.Channel.Users {
-		//note, this might be too slow for really really big channels?
-		//event listeners block while processing
-		//also probably bad to rebuild the set every user change.
-		if user.Name != l.Bridge.MumbleClient.Self.Name {
-			l.Bridge.MumbleUsers[user.Name] = true
-		}
+	//note, this might be too slow for really really big channels?
+	//event listeners block while processing
+	//also probably bad to rebuild the set every user change.
+	for _, name := range c.ChannelUsers() {
+		l.Bridge.MumbleUsers[name] = true
 	}
-	promMumbleUsers.Set(float64(len(l.Bridge.MumbleUsers)))
+	l.Bridge.Metrics.mumbleUsers.Set(float64(len(l.Bridge.MumbleUsers)))
 	l.Bridge.MumbleUsersMutex.Unlock()
 
 }
@@ -39,33 +62,63 @@ func (l *MumbleListener) MumbleConnect(e *gumble.ConnectEvent) {
 		e.Client.Self.Move(startingChannel)
 	}
 
+	// Priority groups are read from the ACL of the channel on every connect
+	if l.Bridge.Priority.usesGroups() {
+		channel := startingChannel
+		if channel == nil {
+			channel = e.Client.Self.Channel
+		}
+		channel.RequestACL()
+	}
+
 	// l.updateUsers() // patch below
 
 	// This is an ugly patch Mumble Client state is slow to update
 	time.AfterFunc(5*time.Second, func() {
 		defer func() {
 			if r := recover(); r != nil {
-				fmt.Printf("Failed to mumble user list %v \n", r)
+				l.log().Error("Failed to update mumble user list", "err", r)
 			}
 		}()
 		l.updateUsers()
 	})
 }
 
+// MumbleACL receives the ACL requested on connect and on user changes
+func (l *MumbleListener) MumbleACL(e *gumble.ACLEvent) {
+	l.Bridge.Priority.setACL(e.ACL)
+	l.log().Info("Received Mumble ACL for priority groups", "channel", e.ACL.Channel.Name)
+}
+
+// MumblePermissionDenied logs the requests of the bridge that the server denied
+func (l *MumbleListener) MumblePermissionDenied(e *gumble.PermissionDeniedEvent) {
+	if e.Type == gumble.PermissionDeniedPermission && e.Permission.Has(gumble.PermissionWrite) && l.Bridge.Priority.usesGroups() {
+		l.log().Error("Mumble denied reading the ACL, priority groups need the Write ACL permission on the bridge's channel")
+		return
+	}
+	l.log().Warn("Mumble permission denied", "type", e.Type, "permission", e.Permission, "reason", e.String)
+}
+
 func (l *MumbleListener) MumbleUserChange(e *gumble.UserChangeEvent) {
 	l.updateUsers()
 
+	// Group members may have changed, registered users joining or registering are looked up again
+	if l.Bridge.Priority.usesGroups() && l.Bridge.MumbleClient != nil &&
+		(e.Type.Has(gumble.UserChangeRegistered) || (e.Type.Has(gumble.UserChangeConnected) && e.User.UserID != 0)) {
+		l.Bridge.MumbleClient.RequestACL()
+	}
+
 	if e.Type.Has(gumble.UserChangeConnected) {
 
-		log.Println("User connected to mumble " + e.User.Name)
+		l.log().Info("User connected to mumble", "user", e.User.Name, "session", e.User.Session)
 
 		if !l.Bridge.BridgeConfig.MumbleDisableText {
-			e.User.Send("Mumble-Discord-Bridge " + l.Bridge.BridgeConfig.Version)
+			l.sendUser(e.User, "Mumble-Discord-Bridge "+l.Bridge.BridgeConfig.Version)
 
 			// Tell the user who is connected to discord
 			l.Bridge.DiscordUsersMutex.Lock()
 			if len(l.Bridge.DiscordUsers) == 0 {
-				e.User.Send("No users connected to Discord")
+				l.sendUser(e.User, "No users connected to Discord")
 			} else {
 				s := "Connected to Discord: "
 
@@ -76,7 +129,7 @@ func (l *MumbleListener) MumbleUserChange(e *gumble.UserChangeEvent) {
 
 				s = s + strings.Join(arr[:], ",")
 
-				e.User.Send(s)
+				l.sendUser(e.User, s)
 			}
 			l.Bridge.DiscordUsersMutex.Unlock()
 
@@ -84,11 +137,13 @@ func (l *MumbleListener) MumbleUserChange(e *gumble.UserChangeEvent) {
 
 		// Send discord a notice
 		l.Bridge.discordSendMessageAll(e.User.Name + " has joined mumble")
+		l.Bridge.Chimes.Event(ChimeJoin, sideMumble, e.User.Name)
 	}
 
 	if e.Type.Has(gumble.UserChangeDisconnected) {
 		l.Bridge.discordSendMessageAll(e.User.Name + " has left mumble")
-		log.Println("User disconnected from mumble " + e.User.Name)
+		l.Bridge.Chimes.Event(ChimeLeave, sideMumble, e.User.Name)
+		l.log().Info("User disconnected from mumble", "user", e.User.Name, "session", e.User.Session)
 	}
 }
 
@@ -98,9 +153,13 @@ func (l *MumbleListener) MumbleTextMessage(e *gumble.TextMessageEvent) {
 	}
 	prefix := "/" //+ l.Bridge.BridgeConfig.Command <- I don't know what this is supposed to mean?
 	if strings.HasPrefix(e.Message, prefix+"help") {
-		e.Sender.Send("<br/>/volume (ID) (VOLUME) - change volume on a discord user<br/>/users - shows discord users in channel<br/>" +
-			"/mute (ID) - mutes a person in discord<br/>/unmute (ID) - unmutes a person in discord<br/>" +
-			"/channels - shows all channels on the discord server<br/>/changechannel (ID) - switch discord channel")
+		l.sendUser(e.Sender, "<br/>/volume (ID) (VOLUME) - change volume on a discord user<br/>/users - shows discord users in channel<br/>"+
+			"/mute (ID) - mutes a person in discord<br/>/unmute (ID) - unmutes a person in discord<br/>"+
+			"/channels - shows all channels on the discord server<br/>/changechannel (ID) - switch discord channel<br/>"+
+			"/stats - shows audio statistics per user<br/>/record (start|stop|status) - record the bridge to disk<br/>"+
+			"/clip (SECONDS) - save the last seconds of the bridge<br/>"+
+			"/sound (play FILE|skip|stop|queue|list) - play a soundboard file into the bridge<br/>"+
+			"/direction (both|mumble-to-discord|discord-to-mumble) - show or change the direction of the bridge")
 		return
 	}
 
@@ -111,84 +170,116 @@ func (l *MumbleListener) MumbleTextMessage(e *gumble.TextMessageEvent) {
 			message += user.username + " → " + userId + "<br/>"
 		}
 		l.Bridge.DiscordUsersMutex.Unlock()
-		e.Sender.Send(message)
+		l.sendUser(e.Sender, message)
+	}
+
+	if strings.HasPrefix(e.Message, prefix+"stats") {
+		l.sendUser(e.Sender, l.Bridge.UserStats.Summary(10, "<br/>"))
+	}
+
+	// Commands changing the bridge are limited to the users of the bridged channel
+	for _, c := range []string{"record", "clip", "direction", "sound"} {
+		if strings.HasPrefix(e.Message, prefix+c) && !l.inChannel(e.Sender) {
+			l.sendUser(e.Sender, "Join the bridged channel to use this command")
+			return
+		}
+	}
+
+	if strings.HasPrefix(e.Message, prefix+"record") {
+		arg := strings.TrimSpace(strings.TrimPrefix(e.Message, prefix+"record"))
+		l.sendUser(e.Sender, l.Bridge.recordCommand(arg, e.Sender.Name))
+	}
+
+	if strings.HasPrefix(e.Message, prefix+"clip") {
+		arg := strings.TrimSpace(strings.TrimPrefix(e.Message, prefix+"clip"))
+		l.sendUser(e.Sender, l.Bridge.clipCommand(arg, e.Sender.Name))
+	}
+
+	if strings.HasPrefix(e.Message, prefix+"direction") {
+		arg := strings.TrimSpace(strings.TrimPrefix(e.Message, prefix+"direction"))
+		l.sendUser(e.Sender, l.Bridge.directionCommand(arg, e.Sender.Name))
+	}
+
+	if strings.HasPrefix(e.Message, prefix+"sound") {
+		args := strings.Fields(strings.TrimPrefix(e.Message, prefix+"sound"))
+		l.sendUser(e.Sender, l.Bridge.soundCommand(args, e.Sender.Name, "<br/>"))
 	}
 
 	if strings.HasPrefix(e.Message, prefix+"volume") {
 		command := strings.Split(e.Message, " ")
 		if len(command) != 3 {
-			e.Sender.Send("Invalid amount of arguments! usage: '" + prefix + "volume (ID) (VOLUME)'")
+			l.sendUser(e.Sender, "Invalid amount of arguments! usage: '"+prefix+"volume (ID) (VOLUME)'")
 			return
 		}
 		if _, ok := l.Bridge.DiscordUsers[command[1]]; !ok {
-			e.Sender.Send("Invalid user! use '" + prefix + "users' to get a list of users")
+			l.sendUser(e.Sender, "Invalid user! use '"+prefix+"users' to get a list of users")
 			return
 		}
 		// either volume percentage or volume as a float or just an int/number below 200
 		exp, err := regexp.Compile(`^((\d|\d\d|1\d\d)(\\.\d+)?|200)%?$`)
 		if err != nil {
-			fmt.Println("you are bad at writing regex")
+			l.log().Error("you are bad at writing regex", "err", err)
 			return
 		}
 		if !exp.MatchString(command[2]) {
-			e.Sender.Send("Bad volume value! try a number less than or equal to 200")
+			l.sendUser(e.Sender, "Bad volume value! try a number less than or equal to 200")
 			return
 		}
 		volumepercent, err := strconv.ParseFloat(exp.FindStringSubmatch(command[2])[0], 64)
 		if err != nil {
-			e.Sender.Send("Invalid volume value, how you manage to get this error is a whole nother question tho")
+			l.sendUser(e.Sender, "Invalid volume value, how you manage to get this error is a whole nother question tho")
 			return
 		}
 		l.Bridge.DiscordUserVolumeMutex.Lock()
 		l.Bridge.DiscordUserVolume[command[1]] = volumepercent / 100
 		l.Bridge.DiscordUserVolumeMutex.Unlock()
-		e.Sender.Send("Volume changed for " + command[1])
+		l.sendUser(e.Sender, "Volume changed for "+command[1])
 	}
 
 	if strings.HasPrefix(e.Message, prefix+"mute") {
 		command := strings.Split(e.Message, " ")
 		if len(command) != 2 {
-			e.Sender.Send("Invalid amount of arguments! usage: '" + prefix + "mute (ID)'")
+			l.sendUser(e.Sender, "Invalid amount of arguments! usage: '"+prefix+"mute (ID)'")
 			return
 		}
 		if _, ok := l.Bridge.DiscordUsers[command[1]]; !ok {
-			e.Sender.Send("Invalid user! use '" + prefix + "users' to get a list of users")
+			l.sendUser(e.Sender, "Invalid user! use '"+prefix+"users' to get a list of users")
 			return
 		}
 		l.Bridge.DiscordUserVolumeMutex.Lock()
 		l.Bridge.DiscordUserVolume[command[1]] = 0
 		l.Bridge.DiscordUserVolumeMutex.Unlock()
-		e.Sender.Send("Muted " + command[1])
+		l.sendUser(e.Sender, "Muted "+command[1])
 	}
 
 	if strings.HasPrefix(e.Message, prefix+"unmute") {
 		command := strings.Split(e.Message, " ")
 		if len(command) != 2 {
-			e.Sender.Send("Invalid amount of arguments! usage: '" + prefix + "unmute (ID)'")
+			l.sendUser(e.Sender, "Invalid amount of arguments! usage: '"+prefix+"unmute (ID)'")
 			return
 		}
 		if _, ok := l.Bridge.DiscordUsers[command[1]]; !ok {
-			e.Sender.Send("Invalid user! use '" + prefix + "users' to get a list of users")
+			l.sendUser(e.Sender, "Invalid user! use '"+prefix+"users' to get a list of users")
 			return
 		}
 		l.Bridge.DiscordUserVolumeMutex.Lock()
 		l.Bridge.DiscordUserVolume[command[1]] = 1
 		l.Bridge.DiscordUserVolumeMutex.Unlock()
-		e.Sender.Send("Unmuted " + command[1])
+		l.sendUser(e.Sender, "Unmuted "+command[1])
 	}
 
 	if strings.HasPrefix(e.Message, prefix+"changechannel") {
 		command := strings.Split(e.Message, " ")
 		if len(command) != 2 {
-			e.Sender.Send("Invalid amount of arguments! usage: '" + prefix + "changechannel (ID)'")
+			l.sendUser(e.Sender, "Invalid amount of arguments! usage: '"+prefix+"changechannel (ID)'")
 			return
 		}
 		l.Bridge.DiscordChannelID = command[1]
-		l.Bridge.BridgeDie <- true
+		l.Bridge.StopBridge()
 		l.Bridge.StartBridge()
 	}
 	if strings.HasPrefix(e.Message, prefix+"channels") {
-		l.Bridge.DiscordChannels(l.Bridge.DiscordSession)
-		e.Sender.Send(l.Bridge.messagechannel)
+		l.Bridge.DiscordChannels()
+		l.sendUser(e.Sender, l.Bridge.messagechannel)
 	}
 }
@@ -2,142 +2,225 @@ package bridge
 
 import (
 	"context"
-	"log"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/stieneee/gumble/gumble"
 	_ "github.com/stieneee/gumble/opus"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
 	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
 )
 
 // MumbleDuplex - listener and outgoing
 type MumbleDuplex struct {
+	log                *logger.Logger
+	metrics            *Metrics
+	stats              *UserStats
+	recorder           *Recorder
+	replay             *ReplayBuffer
+	soundFrames        func(side string, frames [][]int16) [][]int16
+	ducker             *Ducker
+	priority           *PrioritySpeakers
+	gate               *NoiseGate
+	agc                *AGC
+	pause              bool // pause the mixer while idle
 	mutex              sync.Mutex
-	fromMumbleArr      []chan gumble.AudioBuffer
+	fromMumbleArr      []*audioQueue
 	mumbleStreamingArr []bool
+	mumbleUserIDArr    []uint32 // registered user ID of each stream
+	mumbleSpeakerArr   []*speakerState
+	maxSpeakers        int
+	backpressure       BackpressurePolicy // of the stream buffers
+	mixFrames          [][]int16          // scratch slices of mixBlock, reused every block
+	mixPriority        []bool
+	mixSpeakers        []*speakerState
+	mixSounds          [][]int16
 	mumbleSleepTick    sleepct.SleepCT
+	mixerTick          loopTick
 }
 
-func NewMumbleDuplex() *MumbleDuplex {
+func NewMumbleDuplex(b *BridgeState, log *logger.Logger) *MumbleDuplex {
 	return &MumbleDuplex{
-		fromMumbleArr:      make([]chan gumble.AudioBuffer, 0),
+		log:                log,
+		metrics:            b.Metrics,
+		stats:              b.UserStats,
+		recorder:           b.Recorder,
+		replay:             b.Replay,
+		soundFrames:        b.soundFrames,
+		ducker:             b.Ducker,
+		priority:           b.Priority,
+		gate:               b.NoiseGate,
+		agc:                b.AGC,
+		pause:              b.BridgeConfig.IdlePause,
+		fromMumbleArr:      make([]*audioQueue, 0),
 		mumbleStreamingArr: make([]bool, 0),
-		mumbleSleepTick:    sleepct.SleepCT{},
+		mumbleUserIDArr:    make([]uint32, 0),
+		mumbleSpeakerArr:   make([]*speakerState, 0),
+		maxSpeakers:        b.BridgeConfig.MixMaxSpeakers,
+		backpressure:       b.BridgeConfig.Backpressure.FromMumble,
+		mumbleSleepTick:    sleepct.SleepCT{Clock: b.Clock, CatchUp: b.BridgeConfig.TimerCatchUp, ResyncThreshold: b.BridgeConfig.TimerResyncThreshold},
 	}
 }
 
 // OnAudioStream - Spawn routines to handle incoming packets
 func (m *MumbleDuplex) OnAudioStream(e *gumble.AudioStreamEvent) {
 
-	// hold a reference ot the channel in the closure
-	streamChan := make(chan gumble.AudioBuffer, 100)
+	name := e.User.Name
+	slog := m.log.With("user", name, "session", e.User.Session)
+
+	// hold a reference ot the queue in the closure
+	streamQueue := newAudioQueue(queueFromMumble, 100, m.backpressure, blockPool, slog, m.metrics)
 
 	m.mutex.Lock()
-	m.fromMumbleArr = append(m.fromMumbleArr, streamChan)
+	m.fromMumbleArr = append(m.fromMumbleArr, streamQueue)
 	m.mumbleStreamingArr = append(m.mumbleStreamingArr, false)
+	m.mumbleUserIDArr = append(m.mumbleUserIDArr, e.User.UserID)
+	m.mumbleSpeakerArr = append(m.mumbleSpeakerArr, &speakerState{})
 	m.mutex.Unlock()
 
-	promMumbleArraySize.Set(float64(len(m.fromMumbleArr)))
+	m.metrics.mumbleArraySize.Set(float64(len(m.fromMumbleArr)))
 
 	go func() {
-		name := e.User.Name
-		log.Println("New mumble audio stream", name)
+		stream := "session:" + strconv.FormatUint(uint64(e.User.Session), 10)
+		slog.Info("New mumble audio stream")
+		g := m.gate.newGate(sideMumble)
+		gc := m.agc.newAGC()
+		var splitter blockSplitter
 		for p := range e.C {
 			// log.Println("audio packet", p.Sender.Name, len(p.AudioBuffer))
 
-			// 480 per 10ms
-			for i := 0; i < len(p.AudioBuffer)/480; i++ {
-				streamChan <- p.AudioBuffer[480*i : 480*(i+1)]
+			m.stats.Packet(sideMumble, name, name)
+
+			// Mumble clients send 10ms to 60ms packets
+			for _, frame := range splitter.split(p.AudioBuffer) {
+				m.stats.Frame(sideMumble, name, name, frame, blockDuration)
+				m.recorder.Frame(sideMumble, stream, name, name, frame)
+				if !g.process(frame) {
+					m.metrics.mumbleGated.Add(blockDuration.Seconds())
+					blockPool.put(frame)
+					continue
+				}
+				gc.process(frame)
+				if !streamQueue.push(frame) {
+					m.stats.Drop(sideMumble, name, name)
+				}
 			}
-			promReceivedMumblePackets.Inc()
+			m.metrics.receivedMumblePackets.Inc()
 			m.mumbleSleepTick.Notify()
 		}
-		log.Println("Mumble audio stream ended", name)
+		slog.Info("Mumble audio stream ended")
 	}()
 }
 
-func (m *MumbleDuplex) fromMumbleMixer(ctx context.Context, cancel context.CancelFunc, toDiscord chan []int16) {
-	m.mumbleSleepTick.Start(10 * time.Millisecond)
+// fromMumbleMixer mixes the mumble streams into toDiscord and calls notify after queueing audio
+// The session is cancelled once the queue toward Discord has been full for the timeout, 0 waits forever.
+func (m *MumbleDuplex) fromMumbleMixer(ctx context.Context, cancel context.CancelFunc, toDiscord *audioQueue, notify func(), timeout time.Duration) {
+	m.mumbleSleepTick.Start(blockDuration)
 
 	sendAudio := false
 
-	droppingPackets := false
-	droppingPacketCount := 0
-
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Stopping From Mumble Mixer")
+			m.log.Info("Stopping From Mumble Mixer")
 			return
 		default:
 		}
 
-		promTimerMumbleMixer.Observe(float64(m.mumbleSleepTick.SleepNextTarget(ctx, false)))
+		// if didn't send audio try to pause, OnAudioStream notifies when it queues audio
+		m.metrics.timerMumbleMixer.Observe(float64(m.mumbleSleepTick.SleepNextTarget(ctx, !sendAudio && m.pause)))
+		m.mixerTick.tick()
 
-		m.mutex.Lock()
+		outBuf := m.mixBlock()
+		sendAudio = outBuf != nil
+		if !sendAudio {
+			continue
+		}
 
-		sendAudio = false
-		internalMixerArr := make([]gumble.AudioBuffer, 0)
-		streamingCount := 0
+		m.metrics.toDiscordBufferSize.Set(float64(toDiscord.len()))
+		if toDiscord.push(outBuf) {
+			notify()
+		} else if lost := toDiscord.overflowing(blockDuration); timeout > 0 && lost >= timeout {
+			m.log.Error("Discord Timeout", "lost", lost)
+			cancel()
+		}
+	}
+}
 
-		// Work through each channel
-		for i := 0; i < len(m.fromMumbleArr); i++ {
-			if len(m.fromMumbleArr[i]) > 0 {
-				sendAudio = true
-				if !m.mumbleStreamingArr[i] {
-					m.mumbleStreamingArr[i] = true
-					streamingCount++
-					// log.Println("Mumble starting", i)
-				}
+// mixBlock mixes one block of the mumble streams and the sounds into a pooled block, it returns nil without audio
+func (m *MumbleDuplex) mixBlock() []int16 {
+	m.mutex.Lock()
 
-				x1 := (<-m.fromMumbleArr[i])
-				internalMixerArr = append(internalMixerArr, x1)
-			} else {
-				if m.mumbleStreamingArr[i] {
-					m.mumbleStreamingArr[i] = false
-					// log.Println("Mumble stopping", i)
-				}
+	sendAudio := false
+	internalMixerArr := m.mixFrames[:0]
+	priorityArr := m.mixPriority[:0]
+	speakerArr := m.mixSpeakers[:0]
+	prioritySpeaking := false
+	streamingCount := 0
+
+	// Work through each channel
+	for i := 0; i < len(m.fromMumbleArr); i++ {
+		if m.fromMumbleArr[i].len() > 0 {
+			sendAudio = true
+			if !m.mumbleStreamingArr[i] {
+				m.mumbleStreamingArr[i] = true
+				streamingCount++
+				// log.Println("Mumble starting", i)
+			}
+
+			x1 := m.fromMumbleArr[i].pop()
+			internalMixerArr = append(internalMixerArr, x1)
+			priority := m.priority.Mumble(m.mumbleUserIDArr[i])
+			priorityArr = append(priorityArr, priority)
+			speakerArr = append(speakerArr, m.mumbleSpeakerArr[i])
+			prioritySpeaking = prioritySpeaking || priority
+		} else {
+			m.mumbleSpeakerArr[i].decay()
+			if m.mumbleStreamingArr[i] {
+				m.mumbleStreamingArr[i] = false
+				// log.Println("Mumble stopping", i)
 			}
 		}
+	}
 
-		m.mutex.Unlock()
+	m.mixFrames, m.mixPriority, m.mixSpeakers = internalMixerArr, priorityArr, speakerArr
+	popped := internalMixerArr
 
-		promMumbleStreaming.Set(float64(streamingCount))
+	// Only the loudest streams are mixed, the others are still counted as streaming
+	internalMixerArr, priorityArr, unmixed := selectSpeakers(internalMixerArr, priorityArr, speakerArr, m.maxSpeakers)
+	m.metrics.mumbleUnmixed.Add(float64(unmixed))
 
-		if sendAudio {
+	m.mutex.Unlock()
 
-			outBuf := make([]int16, 480)
+	gain := m.priority.gain(sideMumble, prioritySpeaking)
+	applyGain(internalMixerArr, priorityArr, gain)
+	m.ducker.Speaking(sideMumble, len(internalMixerArr) > 0)
 
-			for i := 0; i < len(outBuf); i++ {
-				for j := 0; j < len(internalMixerArr); j++ {
-					outBuf[i] += (internalMixerArr[j])[i]
-				}
-			}
+	// Soundboard and chimes, lowered like the other speakers while a priority speaker talks
+	sounds := m.soundFrames(sideDiscord, m.mixSounds[:0])
+	applyGainAll(sounds, gain)
+	if len(sounds) > 0 {
+		sendAudio = true
+	}
 
-			promToDiscordBufferSize.Set(float64(len(toDiscord)))
-			select {
-			case toDiscord <- outBuf:
-				{
-					if droppingPackets {
-						log.Println("Discord buffer ok, total packets dropped " + strconv.Itoa(droppingPacketCount))
-						droppingPackets = false
-					}
-				}
-			default:
-				if !droppingPackets {
-					log.Println("Error: toDiscord buffer full. Dropping packets")
-					droppingPackets = true
-					droppingPacketCount = 0
-				}
-				droppingPacketCount++
-				promToDiscordDropped.Inc()
-				if droppingPacketCount > 250 {
-					log.Println("Discord Timeout")
-					cancel()
-				}
-			}
+	m.metrics.mumbleStreaming.Set(float64(streamingCount))
+
+	var outBuf []int16
+	if sendAudio {
+		outBuf = blockPool.get()
+		mix(outBuf, internalMixerArr)
+		// Mumble speakers are ducked while Discord users speak, sounds are not
+		m.ducker.apply(sideDiscord, outBuf)
+		if len(sounds) > 0 {
+			m.mixSounds = append(sounds, outBuf)
+			mix(outBuf, m.mixSounds)
 		}
+		m.recorder.mixFrame(sideDiscord, outBuf)
+		m.replay.Frame(sideDiscord, outBuf)
 	}
+
+	blockPool.putAll(popped)
+	blockPool.putAll(sounds)
+	return outBuf
 }
@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gumble/gumble"
+)
+
+// The bridge only talks to Discord and Mumble through the narrow interfaces below.
+// Production adapters wrap discordgo and gumble, the bridgetest package provides in-memory fakes.
+
+// DiscordVoice is the voice transport of a joined Discord voice channel
+type DiscordVoice interface {
+	// SendReady reports if the connection is able to send opus packets.
+	// A deafened connection sends without receiving, the receive side is reported by OpusRecv.
+	SendReady() bool
+	// SendOpus sends a single opus frame, blocking until it is queued or ctx is done.
+	// It returns false if the connection was not ready to send.
+	SendOpus(ctx context.Context, opus []byte) bool
+	// OpusRecv returns the channel of received opus packets, or false if the connection is not ready to receive
+	OpusRecv() (<-chan *discordgo.Packet, bool)
+	Speaking(speaking bool) error
+	Disconnect() error
+}
+
+// DiscordMessenger sends text messages to Discord channels
+type DiscordMessenger interface {
+	ChannelMessageSend(channelID, content string) error
+}
+
+// DiscordPresence is the bot's gateway connection and status
+type DiscordPresence interface {
+	GatewayReady() bool
+	HeartbeatLatency() time.Duration
+	UpdateListeningStatus(status string) error
+}
+
+// DiscordDirectory looks up Discord users, channels and voice states
+type DiscordDirectory interface {
+	BotUserID() string
+	Username(userID string) (string, error)
+	// DMChannel returns the ID of the private channel with a user
+	DMChannel(userID string) (string, error)
+	// ChannelGuild returns the guild ID of a channel
+	ChannelGuild(channelID string) (string, error)
+	VoiceStates(guildID string) ([]*discordgo.VoiceState, error)
+	// MemberRoles returns the role IDs of a guild member
+	MemberRoles(guildID, userID string) ([]string, error)
+	VoiceChannels(guildID string) ([]*discordgo.Channel, error)
+}
+
+// DiscordSession combines the Discord capabilities used by the bridge
+type DiscordSession interface {
+	DiscordMessenger
+	DiscordPresence
+	DiscordDirectory
+	// JoinVoice joins a voice channel. onSpeaking receives the SSRC of each user that starts speaking.
+	JoinVoice(guildID, channelID string, mute, deaf bool, onSpeaking func(ssrc uint32, userID string)) (DiscordVoice, error)
+}
+
+// MumbleVoice is the outgoing audio transport to Mumble.
+// Incoming audio is delivered to MumbleDuplex.OnAudioStream through the gumble audio listeners.
+type MumbleVoice interface {
+	// AudioOutgoing returns the channel of the frames to send.
+	// The bridge reuses a frame once two later frames were received, gumble encodes each frame before receiving the one after the next.
+	AudioOutgoing() chan<- gumble.AudioBuffer
+}
+
+// MumbleMessenger sends text messages to Mumble
+type MumbleMessenger interface {
+	// SendChannel sends a message to the channel the bridge is in
+	SendChannel(message string)
+	// SendUser sends a private message to the user with the given session
+	SendUser(session uint32, message string)
+}
+
+// MumblePresence is the connection state of the bridge's own Mumble user
+type MumblePresence interface {
+	State() gumble.State
+	SelfName() string
+	// SetSelfMuted shows the bridge's user as muted, a muted user is not heard
+	SetSelfMuted(muted bool)
+	Disconnect() error
+}
+
+// MumbleDirectory looks up Mumble users
+type MumbleDirectory interface {
+	// ChannelUsers returns the names of the users in the bridge's channel, excluding the bridge
+	ChannelUsers() []string
+	// SelfChannelID returns the ID of the bridge's channel, false while the bridge is not in a channel
+	SelfChannelID() (uint32, bool)
+	// RequestACL asks the server for the ACL of the bridge's channel, it is delivered to MumbleListener.MumbleACL
+	RequestACL()
+}
+
+// MumbleClient combines the Mumble capabilities used by the bridge
+type MumbleClient interface {
+	MumbleVoice
+	MumbleMessenger
+	MumblePresence
+	MumbleDirectory
+}
+
+// MumbleDialer connects to a Mumble server
+type MumbleDialer func(addr string, config *gumble.Config, tlsConfig *tls.Config) (MumbleClient, error)
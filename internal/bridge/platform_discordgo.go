@@ -0,0 +1,158 @@
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordgoSession adapts a discordgo session to DiscordSession
+type discordgoSession struct {
+	s *discordgo.Session
+}
+
+// NewDiscordSession wraps an open discordgo session.
+// State tracking must be enabled on the session for the directory lookups.
+func NewDiscordSession(s *discordgo.Session) DiscordSession {
+	return &discordgoSession{s: s}
+}
+
+func (d *discordgoSession) ChannelMessageSend(channelID, content string) error {
+	_, err := d.s.ChannelMessageSend(channelID, content)
+	return err
+}
+
+func (d *discordgoSession) GatewayReady() bool {
+	d.s.RLock()
+	defer d.s.RUnlock()
+	return d.s.DataReady
+}
+
+func (d *discordgoSession) HeartbeatLatency() time.Duration {
+	return d.s.HeartbeatLatency()
+}
+
+func (d *discordgoSession) UpdateListeningStatus(status string) error {
+	return d.s.UpdateListeningStatus(status)
+}
+
+func (d *discordgoSession) BotUserID() string {
+	return d.s.State.User.ID
+}
+
+func (d *discordgoSession) Username(userID string) (string, error) {
+	u, err := d.s.User(userID)
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+func (d *discordgoSession) MemberRoles(guildID, userID string) ([]string, error) {
+	m, err := d.s.State.Member(guildID, userID)
+	if err != nil {
+		m, err = d.s.GuildMember(guildID, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.Roles, nil
+}
+
+func (d *discordgoSession) DMChannel(userID string) (string, error) {
+	c, err := d.s.UserChannelCreate(userID)
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+func (d *discordgoSession) ChannelGuild(channelID string) (string, error) {
+	c, err := d.s.State.Channel(channelID)
+	if err != nil {
+		return "", err
+	}
+	return c.GuildID, nil
+}
+
+func (d *discordgoSession) VoiceStates(guildID string) ([]*discordgo.VoiceState, error) {
+	g, err := d.s.State.Guild(guildID)
+	if err != nil {
+		return nil, err
+	}
+	return g.VoiceStates, nil
+}
+
+func (d *discordgoSession) VoiceChannels(guildID string) ([]*discordgo.Channel, error) {
+	channels, err := d.s.GuildChannels(guildID)
+	if err != nil {
+		return nil, err
+	}
+	voice := make([]*discordgo.Channel, 0, len(channels))
+	for _, c := range channels {
+		if c.Type == discordgo.ChannelTypeGuildVoice {
+			voice = append(voice, c)
+		}
+	}
+	return voice, nil
+}
+
+func (d *discordgoSession) JoinVoice(guildID, channelID string, mute, deaf bool, onSpeaking func(ssrc uint32, userID string)) (DiscordVoice, error) {
+	vc, err := d.s.ChannelVoiceJoin(guildID, channelID, mute, deaf)
+	if err != nil {
+		if vc != nil {
+			vc.Disconnect()
+		}
+		return nil, err
+	}
+	if onSpeaking != nil {
+		vc.AddHandler(func(vc *discordgo.VoiceConnection, event *discordgo.VoiceSpeakingUpdate) {
+			onSpeaking(uint32(event.SSRC), event.UserID)
+		})
+	}
+	return &discordgoVoice{vc: vc}, nil
+}
+
+// discordgoVoice adapts a discordgo voice connection to DiscordVoice
+type discordgoVoice struct {
+	vc *discordgo.VoiceConnection
+}
+
+func (v *discordgoVoice) SendReady() bool {
+	v.vc.RLock()
+	defer v.vc.RUnlock()
+	// discordgo does not create OpusRecv for a deafened connection
+	return v.vc.Ready && v.vc.OpusSend != nil
+}
+
+func (v *discordgoVoice) SendOpus(ctx context.Context, opus []byte) bool {
+	// The read lock is held while sending to keep discordgo from replacing the channel during a reconnect
+	v.vc.RLock()
+	defer v.vc.RUnlock()
+	if !v.vc.Ready || v.vc.OpusSend == nil {
+		return false
+	}
+	select {
+	case v.vc.OpusSend <- opus:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+func (v *discordgoVoice) OpusRecv() (<-chan *discordgo.Packet, bool) {
+	v.vc.RLock()
+	defer v.vc.RUnlock()
+	if !v.vc.Ready || v.vc.OpusRecv == nil {
+		return nil, false
+	}
+	return v.vc.OpusRecv, true
+}
+
+func (v *discordgoVoice) Speaking(speaking bool) error {
+	return v.vc.Speaking(speaking)
+}
+
+func (v *discordgoVoice) Disconnect() error {
+	return v.vc.Disconnect()
+}
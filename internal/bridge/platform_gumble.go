@@ -0,0 +1,102 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/stieneee/gumble/gumble"
+)
+
+// gumbleClient adapts a gumble client to MumbleClient
+type gumbleClient struct {
+	c *gumble.Client
+}
+
+// DialMumble connects to a Mumble server with gumble
+func DialMumble(addr string, config *gumble.Config, tlsConfig *tls.Config) (MumbleClient, error) {
+	c, err := gumble.DialWithDialer(new(net.Dialer), addr, config, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &gumbleClient{c: c}, nil
+}
+
+func (g *gumbleClient) AudioOutgoing() chan<- gumble.AudioBuffer {
+	return g.c.AudioOutgoing()
+}
+
+func (g *gumbleClient) SendChannel(message string) {
+	g.c.Do(func() {
+		if g.c.Self != nil && g.c.Self.Channel != nil {
+			g.c.Self.Channel.Send(message, false)
+		}
+	})
+}
+
+func (g *gumbleClient) SendUser(session uint32, message string) {
+	g.c.Do(func() {
+		if u, ok := g.c.Users[session]; ok {
+			u.Send(message)
+		}
+	})
+}
+
+func (g *gumbleClient) State() gumble.State {
+	return g.c.State()
+}
+
+func (g *gumbleClient) SelfName() string {
+	var name string
+	g.c.Do(func() {
+		if g.c.Self != nil {
+			name = g.c.Self.Name
+		}
+	})
+	return name
+}
+
+func (g *gumbleClient) SetSelfMuted(muted bool) {
+	g.c.Do(func() {
+		if g.c.Self != nil {
+			g.c.Self.SetSelfMuted(muted)
+		}
+	})
+}
+
+func (g *gumbleClient) Disconnect() error {
+	return g.c.Disconnect()
+}
+
+func (g *gumbleClient) ChannelUsers() []string {
+	var users []string
+	g.c.Do(func() {
+		if g.c.Self == nil || g.c.Self.Channel == nil {
+			return
+		}
+		for _, user := range g.c.Self.Channel.Users {
+			if user.Name != g.c.Self.Name {
+				users = append(users, user.Name)
+			}
+		}
+	})
+	return users
+}
+
+func (g *gumbleClient) SelfChannelID() (uint32, bool) {
+	var id uint32
+	ok := false
+	g.c.Do(func() {
+		if g.c.Self != nil && g.c.Self.Channel != nil {
+			id, ok = g.c.Self.Channel.ID, true
+		}
+	})
+	return id, ok
+}
+
+func (g *gumbleClient) RequestACL() {
+	g.c.Do(func() {
+		if g.c.Self != nil && g.c.Self.Channel != nil {
+			g.c.Self.Channel.RequestACL()
+		}
+	})
+}
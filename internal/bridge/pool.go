@@ -0,0 +1,62 @@
+package bridge
+
+import "sync"
+
+// framePoolMax is the most frames a pool keeps, frames returned to a full pool are left to the GC
+const framePoolMax = 1024
+
+// framePool recycles PCM frames of one size so the audio loops do not allocate every tick.
+// A frame has one owner at a time: the owner either passes it on, to a queue or the next stage, or puts it back.
+// Frames put to a nil pool are left to the GC.
+type framePool struct {
+	size int
+	mu   sync.Mutex
+	free [][]int16
+}
+
+// blockPool holds the 10ms blocks passed between the receive loops, the queues and the mixers
+var blockPool = newFramePool(blockSize)
+
+func newFramePool(size int) *framePool {
+	return &framePool{size: size}
+}
+
+// get returns a frame of the pool size, its samples are not cleared
+func (p *framePool) get() []int16 {
+	p.mu.Lock()
+	if n := len(p.free); n > 0 {
+		f := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		p.mu.Unlock()
+		return f
+	}
+	p.mu.Unlock()
+	return make([]int16, p.size)
+}
+
+// put returns a frame to the pool, the caller must not use it anymore
+func (p *framePool) put(f []int16) {
+	if p == nil || cap(f) < p.size {
+		return
+	}
+	p.mu.Lock()
+	if len(p.free) < framePoolMax {
+		p.free = append(p.free, f[:p.size])
+	}
+	p.mu.Unlock()
+}
+
+// putAll returns the frames to the pool
+func (p *framePool) putAll(frames [][]int16) {
+	for _, f := range frames {
+		p.put(f)
+	}
+}
+
+// zero sets the samples of the frame to zero
+func zero(f []int16) {
+	for i := range f {
+		f[i] = 0
+	}
+}
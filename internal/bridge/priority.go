@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stieneee/gumble/gumble"
+)
+
+// PrioritySpeakers talk over everyone, while one of them speaks every other speaker in both mixers is lowered to volume.
+// A nil *PrioritySpeakers is valid and gives every speaker the same priority.
+type PrioritySpeakers struct {
+	volume       float64
+	discordIDs   map[string]bool // Discord user and role IDs
+	mumbleIDs    map[uint32]bool // registered Mumble user IDs
+	mumbleGroups map[string]bool // Mumble ACL group names
+
+	mu           sync.Mutex
+	discordRoles map[string]bool // Discord users with a priority role
+	groupMembers map[uint32]bool // registered Mumble user IDs in a priority group
+	speaking     map[string]bool // sides with a priority speaker
+}
+
+// NewPrioritySpeakers returns the priority speakers of the comma separated lists.
+// discord holds user or role IDs, in mumble numbers are registered user IDs and other entries ACL group names.
+func NewPrioritySpeakers(discord, mumble string, volume float64) *PrioritySpeakers {
+	p := &PrioritySpeakers{
+		volume:       volume,
+		discordIDs:   make(map[string]bool),
+		mumbleIDs:    make(map[uint32]bool),
+		mumbleGroups: make(map[string]bool),
+		discordRoles: make(map[string]bool),
+		groupMembers: make(map[uint32]bool),
+		speaking:     make(map[string]bool),
+	}
+	for _, id := range strings.Split(discord, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			p.discordIDs[id] = true
+		}
+	}
+	for _, entry := range strings.Split(mumble, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if id, err := strconv.ParseUint(entry, 10, 32); err == nil {
+			p.mumbleIDs[uint32(id)] = true
+		} else {
+			p.mumbleGroups[entry] = true
+		}
+	}
+	return p
+}
+
+// Discord reports if the Discord user is a priority speaker
+func (p *PrioritySpeakers) Discord(userID string) bool {
+	if p == nil || userID == "" {
+		return false
+	}
+	if p.discordIDs[userID] {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discordRoles[userID]
+}
+
+// Mumble reports if the registered Mumble user is a priority speaker, unregistered users have ID 0 and never are
+func (p *PrioritySpeakers) Mumble(userID uint32) bool {
+	if p == nil || userID == 0 {
+		return false
+	}
+	if p.mumbleIDs[userID] {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.groupMembers[userID]
+}
+
+// setDiscordRoles records the roles of a Discord user who joined the voice channel
+func (p *PrioritySpeakers) setDiscordRoles(userID string, roles []string) {
+	if p == nil {
+		return
+	}
+	priority := false
+	for _, r := range roles {
+		if p.discordIDs[r] {
+			priority = true
+		}
+	}
+	p.mu.Lock()
+	p.discordRoles[userID] = priority
+	p.mu.Unlock()
+}
+
+// removeDiscordUser forgets the roles of a Discord user who left the voice channel
+func (p *PrioritySpeakers) removeDiscordUser(userID string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	delete(p.discordRoles, userID)
+	p.mu.Unlock()
+}
+
+// usesGroups reports if the channel ACL is needed to resolve Mumble groups
+func (p *PrioritySpeakers) usesGroups() bool {
+	return p != nil && len(p.mumbleGroups) > 0
+}
+
+// setACL collects the members of the priority groups from the ACL of the bridge's channel
+func (p *PrioritySpeakers) setACL(acl *gumble.ACL) {
+	if p == nil || acl == nil {
+		return
+	}
+	members := make(map[uint32]bool)
+	for _, g := range acl.Groups {
+		if !p.mumbleGroups[g.Name] {
+			continue
+		}
+		for id := range g.UsersInherited {
+			members[id] = true
+		}
+		for id := range g.UsersAdd {
+			members[id] = true
+		}
+		for id := range g.UsersRemove {
+			delete(members, id)
+		}
+	}
+	p.mu.Lock()
+	p.groupMembers = members
+	p.mu.Unlock()
+}
+
+// gain records if a priority speaker speaks on side and returns the gain of the other speakers of the side
+func (p *PrioritySpeakers) gain(side string, speaking bool) float64 {
+	if p == nil {
+		return 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.speaking[side] = speaking
+	for _, s := range p.speaking {
+		if s {
+			return p.volume
+		}
+	}
+	return 1
+}
+
+func (p *PrioritySpeakers) reset() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.speaking = make(map[string]bool)
+	p.mu.Unlock()
+}
+
+// Speaking reports if a priority speaker speaks on either side
+func (p *PrioritySpeakers) Speaking() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.speaking[sideMumble] || p.speaking[sideDiscord]
+}
+
+// applyGain lowers the frames of the speakers that are not priority speakers in place, the mixer owns the frames
+func applyGain(frames [][]int16, priority []bool, gain float64) {
+	if gain == 1 {
+		return
+	}
+	for i, f := range frames {
+		if !priority[i] {
+			scale(f, gain)
+		}
+	}
+}
+
+// applyGainAll lowers all frames in place, for the soundboard and chime frames owned by the mixer
+func applyGainAll(frames [][]int16, gain float64) {
+	if gain == 1 {
+		return
+	}
+	for _, f := range frames {
+		scale(f, gain)
+	}
+}
@@ -1,141 +1,331 @@
 package bridge
 
 import (
-	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
 )
 
-var (
-	// Bridge General
-
-	PromApplicationStartTime = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_bridge_start_time",
-		Help: "The time the application started",
-	})
+// Audio directions used as the direction label
+const (
+	directionToDiscord = "to_discord"
+	directionToMumble  = "to_mumble"
+)
 
-	promBridgeStarts = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_bridge_starts_count",
-		Help: "The number of times the bridge start routine has been called",
-	})
+// Metrics holds the Prometheus metrics of one bridge.
+// The metrics are registered on a registry owned by the bridge and carry a bridge label,
+// allowing multiple bridges per process and isolated tests.
+type Metrics struct {
+	registry *prometheus.Registry
+	factory  promauto.Factory // registers on registry with the bridge label
 
-	promBridgeStartTime = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_bridge_starts_time",
-		Help: "The time the current bridge instance started",
-	})
+	// Bridge General
+	ApplicationStartTime prometheus.Gauge
+	bridgeStarts         prometheus.Counter
+	bridgeStartTime      prometheus.Gauge
 
 	// MUMBLE
-	promMumblePing = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_mumble_ping",
-		Help: "Mumble ping",
-	})
-
-	promMumbleUsers = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_mumble_users_gauge",
-		Help: "The number of connected Mumble users",
-	})
-
-	promReceivedMumblePackets = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_mumble_received_count",
-		Help: "The count of Mumble audio packets received",
-	})
-
-	promSentMumblePackets = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_mumble_sent_count",
-		Help: "The count of audio packets sent to mumble",
-	})
-
-	// promToMumbleBufferSize = promauto.NewGauge(prometheus.GaugeOpts{
-	// 	Name: "mdb_to_mumble_buffer_gauge",
-	// 	Help: "",
-	// })
-
-	promToMumbleDropped = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_to_mumble_dropped",
-		Help: "The number of packets timeouts to mumble",
-	})
-
-	promMumbleArraySize = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_to_mumble_array_size_gauge",
-		Help: "The array size of mumble streams",
-	})
-
-	promMumbleStreaming = promauto.NewGauge(prometheus.GaugeOpts{ //SUMMARY?
-		Name: "mdb_mumble_streaming_gauge",
-		Help: "The number of active audio streams streaming audio from mumble",
-	})
+	mumblePing            prometheus.Gauge
+	mumbleUsers           prometheus.Gauge
+	receivedMumblePackets prometheus.Counter
+	sentMumblePackets     prometheus.Counter
+	toMumbleDropped       prometheus.Counter
+	toMumbleToggles       prometheus.Gauge
+	mumbleArraySize       prometheus.Gauge
+	mumbleStreaming       prometheus.Gauge
+	mumbleGated           prometheus.Counter
+	mumbleUnmixed         prometheus.Counter
 
 	// DISCORD
+	discordHeartBeat       prometheus.Gauge
+	discordUsers           prometheus.Gauge
+	discordReceivedPackets prometheus.Counter
+	discordSentPackets     prometheus.Counter
+	toDiscordBufferSize    prometheus.Gauge
+	toDiscordDropped       prometheus.Counter
+	toDiscordToggles       prometheus.Gauge
+	discordArraySize       prometheus.Gauge
+	discordStreaming       prometheus.Gauge
+	discordGated           prometheus.Counter
+	discordUnmixed         prometheus.Counter
 
-	// TODO Discrod Ping
+	// Sleep Timer Performance
+	timerDiscordSend  prometheus.Histogram
+	timerDiscordMixer prometheus.Histogram
+	timerMumbleMixer  prometheus.Histogram
+	timerDriftMax     *prometheus.GaugeVec
+	timerDriftMean    *prometheus.GaugeVec
+	timerDriftP99     *prometheus.GaugeVec
+	timerMissedTicks  *prometheus.CounterVec
 
-	promDiscordHeartBeat = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_discord_latency",
-		Help: "Discord heartbeat latency",
-	})
+	// Audio queues
+	queueLost *prometheus.CounterVec
+}
 
-	promDiscordUsers = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_discord_users_gauge",
-		Help: "The number of Connected Discord users",
-	})
+// NewMetrics creates the metrics for a bridge on a new registry.
+// Every metric is labelled with the bridge name, audio path metrics are also labelled with their direction.
+func NewMetrics(name string) *Metrics {
+	reg := prometheus.NewRegistry()
+	f := promauto.With(prometheus.WrapRegistererWith(prometheus.Labels{"bridge": name}, reg))
 
-	promDiscordReceivedPackets = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_discord_received_count",
-		Help: "The number of received packets from Discord",
-	})
+	toDiscord := prometheus.Labels{"direction": directionToDiscord}
+	toMumble := prometheus.Labels{"direction": directionToMumble}
 
-	promDiscordSentPackets = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_discord_sent_count",
-		Help: "The number of packets sent to Discord",
-	})
+	timerBuckets := []float64{1000, 2000, 5000, 10000, 20000}
+	timerLabels := []string{"loop", "direction"}
 
-	promToDiscordBufferSize = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_discord_buffer_gauge",
-		Help: "The buffer size for packets to Discord",
-	})
+	return &Metrics{
+		registry: reg,
+		factory:  f,
 
-	promToDiscordDropped = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mdb_to_discord_dropped",
-		Help: "The count of packets dropped to discord",
-	})
+		// Bridge General
 
-	promDiscordArraySize = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_discord_array_size_gauge",
-		Help: "The discord receiving array size",
-	})
+		ApplicationStartTime: f.NewGauge(prometheus.GaugeOpts{
+			Name: "mdb_bridge_start_time",
+			Help: "The time the application started",
+		}),
 
-	promDiscordStreaming = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mdb_discord_streaming_gauge",
-		Help: "The number of active audio streams streaming from discord",
-	})
+		bridgeStarts: f.NewCounter(prometheus.CounterOpts{
+			Name: "mdb_bridge_starts_count",
+			Help: "The number of times the bridge start routine has been called",
+		}),
 
-	// Sleep Timer Performance
+		bridgeStartTime: f.NewGauge(prometheus.GaugeOpts{
+			Name: "mdb_bridge_starts_time",
+			Help: "The time the current bridge instance started",
+		}),
 
-	promTimerDiscordSend = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "mdb_timer_discord_send",
-		Help:    "Timer performance for Discord send",
-		Buckets: []float64{1000, 2000, 5000, 10000, 20000},
-	})
-
-	promTimerDiscordMixer = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "mdb_timer_discord_mixer",
-		Help:    "Timer performance for the Discord mixer",
-		Buckets: []float64{1000, 2000, 5000, 10000, 20000},
-	})
-
-	promTimerMumbleMixer = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "mdb_timer_mumble_mixer",
-		Help:    "Timer performance for the Mumble mixer",
-		Buckets: []float64{1000, 2000, 5000, 10000, 20000},
-	})
-)
+		// MUMBLE
+
+		mumblePing: f.NewGauge(prometheus.GaugeOpts{
+			Name: "mdb_mumble_ping",
+			Help: "Mumble ping",
+		}),
+
+		mumbleUsers: f.NewGauge(prometheus.GaugeOpts{
+			Name: "mdb_mumble_users_gauge",
+			Help: "The number of connected Mumble users",
+		}),
+
+		receivedMumblePackets: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_mumble_received_count",
+			Help:        "The count of Mumble audio packets received",
+			ConstLabels: toDiscord,
+		}),
+
+		sentMumblePackets: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_mumble_sent_count",
+			Help:        "The count of audio packets sent to mumble",
+			ConstLabels: toMumble,
+		}),
+
+		toMumbleDropped: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_to_mumble_dropped",
+			Help:        "The number of packets timeouts to mumble",
+			ConstLabels: toMumble,
+		}),
+
+		toMumbleToggles: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "mdb_to_mumble_speaking_toggles_per_minute",
+			Help:        "The number of speaking state changes to mumble in the last minute",
+			ConstLabels: toMumble,
+		}),
+
+		mumbleArraySize: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "mdb_to_mumble_array_size_gauge",
+			Help:        "The array size of mumble streams",
+			ConstLabels: toDiscord,
+		}),
+
+		mumbleStreaming: f.NewGauge(prometheus.GaugeOpts{ //SUMMARY?
+			Name:        "mdb_mumble_streaming_gauge",
+			Help:        "The number of active audio streams streaming audio from mumble",
+			ConstLabels: toDiscord,
+		}),
+
+		mumbleGated: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_mumble_gated_seconds",
+			Help:        "The time of Mumble audio removed by the noise gate in seconds",
+			ConstLabels: toDiscord,
+		}),
+
+		mumbleUnmixed: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_mumble_unmixed_count",
+			Help:        "The number of frames of active Mumble streams left out of the mix",
+			ConstLabels: toDiscord,
+		}),
+
+		// DISCORD
+
+		// TODO Discrod Ping
+
+		discordHeartBeat: f.NewGauge(prometheus.GaugeOpts{
+			Name: "mdb_discord_latency",
+			Help: "Discord heartbeat latency",
+		}),
+
+		discordUsers: f.NewGauge(prometheus.GaugeOpts{
+			Name: "mdb_discord_users_gauge",
+			Help: "The number of Connected Discord users",
+		}),
+
+		discordReceivedPackets: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_discord_received_count",
+			Help:        "The number of received packets from Discord",
+			ConstLabels: toMumble,
+		}),
+
+		discordSentPackets: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_discord_sent_count",
+			Help:        "The number of packets sent to Discord",
+			ConstLabels: toDiscord,
+		}),
+
+		toDiscordBufferSize: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "mdb_discord_buffer_gauge",
+			Help:        "The buffer size for packets to Discord",
+			ConstLabels: toDiscord,
+		}),
+
+		toDiscordDropped: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_to_discord_dropped",
+			Help:        "The count of packets dropped to discord",
+			ConstLabels: toDiscord,
+		}),
+
+		toDiscordToggles: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "mdb_to_discord_speaking_toggles_per_minute",
+			Help:        "The number of speaking state changes to discord in the last minute",
+			ConstLabels: toDiscord,
+		}),
+
+		discordArraySize: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "mdb_discord_array_size_gauge",
+			Help:        "The discord receiving array size",
+			ConstLabels: toMumble,
+		}),
+
+		discordStreaming: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "mdb_discord_streaming_gauge",
+			Help:        "The number of active audio streams streaming from discord",
+			ConstLabels: toMumble,
+		}),
+
+		discordGated: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_discord_gated_seconds",
+			Help:        "The time of Discord audio removed by the noise gate in seconds",
+			ConstLabels: toMumble,
+		}),
+
+		discordUnmixed: f.NewCounter(prometheus.CounterOpts{
+			Name:        "mdb_discord_unmixed_count",
+			Help:        "The number of frames of active Discord streams left out of the mix",
+			ConstLabels: toMumble,
+		}),
+
+		// Sleep Timer Performance
+
+		timerDiscordSend: f.NewHistogram(prometheus.HistogramOpts{
+			Name:        "mdb_timer_discord_send",
+			Help:        "Timer performance for Discord send",
+			Buckets:     timerBuckets,
+			ConstLabels: toDiscord,
+		}),
+
+		timerDiscordMixer: f.NewHistogram(prometheus.HistogramOpts{
+			Name:        "mdb_timer_discord_mixer",
+			Help:        "Timer performance for the Discord mixer",
+			Buckets:     timerBuckets,
+			ConstLabels: toMumble,
+		}),
+
+		timerMumbleMixer: f.NewHistogram(prometheus.HistogramOpts{
+			Name:        "mdb_timer_mumble_mixer",
+			Help:        "Timer performance for the Mumble mixer",
+			Buckets:     timerBuckets,
+			ConstLabels: toDiscord,
+		}),
+
+		timerDriftMax: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mdb_timer_drift_max",
+			Help: "The largest wake drift of the audio loop in microseconds",
+		}, timerLabels),
+
+		timerDriftMean: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mdb_timer_drift_mean",
+			Help: "The mean wake drift of the audio loop in microseconds",
+		}, timerLabels),
+
+		timerDriftP99: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mdb_timer_drift_p99",
+			Help: "The 99th percentile wake drift of the last 1000 wakes of the audio loop in microseconds",
+		}, timerLabels),
+
+		timerMissedTicks: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "mdb_timer_missed_ticks",
+			Help: "The number of audio loop ticks missed by late wakes",
+		}, timerLabels),
+
+		queueLost: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "mdb_queue_lost_count",
+			Help: "The number of frames a full audio queue dropped or compressed away by its backpressure policy",
+		}, []string{"queue", "policy"}),
+	}
+}
+
+// loopTimer is the sleeper of an audio loop exported to the timer metrics
+type loopTimer struct {
+	loop      string
+	direction string
+	s         *sleepct.SleepCT
+	missed    uint64 // missed ticks already counted
+}
+
+// loopTimers returns the sleepers of the running bridge
+func (b *BridgeState) loopTimers() []*loopTimer {
+	return []*loopTimer{
+		{loop: "discord_send", direction: directionToDiscord, s: &b.DiscordStream.discordSendSleepTick},
+		{loop: "discord_mixer", direction: directionToMumble, s: &b.DiscordStream.discordReceiveSleepTick},
+		{loop: "mumble_mixer", direction: directionToDiscord, s: &b.MumbleStream.mumbleSleepTick},
+	}
+}
+
+// observeTimers exports the drift statistics of the audio loops
+func (m *Metrics) observeTimers(timers []*loopTimer) {
+	for _, t := range timers {
+		st := t.s.Stats()
+		l := prometheus.Labels{"loop": t.loop, "direction": t.direction}
+		m.timerDriftMax.With(l).Set(float64(st.Max.Microseconds()))
+		m.timerDriftMean.With(l).Set(float64(st.Mean.Microseconds()))
+		m.timerDriftP99.With(l).Set(float64(st.P99.Microseconds()))
+		m.timerMissedTicks.With(l).Add(float64(st.Missed - t.missed))
+		t.missed = st.Missed
+	}
+}
+
+// Registry returns the registry the bridge metrics are registered on.
+// Embedders may register additional collectors on it.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the bridge metrics in the Prometheus exposition format.
+// It can be mounted on any mux by embedders.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
 
-func StartPromServer(port int) {
-	log.Println("Starting Metrics Server")
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":"+strconv.Itoa(port), nil)
+// StartPromServer serves the metrics handler on /metrics at the given port
+func StartPromServer(port int, handler http.Handler, log *logger.Logger) {
+	log.Info("Starting Metrics Server", "port", port)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), mux); err != nil {
+		log.Error("Metrics Server stopped", "err", err)
+	}
 }
@@ -0,0 +1,439 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+	"github.com/stieneee/mumble-discord-bridge/pkg/wav"
+)
+
+// Recordings are 48kHz mono 16 bit WAV, the format of the audio loops
+const recordSampleRate = 48000
+
+// recordGapTolerance is how far a track may fall behind the session clock before the gap is filled with silence.
+// It absorbs the bursts of frames from a single packet and the jitter of the loops.
+const recordGapTolerance = 100 * time.Millisecond
+
+// recordQueueSize is the number of frames queued for the writer before frames are dropped
+const recordQueueSize = 2000
+
+// Track kinds of a recording
+const (
+	TrackUser = "user" // a single Discord SSRC or Mumble audio stream
+	TrackMix  = "mix"  // the mixed audio sent to one side
+)
+
+// IDs of the mix tracks
+const (
+	mixToDiscord = "to_discord"
+	mixToMumble  = "to_mumble"
+)
+
+var (
+	// ErrRecorderDisabled is returned by the recording controls when no recorder is configured
+	ErrRecorderDisabled = errors.New("recording is not enabled")
+	// ErrRecording is returned when starting a recording while one is running
+	ErrRecording = errors.New("already recording")
+	// ErrNotRecording is returned when stopping while no recording is running
+	ErrNotRecording = errors.New("not recording")
+)
+
+// RecordingTrack describes one file of a recording
+type RecordingTrack struct {
+	File string `json:"file"`
+	Kind string `json:"kind"`
+	// Side the user is on, or the side a mix is sent to
+	Side string `json:"side"`
+	// Discord SSRC or Mumble session of the stream, or the direction of a mix
+	Stream string `json:"stream"`
+	// Discord user ID or Mumble user name, empty until the user of a Discord stream is known
+	User string `json:"user,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Position of the first sample in the session
+	OffsetMS      int64 `json:"offset_ms"`
+	OffsetSamples int64 `json:"offset_samples"`
+	Samples       int64 `json:"samples"`
+}
+
+// RecordingManifest is written as manifest.json to the session directory when a recording stops
+type RecordingManifest struct {
+	Dir        string           `json:"-"`
+	Started    time.Time        `json:"started"`
+	Stopped    time.Time        `json:"stopped"`
+	Format     string           `json:"format"`
+	SampleRate int              `json:"sample_rate"`
+	Channels   int              `json:"channels"`
+	Dropped    uint64           `json:"dropped_frames"`
+	Tracks     []RecordingTrack `json:"tracks"`
+}
+
+// RecordingStatus is the state of the recorder
+type RecordingStatus struct {
+	Recording bool      `json:"recording"`
+	Dir       string    `json:"dir,omitempty"`
+	Started   time.Time `json:"started,omitempty"`
+	Tracks    int64     `json:"tracks"`
+	Dropped   uint64    `json:"dropped_frames"`
+}
+
+// Recorder writes the streams of both sides and the two mixes to time aligned tracks in a session directory.
+// Frames are queued to a writer goroutine so the audio loops never wait for the disk.
+// A nil *Recorder is valid and records nothing.
+type Recorder struct {
+	dir   string
+	clock clock.Clock
+	log   *logger.Logger
+
+	mu      sync.RWMutex
+	session *recordingSession
+}
+
+// NewRecorder returns a recorder that creates session directories in dir. A nil clock is the real clock.
+func NewRecorder(dir string, c clock.Clock, log *logger.Logger) *Recorder {
+	return &Recorder{dir: dir, clock: clock.OrReal(c), log: log}
+}
+
+type trackKey struct {
+	kind   string
+	side   string
+	stream string
+}
+
+type recordedFrame struct {
+	trackKey
+	user string
+	name string
+	at   time.Time
+	pcm  []int16
+}
+
+type recordingSession struct {
+	dropped  uint64 // atomic, first for 64 bit alignment
+	tracks   int64  // atomic
+	manifest RecordingManifest
+	frames   chan recordedFrame
+	done     chan struct{}
+
+	// Owned by the writer goroutine
+	files map[trackKey]*recordingFile
+	order []*recordingFile
+	err   error
+}
+
+type recordingFile struct {
+	info   RecordingTrack
+	f      *os.File
+	w      *wav.Writer
+	failed bool
+}
+
+// Start creates a session directory and starts recording into it
+func (r *Recorder) Start() (RecordingStatus, error) {
+	if r == nil {
+		return RecordingStatus{}, ErrRecorderDisabled
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.session != nil {
+		return r.status(), ErrRecording
+	}
+
+	now := r.clock.Now()
+	dir, err := r.sessionDir(now)
+	if err != nil {
+		return RecordingStatus{}, err
+	}
+	s := &recordingSession{
+		manifest: RecordingManifest{
+			Dir:        dir,
+			Started:    now,
+			Format:     "wav",
+			SampleRate: recordSampleRate,
+			Channels:   1,
+		},
+		frames: make(chan recordedFrame, recordQueueSize),
+		done:   make(chan struct{}),
+		files:  make(map[trackKey]*recordingFile),
+	}
+	r.session = s
+	go s.run(r.log)
+	r.log.Info("Recording started", "dir", dir)
+	return r.status(), nil
+}
+
+// sessionDir creates a new directory named after the start time
+func (r *Recorder) sessionDir(now time.Time) (string, error) {
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return "", err
+	}
+	base := filepath.Join(r.dir, "session-"+now.Format("20060102-150405"))
+	dir := base
+	for i := 2; ; i++ {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			return dir, nil
+		}
+		if !os.IsExist(err) || i > 100 {
+			return "", err
+		}
+		dir = fmt.Sprintf("%v-%v", base, i)
+	}
+}
+
+// Stop finishes the tracks and writes the manifest of the session
+func (r *Recorder) Stop() (*RecordingManifest, error) {
+	if r == nil {
+		return nil, ErrRecorderDisabled
+	}
+	r.mu.Lock()
+	s := r.session
+	r.session = nil
+	if s != nil {
+		close(s.frames)
+	}
+	r.mu.Unlock()
+	if s == nil {
+		return nil, ErrNotRecording
+	}
+	<-s.done
+
+	m := &s.manifest
+	m.Stopped = r.clock.Now()
+	m.Dropped = atomic.LoadUint64(&s.dropped)
+	m.Tracks = make([]RecordingTrack, 0, len(s.order))
+	for _, f := range s.order {
+		m.Tracks = append(m.Tracks, f.info)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(m.Dir, "manifest.json"), data, 0600)
+	}
+	if err == nil {
+		err = s.err
+	}
+	r.log.Info("Recording stopped", "dir", m.Dir, "tracks", len(m.Tracks), "dropped", m.Dropped)
+	return m, err
+}
+
+// Status returns the state of the recorder
+func (r *Recorder) Status() RecordingStatus {
+	if r == nil {
+		return RecordingStatus{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.status()
+}
+
+func (r *Recorder) status() RecordingStatus {
+	s := r.session
+	if s == nil {
+		return RecordingStatus{}
+	}
+	return RecordingStatus{
+		Recording: true,
+		Dir:       s.manifest.Dir,
+		Started:   s.manifest.Started,
+		Tracks:    atomic.LoadInt64(&s.tracks),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+	}
+}
+
+// Frame records a 10ms frame of a user stream. Every stream is its own track, user and name may be empty until known.
+func (r *Recorder) Frame(side, stream, user, name string, pcm []int16) {
+	r.frame(trackKey{TrackUser, side, stream}, user, name, pcm)
+}
+
+// mixFrame records a frame of the mix sent to the Discord or Mumble side
+func (r *Recorder) mixFrame(to string, pcm []int16) {
+	id := mixToMumble
+	if to == sideDiscord {
+		id = mixToDiscord
+	}
+	r.frame(trackKey{TrackMix, to, id}, "", "", pcm)
+}
+
+func (r *Recorder) frame(k trackKey, user, name string, pcm []int16) {
+	if r == nil {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s := r.session
+	if s == nil {
+		return
+	}
+	f := recordedFrame{trackKey: k, user: user, name: name, at: r.clock.Now(), pcm: make([]int16, len(pcm))}
+	copy(f.pcm, pcm)
+	select {
+	case s.frames <- f:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *recordingSession) run(log *logger.Logger) {
+	defer close(s.done)
+	for f := range s.frames {
+		t := s.files[f.trackKey]
+		if t == nil {
+			t = s.open(f, log)
+		}
+		if t.info.User == "" && f.user != "" {
+			t.info.User, t.info.Name = f.user, f.name
+		}
+		if t.failed {
+			continue
+		}
+		if err := t.write(f.pcm, samplesAt(f.at.Sub(s.manifest.Started))); err != nil {
+			s.fail(t, err, log)
+		}
+	}
+	for _, t := range s.order {
+		if t.failed {
+			continue
+		}
+		if err := t.w.Close(); err != nil {
+			s.fail(t, err, log)
+		}
+		if err := t.f.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+}
+
+// nonFileChars are replaced in the user names of track files
+var nonFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func (s *recordingSession) open(f recordedFrame, log *logger.Logger) *recordingFile {
+	n := len(s.order) + 1
+	offset := samplesAt(f.at.Sub(s.manifest.Started))
+	label := f.name
+	if label == "" {
+		label = f.stream
+	}
+	t := &recordingFile{info: RecordingTrack{
+		File:          fmt.Sprintf("%02d-%v-%v.wav", n, f.side, nonFileChars.ReplaceAllString(label, "_")),
+		Kind:          f.kind,
+		Side:          f.side,
+		Stream:        f.stream,
+		User:          f.user,
+		Name:          f.name,
+		OffsetMS:      offset * 1000 / recordSampleRate,
+		OffsetSamples: offset,
+	}}
+	s.files[f.trackKey] = t
+	s.order = append(s.order, t)
+	atomic.AddInt64(&s.tracks, 1)
+
+	file, err := os.OpenFile(filepath.Join(s.manifest.Dir, t.info.File), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		s.fail(t, err, log)
+		return t
+	}
+	t.f = file
+	if t.w, err = wav.NewWriter(file, recordSampleRate, 1); err != nil {
+		s.fail(t, err, log)
+	}
+	return t
+}
+
+func (s *recordingSession) fail(t *recordingFile, err error, log *logger.Logger) {
+	log.Error("Recording track failed", "file", t.info.File, "err", err)
+	t.failed = true
+	if t.f != nil {
+		t.f.Close()
+	}
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// write appends pcm at position pos of the session, filling gaps longer than recordGapTolerance with silence
+func (t *recordingFile) write(pcm []int16, pos int64) error {
+	end := t.info.OffsetSamples + t.w.Samples()
+	if gap := pos - end; gap > samplesAt(recordGapTolerance) {
+		if err := t.w.WriteSilence(int(gap)); err != nil {
+			return err
+		}
+	}
+	if err := t.w.Write(pcm); err != nil {
+		return err
+	}
+	t.info.Samples = t.w.Samples()
+	return nil
+}
+
+func samplesAt(d time.Duration) int64 {
+	return int64(d/time.Microsecond) * recordSampleRate / 1e6
+}
+
+// StartRecording starts the recorder and announces the recording on both sides. by names who started it, optional.
+func (b *BridgeState) StartRecording(by string) (RecordingStatus, error) {
+	st, err := b.Recorder.Start()
+	if err != nil {
+		return st, err
+	}
+	b.announce(withBy("Recording started", by) + ", audio on both sides of the bridge is being recorded")
+	return st, nil
+}
+
+// StopRecording stops the recorder and announces it on both sides. by names who stopped it, optional.
+// The manifest is returned with the error of a failed track.
+func (b *BridgeState) StopRecording(by string) (*RecordingManifest, error) {
+	m, err := b.Recorder.Stop()
+	if m != nil {
+		b.announce(withBy("Recording stopped", by))
+	}
+	return m, err
+}
+
+func withBy(msg, by string) string {
+	if by == "" {
+		return msg
+	}
+	return msg + " by " + by
+}
+
+// recordCommand runs the record chat commands and returns the reply
+func (b *BridgeState) recordCommand(arg, by string) string {
+	switch arg {
+	case "start":
+		st, err := b.StartRecording(by)
+		if err != nil {
+			return "Could not start recording: " + err.Error()
+		}
+		return "Recording to " + filepath.Base(st.Dir)
+	case "stop":
+		m, err := b.StopRecording(by)
+		if m == nil {
+			return "Could not stop recording: " + err.Error()
+		}
+		reply := fmt.Sprintf("Recorded %v tracks to %v", len(m.Tracks), filepath.Base(m.Dir))
+		if err != nil {
+			reply += ", some tracks failed: " + err.Error()
+		}
+		return reply
+	case "", "status":
+		if b.Recorder == nil {
+			return "Recording is not enabled"
+		}
+		st := b.Recorder.Status()
+		if !st.Recording {
+			return "Not recording"
+		}
+		return fmt.Sprintf("Recording to %v since %v, %v tracks", filepath.Base(st.Dir), st.Started.Format("15:04:05"), st.Tracks)
+	}
+	return "Usage: record start|stop|status"
+}
@@ -0,0 +1,197 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/wav"
+)
+
+// ErrReplayDisabled is returned by Clip when no replay buffer is configured
+var ErrReplayDisabled = errors.New("replay buffer is not enabled")
+
+// ReplayBuffer keeps the last seconds of the mixed audio of both directions in memory, so moments can be clipped after the fact.
+// Silences are kept as well, the buffer always covers the most recent time.
+// A nil *ReplayBuffer is valid and keeps nothing.
+type ReplayBuffer struct {
+	dir    string
+	clock  clock.Clock
+	length time.Duration
+	origin time.Time
+
+	mu        sync.Mutex
+	toMumble  replayRing
+	toDiscord replayRing
+}
+
+// NewReplayBuffer returns a buffer of the given length that writes clips to dir. A nil clock is the real clock.
+func NewReplayBuffer(dir string, length time.Duration, c clock.Clock) *ReplayBuffer {
+	c = clock.OrReal(c)
+	n := samplesAt(length)
+	return &ReplayBuffer{
+		dir:       dir,
+		clock:     c,
+		length:    length,
+		origin:    c.Now(),
+		toMumble:  replayRing{buf: make([]int16, n)},
+		toDiscord: replayRing{buf: make([]int16, n)},
+	}
+}
+
+// replayRing is a ring of samples on the timeline of the buffer
+type replayRing struct {
+	buf []int16
+	end int64 // position after the last sample
+}
+
+// advance fills the ring with silence up to pos when it fell behind by more than recordGapTolerance
+func (r *replayRing) advance(pos int64) {
+	gap := pos - r.end
+	if gap <= samplesAt(recordGapTolerance) {
+		return
+	}
+	n := gap
+	if n > int64(len(r.buf)) {
+		n = int64(len(r.buf))
+	}
+	for i := r.end + gap - n; i < r.end+gap; i++ {
+		r.buf[i%int64(len(r.buf))] = 0
+	}
+	r.end += gap
+}
+
+func (r *replayRing) write(pcm []int16) {
+	for len(pcm) > 0 {
+		i := int(r.end % int64(len(r.buf)))
+		c := copy(r.buf[i:], pcm)
+		pcm = pcm[c:]
+		r.end += int64(c)
+	}
+}
+
+// last returns the latest n samples, samples from before the start of the buffer are silent
+func (r *replayRing) last(n int) []int16 {
+	out := make([]int16, n)
+	for i := 0; i < n; i++ {
+		if p := r.end - int64(n-i); p >= 0 {
+			out[i] = r.buf[p%int64(len(r.buf))]
+		}
+	}
+	return out
+}
+
+// Frame keeps a frame of the mix sent to the side to, "discord" or "mumble"
+func (rb *ReplayBuffer) Frame(to string, pcm []int16) {
+	if rb == nil || len(rb.toMumble.buf) == 0 {
+		return
+	}
+	pos := samplesAt(rb.clock.Now().Sub(rb.origin))
+	rb.mu.Lock()
+	r := &rb.toMumble
+	if to == sideDiscord {
+		r = &rb.toDiscord
+	}
+	r.advance(pos)
+	r.write(pcm)
+	rb.mu.Unlock()
+}
+
+// Clip writes the last d of both mixes to a timestamped stereo WAV file and returns its path.
+// The left channel is the audio sent to Mumble, the right channel the audio sent to Discord.
+// A d of zero or longer than the buffer clips the whole buffer.
+func (rb *ReplayBuffer) Clip(d time.Duration) (string, time.Duration, error) {
+	if rb == nil {
+		return "", 0, ErrReplayDisabled
+	}
+	if d <= 0 || d > rb.length {
+		d = rb.length
+	}
+	n := int(samplesAt(d))
+	now := rb.clock.Now()
+	pos := samplesAt(now.Sub(rb.origin))
+
+	rb.mu.Lock()
+	rb.toMumble.advance(pos)
+	rb.toDiscord.advance(pos)
+	left := rb.toMumble.last(n)
+	right := rb.toDiscord.last(n)
+	rb.mu.Unlock()
+
+	stereo := make([]int16, 2*n)
+	for i := 0; i < n; i++ {
+		stereo[2*i] = left[i]
+		stereo[2*i+1] = right[i]
+	}
+
+	f, err := rb.create(now)
+	if err != nil {
+		return "", 0, err
+	}
+	w, err := wav.NewWriter(f, recordSampleRate, 2)
+	if err == nil {
+		err = w.Write(stereo)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), d, nil
+}
+
+// create opens a new clip file named after the time of the clip
+func (rb *ReplayBuffer) create(now time.Time) (*os.File, error) {
+	if err := os.MkdirAll(rb.dir, 0700); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(rb.dir, "clip-"+now.Format("20060102-150405"))
+	path := base + ".wav"
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsExist(err) || i > 100 {
+			return nil, err
+		}
+		path = fmt.Sprintf("%v-%v.wav", base, i)
+	}
+}
+
+// SaveClip saves the last d of the replay buffer and announces the clip on both sides. by names who saved it, optional.
+func (b *BridgeState) SaveClip(d time.Duration, by string) (string, time.Duration, error) {
+	path, d, err := b.Replay.Clip(d)
+	if err != nil {
+		return "", 0, err
+	}
+	b.announce(withBy(fmt.Sprintf("Clip of the last %v saved", d), by))
+	return path, d, nil
+}
+
+// clipCommand runs the clip chat command, the argument is the optional length in seconds
+func (b *BridgeState) clipCommand(arg, by string) string {
+	var d time.Duration
+	if arg != "" {
+		s, err := strconv.Atoi(arg)
+		if err != nil || s <= 0 {
+			return "Usage: clip [seconds]"
+		}
+		d = time.Duration(s) * time.Second
+	}
+	path, _, err := b.SaveClip(d, by)
+	if err != nil {
+		return "Could not save clip: " + err.Error()
+	}
+	return "Saved " + filepath.Base(path)
+}
@@ -0,0 +1,77 @@
+package bridge
+
+// Loudest speaker selection
+const (
+	// speakerSmoothing is the share of the energy of a new frame in the smoothed energy of a stream (about 200ms)
+	speakerSmoothing = 0.05
+	// speakerHysteresis is the energy factor a stream needs over a stream in the mix to replace it (3 dB)
+	speakerHysteresis = 2
+)
+
+// speakerState is the smoothed energy of a stream and if it was mixed in the last tick
+type speakerState struct {
+	energy   float64
+	selected bool
+	keep     bool // picked this tick
+}
+
+func (s *speakerState) update(frame []int16) {
+	level := rms(frame)
+	s.energy += (level*level - s.energy) * speakerSmoothing
+}
+
+// decay lowers the energy of a stream without audio this tick
+func (s *speakerState) decay() {
+	s.energy -= s.energy * speakerSmoothing
+}
+
+// selectSpeakers keeps every priority frame and the max loudest of the other frames of this tick, all if max is 0.
+// Streams in the mix keep their place until another stream is 3 dB louder.
+// The kept frames are moved in order to the front of frames and priority, the frames left out follow them.
+// It returns the kept frames and their priority and the number of frames left out.
+func selectSpeakers(frames [][]int16, priority []bool, states []*speakerState, max int) ([][]int16, []bool, int) {
+	for i, f := range frames {
+		states[i].update(f)
+	}
+	others := 0
+	for i := range frames {
+		states[i].keep = priority[i]
+		if !priority[i] {
+			others++
+		}
+	}
+	if max <= 0 || others <= max {
+		for _, s := range states {
+			s.selected = true
+		}
+		return frames, priority, 0
+	}
+
+	score := func(i int) float64 {
+		if states[i].selected {
+			return states[i].energy * speakerHysteresis
+		}
+		return states[i].energy
+	}
+	// Pick the loudest of the other frames max times, ties go to the first stream
+	for n := 0; n < max; n++ {
+		best := -1
+		for i := range frames {
+			if !states[i].keep && (best < 0 || score(i) > score(best)) {
+				best = i
+			}
+		}
+		states[best].keep = true
+	}
+
+	n := 0
+	for i := range frames {
+		states[i].selected = states[i].keep
+		if states[i].keep {
+			frames[n], frames[i] = frames[i], frames[n]
+			priority[n], priority[i] = priority[i], priority[n]
+			n++
+		}
+	}
+	return frames[:n], priority[:n], len(frames) - n
+}
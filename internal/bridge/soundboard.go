@@ -0,0 +1,272 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/sound"
+)
+
+// TargetBoth plays a sound to Discord and Mumble
+const TargetBoth = "both"
+
+// soundboardMaxVolume is the loudest volume a sound can be played at, 2 is 200%
+const soundboardMaxVolume = 2
+
+// soundboardMaxQueue is the number of sounds that can wait behind the playing one
+const soundboardMaxQueue = 20
+
+var (
+	// ErrSoundboardDisabled is returned by the soundboard controls when no soundboard is configured
+	ErrSoundboardDisabled = errors.New("soundboard is not enabled")
+	// ErrSoundNotFound is returned for names that do not match a file in the soundboard directory
+	ErrSoundNotFound = errors.New("sound not found")
+	// ErrSoundQueueFull is returned when too many sounds are queued
+	ErrSoundQueueFull = errors.New("sound queue is full")
+	// ErrNothingPlaying is returned when skipping while no sound plays
+	ErrNothingPlaying = errors.New("nothing is playing")
+	// ErrInvalidSound is returned for an invalid target or volume
+	ErrInvalidSound = errors.New("invalid target or volume")
+	// ErrNotConnected is returned for controls that need a running bridge
+	ErrNotConnected = errors.New("bridge is not connected")
+)
+
+// SoundboardItem is a playing or queued sound
+type SoundboardItem struct {
+	File string `json:"file"`
+	// discord, mumble or both
+	To      string  `json:"to"`
+	Volume  float64 `json:"volume"`
+	Seconds float64 `json:"seconds"`
+	By      string  `json:"by,omitempty"`
+}
+
+// Soundboard plays local audio files as an extra source of the mixers of one or both sides.
+// Sounds play one after the other, the first sound of the queue is playing.
+// A nil *Soundboard is valid and plays nothing.
+type Soundboard struct {
+	dir   string
+	queue soundQueue
+}
+
+// NewSoundboard returns a soundboard playing the files in dir
+func NewSoundboard(dir string) *Soundboard {
+	return &Soundboard{dir: dir}
+}
+
+// Files lists the playable files of the soundboard directory
+func (sb *Soundboard) Files() ([]string, error) {
+	if sb == nil {
+		return nil, ErrSoundboardDisabled
+	}
+	entries, err := ioutil.ReadDir(sb.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && sound.Supported(e.Name()) && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, e.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// resolve finds the file name in the soundboard directory, names without an extension match any supported format
+func (sb *Soundboard) resolve(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", ErrSoundNotFound
+	}
+	candidates := []string{name}
+	if !sound.Supported(name) {
+		candidates = nil
+		for _, ext := range sound.Extensions {
+			candidates = append(candidates, name+ext)
+		}
+	}
+	for _, c := range candidates {
+		if info, err := os.Stat(filepath.Join(sb.dir, c)); err == nil && info.Mode().IsRegular() {
+			return c, nil
+		}
+	}
+	return "", ErrSoundNotFound
+}
+
+// Play decodes the named file and queues it for the side to, discord, mumble or both.
+// volume scales the file, 1 plays it at its own level. It returns the queued sound and its position, 0 if it plays now.
+func (sb *Soundboard) Play(name, to string, volume float64, by string) (SoundboardItem, int, error) {
+	if sb == nil {
+		return SoundboardItem{}, 0, ErrSoundboardDisabled
+	}
+	if (to != sideDiscord && to != sideMumble && to != TargetBoth) || volume < 0 || volume > soundboardMaxVolume {
+		return SoundboardItem{}, 0, ErrInvalidSound
+	}
+	file, err := sb.resolve(name)
+	if err != nil {
+		return SoundboardItem{}, 0, err
+	}
+	if sb.queue.full(soundboardMaxQueue) {
+		return SoundboardItem{}, 0, ErrSoundQueueFull
+	}
+
+	pcm, err := sound.Load(filepath.Join(sb.dir, file))
+	if err != nil {
+		return SoundboardItem{}, 0, fmt.Errorf("%v: %w", file, err)
+	}
+	q := &queuedSound{
+		SoundboardItem: SoundboardItem{
+			File:    file,
+			To:      to,
+			Volume:  volume,
+			Seconds: float64(len(pcm)) / sound.SampleRate,
+			By:      by,
+		},
+		pcm: pcm,
+	}
+
+	position, ok := sb.queue.add(q, soundboardMaxQueue)
+	if !ok {
+		return SoundboardItem{}, 0, ErrSoundQueueFull
+	}
+	return q.SoundboardItem, position, nil
+}
+
+// Skip ends the playing sound, the next queued sound starts
+func (sb *Soundboard) Skip() (SoundboardItem, error) {
+	if sb == nil {
+		return SoundboardItem{}, ErrSoundboardDisabled
+	}
+	skipped, ok := sb.queue.skip()
+	if !ok {
+		return SoundboardItem{}, ErrNothingPlaying
+	}
+	return skipped, nil
+}
+
+// Stop ends the playing sound and clears the queue, it returns the number of sounds removed
+func (sb *Soundboard) Stop() int {
+	if sb == nil {
+		return 0
+	}
+	return sb.queue.clear()
+}
+
+// Queue returns the playing sound followed by the queued sounds
+func (sb *Soundboard) Queue() []SoundboardItem {
+	if sb == nil {
+		return []SoundboardItem{}
+	}
+	return sb.queue.items()
+}
+
+func (sb *Soundboard) setWake(wake func(), direction BridgeDirection) {
+	if sb != nil {
+		sb.queue.setWake(wake, direction)
+	}
+}
+
+func (sb *Soundboard) frame(side string) []int16 {
+	if sb == nil {
+		return nil
+	}
+	return sb.queue.frame(side)
+}
+
+// PlaySound queues a soundboard file while the bridge is connected
+func (b *BridgeState) PlaySound(name, to string, volume float64, by string) (SoundboardItem, int, error) {
+	if b.Soundboard == nil {
+		return SoundboardItem{}, 0, ErrSoundboardDisabled
+	}
+	b.BridgeMutex.Lock()
+	connected := b.Connected
+	direction := b.BridgeConfig.Direction
+	b.BridgeMutex.Unlock()
+	if !connected {
+		return SoundboardItem{}, 0, ErrNotConnected
+	}
+	if !direction.plays(to) {
+		return SoundboardItem{}, 0, ErrDirection
+	}
+	return b.Soundboard.Play(name, to, volume, by)
+}
+
+// soundCommand runs the sound chat commands and returns the reply, sep separates lines
+func (b *BridgeState) soundCommand(args []string, by, sep string) string {
+	usage := "Usage: sound play FILE [discord|mumble|both] [VOLUME%] | skip | stop | queue | list"
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "play":
+		if len(args) < 2 {
+			return usage
+		}
+		to, volume := TargetBoth, 1.0
+		for _, a := range args[2:] {
+			switch a {
+			case sideDiscord, sideMumble, TargetBoth:
+				to = a
+			default:
+				percent, err := strconv.ParseFloat(strings.TrimSuffix(a, "%"), 64)
+				if err != nil {
+					return usage
+				}
+				volume = percent / 100
+			}
+		}
+		item, position, err := b.PlaySound(args[1], to, volume, by)
+		if err != nil {
+			return "Could not play sound: " + err.Error()
+		}
+		if position == 0 {
+			return fmt.Sprintf("Playing %v (%v) to %v", item.File, secondsString(item.Seconds), item.To)
+		}
+		return fmt.Sprintf("Queued %v at position %v", item.File, position)
+	case "skip":
+		item, err := b.Soundboard.Skip()
+		if err != nil {
+			return "Could not skip: " + err.Error()
+		}
+		return "Skipped " + item.File
+	case "stop":
+		if b.Soundboard == nil {
+			return "Could not stop: " + ErrSoundboardDisabled.Error()
+		}
+		return fmt.Sprintf("Stopped %v sounds", b.Soundboard.Stop())
+	case "queue":
+		if b.Soundboard == nil {
+			return ErrSoundboardDisabled.Error()
+		}
+		items := b.Soundboard.Queue()
+		if len(items) == 0 {
+			return "Nothing is playing"
+		}
+		lines := []string{}
+		for i, item := range items {
+			lines = append(lines, fmt.Sprintf("%v. %v (%v) to %v", i, item.File, secondsString(item.Seconds), item.To))
+		}
+		return strings.Join(lines, sep)
+	case "list":
+		files, err := b.Soundboard.Files()
+		if err != nil {
+			return "Could not list sounds: " + err.Error()
+		}
+		if len(files) == 0 {
+			return "No sounds available"
+		}
+		return "Sounds: " + strings.Join(files, ", ")
+	}
+	return usage
+}
+
+func secondsString(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,164 @@
+package bridge
+
+import "sync"
+
+// queuedSound is 48kHz mono audio waiting to be mixed into one or both sides
+type queuedSound struct {
+	SoundboardItem
+	pcm        []int16
+	posDiscord int
+	posMumble  int
+}
+
+func (q *queuedSound) plays(side string) bool {
+	return q.To == TargetBoth || q.To == side
+}
+
+// soundQueue plays sounds one after the other as an extra source of the mixers, the first sound is playing
+type soundQueue struct {
+	mu        sync.Mutex
+	sounds    []*queuedSound
+	wake      func() // wakes paused mixers when a sound starts, nil while the bridge is not running
+	direction BridgeDirection
+}
+
+// plays reports if q still has audio for side, sides the bridge does not play to are skipped
+func (sq *soundQueue) plays(q *queuedSound, side string) bool {
+	if !q.plays(side) || !sq.direction.plays(side) {
+		return false
+	}
+	if side == sideDiscord {
+		return q.posDiscord < len(q.pcm)
+	}
+	return q.posMumble < len(q.pcm)
+}
+
+func (sq *soundQueue) done(q *queuedSound) bool {
+	return !sq.plays(q, sideDiscord) && !sq.plays(q, sideMumble)
+}
+
+// add queues q unless more than max sounds wait, it returns the position of q
+func (sq *soundQueue) add(q *queuedSound, max int) (int, bool) {
+	sq.mu.Lock()
+	if len(sq.sounds) > max {
+		sq.mu.Unlock()
+		return 0, false
+	}
+	sq.sounds = append(sq.sounds, q)
+	position := len(sq.sounds) - 1
+	wake := sq.wake
+	sq.mu.Unlock()
+
+	if position == 0 && wake != nil {
+		wake()
+	}
+	return position, true
+}
+
+func (sq *soundQueue) full(max int) bool {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return len(sq.sounds) > max
+}
+
+// active reports if the bridge is running and plays to side
+func (sq *soundQueue) active(side string) bool {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return sq.wake != nil && sq.direction.plays(side)
+}
+
+// skip removes the playing sound
+func (sq *soundQueue) skip() (SoundboardItem, bool) {
+	sq.mu.Lock()
+	if len(sq.sounds) == 0 {
+		sq.mu.Unlock()
+		return SoundboardItem{}, false
+	}
+	skipped := sq.sounds[0].SoundboardItem
+	sq.sounds = sq.sounds[1:]
+	wake := sq.wake
+	next := len(sq.sounds) > 0
+	sq.mu.Unlock()
+
+	if next && wake != nil {
+		wake()
+	}
+	return skipped, true
+}
+
+// clear removes all sounds and returns their number
+func (sq *soundQueue) clear() int {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	n := len(sq.sounds)
+	sq.sounds = nil
+	return n
+}
+
+func (sq *soundQueue) items() []SoundboardItem {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	items := []SoundboardItem{}
+	for _, q := range sq.sounds {
+		items = append(items, q.SoundboardItem)
+	}
+	return items
+}
+
+func (sq *soundQueue) setWake(wake func(), direction BridgeDirection) {
+	sq.mu.Lock()
+	sq.wake = wake
+	sq.direction = direction
+	sq.mu.Unlock()
+}
+
+// frame returns the next 10ms of the playing sound for side as a pooled block, nil while no sound plays to side
+func (sq *soundQueue) frame(side string) []int16 {
+	sq.mu.Lock()
+	// Sounds only for sides the bridge does not play to are dropped
+	for len(sq.sounds) > 0 && sq.done(sq.sounds[0]) {
+		sq.sounds = sq.sounds[1:]
+	}
+	if len(sq.sounds) == 0 || !sq.plays(sq.sounds[0], side) {
+		// Nothing playing, or waiting for the other side to finish
+		sq.mu.Unlock()
+		return nil
+	}
+	q := sq.sounds[0]
+	pos := &q.posMumble
+	if side == sideDiscord {
+		pos = &q.posDiscord
+	}
+	out := blockPool.get()
+	zero(out[copy(out, q.pcm[*pos:]):])
+	*pos += len(out)
+
+	var wake func()
+	if sq.done(q) {
+		sq.sounds = sq.sounds[1:]
+		if len(sq.sounds) > 0 {
+			wake = sq.wake
+		}
+	}
+	sq.mu.Unlock()
+
+	if q.Volume != 1 {
+		scale(out, q.Volume)
+	}
+	if wake != nil {
+		wake()
+	}
+	return out
+}
+
+// soundFrames appends the frames of the soundboard and the chimes playing to side
+func (b *BridgeState) soundFrames(side string, frames [][]int16) [][]int16 {
+	if f := b.Soundboard.frame(side); f != nil {
+		frames = append(frames, f)
+	}
+	if f := b.Chimes.frame(side); f != nil {
+		frames = append(frames, f)
+	}
+	return frames
+}
@@ -0,0 +1,95 @@
+package bridge
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+)
+
+// speakingState is the speaking state of the audio sent to one side.
+// After the last audio the state is kept for the hangover while silence or comfort noise is sent,
+// and it is kept for at least the hold time, so short pauses do not toggle it.
+type speakingState struct {
+	frame    time.Duration // length of one frame
+	hangover time.Duration
+	hold     time.Duration
+	noise    float64 // half width of the uniform comfort noise, 0 sends silence
+
+	speaking bool
+	elapsed  time.Duration // time in the speaking state
+	silent   time.Duration // time since the last audio
+
+	clock   clock.Clock
+	toggles []time.Time // changes of the speaking state in the last minute
+	gauge   prometheus.Gauge
+}
+
+func newSpeakingState(c clock.Clock, frame, hangover, hold time.Duration, comfortNoise float64, gauge prometheus.Gauge) *speakingState {
+	s := &speakingState{frame: frame, hangover: hangover, hold: hold, clock: c, gauge: gauge}
+	if comfortNoise < 0 {
+		// A uniform noise of width 2a has an RMS level of a/sqrt(3)
+		s.noise = 32768 * math.Pow(10, comfortNoise/20) * math.Sqrt(3)
+	}
+	return s
+}
+
+// audio records a frame with audio, it returns true if the speaking state starts
+func (s *speakingState) audio() bool {
+	start := !s.speaking
+	if start {
+		s.speaking = true
+		s.elapsed = 0
+		s.toggle()
+	}
+	s.silent = 0
+	s.elapsed += s.frame
+	return start
+}
+
+// silence records a frame without audio in the speaking state.
+// It returns true while the state is kept and a silence frame should be sent, false once the state drops.
+func (s *speakingState) silence() bool {
+	if s.silent >= s.hangover && s.elapsed >= s.hold {
+		s.speaking = false
+		s.toggle()
+		return false
+	}
+	s.silent += s.frame
+	s.elapsed += s.frame
+	return true
+}
+
+// spoken is the time from the start of the speaking state to the last audio
+func (s *speakingState) spoken() time.Duration {
+	return s.elapsed - s.silent
+}
+
+// fill writes the comfort noise, or silence, to the frame
+func (s *speakingState) fill(frame []int16) {
+	for i := range frame {
+		if s.noise == 0 {
+			frame[i] = 0
+		} else {
+			frame[i] = int16(math.Round((rand.Float64()*2 - 1) * s.noise))
+		}
+	}
+}
+
+func (s *speakingState) toggle() {
+	s.toggles = append(s.toggles, s.clock.Now())
+	s.update()
+}
+
+// update drops the changes older than a minute from the toggle gauge
+func (s *speakingState) update() {
+	now := s.clock.Now()
+	n := 0
+	for n < len(s.toggles) && now.Sub(s.toggles[n]) >= time.Minute {
+		n++
+	}
+	s.toggles = s.toggles[n:]
+	s.gauge.Set(float64(len(s.toggles)))
+}
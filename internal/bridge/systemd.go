@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/sdnotify"
+)
+
+// statusLine summarises the bridge state for systemctl status
+func (b *BridgeState) statusLine() string {
+	b.BridgeMutex.Lock()
+	connected := b.Connected
+	failures := b.startFailures
+	b.BridgeMutex.Unlock()
+
+	b.DiscordUsersMutex.Lock()
+	discordUsers := len(b.DiscordUsers)
+	b.DiscordUsersMutex.Unlock()
+
+	b.MumbleUsersMutex.Lock()
+	mumbleUsers := len(b.MumbleUsers)
+	b.MumbleUsersMutex.Unlock()
+
+	state := "idle"
+	if connected {
+		state = "connected"
+	} else if failures > 0 {
+		state = fmt.Sprintf("failing to start (%v attempts)", failures)
+	}
+
+	return fmt.Sprintf("%v mode, bridge %v, %v Discord users, %v Mumble users", b.Mode, state, discordUsers, mumbleUsers)
+}
+
+// SystemdNotify reports readiness, status and watchdog pings to systemd until done is closed.
+// READY is sent once the Discord gateway is connected.
+// Watchdog pings are only sent while the bridge is live and its audio loops have ticked within half the watchdog interval,
+// so a deadlocked bridge is restarted by systemd.
+// It does nothing when the process is not started by systemd with a notify socket.
+func (b *BridgeState) SystemdNotify(done <-chan struct{}) {
+	if sdnotify.Socket() == "" {
+		return
+	}
+	log := b.Log.With("side", "systemd")
+
+	watchdog, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		log.Warn("Ignoring systemd watchdog", "err", err)
+	}
+
+	interval := 5 * time.Second
+	if watchdog > 0 {
+		interval = watchdog / 2
+		log.Info("systemd watchdog enabled", "interval", watchdog)
+	}
+
+	notify := func(state string) {
+		if _, err := sdnotify.Notify(state); err != nil {
+			log.Warn("systemd notify failed", "err", err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := false
+	lastStatus := ""
+	for {
+		if !ready {
+			ready = b.DiscordSession.GatewayReady()
+			if ready {
+				notify(sdnotify.Ready)
+				log.Info("systemd notified ready")
+			}
+		}
+
+		if status := b.statusLine(); status != lastStatus {
+			notify(sdnotify.Status(status))
+			lastStatus = status
+		}
+
+		if watchdog > 0 {
+			if r := b.liveness(interval); r.OK {
+				notify(sdnotify.Watchdog)
+			} else {
+				log.Warn("Withholding systemd watchdog ping", "checks", r.Checks)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			notify(sdnotify.Stopping)
+			return
+		}
+	}
+}
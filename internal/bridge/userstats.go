@@ -0,0 +1,435 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sides of the bridge a user can be on
+const (
+	sideDiscord = "discord"
+	sideMumble  = "mumble"
+)
+
+// speakingThreshold is the frame RMS above which a user is counted as speaking (about -50 dBFS)
+const speakingThreshold = 100
+
+// UserStat holds the audio statistics of a single user
+type UserStat struct {
+	Side         string        `json:"side"`
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	SpeakingTime time.Duration `json:"speaking_time"`
+	Packets      uint64        `json:"packets"`
+	Frames       uint64        `json:"frames"`
+	Dropped      uint64        `json:"dropped"`
+	Peak         int           `json:"peak"` // max absolute sample
+	SumSquares   float64       `json:"sum_squares"`
+	Samples      uint64        `json:"samples"`
+	FirstSeen    time.Time     `json:"first_seen"`
+	LastSeen     time.Time     `json:"last_seen"`
+}
+
+// RMS returns the root mean square level of the speaking frames
+func (u *UserStat) RMS() float64 {
+	if u.Samples == 0 {
+		return 0
+	}
+	return math.Sqrt(u.SumSquares / float64(u.Samples))
+}
+
+// dBFS converts a sample level to decibels relative to full scale
+func dBFS(level float64) float64 {
+	if level <= 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(level/32768)
+}
+
+func (u *UserStat) merge(o *UserStat) {
+	u.SpeakingTime += o.SpeakingTime
+	u.Packets += o.Packets
+	u.Frames += o.Frames
+	u.Dropped += o.Dropped
+	if o.Peak > u.Peak {
+		u.Peak = o.Peak
+	}
+	u.SumSquares += o.SumSquares
+	u.Samples += o.Samples
+	if u.FirstSeen.IsZero() || (!o.FirstSeen.IsZero() && o.FirstSeen.Before(u.FirstSeen)) {
+		u.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen.After(u.LastSeen) {
+		u.LastSeen = o.LastSeen
+	}
+	if o.Name != "" {
+		u.Name = o.Name
+	}
+}
+
+type userStatKey struct {
+	side string
+	id   string
+}
+
+// UserStats accounts per user speaking time, packets, levels and drops on both sides of the bridge.
+// The counters cover the current day and are written to the data dir by Rollup.
+// A nil *UserStats is valid and records nothing.
+type UserStats struct {
+	mu    sync.Mutex
+	users map[userStatKey]*UserStat
+	day   time.Time
+
+	// Optional Prometheus metrics
+	metricLimit    int
+	metricUsers    map[userStatKey]string // users with a label today and their exported name
+	userInfo       *prometheus.GaugeVec
+	speakingTime   *prometheus.CounterVec
+	packets        *prometheus.CounterVec
+	dropped        *prometheus.CounterVec
+	peak           *prometheus.GaugeVec
+	rmsLevel       *prometheus.GaugeVec
+	metricsEnabled bool
+}
+
+func NewUserStats() *UserStats {
+	return &UserStats{
+		users: make(map[userStatKey]*UserStat),
+		day:   startOfDay(time.Now()),
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// EnableMetrics exposes the per user statistics as Prometheus metrics.
+// Users are labelled by ID, at most limit users per day get their own label value and further users are counted as "other".
+func (s *UserStats) EnableMetrics(m *Metrics, limit int) {
+	labels := []string{"side", "user"}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metricLimit = limit
+	s.metricUsers = make(map[userStatKey]string)
+	s.userInfo = m.factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mdb_user_info",
+		Help: "The display name of a labelled user",
+	}, []string{"side", "user", "name"})
+	s.speakingTime = m.factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdb_user_speaking_seconds",
+		Help: "The time a user has been speaking",
+	}, labels)
+	s.packets = m.factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdb_user_packets_count",
+		Help: "The number of audio packets received from a user",
+	}, labels)
+	s.dropped = m.factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdb_user_dropped_count",
+		Help: "The number of audio frames dropped from a user",
+	}, labels)
+	s.peak = m.factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mdb_user_peak_dbfs",
+		Help: "The peak level of a user today",
+	}, labels)
+	s.rmsLevel = m.factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mdb_user_rms_dbfs",
+		Help: "The RMS level of a user while speaking today",
+	}, labels)
+	s.metricsEnabled = true
+}
+
+// get returns the stat entry for a user, s.mu must be held
+func (s *UserStats) get(side, id, name string) *UserStat {
+	k := userStatKey{side, id}
+	u, ok := s.users[k]
+	if !ok {
+		u = &UserStat{Side: side, ID: id, Name: name, FirstSeen: time.Now()}
+		s.users[k] = u
+	}
+	if name != "" {
+		u.Name = name
+	}
+	u.LastSeen = time.Now()
+	return u
+}
+
+// metricLabel returns the user label value, applying the cardinality limit. s.mu must be held
+func (s *UserStats) metricLabel(side, id, name string) string {
+	k := userStatKey{side, id}
+	old, ok := s.metricUsers[k]
+	if !ok && len(s.metricUsers) >= s.metricLimit {
+		return "other"
+	}
+	if !ok || (name != "" && name != old) {
+		if ok {
+			s.userInfo.DeleteLabelValues(side, id, old)
+		}
+		if name == "" {
+			name = id
+		}
+		s.metricUsers[k] = name
+		s.userInfo.WithLabelValues(side, id, name).Set(1)
+	}
+	return id
+}
+
+// resetMetrics removes all user series so the labels are assigned again for the new day. s.mu must be held
+func (s *UserStats) resetMetrics() {
+	if !s.metricsEnabled {
+		return
+	}
+	s.metricUsers = make(map[userStatKey]string)
+	s.userInfo.Reset()
+	s.speakingTime.Reset()
+	s.packets.Reset()
+	s.dropped.Reset()
+	s.peak.Reset()
+	s.rmsLevel.Reset()
+}
+
+// Packet counts a received audio packet
+func (s *UserStats) Packet(side, id, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(side, id, name).Packets++
+	if s.metricsEnabled {
+		s.packets.WithLabelValues(side, s.metricLabel(side, id, name)).Inc()
+	}
+}
+
+// Frame accounts a decoded PCM frame of duration d relayed from the user
+func (s *UserStats) Frame(side, id, name string, pcm []int16, d time.Duration) {
+	if s == nil {
+		return
+	}
+
+	peak := 0
+	var sum float64
+	for _, v := range pcm {
+		x := int(v)
+		if x < 0 {
+			x = -x
+		}
+		if x > peak {
+			peak = x
+		}
+		sum += float64(v) * float64(v)
+	}
+	rms := 0.0
+	if len(pcm) > 0 {
+		rms = math.Sqrt(sum / float64(len(pcm)))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.get(side, id, name)
+	u.Frames++
+	if peak > u.Peak {
+		u.Peak = peak
+	}
+	if rms < speakingThreshold {
+		return
+	}
+	u.SpeakingTime += d
+	u.SumSquares += sum
+	u.Samples += uint64(len(pcm))
+
+	if s.metricsEnabled {
+		l := s.metricLabel(side, id, name)
+		s.speakingTime.WithLabelValues(side, l).Add(d.Seconds())
+		if l != "other" {
+			s.peak.WithLabelValues(side, l).Set(dBFS(float64(u.Peak)))
+			s.rmsLevel.WithLabelValues(side, l).Set(dBFS(u.RMS()))
+		}
+	}
+}
+
+// Drop counts a frame from the user that was dropped before reaching the other side
+func (s *UserStats) Drop(side, id, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(side, id, name).Dropped++
+	if s.metricsEnabled {
+		s.dropped.WithLabelValues(side, s.metricLabel(side, id, name)).Inc()
+	}
+}
+
+// Snapshot returns a copy of the current statistics ordered by speaking time
+func (s *UserStats) Snapshot() []UserStat {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	res := make([]UserStat, 0, len(s.users))
+	for _, u := range s.users {
+		res = append(res, *u)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].SpeakingTime == res[j].SpeakingTime {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].SpeakingTime > res[j].SpeakingTime
+	})
+	return res
+}
+
+// Summary formats the top n users for the status commands, lines are joined by sep
+func (s *UserStats) Summary(n int, sep string) string {
+	stats := s.Snapshot()
+	if len(stats) == 0 {
+		return "No audio statistics recorded today"
+	}
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	lines := []string{"Audio statistics today:"}
+	for _, u := range stats {
+		name := u.Name
+		if name == "" {
+			name = u.ID
+		}
+		lines = append(lines, fmt.Sprintf("%v (%v) spoke %v, %v packets, peak %.1f dBFS, rms %.1f dBFS, %v dropped",
+			name, u.Side, u.SpeakingTime.Round(time.Second), u.Packets, dBFS(float64(u.Peak)), dBFS(u.RMS()), u.Dropped))
+	}
+	return strings.Join(lines, sep)
+}
+
+// rollupFile is the daily statistics file format
+type rollupFile struct {
+	Day   string     `json:"day"`
+	Users []UserStat `json:"users"`
+}
+
+// Rollup writes the statistics of the current day to dir and resets the counters.
+// If the day already has a rollup file, for example after a restart, the statistics are merged into it.
+// When force is false the rollup only happens once the day has changed.
+// The Prometheus user series are reset as well, so the label limit applies per day.
+// If the file can not be read or written the statistics are kept for the next rollup.
+func (s *UserStats) Rollup(dir string, force bool) error {
+	if s == nil || dir == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	day := s.day
+	if !force && startOfDay(time.Now()).Equal(day) {
+		s.mu.Unlock()
+		return nil
+	}
+	users := s.users
+	s.users = make(map[userStatKey]*UserStat)
+	s.day = startOfDay(time.Now())
+	s.resetMetrics()
+	s.mu.Unlock()
+
+	if len(users) == 0 {
+		return nil
+	}
+
+	if err := writeRollup(dir, day, users); err != nil {
+		// Keep the statistics for the next rollup
+		s.mu.Lock()
+		for k, u := range s.users {
+			if m, ok := users[k]; ok {
+				m.merge(u)
+			} else {
+				users[k] = u
+			}
+		}
+		s.users = users
+		s.day = day
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeRollup merges users into the rollup file of day in dir, users are not changed
+func writeRollup(dir string, day time.Time, users map[userStatKey]*UserStat) error {
+	path := filepath.Join(dir, "user-stats-"+day.Format("2006-01-02")+".json")
+
+	merged := make(map[userStatKey]*UserStat)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		var old rollupFile
+		if err := json.Unmarshal(data, &old); err != nil {
+			return fmt.Errorf("reading %v: %w", path, err)
+		}
+		for i := range old.Users {
+			u := old.Users[i]
+			merged[userStatKey{u.Side, u.ID}] = &u
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for k, u := range users {
+		if m, ok := merged[k]; ok {
+			m.merge(u)
+		} else {
+			merged[k] = u
+		}
+	}
+
+	out := rollupFile{Day: day.Format("2006-01-02")}
+	for _, u := range merged {
+		out.Users = append(out.Users, *u)
+	}
+	sort.Slice(out.Users, func(i, j int) bool {
+		return out.Users[i].SpeakingTime > out.Users[j].SpeakingTime
+	})
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RollupLoop writes the daily statistics to dir whenever the day changes, until done is closed.
+// The current day is written on exit.
+func (b *BridgeState) RollupLoop(dir string, done <-chan struct{}) {
+	if dir == "" || b.UserStats == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.UserStats.Rollup(dir, false); err != nil {
+				b.Log.Error("Failed to write user statistics", "dir", dir, "err", err)
+			}
+		case <-done:
+			if err := b.UserStats.Rollup(dir, true); err != nil {
+				b.Log.Error("Failed to write user statistics", "dir", dir, "err", err)
+			}
+			return
+		}
+	}
+}
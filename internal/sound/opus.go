@@ -0,0 +1,81 @@
+package sound
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/mumble-discord-bridge/pkg/ogg"
+)
+
+// maxOpusFrame is the largest Opus packet in samples per channel, 120ms at 48kHz
+const maxOpusFrame = 5760
+
+// decodeOpus decodes an Ogg/Opus stream with up to two channels, Opus always decodes at 48kHz
+func decodeOpus(r io.Reader) ([]int16, int, int, error) {
+	or := ogg.NewReader(r)
+	head, err := or.Packet()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return nil, 0, 0, fmt.Errorf("not an Ogg/Opus file: %w", ErrFormat)
+	}
+	channels := int(head[9])
+	preSkip := int(binary.LittleEndian.Uint16(head[10:]))
+	gain := int16(binary.LittleEndian.Uint16(head[16:]))
+	if channels < 1 || channels > 2 {
+		return nil, 0, 0, fmt.Errorf("opus: %v channels are not supported", channels)
+	}
+	// OpusTags
+	if _, err := or.Packet(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	dec, err := gopus.NewDecoder(SampleRate, channels)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var out []int16
+	for {
+		p, err := or.Packet()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		pcm, err := dec.Decode(p, maxOpusFrame, false)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		out = append(out, pcm...)
+	}
+
+	// The granule position of the last page marks the end of the audio
+	if end := int(or.Granule()) * channels; end >= 0 && end < len(out) {
+		out = out[:end]
+	}
+	if skip := preSkip * channels; skip < len(out) {
+		out = out[skip:]
+	} else {
+		out = out[:0]
+	}
+
+	if gain != 0 {
+		// Q7.8 dB
+		g := math.Pow(10, float64(gain)/(256*20))
+		for i, s := range out {
+			v := float64(s) * g
+			if v > math.MaxInt16 {
+				v = math.MaxInt16
+			} else if v < math.MinInt16 {
+				v = math.MinInt16
+			}
+			out[i] = int16(v)
+		}
+	}
+	return out, SampleRate, channels, nil
+}
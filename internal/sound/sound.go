@@ -0,0 +1,110 @@
+// Package sound loads WAV, Ogg/Opus and FLAC files as 48kHz mono samples, the format of the audio loops
+package sound
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/flac"
+	"github.com/stieneee/mumble-discord-bridge/pkg/wav"
+)
+
+// SampleRate of the loaded samples
+const SampleRate = 48000
+
+// MaxDuration limits the length of a file to bound the memory of a queue
+const MaxDuration = 10 * time.Minute
+
+// Extensions are the file extensions of the supported formats
+var Extensions = []string{".wav", ".ogg", ".opus", ".flac"}
+
+// ErrFormat is returned for files in an unsupported format
+var ErrFormat = errors.New("unsupported audio format, use WAV, Ogg/Opus or FLAC")
+
+// Load decodes the file at path
+func Load(path string) ([]int16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Decode(f)
+}
+
+// Decode detects the format of r and returns its audio as 48kHz mono samples
+func Decode(r io.Reader) ([]int16, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	var samples []int16
+	var rate, channels int
+	var err error
+	switch string(magic) {
+	case "RIFF":
+		samples, rate, channels, err = wav.Decode(br)
+	case "OggS":
+		samples, rate, channels, err = decodeOpus(br)
+	case "fLaC":
+		samples, rate, channels, err = flac.Decode(br)
+	default:
+		return nil, ErrFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d := time.Duration(len(samples)/channels) * time.Second / time.Duration(rate); d > MaxDuration {
+		return nil, fmt.Errorf("%v long, the limit is %v", d.Round(time.Second), MaxDuration)
+	}
+	return resample(downmix(samples, channels), rate), nil
+}
+
+// Supported reports if the file name has the extension of a supported format
+func Supported(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// downmix averages interleaved channels to mono
+func downmix(samples []int16, channels int) []int16 {
+	if channels == 1 {
+		return samples
+	}
+	out := make([]int16, len(samples)/channels)
+	for i := range out {
+		var sum int
+		for c := 0; c < channels; c++ {
+			sum += int(samples[i*channels+c])
+		}
+		out[i] = int16(sum / channels)
+	}
+	return out
+}
+
+// resample converts mono samples from rate to SampleRate by linear interpolation
+func resample(in []int16, rate int) []int16 {
+	if rate == SampleRate || len(in) == 0 {
+		return in
+	}
+	out := make([]int16, int64(len(in))*SampleRate/int64(rate))
+	for i := range out {
+		pos := int64(i) * int64(rate)
+		j, frac := pos/SampleRate, pos%SampleRate
+		a, b := int64(in[j]), int64(in[j])
+		if j+1 < int64(len(in)) {
+			b = int64(in[j+1])
+		}
+		out[i] = int16((a*(SampleRate-frac) + b*frac) / SampleRate)
+	}
+	return out
+}
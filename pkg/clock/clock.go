@@ -0,0 +1,71 @@
+// Package clock abstracts time for the audio loops.
+// Real uses the system clock, Virtual only moves when advanced and lets tests step the loops deterministically.
+package clock
+
+import "time"
+
+// Clock provides the time functions used by the audio loops
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// NewTimer returns a timer that sends the time on its channel after d
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine after d
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event timer, see time.Timer
+type Timer interface {
+	// C returns the channel the time is sent on, nil for AfterFunc timers
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if the timer already fired or was stopped
+	Stop() bool
+	// Reset changes the timer to fire after d, it returns false if the timer already fired or was stopped.
+	// As with time.Timer the channel must be drained before the reset.
+	Reset(d time.Duration) bool
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// OrReal returns c, or Real if c is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
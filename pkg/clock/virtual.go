@@ -0,0 +1,191 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Virtual is a clock that only moves when advanced.
+// Sleepers and timers fire when Advance moves the time past their deadline.
+// Woken goroutines all observe the time after the advance, so an advance longer than a
+// loop interval reproduces a late wake exactly.
+type Virtual struct {
+	mu       sync.Mutex
+	now      time.Time
+	waiters  []*waiter
+	seq      uint64
+	sleepers int
+	changed  chan struct{} // closed and replaced when the sleeper count changes
+}
+
+type waiter struct {
+	deadline time.Time
+	seq      uint64 // orders waiters with the same deadline
+	c        chan time.Time
+	f        func()
+	sleeper  bool // a goroutine is blocked in Sleep on c
+	clock    *Virtual
+}
+
+// NewVirtual returns a virtual clock set to start
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start, changed: make(chan struct{})}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+// Sleep blocks until the clock has been advanced by d
+func (v *Virtual) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	v.mu.Lock()
+	w := v.add(d, nil)
+	w.sleeper = true
+	v.sleepers++
+	v.notify()
+	v.mu.Unlock()
+
+	<-w.c
+}
+
+func (v *Virtual) NewTimer(d time.Duration) Timer {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.add(d, nil)
+}
+
+func (v *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.add(d, f)
+}
+
+// Advance moves the clock forward by d and fires every sleeper and timer that is due.
+// Woken sleepers are no longer counted by Sleepers once Advance returns.
+func (v *Virtual) Advance(d time.Duration) {
+	v.mu.Lock()
+	v.now = v.now.Add(d)
+	var due []*waiter
+	for len(v.waiters) > 0 && !v.waiters[0].deadline.After(v.now) {
+		w := v.waiters[0]
+		if w.sleeper {
+			v.sleepers--
+		}
+		due = append(due, w)
+		v.waiters = v.waiters[1:]
+	}
+	if len(due) > 0 {
+		v.notify()
+	}
+	now := v.now
+	v.mu.Unlock()
+
+	for _, w := range due {
+		w.fire(now)
+	}
+}
+
+// Sleepers returns the number of goroutines blocked in Sleep
+func (v *Virtual) Sleepers() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.sleepers
+}
+
+// BlockUntil waits until at least n goroutines are blocked in Sleep.
+// Stepping a loop is BlockUntil followed by Advance.
+func (v *Virtual) BlockUntil(n int) {
+	for {
+		v.mu.Lock()
+		if v.sleepers >= n {
+			v.mu.Unlock()
+			return
+		}
+		c := v.changed
+		v.mu.Unlock()
+		<-c
+	}
+}
+
+// add registers a waiter due after d, v.mu must be held
+func (v *Virtual) add(d time.Duration, f func()) *waiter {
+	w := &waiter{f: f, clock: v}
+	if f == nil {
+		w.c = make(chan time.Time, 1)
+	}
+	v.schedule(w, d)
+	return w
+}
+
+// schedule sets the deadline of w to d from now and adds it to the waiters, v.mu must be held
+func (v *Virtual) schedule(w *waiter, d time.Duration) {
+	v.seq++
+	w.deadline = v.now.Add(d)
+	w.seq = v.seq
+	if d <= 0 {
+		go w.fire(v.now)
+		return
+	}
+	i := sort.Search(len(v.waiters), func(i int) bool {
+		o := v.waiters[i]
+		return o.deadline.After(w.deadline) || (o.deadline.Equal(w.deadline) && o.seq > w.seq)
+	})
+	v.waiters = append(v.waiters, nil)
+	copy(v.waiters[i+1:], v.waiters[i:])
+	v.waiters[i] = w
+}
+
+// remove takes w out of the waiters, it returns false if w was not waiting. v.mu must be held.
+func (v *Virtual) remove(w *waiter) bool {
+	for i, o := range v.waiters {
+		if o == w {
+			v.waiters = append(v.waiters[:i], v.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// notify wakes BlockUntil callers, v.mu must be held
+func (v *Virtual) notify() {
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+func (w *waiter) fire(now time.Time) {
+	if w.f != nil {
+		go w.f()
+		return
+	}
+	// As with time.Timer the value is dropped if the last one was not received
+	select {
+	case w.c <- now:
+	default:
+	}
+}
+
+func (w *waiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *waiter) Stop() bool {
+	v := w.clock
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.remove(w)
+}
+
+func (w *waiter) Reset(d time.Duration) bool {
+	v := w.clock
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	active := v.remove(w)
+	v.schedule(w, d)
+	return active
+}
@@ -0,0 +1,102 @@
+package flac
+
+import (
+	"fmt"
+	"io"
+)
+
+// bitReader reads big endian bit fields. Reads past the end return zero and set err.
+type bitReader struct {
+	data []byte
+	pos  int  // current byte
+	bit  uint // bits of the current byte already read
+	err  error
+}
+
+func (br *bitReader) eof() bool {
+	if br.pos >= len(br.data) {
+		if br.err == nil {
+			br.err = io.ErrUnexpectedEOF
+		}
+		return true
+	}
+	return false
+}
+
+// read returns the next n bits, n at most 64
+func (br *bitReader) read(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		if br.eof() {
+			return 0
+		}
+		avail := 8 - int(br.bit)
+		take := avail
+		if take > n {
+			take = n
+		}
+		b := uint64(br.data[br.pos]) >> uint(avail-take) & (1<<uint(take) - 1)
+		v = v<<uint(take) | b
+		n -= take
+		br.bit += uint(take)
+		if br.bit == 8 {
+			br.bit = 0
+			br.pos++
+		}
+	}
+	return v
+}
+
+// signed returns the next n bits as a two's complement number
+func (br *bitReader) signed(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	v := br.read(n)
+	return int64(v<<uint(64-n)) >> uint(64-n)
+}
+
+// unary counts the zero bits before the next one bit
+func (br *bitReader) unary() int {
+	n := 0
+	for {
+		if br.eof() {
+			return n
+		}
+		if br.bit == 0 && br.data[br.pos] == 0 {
+			n += 8
+			br.pos++
+			continue
+		}
+		if br.read(1) == 1 {
+			return n
+		}
+		n++
+	}
+}
+
+// align skips to the next byte boundary
+func (br *bitReader) align() {
+	if br.bit != 0 {
+		br.bit = 0
+		br.pos++
+	}
+}
+
+// utf8 skips the UTF-8 like coded frame or sample number
+func (br *bitReader) utf8() error {
+	first := br.read(8)
+	n := 0
+	for first&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	if n == 1 || n > 7 {
+		return fmt.Errorf("flac: invalid coded number")
+	}
+	for i := 1; i < n; i++ {
+		if br.read(8)&0xc0 != 0x80 {
+			return fmt.Errorf("flac: invalid coded number")
+		}
+	}
+	return br.err
+}
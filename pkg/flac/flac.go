@@ -0,0 +1,392 @@
+// Package flac decodes FLAC files
+package flac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrFormat is returned for files that are not FLAC files
+var ErrFormat = errors.New("flac: not a flac file")
+
+// ErrChecksum is returned for frames with a wrong CRC
+var ErrChecksum = errors.New("flac: checksum mismatch")
+
+// StreamInfo holds the properties of a stream from its STREAMINFO block
+type StreamInfo struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	TotalSamples  int64 // per channel, 0 if unknown
+}
+
+// Decode reads a whole FLAC file and returns its interleaved samples as 16 bit
+func Decode(r io.Reader) (samples []int16, sampleRate, channels int, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	info, pos, err := readMetadata(data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	d := decoder{data: data, info: info}
+	if info.TotalSamples > 0 {
+		samples = make([]int16, 0, info.TotalSamples*int64(info.Channels))
+	}
+	for pos < len(data) {
+		if samples, pos, err = d.frame(pos, samples); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return samples, info.SampleRate, info.Channels, nil
+}
+
+// readMetadata parses the metadata blocks and returns the position of the first frame
+func readMetadata(data []byte) (StreamInfo, int, error) {
+	var info StreamInfo
+	if len(data) < 4 || string(data[:4]) != "fLaC" {
+		return info, 0, ErrFormat
+	}
+	pos := 4
+	haveInfo := false
+	for {
+		if pos+4 > len(data) {
+			return info, 0, fmt.Errorf("flac: truncated metadata")
+		}
+		last := data[pos]&0x80 != 0
+		typ := data[pos] & 0x7f
+		size := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+size > len(data) {
+			return info, 0, fmt.Errorf("flac: truncated metadata")
+		}
+		if typ == 0 {
+			if size < 34 {
+				return info, 0, fmt.Errorf("flac: short STREAMINFO")
+			}
+			b := data[pos:]
+			info.SampleRate = int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+			info.Channels = int(b[12]>>1&0x07) + 1
+			info.BitsPerSample = int(b[12]&0x01)<<4 | int(b[13]>>4) + 1
+			info.TotalSamples = int64(b[13]&0x0f)<<32 | int64(b[14])<<24 | int64(b[15])<<16 | int64(b[16])<<8 | int64(b[17])
+			haveInfo = true
+		}
+		pos += size
+		if last {
+			break
+		}
+	}
+	if !haveInfo {
+		return info, 0, fmt.Errorf("flac: missing STREAMINFO")
+	}
+	return info, pos, nil
+}
+
+type decoder struct {
+	data []byte
+	info StreamInfo
+	buf  [8][]int64
+}
+
+var blockSizes = [16]int{0, 192, 576, 1152, 2304, 4608, 0, 0, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
+
+var sampleRates = [12]int{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}
+
+var sampleSizes = [8]int{0, 8, 12, 0, 16, 20, 24, 32}
+
+// frame decodes the frame at pos and appends its samples
+func (d *decoder) frame(pos int, out []int16) ([]int16, int, error) {
+	start := pos
+	br := &bitReader{data: d.data, pos: pos}
+
+	if br.read(14) != 0x3ffe {
+		return nil, 0, fmt.Errorf("flac: lost frame sync at %v", pos)
+	}
+	br.read(2) // reserved, blocking strategy
+	bsCode := int(br.read(4))
+	rateCode := int(br.read(4))
+	chanCode := int(br.read(4))
+	sizeCode := int(br.read(3))
+	br.read(1)
+	if err := br.utf8(); err != nil {
+		return nil, 0, err
+	}
+
+	blockSize := blockSizes[bsCode]
+	switch bsCode {
+	case 0:
+		return nil, 0, fmt.Errorf("flac: reserved block size")
+	case 6:
+		blockSize = int(br.read(8)) + 1
+	case 7:
+		blockSize = int(br.read(16)) + 1
+	}
+
+	rate := d.info.SampleRate
+	switch {
+	case rateCode > 0 && rateCode < 12:
+		rate = sampleRates[rateCode]
+	case rateCode == 12:
+		rate = int(br.read(8)) * 1000
+	case rateCode == 13:
+		rate = int(br.read(16))
+	case rateCode == 14:
+		rate = int(br.read(16)) * 10
+	case rateCode == 15:
+		return nil, 0, fmt.Errorf("flac: invalid sample rate")
+	}
+	if rate != d.info.SampleRate {
+		return nil, 0, fmt.Errorf("flac: sample rate changes from %v to %v", d.info.SampleRate, rate)
+	}
+
+	bps := d.info.BitsPerSample
+	if sizeCode != 0 {
+		if bps = sampleSizes[sizeCode]; bps == 0 {
+			return nil, 0, fmt.Errorf("flac: reserved sample size")
+		}
+	}
+
+	channels := chanCode + 1
+	if chanCode > 7 {
+		if chanCode > 10 {
+			return nil, 0, fmt.Errorf("flac: reserved channel assignment")
+		}
+		channels = 2
+	}
+	if channels != d.info.Channels {
+		return nil, 0, fmt.Errorf("flac: channel count changes from %v to %v", d.info.Channels, channels)
+	}
+
+	if br.err != nil {
+		return nil, 0, br.err
+	}
+	if crc8(d.data[start:br.pos]) != byte(br.read(8)) {
+		return nil, 0, ErrChecksum
+	}
+
+	for c := 0; c < channels; c++ {
+		sbps := bps
+		// The side channel needs an extra bit
+		if (chanCode == 8 && c == 1) || (chanCode == 9 && c == 0) || (chanCode == 10 && c == 1) {
+			sbps++
+		}
+		if cap(d.buf[c]) < blockSize {
+			d.buf[c] = make([]int64, blockSize)
+		}
+		d.buf[c] = d.buf[c][:blockSize]
+		if err := subframe(br, d.buf[c], sbps); err != nil {
+			return nil, 0, err
+		}
+	}
+	br.align()
+	if br.err != nil {
+		return nil, 0, br.err
+	}
+	end := br.pos
+	if crc16(d.data[start:end]) != uint16(br.read(16)) {
+		return nil, 0, ErrChecksum
+	}
+	if br.err != nil {
+		return nil, 0, br.err
+	}
+
+	decorrelate(chanCode, d.buf[0], d.buf[1])
+
+	for i := 0; i < blockSize; i++ {
+		for c := 0; c < channels; c++ {
+			s := d.buf[c][i]
+			if bps > 16 {
+				s >>= uint(bps - 16)
+			} else {
+				s <<= uint(16 - bps)
+			}
+			out = append(out, int16(s))
+		}
+	}
+	return out, br.pos, nil
+}
+
+func decorrelate(chanCode int, a, b []int64) {
+	switch chanCode {
+	case 8: // left, side
+		for i := range a {
+			b[i] = a[i] - b[i]
+		}
+	case 9: // side, right
+		for i := range a {
+			a[i] += b[i]
+		}
+	case 10: // mid, side
+		for i := range a {
+			mid := a[i]<<1 | b[i]&1
+			side := b[i]
+			a[i] = (mid + side) >> 1
+			b[i] = (mid - side) >> 1
+		}
+	}
+}
+
+var fixedCoefficients = [5][]int64{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+func subframe(br *bitReader, s []int64, bps int) error {
+	if br.read(1) != 0 {
+		return fmt.Errorf("flac: invalid subframe padding")
+	}
+	typ := int(br.read(6))
+	wasted := 0
+	if br.read(1) == 1 {
+		wasted = br.unary() + 1
+		bps -= wasted
+	}
+
+	switch {
+	case typ == 0:
+		v := br.signed(bps)
+		for i := range s {
+			s[i] = v
+		}
+	case typ == 1:
+		for i := range s {
+			s[i] = br.signed(bps)
+		}
+	case typ >= 8 && typ <= 12:
+		order := typ - 8
+		if order > len(s) {
+			return fmt.Errorf("flac: predictor order %v above block size %v", order, len(s))
+		}
+		for i := 0; i < order; i++ {
+			s[i] = br.signed(bps)
+		}
+		if err := residual(br, s, order); err != nil {
+			return err
+		}
+		predict(s, order, fixedCoefficients[order], 0)
+	case typ >= 32:
+		order := typ - 31
+		if order > len(s) {
+			return fmt.Errorf("flac: predictor order %v above block size %v", order, len(s))
+		}
+		for i := 0; i < order; i++ {
+			s[i] = br.signed(bps)
+		}
+		precision := int(br.read(4)) + 1
+		if precision == 16 {
+			return fmt.Errorf("flac: invalid coefficient precision")
+		}
+		shift := br.signed(5)
+		if shift < 0 {
+			return fmt.Errorf("flac: negative prediction shift")
+		}
+		coefficients := make([]int64, order)
+		for i := range coefficients {
+			coefficients[i] = br.signed(precision)
+		}
+		if err := residual(br, s, order); err != nil {
+			return err
+		}
+		predict(s, order, coefficients, uint(shift))
+	default:
+		return fmt.Errorf("flac: reserved subframe type %v", typ)
+	}
+
+	if wasted > 0 {
+		for i := range s {
+			s[i] <<= uint(wasted)
+		}
+	}
+	return br.err
+}
+
+// predict adds the prediction to the residuals in s after the warm up samples
+func predict(s []int64, order int, coefficients []int64, shift uint) {
+	for i := order; i < len(s); i++ {
+		var sum int64
+		for j, c := range coefficients {
+			sum += c * s[i-j-1]
+		}
+		s[i] += sum >> shift
+	}
+}
+
+// residual decodes the Rice coded residual into s after the warm up samples
+func residual(br *bitReader, s []int64, order int) error {
+	method := br.read(2)
+	if method > 1 {
+		return fmt.Errorf("flac: reserved residual coding method")
+	}
+	paramBits, escape := 4, uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+	partitionOrder := uint(br.read(4))
+	partitions := 1 << partitionOrder
+	if len(s)%partitions != 0 || len(s)>>partitionOrder < order {
+		return fmt.Errorf("flac: invalid partition order %v", partitionOrder)
+	}
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		n := len(s) >> partitionOrder
+		if p == 0 {
+			n -= order
+		}
+		param := br.read(paramBits)
+		if param == escape {
+			bits := int(br.read(5))
+			for j := 0; j < n; j++ {
+				s[i] = br.signed(bits)
+				i++
+			}
+			continue
+		}
+		for j := 0; j < n; j++ {
+			v := uint64(br.unary())<<param | br.read(int(param))
+			s[i] = int64(v>>1) ^ -int64(v&1)
+			i++
+		}
+		if br.err != nil {
+			return br.err
+		}
+	}
+	return br.err
+}
+
+func crc8(b []byte) byte {
+	var c byte
+	for _, v := range b {
+		c ^= v
+		for i := 0; i < 8; i++ {
+			if c&0x80 != 0 {
+				c = c<<1 ^ 0x07
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return c
+}
+
+func crc16(b []byte) uint16 {
+	var c uint16
+	for _, v := range b {
+		c ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if c&0x8000 != 0 {
+				c = c<<1 ^ 0x8005
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return c
+}
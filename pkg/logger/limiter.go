@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter rate limits entries from a hot path.
+// At most one entry is written per interval, the number of entries
+// suppressed since the last write is added to the next entry as "suppressed".
+type Limiter struct {
+	l     *Logger
+	every time.Duration
+
+	mu         sync.Mutex
+	next       time.Time
+	suppressed int
+}
+
+// Every returns a Limiter writing at most one entry per interval d.
+// Each call site that should be limited independently needs its own Limiter.
+func (l *Logger) Every(d time.Duration) *Limiter {
+	return &Limiter{l: l, every: d}
+}
+
+func (r *Limiter) Debug(msg string, kv ...interface{}) { r.Log(LevelDebug, msg, kv...) }
+func (r *Limiter) Info(msg string, kv ...interface{})  { r.Log(LevelInfo, msg, kv...) }
+func (r *Limiter) Warn(msg string, kv ...interface{})  { r.Log(LevelWarn, msg, kv...) }
+func (r *Limiter) Error(msg string, kv ...interface{}) { r.Log(LevelError, msg, kv...) }
+
+// Log writes the entry if the interval has passed, otherwise counts it as suppressed.
+func (r *Limiter) Log(level Level, msg string, kv ...interface{}) {
+	if r == nil || !r.l.Enabled(level) {
+		return
+	}
+
+	r.mu.Lock()
+	now := r.l.sink.now()
+	if now.Before(r.next) {
+		r.suppressed++
+		r.mu.Unlock()
+		return
+	}
+	r.next = now.Add(r.every)
+	suppressed := r.suppressed
+	r.suppressed = 0
+	r.mu.Unlock()
+
+	if suppressed > 0 {
+		kv = append(kv, "suppressed", suppressed)
+	}
+	r.l.Log(level, msg, kv...)
+}
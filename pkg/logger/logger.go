@@ -0,0 +1,251 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) to a Level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format selects how entries are written.
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat converts a format name (text, json) to a Format.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text", "":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("unknown log format %q", s)
+}
+
+// sink is shared by a logger and all of its children.
+type sink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  Level
+	now    func() time.Time
+}
+
+// Logger writes leveled entries with a fixed set of key/value fields.
+// A nil *Logger is valid and discards everything.
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+// New creates a logger writing entries at or above level to w.
+func New(w io.Writer, format Format, level Level) *Logger {
+	return &Logger{
+		sink: &sink{
+			w:      w,
+			format: format,
+			level:  level,
+			now:    time.Now,
+		},
+	}
+}
+
+// With returns a child logger that adds the key/value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// SetLevel changes the minimum level for this logger and all loggers sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	if l == nil {
+		return
+	}
+	l.sink.mu.Lock()
+	l.sink.level = level
+	l.sink.mu.Unlock()
+}
+
+// Enabled reports whether an entry at level would be written.
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		return false
+	}
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	return level >= l.sink.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes a single entry. Keys are expected to be strings, an odd trailing value is logged under "!extra".
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if l == nil {
+		return
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	if level < l.sink.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	t := l.sink.now()
+	switch l.sink.format {
+	case FormatJSON:
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, t.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		eachField(l.fields, kv, func(k string, v interface{}) {
+			buf.WriteByte(',')
+			writeJSON(&buf, k)
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonValue(v))
+		})
+		buf.WriteString("}\n")
+	default:
+		buf.WriteString(t.Format("2006/01/02 15:04:05.000"))
+		buf.WriteByte(' ')
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+		eachField(l.fields, kv, func(k string, v interface{}) {
+			buf.WriteByte(' ')
+			buf.WriteString(k)
+			buf.WriteByte('=')
+			buf.WriteString(textValue(v))
+		})
+		buf.WriteByte('\n')
+	}
+
+	l.sink.w.Write(buf.Bytes())
+}
+
+// Writer returns an io.Writer that logs each line written to it at level.
+// It is intended for log.SetOutput so that libraries using the standard logger share the output.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.Log(level, line)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func eachField(fields, kv []interface{}, f func(k string, v interface{})) {
+	for _, list := range [][]interface{}{fields, kv} {
+		for i := 0; i < len(list); i += 2 {
+			if i+1 >= len(list) {
+				f("!extra", list[i])
+				break
+			}
+			k, ok := list[i].(string)
+			if !ok {
+				k = fmt.Sprint(list[i])
+			}
+			f(k, list[i+1])
+		}
+	}
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case time.Duration:
+		return x.String()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch x := v.(type) {
+	case string:
+		s = x
+	case error:
+		s = x.Error()
+	case nil:
+		s = "<nil>"
+	default:
+		s = fmt.Sprint(x)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,139 @@
+// Package ogg reads the packets of an Ogg stream
+package ogg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrFormat is returned for data that is not an Ogg stream
+var ErrFormat = errors.New("ogg: invalid page")
+
+// ErrChecksum is returned for pages with a wrong CRC
+var ErrChecksum = errors.New("ogg: checksum mismatch")
+
+const headerSize = 27
+
+var crcTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func crc(c uint32, b []byte) uint32 {
+	for _, v := range b {
+		c = c<<8 ^ crcTable[byte(c>>24)^v]
+	}
+	return c
+}
+
+// Reader returns the packets of the first logical stream, pages of other streams are skipped
+type Reader struct {
+	r       *bufio.Reader
+	serial  uint32
+	started bool
+	granule int64
+	packets [][]byte
+	partial []byte
+	eos     bool
+}
+
+// NewReader returns a Reader of the Ogg stream r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Granule returns the granule position of the last page read
+func (r *Reader) Granule() int64 {
+	return r.granule
+}
+
+// Packet returns the next packet, io.EOF after the last packet
+func (r *Reader) Packet() ([]byte, error) {
+	for len(r.packets) == 0 {
+		if r.eos {
+			return nil, io.EOF
+		}
+		if err := r.page(); err != nil {
+			if err == io.EOF && len(r.partial) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	p := r.packets[0]
+	r.packets = r.packets[1:]
+	return p, nil
+}
+
+// page reads the next page of the stream and queues its complete packets
+func (r *Reader) page() error {
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrFormat
+		}
+		return err
+	}
+	if string(h[0:4]) != "OggS" || h[4] != 0 {
+		return ErrFormat
+	}
+	segments := make([]byte, h[26])
+	if _, err := io.ReadFull(r.r, segments); err != nil {
+		return ErrFormat
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return ErrFormat
+	}
+
+	sum := binary.LittleEndian.Uint32(h[22:])
+	h[22], h[23], h[24], h[25] = 0, 0, 0, 0
+	if crc(crc(crc(0, h), segments), body) != sum {
+		return ErrChecksum
+	}
+
+	serial := binary.LittleEndian.Uint32(h[14:])
+	if !r.started {
+		r.serial = serial
+		r.started = true
+	}
+	if serial != r.serial {
+		return nil
+	}
+	if h[5]&0x01 == 0 {
+		// A page without continuation drops the unfinished packet of a lost page
+		r.partial = nil
+	}
+	if g := int64(binary.LittleEndian.Uint64(h[6:])); g != -1 {
+		r.granule = g
+	}
+
+	for _, s := range segments {
+		r.partial = append(r.partial, body[:s]...)
+		body = body[s:]
+		if s < 255 {
+			r.packets = append(r.packets, r.partial)
+			r.partial = nil
+		}
+	}
+	if h[5]&0x04 != 0 {
+		r.eos = true
+	}
+	return nil
+}
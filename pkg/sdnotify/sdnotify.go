@@ -0,0 +1,88 @@
+// Package sdnotify implements the systemd sd_notify protocol.
+// It sends state changes over the datagram socket systemd passes in NOTIFY_SOCKET.
+package sdnotify
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Ready tells systemd that service startup is finished
+	Ready = "READY=1"
+	// Stopping tells systemd that the service is beginning its shutdown
+	Stopping = "STOPPING=1"
+	// Reloading tells systemd that the service is reloading its configuration
+	Reloading = "RELOADING=1"
+	// Watchdog keeps the systemd watchdog from restarting the service
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status formats a free form status line shown by systemctl status
+func Status(s string) string {
+	return "STATUS=" + s
+}
+
+// Socket returns the notification socket path from the environment, empty if not running under systemd
+func Socket() string {
+	return os.Getenv("NOTIFY_SOCKET")
+}
+
+// Notify sends state to the socket in NOTIFY_SOCKET.
+// It returns false with no error when the socket is not set.
+func Notify(state string) (bool, error) {
+	socket := Socket()
+	if socket == "" {
+		return false, nil
+	}
+	if err := NotifySocket(socket, state); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NotifySocket sends state to the given socket path.
+// A leading '@' denotes a Linux abstract socket.
+func NotifySocket(socket, state string) error {
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if socket[0] == '@' {
+		addr.Name = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the watchdog timeout systemd expects pings within.
+// It returns 0 when the watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, errors.New("invalid WATCHDOG_PID " + pid)
+		}
+		if p != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	u, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || u <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC " + usec)
+	}
+	return time.Duration(u) * time.Microsecond, nil
+}
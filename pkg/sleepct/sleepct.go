@@ -3,26 +3,82 @@ package sleepct
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+)
+
+// CatchUp selects how a sleeper recovers from a late wake
+type CatchUp int
+
+const (
+	// CatchUpBurst fires the missed targets back to back
+	CatchUpBurst CatchUp = iota
+	// CatchUpSkip drops the missed targets and continues with the next target in the future
+	CatchUpSkip
+	// CatchUpResync bursts small lags and restarts the time base at the wake once the lag reaches the resync threshold
+	CatchUpResync
 )
 
+func (c CatchUp) String() string {
+	switch c {
+	case CatchUpBurst:
+		return "burst"
+	case CatchUpSkip:
+		return "skip"
+	case CatchUpResync:
+		return "resync"
+	}
+	return "unknown"
+}
+
+// ParseCatchUp converts a policy name (burst, skip, resync) to a CatchUp
+func ParseCatchUp(s string) (CatchUp, error) {
+	switch strings.TrimSpace(s) {
+	case "burst":
+		return CatchUpBurst, nil
+	case "skip":
+		return CatchUpSkip, nil
+	case "resync":
+		return CatchUpResync, nil
+	}
+	return CatchUpBurst, fmt.Errorf("invalid catch-up policy %q", s)
+}
+
 // SleepCT - Sleep constant time step crates a sleep based ticker.
 // designed to maintain a consistent sleep/tick interval.
 // The sleeper can be paused waiting to be signaled from another go routine.
 // This allows for the pausing of loops that do not have work to complete
 type SleepCT struct {
+	Clock           clock.Clock   // time source, the real clock if nil
+	CatchUp         CatchUp       // recovery from late wakes
+	ResyncThreshold time.Duration // lag at which CatchUpResync restarts the time base, at least one interval
+
 	d      time.Duration // desired duration between targets
 	t      time.Time     // last time target
 	resume chan bool
+	once   sync.Once // creates resume, Notify can be called before Start
 	wake   time.Time // last wake time
 	drift  int64     // last wake drift microseconds
+	paused int32     // 1 while waiting to be notified
+	stats  stats
+}
+
+func (s *SleepCT) resumeChan() chan bool {
+	s.once.Do(func() {
+		s.resume = make(chan bool, 2)
+	})
+	return s.resume
 }
 
 func (s *SleepCT) Start(d time.Duration) {
-	s.resume = make(chan bool, 2)
+	s.resumeChan()
 	if s.t.IsZero() {
 		s.d = d
-		s.t = time.Now()
+		s.t = clock.OrReal(s.Clock).Now()
 	} else {
 		panic("SleepCT already started")
 	}
@@ -30,11 +86,14 @@ func (s *SleepCT) Start(d time.Duration) {
 
 // Sleep to the next target duration.
 // If pause it set to true will sleep the duration and wait to be notified.
+// A notification received since the last call prevents the pause, so work published before
+// Notify is never missed. After a pause the loop returns immediately and the next target is a
+// full interval after the notification.
 // The notification channel will be cleared when the thread wakes.
 // SleepNextTarget should not be call more than once concurrently.
 func (s *SleepCT) SleepNextTarget(ctx context.Context, pause bool) int64 {
-
-	now := time.Now()
+	c := clock.OrReal(s.Clock)
+	now := c.Now()
 
 	// if target is zero safety net
 	if s.t.IsZero() {
@@ -46,29 +105,49 @@ func (s *SleepCT) SleepNextTarget(ctx context.Context, pause bool) int64 {
 	s.t = s.t.Add(s.d)
 
 	// Compute the desired sleep time to reach the target
-	d := time.Until(s.t)
+	d := s.t.Sub(now)
 
 	// Sleep
-	time.Sleep(d)
+	c.Sleep(d)
 
 	// record the wake time
-	s.wake = time.Now()
-	s.drift = s.wake.Sub(s.t).Microseconds()
+	s.wake = c.Now()
+	late := s.wake.Sub(s.t)
+	s.drift = late.Microseconds()
+
+	// A tick is missed when the following target passed before the wake
+	var missed uint64
+	if late >= s.d {
+		n := late / s.d
+		switch {
+		case s.CatchUp == CatchUpSkip:
+			s.t = s.t.Add(n * s.d)
+			missed = uint64(n)
+		case s.CatchUp == CatchUpResync && late >= s.ResyncThreshold:
+			s.t = s.wake
+			missed = uint64(n)
+		default:
+			missed = 1
+		}
+	}
+	s.stats.record(late, missed)
 
 	// fmt.Println(s.t.UnixMilli(), d.Milliseconds(), wake.UnixMilli(), drift, pause, len(s.resume))
 
 	// external pause control
 	if pause {
-		// don't pause if the notification channel has something
-		if len(s.resume) == 0 {
-			// fmt.Println("pause")
+		select {
+		case <-s.resume:
+			// notified while sleeping, don't pause
+		default:
+			atomic.StoreInt32(&s.paused, 1)
 			select {
 			case <-s.resume:
 			case <-ctx.Done():
-				// fmt.Println("sleepct ctx exit")
 			}
+			atomic.StoreInt32(&s.paused, 0)
 			// if we did pause set the last sleep target to now
-			s.t = time.Now()
+			s.t = c.Now()
 		}
 	}
 
@@ -83,10 +162,21 @@ func (s *SleepCT) SleepNextTarget(ctx context.Context, pause bool) int64 {
 }
 
 // Notify attempts to resume a paused sleeper.
+// Producers must publish their work before calling Notify.
 // It is safe to call notify from other processes and as often as desired.
 func (s *SleepCT) Notify() {
 	select {
-	case s.resume <- true:
+	case s.resumeChan() <- true:
 	default:
 	}
 }
+
+// Paused reports if the sleeper is waiting to be notified
+func (s *SleepCT) Paused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+// Stats returns the drift statistics of the sleeper
+func (s *SleepCT) Stats() Stats {
+	return s.stats.snapshot()
+}
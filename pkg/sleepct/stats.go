@@ -0,0 +1,61 @@
+package sleepct
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsWindow is the number of recent wakes the p99 drift is computed from
+const statsWindow = 1000
+
+// Stats are the wake drift statistics of a sleeper
+type Stats struct {
+	Wakes  uint64        // number of wakes
+	Missed uint64        // ticks whose following target passed before the wake
+	Max    time.Duration // largest drift
+	Mean   time.Duration // mean drift
+	P99    time.Duration // 99th percentile drift of the last statsWindow wakes
+}
+
+type stats struct {
+	mu     sync.Mutex
+	wakes  uint64
+	missed uint64
+	max    time.Duration
+	sum    time.Duration
+	recent [statsWindow]time.Duration
+}
+
+func (st *stats) record(drift time.Duration, missed uint64) {
+	st.mu.Lock()
+	st.recent[st.wakes%statsWindow] = drift
+	st.wakes++
+	st.missed += missed
+	st.sum += drift
+	if drift > st.max {
+		st.max = drift
+	}
+	st.mu.Unlock()
+}
+
+func (st *stats) snapshot() Stats {
+	st.mu.Lock()
+	r := Stats{Wakes: st.wakes, Missed: st.missed, Max: st.max}
+	n := st.wakes
+	if n > statsWindow {
+		n = statsWindow
+	}
+	recent := make([]time.Duration, n)
+	copy(recent, st.recent[:n])
+	if st.wakes > 0 {
+		r.Mean = st.sum / time.Duration(st.wakes)
+	}
+	st.mu.Unlock()
+
+	if n > 0 {
+		sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+		r.P99 = recent[(len(recent)*99-1)/100]
+	}
+	return r
+}
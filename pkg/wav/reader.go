@@ -0,0 +1,135 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Format tags of the fmt chunk
+const (
+	formatPCM        = 1
+	formatFloat      = 3
+	formatExtensible = 0xfffe
+)
+
+// ErrFormat is returned for files that are not WAV files
+var ErrFormat = errors.New("wav: not a wav file")
+
+// Decode reads a whole WAV file and returns its interleaved samples as 16 bit.
+// PCM with 8 to 32 bits and 32 or 64 bit float samples are supported.
+func Decode(r io.Reader) (samples []int16, sampleRate, channels int, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, 0, ErrFormat
+	}
+
+	var format, bits int
+	var haveFmt bool
+	data = data[12:]
+	for len(data) >= 8 {
+		id := string(data[0:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		body := data[8:]
+		if size > len(body) {
+			// Streamed files leave the sizes unset, take what is there
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, 0, fmt.Errorf("wav: short fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if format == formatExtensible && size >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+			haveFmt = true
+		case "data":
+			if !haveFmt {
+				return nil, 0, 0, fmt.Errorf("wav: data before fmt chunk")
+			}
+			samples, err = convert(body, format, bits)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			if channels < 1 || sampleRate < 1 {
+				return nil, 0, 0, fmt.Errorf("wav: invalid format, %v channels at %vHz", channels, sampleRate)
+			}
+			return samples[:len(samples)/channels*channels], sampleRate, channels, nil
+		}
+
+		// Chunks are padded to an even size
+		size += size & 1
+		if size+8 > len(data) {
+			break
+		}
+		data = data[size+8:]
+	}
+	return nil, 0, 0, fmt.Errorf("wav: no data chunk")
+}
+
+// convert decodes little endian samples to 16 bit
+func convert(b []byte, format, bits int) ([]int16, error) {
+	switch {
+	case format == formatPCM && bits == 8:
+		out := make([]int16, len(b))
+		for i, v := range b {
+			out[i] = int16(int(v)-128) << 8
+		}
+		return out, nil
+	case format == formatPCM && bits == 16:
+		out := make([]int16, len(b)/2)
+		for i := range out {
+			out[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+		}
+		return out, nil
+	case format == formatPCM && bits == 24:
+		out := make([]int16, len(b)/3)
+		for i := range out {
+			out[i] = int16(uint16(b[3*i+1]) | uint16(b[3*i+2])<<8)
+		}
+		return out, nil
+	case format == formatPCM && bits == 32:
+		out := make([]int16, len(b)/4)
+		for i := range out {
+			out[i] = int16(binary.LittleEndian.Uint32(b[4*i:]) >> 16)
+		}
+		return out, nil
+	case format == formatFloat && bits == 32:
+		out := make([]int16, len(b)/4)
+		for i := range out {
+			out[i] = floatSample(float64(math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))))
+		}
+		return out, nil
+	case format == formatFloat && bits == 64:
+		out := make([]int16, len(b)/8)
+		for i := range out {
+			out[i] = floatSample(math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:])))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("wav: unsupported format %v with %v bits", format, bits)
+}
+
+func floatSample(f float64) int16 {
+	f *= 32767
+	if f > 32767 {
+		return 32767
+	}
+	if f < -32768 {
+		return -32768
+	}
+	return int16(f)
+}
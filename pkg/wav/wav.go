@@ -0,0 +1,120 @@
+// Package wav writes 16 bit PCM WAV files
+package wav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// headerSize is the size of the RIFF, fmt and data chunk headers
+const headerSize = 44
+
+// maxDataSize is the largest data chunk the 32 bit RIFF sizes can describe
+const maxDataSize = 1<<32 - 1 - (headerSize - 8)
+
+// ErrTooLarge is returned when a write would exceed the 4GB limit of the format
+var ErrTooLarge = errors.New("wav: file too large")
+
+// Writer writes interleaved 16 bit samples. The chunk sizes are written by Close.
+type Writer struct {
+	ws       io.WriteSeeker
+	bw       *bufio.Writer
+	channels int
+	data     int64 // bytes in the data chunk
+	buf      []byte
+}
+
+// NewWriter writes a WAV header to ws and returns a Writer for the samples.
+// The header is rewritten on Close, ws must be positioned at its start.
+func NewWriter(ws io.WriteSeeker, sampleRate, channels int) (*Writer, error) {
+	w := &Writer{ws: ws, bw: bufio.NewWriterSize(ws, 64*1024), channels: channels}
+	if err := w.header(sampleRate); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) header(sampleRate int) error {
+	h := make([]byte, headerSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(headerSize-8+w.data))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*w.channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(w.channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(w.data))
+	_, err := w.bw.Write(h)
+	return err
+}
+
+// Write appends interleaved samples
+func (w *Writer) Write(samples []int16) error {
+	n := int64(len(samples)) * 2
+	if w.data+n > maxDataSize {
+		return ErrTooLarge
+	}
+	if cap(w.buf) < len(samples)*2 {
+		w.buf = make([]byte, len(samples)*2)
+	}
+	b := w.buf[:len(samples)*2]
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(s))
+	}
+	if _, err := w.bw.Write(b); err != nil {
+		return err
+	}
+	w.data += n
+	return nil
+}
+
+// WriteSilence appends n zero samples
+func (w *Writer) WriteSilence(n int) error {
+	var zero [480]int16
+	for n > 0 {
+		c := n
+		if c > len(zero) {
+			c = len(zero)
+		}
+		if err := w.Write(zero[:c]); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
+
+// Samples returns the number of samples written, counting all channels
+func (w *Writer) Samples() int64 {
+	return w.data / 2
+}
+
+// Close flushes the samples and writes the final chunk sizes. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.ws.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(headerSize-8+w.data))
+	if _, err := w.ws.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := w.ws.Seek(40, io.SeekStart); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(size[:], uint32(w.data))
+	if _, err := w.ws.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.ws.Seek(0, io.SeekEnd)
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// checkPeaks fails if a peak after the first frame, which ramps the gain, is outside min and max
+func checkPeaks(t *testing.T, what string, peaks []int, min, max int) {
+	t.Helper()
+	for _, p := range peaks[1:] {
+		if p < min || p > max {
+			t.Fatalf("%v: unexpected peaks %v", what, peaks)
+		}
+	}
+}
+
+func TestBridgeAGC(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.AGC = &bridge.AGC{Target: -20, MaxGain: 12, Adapt: 10 * time.Millisecond}
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	// A quiet speaker at -33 dBFS is raised by the max gain of 12 dB
+	sendDiscordTone(t, voice, 0, 10, 1000)
+	checkPeaks(t, "quiet", mumblePeaks(t, b, 20), 3900, 4050)
+
+	// A loud speaker at -7 dBFS is lowered by 12 dB
+	sendDiscordTone(t, voice, 10, 10, 20000)
+	checkPeaks(t, "loud", mumblePeaks(t, b, 20), 4950, 5100)
+
+	// The manual volume applies on top
+	b.DiscordUserVolumeMutex.Lock()
+	b.DiscordUserVolume["u1"] = 0.5
+	b.DiscordUserVolumeMutex.Unlock()
+	sendDiscordTone(t, voice, 20, 10, 20000)
+	checkPeaks(t, "volume", mumblePeaks(t, b, 20), 2450, 2550)
+
+	// The limiter keeps a raised spike from clipping
+	user := &gumble.User{Name: "bob", Session: 3}
+	c := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: c})
+	for i := 0; i < 10; i++ {
+		buf := make(gumble.AudioBuffer, 960)
+		for j := range buf {
+			buf[j] = 150
+		}
+		buf[100], buf[580] = 10000, 10000
+		c <- &gumble.AudioPacket{Sender: user, AudioBuffer: buf}
+	}
+	close(c)
+
+	peaks := discordPeaks(t, voice, 10)
+	checkPeaks(t, "limiter", peaks, 28900, 29000)
+}
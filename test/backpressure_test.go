@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// queueLost returns the frames lost by the full audio queues of a kind
+func queueLost(t *testing.T, b *bridgetest.Bridge, queue string) float64 {
+	t.Helper()
+	families, err := b.Metrics.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lost float64
+	for _, f := range families {
+		if f.GetName() != "mdb_queue_lost_count" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "queue" && l.GetValue() == queue {
+					lost += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return lost
+}
+
+func TestBridgeBackpressure(t *testing.T) {
+	for _, name := range []string{"drop-newest", "drop-oldest", "time-compress"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			policy, err := bridge.ParseBackpressurePolicy(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := bridgetest.NewBridge(nil)
+			b.BridgeConfig.Backpressure.FromMumble = policy
+			if !b.Start(bridgeTimeout) {
+				t.Fatal("bridge did not connect")
+			}
+			t.Cleanup(b.Stop)
+			voice := b.Discord.Voice()
+
+			// 75 packets of rising levels at once overflow the buffer of 100 blocks
+			user := &gumble.User{Name: "bob", Session: 3}
+			c := make(chan *gumble.AudioPacket, 75)
+			for i := 0; i < 75; i++ {
+				buf := make(gumble.AudioBuffer, 960)
+				for j := range buf {
+					buf[j] = int16(100 * (i + 1))
+				}
+				c <- &gumble.AudioPacket{Sender: user, AudioBuffer: buf}
+			}
+			close(c)
+			b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: c})
+
+			frames, err := voice.Capture(1500 * time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pcm []int16
+			for _, f := range frames {
+				for _, v := range f.PCM {
+					if v != 0 {
+						pcm = append(pcm, v)
+					}
+				}
+			}
+			if len(pcm) < 100*480 || len(pcm) > 106*480 {
+				t.Fatalf("relayed %v blocks", len(pcm)/480)
+			}
+			first, last := pcm[0], pcm[len(pcm)-1]
+			switch policy {
+			case bridge.DropNewest:
+				if first != 100 || last > 5600 {
+					t.Errorf("relayed %v to %v, expected the oldest audio", first, last)
+				}
+			case bridge.DropOldest:
+				if first == 100 || last != 7500 {
+					t.Errorf("relayed %v to %v, expected the newest audio", first, last)
+				}
+			case bridge.TimeCompress:
+				if first != 100 || last != 7500 {
+					t.Errorf("relayed %v to %v, expected all audio compressed", first, last)
+				}
+			}
+			if n := queueLost(t, b, "from_mumble"); n < 44 || n > 50 {
+				t.Errorf("%v lost blocks", n)
+			}
+		})
+	}
+
+	if _, err := bridge.ParseBackpressurePolicy("drop-all"); err == nil {
+		t.Error("invalid policy accepted")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/benchtiming"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+)
+
+func TestBenchTimingRun(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	done := make(chan benchtiming.Result)
+	go func() {
+		done <- benchtiming.Run(context.Background(), c, 100*time.Millisecond, 0)
+	}()
+
+	// All loops end on the last step
+	for i := 0; i < 10; i++ {
+		c.BlockUntil(3)
+		if i == 5 {
+			// Every loop wakes 5ms late for its 60ms target
+			c.Advance(15 * time.Millisecond)
+			c.BlockUntil(3)
+			c.Advance(5 * time.Millisecond)
+			i++
+			continue
+		}
+		c.Advance(10 * time.Millisecond)
+	}
+	r := <-done
+
+	if r.Duration != 100*time.Millisecond {
+		t.Errorf("measured %v", r.Duration)
+	}
+	send := r.Loop(benchtiming.LoopDiscordSend)
+	if send.Wakes != 5 || send.Missed != 0 || send.P50 != 0 || send.Max != 5*time.Millisecond {
+		t.Errorf("unexpected discord send result %+v", send)
+	}
+	for _, name := range []string{benchtiming.LoopDiscordMixer, benchtiming.LoopMumbleMixer} {
+		l := r.Loop(name)
+		if l.Wakes != 10 || l.Missed != 0 || l.P50 != 0 || l.P95 != 5*time.Millisecond || l.Max != 5*time.Millisecond {
+			t.Errorf("unexpected %v result %+v", name, l)
+		}
+	}
+}
+
+func TestBenchTimingRunMumbleFrame(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	done := make(chan benchtiming.Result)
+	go func() {
+		done <- benchtiming.Run(context.Background(), c, 80*time.Millisecond, 40*time.Millisecond)
+	}()
+	for i := 0; i < 8; i++ {
+		c.BlockUntil(3)
+		c.Advance(10 * time.Millisecond)
+	}
+	r := <-done
+
+	mixer := r.Loop(benchtiming.LoopDiscordMixer)
+	if mixer.Interval != 40*time.Millisecond || mixer.Wakes != 2 {
+		t.Errorf("unexpected discord mixer result %+v", mixer)
+	}
+	if send := r.Loop(benchtiming.LoopDiscordSend); send.Interval != 20*time.Millisecond || send.Wakes != 4 {
+		t.Errorf("unexpected discord send result %+v", send)
+	}
+	// A buffer shorter than the frame is raised like the bridge does
+	r = benchtiming.Result{Loops: []benchtiming.LoopResult{{Name: benchtiming.LoopDiscordMixer, Interval: 60 * time.Millisecond}}}
+	if rec := r.Recommend(); rec.ToMumbleBuffer != 60*time.Millisecond {
+		t.Errorf("recommended %+v for 60ms frames", rec)
+	}
+}
+
+func TestBenchTimingRecommend(t *testing.T) {
+	r := benchtiming.Result{Loops: []benchtiming.LoopResult{
+		{Name: benchtiming.LoopDiscordSend, P999: 4 * time.Millisecond},
+		{Name: benchtiming.LoopMumbleMixer, P999: 7 * time.Millisecond},
+		{Name: benchtiming.LoopDiscordMixer, P999: 12 * time.Millisecond},
+	}}
+	expected := benchtiming.Recommendation{
+		ToDiscordBuffer: 50 * time.Millisecond, // 4+7+30 rounded up
+		ToMumbleBuffer:  50 * time.Millisecond, // 12+30 rounded up
+	}
+	if rec := r.Recommend(); rec != expected {
+		t.Errorf("recommended %+v, expected %+v", rec, expected)
+	}
+
+	idle := benchtiming.Result{}.Recommend()
+	if idle.ToDiscordBuffer != benchtiming.NetworkAllowance || idle.ToMumbleBuffer != benchtiming.NetworkAllowance {
+		t.Errorf("recommended %+v without host drift", idle)
+	}
+}
+
+func TestBenchTimingWriteConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	rec := benchtiming.Recommendation{ToDiscordBuffer: 60 * time.Millisecond, ToMumbleBuffer: 40 * time.Millisecond}
+
+	if err := benchtiming.WriteConfig(path, rec); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "TO_DISCORD_BUFFER=60\nTO_MUMBLE_BUFFER=40\n" {
+		t.Errorf("new config %q", data)
+	}
+
+	existing := "DISCORD_TOKEN=secret\nexport TO_MUMBLE_BUFFER=50\n# TO_DISCORD_BUFFER=10\nMODE=auto\n"
+	if err := ioutil.WriteFile(path, []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := benchtiming.WriteConfig(path, rec); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	expected := "DISCORD_TOKEN=secret\nTO_MUMBLE_BUFFER=40\n# TO_DISCORD_BUFFER=10\nMODE=auto\nTO_DISCORD_BUFFER=60\n"
+	if string(data) != expected {
+		t.Errorf("updated config %q, expected %q", data, expected)
+	}
+}
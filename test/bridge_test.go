@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+const bridgeTimeout = 2 * time.Second
+
+func startTestBridge(t *testing.T) *bridgetest.Bridge {
+	t.Helper()
+	b := bridgetest.NewBridge(nil)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	return b
+}
+
+func TestBridgeDiscordToMumble(t *testing.T) {
+	testDiscordToMumble(t, startTestBridge(t))
+}
+
+// testDiscordToMumble sends a tone from a discord user and expects it on mumble
+func testDiscordToMumble(t *testing.T, b *bridgetest.Bridge) {
+	t.Helper()
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		opus, err := enc.Encode(bridgetest.Tone(440, 8000, i*960, 960), 960, 3840)
+		if err != nil {
+			t.Fatal(err)
+		}
+		voice.Recv <- &discordgo.Packet{SSRC: 1234, Sequence: uint16(i), Timestamp: uint32(i * 960), Opus: opus}
+	}
+
+	audio := b.Mumble.Client().Audio()
+	max := 0
+	timeout := time.After(bridgeTimeout)
+	for frames := 0; frames < 20; frames++ {
+		select {
+		case buf := <-audio:
+			if len(buf) != 480 {
+				t.Fatalf("expected 10ms frames, got %v samples", len(buf))
+			}
+			if p := bridgetest.Peak(buf); p > max {
+				max = p
+			}
+		case <-timeout:
+			t.Fatalf("received %v frames on mumble", frames)
+		}
+	}
+	if max < 2000 {
+		t.Errorf("mumble audio peak %v, expected the tone", max)
+	}
+
+	stats := b.UserStats.Snapshot()
+	if len(stats) != 1 || stats[0].ID != "u1" || stats[0].Name != "alice" || stats[0].Packets != 20 {
+		t.Errorf("unexpected user stats %+v", stats)
+	}
+}
+
+func TestBridgeMumbleToDiscord(t *testing.T) {
+	testMumbleToDiscord(t, startTestBridge(t))
+}
+
+// testMumbleToDiscord sends a tone from a mumble user and expects it on discord
+func testMumbleToDiscord(t *testing.T, b *bridgetest.Bridge) {
+	t.Helper()
+	user := &gumble.User{Name: "bob", Session: 7}
+	c := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: c})
+	for i := 0; i < 25; i++ {
+		c <- &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 8000, i*960, 960)}
+	}
+	defer close(c)
+
+	dec, err := gopus.NewDecoder(48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voice := b.Discord.Voice()
+	max := 0
+	timeout := time.After(bridgeTimeout)
+	for frames := 0; frames < 10; frames++ {
+		select {
+		case opus := <-voice.Sent:
+			pcm, err := dec.Decode(opus, 960, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := bridgetest.Peak(pcm); p > max {
+				max = p
+			}
+		case <-timeout:
+			t.Fatalf("received %v opus frames on discord", frames)
+		}
+	}
+	if max < 2000 {
+		t.Errorf("discord audio peak %v, expected the tone", max)
+	}
+	if speaking, _ := voice.IsSpeaking(); !speaking {
+		t.Error("expected the bot to be speaking on discord")
+	}
+}
+
+func TestBridgeStopDisconnects(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	voice := b.Discord.Voice()
+	b.Stop()
+	if !b.WaitConnected(false, bridgeTimeout) {
+		t.Fatal("bridge still connected")
+	}
+	if !voice.Disconnected() {
+		t.Error("discord voice not disconnected")
+	}
+	if _, ok := <-b.Mumble.Client().Audio(); ok {
+		t.Error("expected the mumble audio channel to be closed")
+	}
+}
+
+func TestBridgeStopBridge(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Mode = bridge.BridgeModeManual
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	if !b.StopBridge() {
+		t.Fatal("stop of a running bridge returned false")
+	}
+	if !b.WaitConnected(false, bridgeTimeout) {
+		t.Fatal("bridge still connected")
+	}
+
+	// Stopping a bridge that is already down neither blocks nor panics, and does not restart it
+	done := make(chan bool)
+	go func() {
+		done <- b.StopBridge()
+	}()
+	select {
+	case stopped := <-done:
+		if stopped {
+			t.Error("stop of a stopped bridge returned true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stop of a stopped bridge blocked")
+	}
+	b.SetDirection(bridge.DirectionMumbleToDiscord, "test")
+	if b.Mumble.Dials() != 1 {
+		t.Errorf("%v dials, expected the stopped bridge to stay down", b.Mumble.Dials())
+	}
+}
+
+func TestBridgeStartFailure(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Mumble.FailDial(errors.New("test failure"))
+	b.StartBridge()
+	if b.Mumble.Dials() != 0 {
+		t.Error("unexpected mumble connection")
+	}
+	if !b.Discord.Voice().Disconnected() {
+		t.Error("discord voice left connected after mumble failure")
+	}
+	r := b.Liveness()
+	if r.Connected {
+		t.Error("bridge reported connected")
+	}
+}
+
+func voiceUpdate(b *bridgetest.Bridge) {
+	b.DiscordListener.VoiceUpdate(nil, &discordgo.VoiceStateUpdate{
+		VoiceState: &discordgo.VoiceState{GuildID: bridgetest.GuildID},
+	})
+}
+
+func TestDiscordListenerJoinLeave(t *testing.T) {
+	b := startTestBridge(t)
+	b.Discord.AddUser("u1", "alice")
+
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	b.Discord.SetVoiceState(bridgetest.GuildID, bridgetest.BotID, bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", "")
+	voiceUpdate(b)
+
+	msgs := b.Mumble.ChannelMessages()
+	expected := []string{"alice has joined Discord\n", "alice has left Discord channel\n"}
+	if strings.Join(msgs, "|") != strings.Join(expected, "|") {
+		t.Errorf("mumble messages %q, expected %q", msgs, expected)
+	}
+}
+
+func TestDiscordListenerCommands(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	send := func(author, content string) {
+		b.DiscordListener.MessageCreate(nil, &discordgo.MessageCreate{Message: &discordgo.Message{
+			ChannelID: bridgetest.TextChannelID,
+			Content:   content,
+			Author:    &discordgo.User{ID: author},
+		}})
+	}
+
+	send(bridgetest.BotID, "!mumble-discord stats")
+	send("u1", "!mumble-discord link")
+	send("u1", "!mumble-discord stats")
+	// Changing the bridge needs the user in the bridged voice channel
+	send("u1", "!mumble-discord direction mumble-to-discord")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	send("u1", "!mumble-discord direction")
+
+	msgs := b.Discord.Messages()
+	if len(msgs) != 4 {
+		t.Fatalf("unexpected discord messages %+v", msgs)
+	}
+	if msgs[0].ChannelID != bridgetest.TextChannelID || !strings.HasPrefix(msgs[0].Content, "Constant mode enabled") {
+		t.Errorf("unexpected reply to link %+v", msgs[0])
+	}
+	if msgs[1].Content != "No audio statistics recorded today" {
+		t.Errorf("unexpected reply to stats %+v", msgs[1])
+	}
+	if msgs[2].Content != "Join the bridged voice channel to use this command" {
+		t.Errorf("unexpected reply to direction %+v", msgs[2])
+	}
+	if !strings.Contains(msgs[3].Content, "both") {
+		t.Errorf("unexpected reply to direction %+v", msgs[3])
+	}
+
+	// Commands from other guilds are ignored
+	b.Discord.AddChannel("g2", "t2", "general", discordgo.ChannelTypeGuildText)
+	b.Discord.SetVoiceState("g2", "u1", bridgetest.VoiceChannelID)
+	for _, c := range []string{"!mumble-discord sound list", "!mumble-discord stats"} {
+		b.DiscordListener.MessageCreate(nil, &discordgo.MessageCreate{Message: &discordgo.Message{
+			ChannelID: "t2",
+			Content:   c,
+			Author:    &discordgo.User{ID: "u1"},
+		}})
+	}
+	if msgs := b.Discord.Messages(); len(msgs) != 4 {
+		t.Errorf("reply to a command from another guild %+v", msgs[4:])
+	}
+}
+
+func TestMumbleListenerCommands(t *testing.T) {
+	b := startTestBridge(t)
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+
+	sender := &gumble.User{Name: "bob", Session: 9}
+	send := func(msg string) {
+		b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: sender, Message: msg}})
+	}
+
+	send("/users")
+	send("/volume u1 50")
+	send("/volume nobody 50")
+
+	msgs := b.Mumble.UserMessages(sender.Session)
+	expected := []string{
+		"Current users in discord:<br/>alice → u1<br/>",
+		"Volume changed for u1",
+		"Invalid user! use '/users' to get a list of users",
+	}
+	if strings.Join(msgs, "|") != strings.Join(expected, "|") {
+		t.Errorf("mumble replies %q, expected %q", msgs, expected)
+	}
+
+	b.DiscordUserVolumeMutex.RLock()
+	volume := b.DiscordUserVolume["u1"]
+	b.DiscordUserVolumeMutex.RUnlock()
+	if volume != 0.5 {
+		t.Errorf("volume %v, expected 0.5", volume)
+	}
+}
+
+func TestMumbleListenerChannelCommands(t *testing.T) {
+	b := startTestBridge(t)
+	b.Mumble.SetSelfChannel(3)
+
+	// Changing the bridge needs the user in the bridged channel
+	outside := &gumble.User{Name: "bob", Session: 9, Channel: &gumble.Channel{ID: 0, Name: "Root"}}
+	inside := &gumble.User{Name: "carol", Session: 10, Channel: &gumble.Channel{ID: 3, Name: "Bridge"}}
+	for _, msg := range []string{"/record start", "/clip 5", "/sound list", "/direction mumble-to-discord"} {
+		b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: outside, Message: msg}})
+	}
+	b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: inside, Message: "/direction"}})
+
+	for _, msg := range b.Mumble.UserMessages(outside.Session) {
+		if msg != "Join the bridged channel to use this command" {
+			t.Errorf("unexpected reply %q", msg)
+		}
+	}
+	if n := len(b.Mumble.UserMessages(outside.Session)); n != 4 {
+		t.Errorf("%v replies, expected 4", n)
+	}
+	if msgs := b.Mumble.UserMessages(inside.Session); len(msgs) != 1 || !strings.Contains(msgs[0], "both") {
+		t.Errorf("unexpected replies to direction %q", msgs)
+	}
+}
+
+func TestMumbleListenerUserChange(t *testing.T) {
+	b := startTestBridge(t)
+	b.BridgeConfig.DiscordDmSpamming = true
+	b.BridgeConfig.DiscordSpamChannel = bridgetest.TextChannelID
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+
+	b.Mumble.SetUsers("bob")
+	user := &gumble.User{Name: "bob", Session: 9}
+	b.MumbleListener.MumbleUserChange(&gumble.UserChangeEvent{User: user, Type: gumble.UserChangeConnected})
+
+	b.MumbleUsersMutex.Lock()
+	tracked := b.MumbleUsers["bob"]
+	b.MumbleUsersMutex.Unlock()
+	if !tracked {
+		t.Error("bob not tracked as mumble user")
+	}
+
+	replies := b.Mumble.UserMessages(user.Session)
+	if len(replies) != 2 || replies[1] != "Connected to Discord: alice" {
+		t.Errorf("unexpected welcome messages %q", replies)
+	}
+
+	msgs := b.Discord.Messages()
+	if len(msgs) != 2 || msgs[0].ChannelID != "dm:u1" || msgs[1].ChannelID != bridgetest.TextChannelID || msgs[1].Content != "bob has joined mumble" {
+		t.Errorf("unexpected discord notices %+v", msgs)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
+)
+
+func TestSleepCTCatchUp(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		policy    sleepct.CatchUp
+		threshold time.Duration
+		steps     []time.Duration
+		drifts    []int64
+	}{
+		// A 35ms late wake of a 10ms loop with the target at 10ms, the targets at 20ms and 30ms are missed
+		{"burst", sleepct.CatchUpBurst, 0, []time.Duration{35 * ms, 5 * ms}, []int64{25000, 15000, 5000, 0}},
+		{"skip", sleepct.CatchUpSkip, 0, []time.Duration{35 * ms, 5 * ms}, []int64{25000, 0}},
+		{"resync", sleepct.CatchUpResync, 20 * ms, []time.Duration{35 * ms, 10 * ms}, []int64{25000, 0}},
+		{"resync below threshold", sleepct.CatchUpResync, 50 * ms, []time.Duration{35 * ms, 5 * ms}, []int64{25000, 15000, 5000, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := sleepct.SleepCT{CatchUp: tt.policy, ResyncThreshold: tt.threshold}
+			drifts := stepSleepCT(t, &s, tt.steps, len(tt.drifts))
+			if !reflect.DeepEqual(drifts, tt.drifts) {
+				t.Errorf("drifts %v, expected %v", drifts, tt.drifts)
+			}
+			if missed := s.Stats().Missed; missed != 2 {
+				t.Errorf("%v missed ticks, expected 2", missed)
+			}
+		})
+	}
+}
+
+func TestParseCatchUp(t *testing.T) {
+	for _, p := range []sleepct.CatchUp{sleepct.CatchUpBurst, sleepct.CatchUpSkip, sleepct.CatchUpResync} {
+		if parsed, err := sleepct.ParseCatchUp(p.String()); err != nil || parsed != p {
+			t.Errorf("%v parsed as %v, %v", p, parsed, err)
+		}
+	}
+	if _, err := sleepct.ParseCatchUp("later"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestSleepCTStats(t *testing.T) {
+	ms := time.Millisecond
+	var steps []time.Duration
+	for i := 0; i < 9; i++ {
+		steps = append(steps, 10*ms)
+	}
+	steps = append(steps, 35*ms, 5*ms)
+
+	s := sleepct.SleepCT{}
+	stepSleepCT(t, &s, steps, 13)
+	expected := sleepct.Stats{
+		Wakes:  13,
+		Missed: 2,
+		Max:    25 * ms,
+		Mean:   45 * ms / 13,
+		P99:    25 * ms,
+	}
+	if st := s.Stats(); st != expected {
+		t.Errorf("stats %+v, expected %+v", st, expected)
+	}
+}
+
+func TestSleepCTStatsWindow(t *testing.T) {
+	// The late wake leaves the p99 window after 1000 on time wakes
+	steps := []time.Duration{20 * time.Millisecond}
+	for i := 0; i < 1000; i++ {
+		steps = append(steps, 10*time.Millisecond)
+	}
+
+	s := sleepct.SleepCT{CatchUp: sleepct.CatchUpSkip}
+	stepSleepCT(t, &s, steps, len(steps))
+	st := s.Stats()
+	if st.Max != 10*time.Millisecond || st.P99 != 0 {
+		t.Errorf("stats %+v, expected a max of 10ms and a p99 of 0", st)
+	}
+}
+
+// loopMetric returns the value of a gauge or counter of an audio loop
+func loopMetric(t *testing.T, b *bridgetest.Bridge, name, loop string) (float64, bool) {
+	t.Helper()
+	families, err := b.Metrics.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "loop" && l.GetValue() == loop {
+					if m.GetCounter() != nil {
+						return m.GetCounter().GetValue(), true
+					}
+					return m.GetGauge().GetValue(), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestBridgeTimerMetrics(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.TimerCatchUp = sleepct.CatchUpSkip
+	b.Clock = c
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(func() { stopVirtual(b, c) })
+
+	for i := 0; i < 10; i++ {
+		c.BlockUntil(3)
+		c.Advance(10 * time.Millisecond)
+	}
+	c.BlockUntil(3)
+	c.Advance(35 * time.Millisecond)
+	c.BlockUntil(3)
+
+	expected := []struct {
+		name, loop string
+		value      float64
+	}{
+		{"mdb_timer_missed_ticks", "mumble_mixer", 2},
+		{"mdb_timer_missed_ticks", "discord_mixer", 2},
+		{"mdb_timer_missed_ticks", "discord_send", 0},
+		{"mdb_timer_drift_max", "mumble_mixer", 25000},
+		{"mdb_timer_drift_max", "discord_send", 15000},
+		{"mdb_timer_drift_p99", "discord_mixer", 25000},
+	}
+	// The metrics are updated by the bridge monitor every 500ms
+	waitFor(t, "timer metrics", func() bool {
+		for _, e := range expected {
+			if v, ok := loopMetric(t, b, e.name, e.loop); !ok || v != e.value {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// activeFrames returns the value of the first n frames received on mumble that are not silent
+func activeFrames(t *testing.T, b *bridgetest.Bridge, n int) []int16 {
+	t.Helper()
+	var values []int16
+	audio := b.Mumble.Client().Audio()
+	timeout := time.After(bridgeTimeout)
+	for len(values) < n {
+		select {
+		case buf := <-audio:
+			if bridgetest.Peak(buf) > 0 {
+				values = append(values, buf[0])
+			}
+		case <-timeout:
+			t.Fatalf("received %v frames on mumble", values)
+		}
+	}
+	return values
+}
+
+func TestBridgeChimes(t *testing.T) {
+	dir := t.TempDir()
+	join := filepath.Join(dir, "join.wav")
+	writeWAVFile(t, join, 48000, 1, append(constFrame(1000), constFrame(1000)...))
+	// The TTS command prints the file named like the user
+	speech := filepath.Join(dir, "alice.wav")
+	writeWAVFile(t, speech, 48000, 1, append(constFrame(2000), constFrame(2000)...))
+
+	chimes, err := bridge.NewChimes(join, "", "cat {name}", 0.5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bridgetest.NewBridge(nil)
+	b.Chimes = chimes
+	// Ignored while the bridge is not running
+	chimes.Event(bridge.ChimeJoin, "discord", speech)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	// A Discord user joining plays the chime and then the speech to Mumble, at half volume
+	b.Discord.AddUser("u1", speech)
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	if values := activeFrames(t, b, 4); values[0] != 500 || values[1] != 500 || values[2] != 1000 || values[3] != 1000 {
+		t.Errorf("unexpected mumble audio %v", values)
+	}
+
+	// Leaving has no chime, only the speech is played
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", "")
+	voiceUpdate(b)
+	if values := activeFrames(t, b, 2); values[0] != 1000 || values[1] != 1000 {
+		t.Errorf("unexpected mumble audio %v", values)
+	}
+
+	// A Mumble user joining is announced on Discord
+	b.MumbleListener.MumbleUserChange(&gumble.UserChangeEvent{
+		User: &gumble.User{Name: speech, Session: 3},
+		Type: gumble.UserChangeConnected,
+	})
+	voice := b.Discord.Voice()
+	select {
+	case <-voice.Sent:
+	case <-time.After(bridgeTimeout):
+		t.Fatal("no chime on discord")
+	}
+}
+
+func TestChimesMissingFile(t *testing.T) {
+	if _, err := bridge.NewChimes("", filepath.Join(t.TempDir(), "missing.wav"), "", 1, nil); err == nil {
+		t.Error("expected an error for a missing chime")
+	}
+}
+
+func TestChimesDashName(t *testing.T) {
+	dir := t.TempDir()
+	join := filepath.Join(dir, "join.wav")
+	writeWAVFile(t, join, 48000, 1, append(constFrame(1000), constFrame(1000)...))
+	writeWAVFile(t, filepath.Join(dir, "-bob"), 48000, 1, append(constFrame(2000), constFrame(2000)...))
+	writeWAVFile(t, filepath.Join(dir, "carol"), 48000, 1, append(constFrame(3000), constFrame(3000)...))
+
+	chimes, err := bridge.NewChimes(join, "", "cat "+dir+"/{name}", 0.5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bridgetest.NewBridge(nil)
+	b.Chimes = chimes
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	// A name that could be read as an option only plays the chime
+	b.Discord.AddUser("u1", "-bob")
+	b.Discord.AddUser("u2", "carol")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u2", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	// The two events run in either order
+	counts := make(map[int16]int)
+	values := activeFrames(t, b, 6)
+	for _, v := range values {
+		counts[v]++
+	}
+	if counts[500] != 4 || counts[1500] != 2 {
+		t.Errorf("unexpected mumble audio %v", values)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
+)
+
+var epoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestVirtualClock(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+
+	timer := c.NewTimer(20 * time.Millisecond)
+	stopped := c.NewTimer(20 * time.Millisecond)
+	fired := make(chan bool, 1)
+	c.AfterFunc(30*time.Millisecond, func() { fired <- true })
+
+	woke := make(chan time.Time)
+	go func() {
+		c.Sleep(10 * time.Millisecond)
+		woke <- c.Now()
+	}()
+	c.BlockUntil(1)
+
+	c.Advance(5 * time.Millisecond)
+	if c.Sleepers() != 1 {
+		t.Fatal("sleeper woke early")
+	}
+	c.Advance(5 * time.Millisecond)
+	if c.Sleepers() != 0 {
+		t.Fatal("sleeper still counted after its deadline")
+	}
+	if now := <-woke; !now.Equal(epoch.Add(10 * time.Millisecond)) {
+		t.Errorf("woke at %v", now)
+	}
+
+	if !stopped.Stop() {
+		t.Error("stop of a pending timer returned false")
+	}
+	c.Advance(10 * time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(epoch.Add(20 * time.Millisecond)) {
+			t.Errorf("timer fired at %v", now)
+		}
+	default:
+		t.Error("timer did not fire")
+	}
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+	if timer.Stop() {
+		t.Error("stop of a fired timer returned true")
+	}
+
+	c.Advance(10 * time.Millisecond)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Error("AfterFunc did not run")
+	}
+
+	// A fired and received timer is reused
+	if timer.Reset(10 * time.Millisecond) {
+		t.Error("reset of a fired timer returned true")
+	}
+	if !timer.Reset(20 * time.Millisecond) {
+		t.Error("reset of a pending timer returned false")
+	}
+	c.Advance(10 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Error("reset timer fired at its old deadline")
+	default:
+	}
+	c.Advance(10 * time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(epoch.Add(50 * time.Millisecond)) {
+			t.Errorf("reset timer fired at %v", now)
+		}
+	default:
+		t.Error("reset timer did not fire")
+	}
+
+	// A timer firing again before its last value was received does not block the clock
+	timer.Reset(10 * time.Millisecond)
+	c.Advance(10 * time.Millisecond)
+	timer.Reset(10 * time.Millisecond)
+	advanced := make(chan bool)
+	go func() {
+		c.Advance(10 * time.Millisecond)
+		advanced <- true
+	}()
+	select {
+	case <-advanced:
+	case <-time.After(time.Second):
+		t.Fatal("advance blocked on an undrained timer")
+	}
+	if now := <-timer.C(); !now.Equal(epoch.Add(60 * time.Millisecond)) {
+		t.Errorf("undrained timer holds %v", now)
+	}
+}
+
+// stepSleepCT runs a 10ms SleepCT loop on a virtual clock and returns the drift of every wake
+func stepSleepCT(t *testing.T, s *sleepct.SleepCT, steps []time.Duration, wakes int) []int64 {
+	t.Helper()
+	c := clock.NewVirtual(epoch)
+	s.Clock = c
+	s.Start(10 * time.Millisecond)
+
+	drifts := make(chan int64, wakes)
+	go func() {
+		for i := 0; i < wakes; i++ {
+			drifts <- s.SleepNextTarget(context.Background(), false)
+		}
+	}()
+
+	for _, d := range steps {
+		c.BlockUntil(1)
+		c.Advance(d)
+	}
+
+	var out []int64
+	for i := 0; i < wakes; i++ {
+		select {
+		case d := <-drifts:
+			out = append(out, d)
+		case <-time.After(time.Second):
+			t.Fatalf("only %v of %v wakes", i, wakes)
+		}
+	}
+	return out
+}
+
+func TestSleepCTVirtualSteps(t *testing.T) {
+	steps := make([]time.Duration, 100)
+	for i := range steps {
+		steps[i] = 10 * time.Millisecond
+	}
+	for i, d := range stepSleepCT(t, &sleepct.SleepCT{}, steps, len(steps)) {
+		if d != 0 {
+			t.Fatalf("wake %v drifted %vus", i, d)
+		}
+	}
+}
+
+func TestSleepCTVirtualLateWake(t *testing.T) {
+	// A 35ms late wake is caught up without sleeping, then the loop is back on its targets
+	drifts := stepSleepCT(t, &sleepct.SleepCT{}, []time.Duration{35 * time.Millisecond, 5 * time.Millisecond}, 4)
+	expected := []int64{25000, 15000, 5000, 0}
+	for i := range expected {
+		if drifts[i] != expected[i] {
+			t.Fatalf("drifts %v, expected %v", drifts, expected)
+		}
+	}
+}
+
+// timerStats returns the sample count and sum of a loop timer histogram
+func timerStats(t *testing.T, b *bridgetest.Bridge, name string) (uint64, float64) {
+	t.Helper()
+	families, err := b.Metrics.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			h := f.GetMetric()[0].GetHistogram()
+			return h.GetSampleCount(), h.GetSampleSum()
+		}
+	}
+	t.Fatalf("metric %v not found", name)
+	return 0, 0
+}
+
+// stopVirtual stops a bridge running on a virtual clock.
+// Sleeping loops only see the cancelled context once they wake, so the clock is advanced until the bridge exits.
+func stopVirtual(b *bridgetest.Bridge, c *clock.Virtual) {
+	stopped := make(chan bool)
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-time.After(time.Millisecond):
+			c.Advance(10 * time.Millisecond)
+		}
+	}
+}
+
+// startVirtual starts b on a virtual clock and stops it at the end of the test
+func startVirtual(t *testing.T, b *bridgetest.Bridge) *clock.Virtual {
+	t.Helper()
+	c := clock.NewVirtual(epoch)
+	b.Clock = c
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(func() { stopVirtual(b, c) })
+	return c
+}
+
+// stepBridge runs n 10ms ticks of the three audio loops of a bridge on a virtual clock and waits for the loops to finish the last one
+func stepBridge(c *clock.Virtual, n int) {
+	for i := 0; i < n; i++ {
+		c.BlockUntil(3)
+		c.Advance(10 * time.Millisecond)
+	}
+	c.BlockUntil(3)
+}
+
+// waitReceived waits until the bridge has taken n packets off the receive counter name
+func waitReceived(t *testing.T, b *bridgetest.Bridge, name string, n float64) {
+	t.Helper()
+	waitFor(t, name, func() bool { return counterMetric(t, b, name) >= n })
+}
+
+func TestBridgeVirtualClock(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	b := bridgetest.NewBridge(nil)
+	b.Clock = c
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(func() { stopVirtual(b, c) })
+
+	// The discord send loop and both mixers sleep on the clock
+	const loops = 3
+	for i := 0; i < 100; i++ {
+		c.BlockUntil(loops)
+		c.Advance(10 * time.Millisecond)
+	}
+	c.BlockUntil(loops)
+
+	check := func(name string, count uint64, sum float64) {
+		t.Helper()
+		if n, s := timerStats(t, b, name); n != count || s != sum {
+			t.Errorf("%v has %v samples with %vus drift, expected %v samples with %vus", name, n, s, count, sum)
+		}
+	}
+	check("mdb_timer_mumble_mixer", 100, 0)
+	check("mdb_timer_discord_mixer", 100, 0)
+	check("mdb_timer_discord_send", 50, 0)
+
+	// Wake every loop 35ms late
+	c.Advance(35 * time.Millisecond)
+	c.BlockUntil(loops)
+	check("mdb_timer_mumble_mixer", 103, 25000+15000+5000)
+	check("mdb_timer_discord_mixer", 103, 25000+15000+5000)
+	check("mdb_timer_discord_send", 51, 15000)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+func startDirectionBridge(t *testing.T, d bridge.BridgeDirection) *bridgetest.Bridge {
+	t.Helper()
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.Direction = d
+	b.BridgeConfig.OneWayMute = true
+	b.BridgeConfig.HealthTickTimeout = time.Second
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	return b
+}
+
+func TestParseBridgeDirection(t *testing.T) {
+	for _, d := range []bridge.BridgeDirection{bridge.DirectionBoth, bridge.DirectionMumbleToDiscord, bridge.DirectionDiscordToMumble} {
+		if p, err := bridge.ParseBridgeDirection(d.String()); err != nil || p != d {
+			t.Errorf("%v parsed as %v %v", d, p, err)
+		}
+	}
+	if _, err := bridge.ParseBridgeDirection("sideways"); err == nil {
+		t.Error("expected an error for an invalid direction")
+	}
+}
+
+func TestBridgeMumbleToDiscordOnly(t *testing.T) {
+	b := startDirectionBridge(t, bridge.DirectionMumbleToDiscord)
+	voice := b.Discord.Voice()
+	if !voice.Deaf || voice.Mute {
+		t.Errorf("discord joined with mute %v deaf %v", voice.Mute, voice.Deaf)
+	}
+	if !b.Mumble.Client().SelfMuted() {
+		t.Error("expected the bot to be muted on mumble")
+	}
+	testMumbleToDiscord(t, b)
+
+	// Discord audio is not received at all, a deafened connection has no receive channel
+	if voice.Recv != nil {
+		t.Error("deafened connection receives audio")
+	}
+
+	found := false
+	for _, check := range b.Liveness().Checks {
+		if check.Name == "from_discord_mixer_loop" {
+			found = true
+			if !check.OK || check.Detail != "not running in mumble-to-discord" {
+				t.Errorf("unexpected check %+v", check)
+			}
+		}
+	}
+	if !found {
+		t.Error("no from_discord_mixer_loop check")
+	}
+}
+
+func TestBridgeMumbleToDiscordDeafened(t *testing.T) {
+	// The default ONE_WAY_MUTE joins deafened, the connection can send without a receive channel
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.Direction = bridge.DirectionMumbleToDiscord
+	b.BridgeConfig.OneWayMute = true
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	if !b.Discord.Voice().Deaf {
+		t.Fatal("discord joined without deaf")
+	}
+
+	testMumbleToDiscord(t, b)
+	for _, check := range b.Readiness().Checks {
+		if check.Name == "discord_voice" && !check.OK {
+			t.Errorf("deafened voice connection not ready %+v", check)
+		}
+	}
+}
+
+func TestBridgeDiscordToMumbleOnly(t *testing.T) {
+	b := startDirectionBridge(t, bridge.DirectionDiscordToMumble)
+	voice := b.Discord.Voice()
+	if !voice.Mute || voice.Deaf {
+		t.Errorf("discord joined with mute %v deaf %v", voice.Mute, voice.Deaf)
+	}
+	if b.Mumble.Client().SelfMuted() {
+		t.Error("the bot is muted on mumble where it speaks")
+	}
+	testDiscordToMumble(t, b)
+
+	// Mumble audio is not sent to Discord
+	user := &gumble.User{Name: "bob", Session: 7}
+	c := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: c})
+	for i := 0; i < 10; i++ {
+		c <- &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 8000, i*960, 960)}
+	}
+	close(c)
+	select {
+	case <-voice.Sent:
+		t.Error("audio sent to discord")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if r := b.Liveness(); !r.OK {
+		t.Errorf("unhealthy one-way bridge %+v", r)
+	}
+}
+
+func TestBridgeDirectionCommand(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Mode = bridge.BridgeModeManual
+	b.BridgeConfig.OneWayMute = true
+	sender := &gumble.User{Name: "bob", Session: 9, Channel: &gumble.Channel{Name: "Root"}}
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(func() {
+		b.Stop()
+		b.WaitConnected(false, bridgeTimeout)
+	})
+
+	send := func(msg string) {
+		b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: sender, Message: msg}})
+	}
+	send("/direction")
+	send("/direction sideways")
+	send("/direction mumble-to-discord")
+	replies := b.Mumble.UserMessages(sender.Session)
+	if len(replies) != 3 || replies[0] != "Direction: both" ||
+		replies[1] != "Usage: direction [both|mumble-to-discord|discord-to-mumble]" || replies[2] != "Direction: mumble-to-discord" {
+		t.Fatalf("unexpected replies %q", replies)
+	}
+
+	// The bridge reconnects in the new direction
+	deadline := time.Now().Add(bridgeTimeout)
+	for b.Mumble.Dials() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !b.WaitConnected(true, bridgeTimeout) || b.Mumble.Dials() != 2 {
+		t.Fatalf("bridge did not reconnect, %v dials", b.Mumble.Dials())
+	}
+	if voice := b.Discord.Voice(); !voice.Deaf {
+		t.Error("expected discord to be deafened after the change")
+	}
+}
+
+func TestPlaySoundDirection(t *testing.T) {
+	dir := t.TempDir()
+	writeWAVFile(t, filepath.Join(dir, "beep.wav"), 48000, 1, constFrame(1000))
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.Direction = bridge.DirectionMumbleToDiscord
+	b.Soundboard = bridge.NewSoundboard(dir)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	if _, _, err := b.PlaySound("beep", "mumble", 1, "test"); err != bridge.ErrDirection {
+		t.Errorf("play to mumble returned %v", err)
+	}
+	if _, _, err := b.PlaySound("beep", "discord", 1, "test"); err != nil {
+		t.Errorf("play to discord returned %v", err)
+	}
+}
+
+func TestDirectionAPI(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	srv := httptest.NewServer(b.APIHandler(""))
+	defer srv.Close()
+
+	request := func(method, path string) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	if code, body := request(http.MethodGet, "/direction"); code != http.StatusOK || body["direction"] != "both" {
+		t.Errorf("direction returned %v %v", code, body)
+	}
+	if code, _ := request(http.MethodPost, "/direction?set=sideways"); code != http.StatusBadRequest {
+		t.Errorf("invalid direction returned %v", code)
+	}
+	if code, body := request(http.MethodPost, "/direction?set=discord-to-mumble"); code != http.StatusOK || body["direction"] != "discord-to-mumble" {
+		t.Errorf("set direction returned %v %v", code, body)
+	}
+	if b.Direction() != bridge.DirectionDiscordToMumble {
+		t.Errorf("direction is %v", b.Direction())
+	}
+	if code, _ := request(http.MethodDelete, "/direction"); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE direction returned %v", code)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// sendDiscordTone sends n 20ms packets of a tone with the given amplitude from a discord user
+func sendDiscordTone(t *testing.T, voice *bridgetest.Voice, seq, n int, amplitude float64) {
+	t.Helper()
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := seq; i < seq+n; i++ {
+		opus, err := enc.Encode(bridgetest.Tone(440, amplitude, i*960, 960), 960, 3840)
+		if err != nil {
+			t.Fatal(err)
+		}
+		voice.Recv <- &discordgo.Packet{SSRC: 1234, Sequence: uint16(i), Timestamp: uint32(i * 960), Opus: opus}
+	}
+}
+
+// mumblePeaks returns the peaks of the next n frames received on mumble that are not silent
+func mumblePeaks(t *testing.T, b *bridgetest.Bridge, n int) []int {
+	t.Helper()
+	var peaks []int
+	audio := b.Mumble.Client().Audio()
+	timeout := time.After(bridgeTimeout)
+	for len(peaks) < n {
+		select {
+		case buf := <-audio:
+			if p := bridgetest.Peak(buf); p > 0 {
+				peaks = append(peaks, p)
+			}
+		case <-timeout:
+			t.Fatalf("received %v frames on mumble", peaks)
+		}
+	}
+	return peaks
+}
+
+func TestBridgeDucking(t *testing.T) {
+	// The default attack and release
+	ducker, err := bridge.NewDucker("mumble", 0.25, 50*time.Millisecond, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bridgetest.NewBridge(nil)
+	b.Ducker = ducker
+	c := startVirtual(t, b)
+
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	// A Mumble presenter speaks for 600ms
+	user := &gumble.User{Name: "bob", Session: 7}
+	mc := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: mc})
+	for i := 0; i < 30; i++ {
+		mc <- &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 8000, i*960, 960)}
+	}
+	defer close(mc)
+	waitReceived(t, b, "mdb_mumble_received_count", 30)
+	stepBridge(c, 10)
+	if d := ducker.Ducked("mumble"); d != 0.75 {
+		t.Errorf("mumble ducked by %v after the attack", d)
+	}
+
+	// Discord audio relayed into Mumble is ducked to a quarter
+	sendDiscordTone(t, voice, 0, 10, 8000)
+	waitReceived(t, b, "mdb_discord_received_count", 10)
+	stepBridge(c, 30)
+	peaks := mumblePeaks(t, b, 20)
+	for _, p := range peaks[1:] {
+		if p < 1500 || p > 2200 {
+			t.Fatalf("expected ducked audio, peaks %v", peaks)
+		}
+	}
+	if d := ducker.Ducked("discord"); d != 0 {
+		t.Errorf("discord ducked by %v", d)
+	}
+
+	// The presenter stops while Discord is silent, the release runs without relayed audio
+	stepBridge(c, 80)
+	if d := ducker.Ducked("mumble"); d != 0 {
+		t.Errorf("mumble still ducked by %v after the release", d)
+	}
+
+	// The next Discord speaker starts at full level
+	sendDiscordTone(t, voice, 10, 10, 8000)
+	waitReceived(t, b, "mdb_discord_received_count", 20)
+	stepBridge(c, 30)
+	peaks = mumblePeaks(t, b, 20)
+	for _, p := range peaks {
+		if p < 7000 {
+			t.Fatalf("expected full audio, peaks %v", peaks)
+		}
+	}
+}
+
+func TestDuckerPriority(t *testing.T) {
+	for _, p := range []string{"mumble", "discord", "both"} {
+		if _, err := bridge.NewDucker(p, 0.5, time.Millisecond, time.Millisecond); err != nil {
+			t.Errorf("%v: %v", p, err)
+		}
+	}
+	if _, err := bridge.NewDucker("presenter", 0.5, time.Millisecond, time.Millisecond); err == nil {
+		t.Error("expected an error for an invalid priority")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// End to end tests run the full bridge with the production gumble client against a local Mumble server
+// and a fake Discord voice connection. Audio is paced in real time.
+
+const (
+	talkDuration    = time.Second
+	captureDuration = 1500 * time.Millisecond
+	maxLatency      = 300 * time.Millisecond
+	activeRMS       = 500
+)
+
+type talker struct {
+	name string
+	freq float64
+	amp  float64
+}
+
+func newHarness(t *testing.T, setup func(h *bridgetest.Harness)) *bridgetest.Harness {
+	t.Helper()
+	h, err := bridgetest.NewHarness(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(h)
+	}
+	if !h.Start(5 * time.Second) {
+		h.Server.Close()
+		t.Fatal("bridge did not connect to the local mumble server")
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// discordToMumble streams the talkers as Discord users and captures the mixed audio on the Mumble server
+func discordToMumble(t *testing.T, h *bridgetest.Harness, talkers []talker) ([]bridgetest.Frame, time.Time) {
+	voice := h.Discord.Voice()
+	for i, tk := range talkers {
+		id := "u" + tk.name
+		h.Discord.AddUser(id, tk.name)
+		h.Discord.SetVoiceState(bridgetest.GuildID, id, bridgetest.VoiceChannelID)
+		voiceUpdate(h.Bridge)
+		voice.Speak(uint32(100+i), id)
+	}
+
+	start := time.Now().Add(50 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i, tk := range talkers {
+		wg.Add(1)
+		go func(ssrc uint32, pcm []int16) {
+			defer wg.Done()
+			if err := voice.Stream(ssrc, pcm, start); err != nil {
+				t.Error(err)
+			}
+		}(uint32(100+i), bridgetest.Tone(tk.freq, tk.amp, 0, int(talkDuration.Seconds()*bridgetest.SampleRate)))
+	}
+
+	frames, err := h.Server.Capture(captureDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	return frames, start
+}
+
+// mumbleToDiscord streams the talkers as Mumble users and captures the mixed audio sent to Discord
+func mumbleToDiscord(t *testing.T, h *bridgetest.Harness, talkers []talker) ([]bridgetest.Frame, time.Time) {
+	sessions := make([]uint32, len(talkers))
+	for i, tk := range talkers {
+		sessions[i] = h.Server.AddUser(tk.name)
+	}
+
+	start := time.Now().Add(50 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i, tk := range talkers {
+		wg.Add(1)
+		go func(session uint32, pcm []int16) {
+			defer wg.Done()
+			if err := h.Server.Stream(session, pcm, 960, start); err != nil {
+				t.Error(err)
+			}
+		}(sessions[i], bridgetest.Tone(tk.freq, tk.amp, 0, int(talkDuration.Seconds()*bridgetest.SampleRate)))
+	}
+
+	frames, err := h.Discord.Voice().Capture(captureDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	return frames, start
+}
+
+// checkLatency asserts that the audio arrived and returns the active frames
+func checkLatency(t *testing.T, frames []bridgetest.Frame, start time.Time) []bridgetest.Frame {
+	t.Helper()
+	first, ok := bridgetest.FirstActive(frames, activeRMS)
+	if !ok {
+		t.Fatalf("no audio in %v captured frames", len(frames))
+	}
+	if latency := first.Sub(start); latency > maxLatency {
+		t.Errorf("latency %v, expected at most %v", latency, maxLatency)
+	}
+	active := bridgetest.Active(frames, activeRMS)
+	if d := time.Duration(len(bridgetest.PCM(active))) * time.Second / bridgetest.SampleRate; d < talkDuration/2 {
+		t.Errorf("only %v of audio captured", d)
+	}
+	return active
+}
+
+// checkWraparound asserts that no frame has a step only explained by int16 overflow.
+// Steps are only measured inside frames, a lost frame can legitimately cause a step at frame boundaries.
+func checkWraparound(t *testing.T, frames []bridgetest.Frame) {
+	t.Helper()
+	for _, f := range frames {
+		if step := bridgetest.MaxStep(f.PCM); step > math.MaxInt16 {
+			t.Fatalf("sample step of %v, the mix wrapped around", step)
+		}
+	}
+}
+
+// checkMix asserts every talker is present at its level and the overall level matches the sum of the talkers
+func checkMix(t *testing.T, frames []bridgetest.Frame, start time.Time, talkers []talker) {
+	t.Helper()
+	active := checkLatency(t, frames, start)
+	checkWraparound(t, frames)
+
+	pcm := bridgetest.PCM(active)
+	var power float64
+	for _, tk := range talkers {
+		power += tk.amp * tk.amp / 2
+		if level := bridgetest.ToneLevel(pcm, tk.freq); level < tk.amp/2 || level > tk.amp*2 {
+			t.Errorf("%v at %vHz has level %.0f, expected about %v", tk.name, tk.freq, level, tk.amp)
+		}
+	}
+	expected := math.Sqrt(power)
+	if rms := bridgetest.RMS(pcm); math.Abs(20*math.Log10(rms/expected)) > 3 {
+		t.Errorf("mix rms %.0f, expected %.0f within 3dB", rms, expected)
+	}
+}
+
+var quietTalkers = []talker{
+	{"alice", 300, 4000},
+	{"bob", 500, 4000},
+	{"carol", 700, 4000},
+}
+
+// loudTalkers are in phase and sum beyond the int16 range
+var loudTalkers = []talker{
+	{"dave", 400, 14000},
+	{"erin", 400, 14000},
+	{"frank", 400, 14000},
+}
+
+func TestE2EDiscordToMumble(t *testing.T) {
+	h := newHarness(t, nil)
+	frames, start := discordToMumble(t, h, quietTalkers)
+	checkMix(t, frames, start, quietTalkers)
+
+	stats := h.UserStats.Snapshot()
+	if len(stats) != len(quietTalkers) {
+		t.Errorf("expected stats for %v users, got %+v", len(quietTalkers), stats)
+	}
+}
+
+func TestE2EMumbleToDiscord(t *testing.T) {
+	h := newHarness(t, nil)
+	frames, start := mumbleToDiscord(t, h, quietTalkers)
+	checkMix(t, frames, start, quietTalkers)
+
+	if speaking, _ := h.Discord.Voice().IsSpeaking(); speaking {
+		t.Error("bot still speaking on discord after the talkers stopped")
+	}
+}
+
+func TestE2EDiscordToMumbleClipping(t *testing.T) {
+	h := newHarness(t, nil)
+	frames, start := discordToMumble(t, h, loudTalkers)
+	active := checkLatency(t, frames, start)
+	checkWraparound(t, frames)
+	if p := bridgetest.Peak(bridgetest.PCM(active)); p < 30000 {
+		t.Errorf("peak %v, expected the mix to saturate", p)
+	}
+}
+
+func TestE2EMumbleToDiscordClipping(t *testing.T) {
+	h := newHarness(t, nil)
+	frames, start := mumbleToDiscord(t, h, loudTalkers)
+	active := checkLatency(t, frames, start)
+	checkWraparound(t, frames)
+	if p := bridgetest.Peak(bridgetest.PCM(active)); p < 30000 {
+		t.Errorf("peak %v, expected the mix to saturate", p)
+	}
+}
+
+func TestE2EJoinLeaveText(t *testing.T) {
+	h := newHarness(t, func(h *bridgetest.Harness) {
+		h.BridgeConfig.DiscordSpamChannel = bridgetest.TextChannelID
+	})
+
+	hasDiscordMessage := func(content string) func() bool {
+		return func() bool {
+			for _, m := range h.Discord.Messages() {
+				if m.ChannelID == bridgetest.TextChannelID && m.Content == content {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	hasMumbleMessage := func(session uint32, channel bool, content string) func() bool {
+		return func() bool {
+			for _, m := range h.Server.TextMessages() {
+				targets := m.Sessions
+				if channel {
+					targets = m.Channels
+				}
+				for _, target := range targets {
+					if target == session && strings.Contains(m.Message, content) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+	}
+
+	// Mumble user joins and leaves
+	dave := h.Server.AddUser("dave")
+	waitFor(t, "mumble join notice on discord", hasDiscordMessage("dave has joined mumble"))
+	waitFor(t, "welcome message to dave", hasMumbleMessage(dave, false, "Mumble-Discord-Bridge test"))
+	waitFor(t, "discord user list to dave", hasMumbleMessage(dave, false, "No users connected to Discord"))
+
+	// Discord user joins, is listed to mumble and leaves
+	h.Discord.AddUser("u1", "alice")
+	h.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(h.Bridge)
+	waitFor(t, "discord join notice on mumble", hasMumbleMessage(0, true, "alice has joined Discord"))
+
+	h.Server.SendText(dave, "/users")
+	waitFor(t, "reply to /users", hasMumbleMessage(dave, false, "alice → u1"))
+
+	h.Discord.SetVoiceState(bridgetest.GuildID, "u1", "")
+	voiceUpdate(h.Bridge)
+	waitFor(t, "discord leave notice on mumble", hasMumbleMessage(0, true, "alice has left Discord channel"))
+
+	h.Server.RemoveUser(dave)
+	waitFor(t, "mumble leave notice on discord", hasDiscordMessage("dave has left mumble"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// countValue returns the number of samples of the value
+func countValue(pcm []int16, value int16) int {
+	n := 0
+	for _, v := range pcm {
+		if v == value {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBridgeFrameSizes(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.MumbleFrame = 40 * time.Millisecond
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	// Discord packets of 60ms and 5ms are relayed in whole 40ms frames
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := 0
+	for i, size := range []int{2880, 2880, 2880, 2880, 2880, 240, 240, 240, 240} {
+		pcm := make([]int16, size)
+		for j := range pcm {
+			pcm[j] = 3000
+		}
+		opus, err := enc.Encode(pcm, size, size*4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		voice.Recv <- &discordgo.Packet{SSRC: 1234, Sequence: uint16(i), Timestamp: uint32(timestamp), Opus: opus}
+		timestamp += size
+	}
+	audio := b.Mumble.Client().Audio()
+	timeout := time.After(bridgeTimeout)
+	for relayed := 0; relayed < 15360; {
+		select {
+		case buf := <-audio:
+			if len(buf) != 1920 {
+				t.Fatalf("%v samples in a mumble frame", len(buf))
+			}
+			relayed += countValue(buf, 3000)
+		case <-timeout:
+			t.Fatalf("relayed %v samples to mumble", relayed)
+		}
+	}
+
+	// Mumble audio is sent to Discord in 20ms frames, the pacing of the discordgo sender
+	mumbleSpeaker(b, 1, 3000, 9)
+	frames, err := voice.Capture(500 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := 0
+	for _, f := range frames {
+		if len(f.PCM) != 960 {
+			t.Fatalf("%v samples in a discord frame", len(f.PCM))
+		}
+		relayed += countValue(f.PCM, 3000)
+	}
+	if relayed != 8640 {
+		t.Errorf("relayed %v samples to discord", relayed)
+	}
+}
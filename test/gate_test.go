@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// counterMetric returns the value of a counter or gauge of the bridge
+func counterMetric(t *testing.T, b *bridgetest.Bridge, name string) float64 {
+	t.Helper()
+	families, err := b.Metrics.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			m := f.GetMetric()[0]
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("no metric %v", name)
+	return 0
+}
+
+// noActiveFrames fails if any frame that is not silent is waiting on mumble
+func noActiveFrames(t *testing.T, b *bridgetest.Bridge) {
+	t.Helper()
+	audio := b.Mumble.Client().Audio()
+	for {
+		select {
+		case buf := <-audio:
+			if p := bridgetest.Peak(buf); p > 0 {
+				t.Fatalf("unexpected audio on mumble, peak %v", p)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestBridgeNoiseGate(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.NoiseGate = &bridge.NoiseGate{Threshold: -30, Hold: 30 * time.Millisecond, Release: 20 * time.Millisecond, Mumble: true}
+	c := startVirtual(t, b)
+
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	// Room noise at about -47 dBFS is not relayed
+	sendDiscordTone(t, voice, 0, 10, 200)
+	waitReceived(t, b, "mdb_discord_received_count", 10)
+	stepBridge(c, 30)
+	if s := counterMetric(t, b, "mdb_discord_gated_seconds"); s < 0.195 {
+		t.Fatalf("gated %vs of noise", s)
+	}
+	noActiveFrames(t, b)
+
+	// Speech opens the gate, the noise after it is held for 3 frames and faded out over 2
+	sendDiscordTone(t, voice, 10, 10, 8000)
+	sendDiscordTone(t, voice, 20, 10, 200)
+	waitReceived(t, b, "mdb_discord_received_count", 30)
+	stepBridge(c, 70)
+	peaks := mumblePeaks(t, b, 25)
+	for i, p := range peaks {
+		switch {
+		case i < 20 && p < 7000:
+			t.Fatalf("speech gated, peaks %v", peaks)
+		case i >= 20 && i < 23 && (p < 150 || p > 250):
+			t.Fatalf("noise not held, peaks %v", peaks)
+		case i >= 23 && p > 200:
+			t.Fatalf("noise not faded out, peaks %v", peaks)
+		}
+	}
+	if s := counterMetric(t, b, "mdb_discord_gated_seconds"); s < 0.345 {
+		t.Fatalf("gated %vs of noise", s)
+	}
+	noActiveFrames(t, b)
+
+	// Mumble streams are gated too
+	user := &gumble.User{Name: "bob", Session: 3}
+	mc := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: mc})
+	for i := 0; i < 5; i++ {
+		mc <- &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 200, i*960, 960)}
+	}
+	close(mc)
+	waitReceived(t, b, "mdb_mumble_received_count", 5)
+	stepBridge(c, 20)
+	if s := counterMetric(t, b, "mdb_mumble_gated_seconds"); s < 0.095 {
+		t.Fatalf("gated %vs of mumble noise", s)
+	}
+	select {
+	case <-voice.Sent:
+		t.Error("gated mumble audio sent to discord")
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// cpuTime returns the user and system CPU time used by the process
+func cpuTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// loopWakes returns the number of wakes of the three audio loops
+func loopWakes(b *testing.B, br *bridgetest.Bridge) uint64 {
+	families, err := br.Metrics.Registry().Gather()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var n uint64
+	for _, f := range families {
+		switch f.GetName() {
+		case "mdb_timer_discord_send", "mdb_timer_discord_mixer", "mdb_timer_mumble_mixer":
+			n += f.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return n
+}
+
+// benchmarkIdleBridge measures a connected bridge without any audio.
+// Every op is 10ms of idle wall time, the interesting results are the loop wakes and CPU time per op.
+func benchmarkIdleBridge(b *testing.B, pause bool) {
+	br := bridgetest.NewBridge(nil)
+	br.BridgeConfig.IdlePause = pause
+	if !br.Start(bridgeTimeout) {
+		b.Fatal("bridge did not connect")
+	}
+	defer br.Stop()
+	// Let the loops settle, pausing loops pause after their first target
+	time.Sleep(100 * time.Millisecond)
+
+	b.ResetTimer()
+	wakes := loopWakes(b, br)
+	cpu := cpuTime(b)
+	time.Sleep(time.Duration(b.N) * 10 * time.Millisecond)
+	cpu = cpuTime(b) - cpu
+	wakes = loopWakes(b, br) - wakes
+	b.StopTimer()
+
+	b.ReportMetric(float64(wakes)/float64(b.N), "wakes/op")
+	b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/op")
+}
+
+func BenchmarkIdleBridgePoll(b *testing.B) {
+	benchmarkIdleBridge(b, false)
+}
+
+func BenchmarkIdleBridgePause(b *testing.B) {
+	benchmarkIdleBridge(b, true)
+}
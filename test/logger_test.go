@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/logger"
+)
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := logger.New(&buf, logger.FormatText, logger.LevelInfo).With("bridge", "test", "side", "discord")
+
+	l.Debug("hidden")
+	l.Info("User joined", "user", "some one", "ssrc", uint32(42))
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("debug entry written at info level")
+	}
+	for _, want := range []string{"INFO User joined", "bridge=test", "side=discord", `user="some one"`, "ssrc=42"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := logger.New(&buf, logger.FormatJSON, logger.LevelDebug).With("bridge", "test")
+
+	l.Warn("Dropping packet", "err", errors.New("full"), "session", 7)
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if entry["level"] != "warn" || entry["msg"] != "Dropping packet" || entry["bridge"] != "test" || entry["err"] != "full" || entry["session"] != float64(7) {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestLoggerLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	l := logger.New(&buf, logger.FormatText, logger.LevelInfo)
+	r := l.Every(time.Hour)
+
+	for i := 0; i < 100; i++ {
+		r.Warn("Dropping packet")
+	}
+
+	if n := strings.Count(buf.String(), "Dropping packet"); n != 1 {
+		t.Errorf("expected 1 entry, got %v", n)
+	}
+}
+
+func TestLoggerNil(t *testing.T) {
+	var l *logger.Logger
+	l.With("a", 1).Info("nothing")
+	l.Every(time.Second).Warn("nothing")
+}
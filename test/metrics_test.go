@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+)
+
+func TestMetricsPerInstance(t *testing.T) {
+	a := bridge.NewMetrics("a")
+	b := bridge.NewMetrics("b")
+
+	a.ApplicationStartTime.Set(1)
+	b.ApplicationStartTime.Set(2)
+
+	for name, m := range map[string]*bridge.Metrics{"a": a, "b": b} {
+		families, err := m.Registry().Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) == 0 {
+			t.Fatal("no metrics registered")
+		}
+		for _, f := range families {
+			for _, metric := range f.GetMetric() {
+				found := false
+				for _, l := range metric.GetLabel() {
+					if l.GetName() == "bridge" {
+						found = l.GetValue() == name
+					}
+				}
+				if !found {
+					t.Errorf("%v missing bridge label %q", f.GetName(), name)
+				}
+			}
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := bridge.NewMetrics("test")
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		`mdb_bridge_start_time{bridge="test"}`,
+		`mdb_discord_sent_count{bridge="test",direction="to_discord"}`,
+		`mdb_mumble_sent_count{bridge="test",direction="to_mumble"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %v", want)
+		}
+	}
+}
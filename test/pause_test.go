@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+	"github.com/stieneee/mumble-discord-bridge/pkg/sleepct"
+)
+
+func waitPaused(t *testing.T, s *sleepct.SleepCT) {
+	t.Helper()
+	waitFor(t, "sleeper to pause", s.Paused)
+}
+
+func TestSleepCTPauseNotify(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	s := sleepct.SleepCT{Clock: c}
+	s.Start(10 * time.Millisecond)
+
+	woke := make(chan time.Time)
+	go func() {
+		s.SleepNextTarget(context.Background(), true)
+		woke <- c.Now()
+		s.SleepNextTarget(context.Background(), false)
+		woke <- c.Now()
+	}()
+
+	// The sleeper still sleeps to its target before pausing
+	c.BlockUntil(1)
+	c.Advance(10 * time.Millisecond)
+	waitPaused(t, &s)
+
+	c.Advance(100 * time.Millisecond)
+	select {
+	case <-woke:
+		t.Fatal("paused sleeper woke without a notification")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A notification resumes the sleeper without waiting for the next target
+	s.Notify()
+	if now := <-woke; !now.Equal(epoch.Add(110 * time.Millisecond)) {
+		t.Fatalf("resumed at %v", now.Sub(epoch))
+	}
+	if s.Paused() {
+		t.Error("still paused after resuming")
+	}
+
+	// The next target is a full interval after the notification
+	c.BlockUntil(1)
+	c.Advance(10 * time.Millisecond)
+	if now := <-woke; !now.Equal(epoch.Add(120 * time.Millisecond)) {
+		t.Fatalf("woke at %v", now.Sub(epoch))
+	}
+}
+
+func TestSleepCTNotifyWhileSleeping(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	s := sleepct.SleepCT{Clock: c}
+	s.Start(10 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		s.SleepNextTarget(context.Background(), true)
+		close(done)
+	}()
+
+	// Work published before the pause prevents it
+	c.BlockUntil(1)
+	s.Notify()
+	c.Advance(10 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sleeper paused despite a pending notification")
+	}
+}
+
+func TestSleepCTPauseCancel(t *testing.T) {
+	s := sleepct.SleepCT{}
+	s.Start(time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan bool)
+	go func() {
+		s.SleepNextTarget(ctx, true)
+		close(done)
+	}()
+	waitPaused(t, &s)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("paused sleeper ignored the cancelled context")
+	}
+}
+
+// TestSleepCTNotifyNoLostWakeups runs producers against a consumer that pauses whenever it sees no work.
+// A lost notification leaves work queued while the consumer is paused.
+func TestSleepCTNotifyNoLostWakeups(t *testing.T) {
+	const producers = 4
+	const items = 500
+
+	s := sleepct.SleepCT{}
+	s.Start(time.Millisecond)
+	work := make(chan int, producers*items)
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < items; i++ {
+				work <- i
+				s.Notify()
+				if i%50 == 0 {
+					time.Sleep(3 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	received := 0
+	for received < producers*items && ctx.Err() == nil {
+		s.SleepNextTarget(ctx, len(work) == 0)
+		for len(work) > 0 {
+			<-work
+			received++
+		}
+	}
+	wg.Wait()
+	if received != producers*items {
+		t.Fatalf("received %v of %v items", received, producers*items)
+	}
+}
+
+// startPausingBridge starts a bridge with idle pause on c, or the real clock if c is nil
+func startPausingBridge(t *testing.T, c *clock.Virtual) *bridgetest.Bridge {
+	t.Helper()
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.IdlePause = true
+	b.BridgeConfig.MumbleStartStreamCount = 0
+	b.BridgeConfig.HealthTickTimeout = 50 * time.Millisecond
+	if c != nil {
+		b.Clock = c
+	}
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	if c != nil {
+		t.Cleanup(func() { stopVirtual(b, c) })
+	} else {
+		t.Cleanup(b.Stop)
+	}
+	return b
+}
+
+// waitLoopsPaused waits until liveness reports every audio loop as paused
+func waitLoopsPaused(t *testing.T, b *bridgetest.Bridge) bridge.HealthReport {
+	t.Helper()
+	var r bridge.HealthReport
+	waitFor(t, "audio loops to pause", func() bool {
+		r = b.Liveness()
+		paused := 0
+		for _, check := range r.Checks {
+			if check.Detail == "paused" {
+				paused++
+			}
+		}
+		return paused == 3
+	})
+	return r
+}
+
+func TestBridgeIdlePause(t *testing.T) {
+	b := startPausingBridge(t, nil)
+	waitLoopsPaused(t, b)
+
+	// Paused loops stay healthy past the tick timeout
+	time.Sleep(100 * time.Millisecond)
+	if r := waitLoopsPaused(t, b); !r.OK {
+		t.Errorf("idle bridge is not live: %+v", r)
+	}
+}
+
+func TestBridgeIdlePauseAudio(t *testing.T) {
+	// Both directions resume from the paused state and pause again once the audio ends
+	b := startPausingBridge(t, nil)
+	waitLoopsPaused(t, b)
+	testDiscordToMumble(t, b)
+	waitLoopsPaused(t, b)
+	testMumbleToDiscord(t, b)
+	waitLoopsPaused(t, b)
+}
+
+func TestBridgeIdlePauseFirstFrame(t *testing.T) {
+	// The virtual clock does not advance, so audio only arrives if the paused mixer wakes on the notification
+	c := clock.NewVirtual(epoch)
+	b := startPausingBridge(t, c)
+
+	c.BlockUntil(3)
+	c.Advance(20 * time.Millisecond)
+	waitLoopsPaused(t, b)
+
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opus, err := enc.Encode(bridgetest.Tone(440, 8000, 0, 960), 960, 3840)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voice.Recv <- &discordgo.Packet{SSRC: 1234, Sequence: 1, Timestamp: 960, Opus: opus}
+
+	select {
+	case buf := <-b.Mumble.Client().Audio():
+		if p := bridgetest.Peak(buf); p < 2000 {
+			t.Errorf("first frame peak %v, expected the tone", p)
+		}
+	case <-time.After(bridgeTimeout):
+		t.Fatal("paused mixer did not wake for the first frame")
+	}
+	if now := c.Now(); !now.Equal(epoch.Add(20 * time.Millisecond)) {
+		t.Errorf("clock advanced to %v", now.Sub(epoch))
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+func TestPrioritySpeakers(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Priority = bridge.NewPrioritySpeakers("u1, role1", "42,presenters", 0)
+	p := b.Priority
+
+	if !p.Discord("u1") || p.Discord("u2") || p.Discord("") {
+		t.Error("unexpected discord priority by user ID")
+	}
+	if !p.Mumble(42) || p.Mumble(7) || p.Mumble(0) {
+		t.Error("unexpected mumble priority by user ID")
+	}
+
+	// Discord roles are looked up when users join
+	b.Discord.AddUser("u2", "alice")
+	b.Discord.SetRoles("u2", "role2", "role1")
+	b.Discord.AddUser("u3", "carol")
+	b.Discord.SetRoles("u3", "role2")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u2", bridgetest.VoiceChannelID)
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u3", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	if !p.Discord("u2") || p.Discord("u3") {
+		t.Error("unexpected discord priority by role")
+	}
+
+	// Including users already in the channel when the bridge starts
+	b.Discord.AddUser("u4", "dave")
+	b.Discord.SetRoles("u4", "role1")
+	b.DiscordListener.GuildCreate(nil, &discordgo.GuildCreate{Guild: &discordgo.Guild{
+		ID:          bridgetest.GuildID,
+		VoiceStates: []*discordgo.VoiceState{{GuildID: bridgetest.GuildID, UserID: "u4", ChannelID: bridgetest.VoiceChannelID}},
+	}})
+	if !p.Discord("u4") {
+		t.Error("role of a user in the channel at start not looked up")
+	}
+
+	// And forgotten when they leave
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u2", "")
+	voiceUpdate(b)
+	if p.Discord("u2") {
+		t.Error("role of a user who left is kept")
+	}
+
+	// Mumble groups are read from the channel ACL
+	b.MumbleListener.MumbleACL(&gumble.ACLEvent{ACL: &gumble.ACL{
+		Channel: &gumble.Channel{Name: "Root"},
+		Groups: []*gumble.ACLGroup{
+			{
+				Name:           "presenters",
+				UsersAdd:       map[uint32]*gumble.ACLUser{7: {UserID: 7}},
+				UsersInherited: map[uint32]*gumble.ACLUser{8: {UserID: 8}, 9: {UserID: 9}},
+				UsersRemove:    map[uint32]*gumble.ACLUser{9: {UserID: 9}},
+			},
+			{Name: "admin", UsersAdd: map[uint32]*gumble.ACLUser{10: {UserID: 10}}},
+		},
+	}})
+	if !p.Mumble(7) || !p.Mumble(8) || p.Mumble(9) || p.Mumble(10) {
+		t.Error("unexpected mumble priority by group")
+	}
+}
+
+func TestBridgePriorityACLRefresh(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Priority = bridge.NewPrioritySpeakers("", "presenters", 0)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	// Registered users joining or registering may be group members, the ACL is requested again
+	change := func(user *gumble.User, typ gumble.UserChangeType) {
+		b.MumbleListener.MumbleUserChange(&gumble.UserChangeEvent{User: user, Type: typ})
+	}
+	change(&gumble.User{Name: "guest", Session: 3}, gumble.UserChangeConnected)
+	if n := b.Mumble.ACLRequests(); n != 0 {
+		t.Errorf("%v ACL requests for an unregistered user", n)
+	}
+	change(&gumble.User{Name: "bob", Session: 4, UserID: 7}, gumble.UserChangeConnected)
+	change(&gumble.User{Name: "guest", Session: 3, UserID: 8}, gumble.UserChangeRegistered)
+	if n := b.Mumble.ACLRequests(); n != 2 {
+		t.Errorf("%v ACL requests, expected 2", n)
+	}
+
+	// A denied request is only logged
+	b.MumbleListener.MumblePermissionDenied(&gumble.PermissionDeniedEvent{Type: gumble.PermissionDeniedPermission, Permission: gumble.PermissionWrite})
+}
+
+func TestBridgePrioritySpeaker(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Priority = bridge.NewPrioritySpeakers("", "7", 0.25)
+	c := startVirtual(t, b)
+
+	b.Discord.AddUser("u1", "alice")
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	voiceUpdate(b)
+	voice := b.Discord.Voice()
+	voice.Speak(1234, "u1")
+
+	// A registered Mumble user with priority speaks for 600ms
+	user := &gumble.User{Name: "bob", Session: 3, UserID: 7}
+	mc := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: mc})
+	for i := 0; i < 30; i++ {
+		mc <- &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 8000, i*960, 960)}
+	}
+	defer close(mc)
+	waitReceived(t, b, "mdb_mumble_received_count", 30)
+	stepBridge(c, 5)
+	if !b.Priority.Speaking() {
+		t.Fatal("priority speaker not detected")
+	}
+
+	// Discord speakers are lowered while the priority speaker talks
+	sendDiscordTone(t, voice, 0, 10, 8000)
+	waitReceived(t, b, "mdb_discord_received_count", 10)
+	stepBridge(c, 30)
+	peaks := mumblePeaks(t, b, 20)
+	for _, p := range peaks {
+		if p < 1500 || p > 2200 {
+			t.Fatalf("expected lowered audio, peaks %v", peaks)
+		}
+	}
+
+	// And are back to their level after
+	stepBridge(c, 40)
+	if b.Priority.Speaking() {
+		t.Fatal("priority speaker still speaking")
+	}
+	sendDiscordTone(t, voice, 10, 10, 8000)
+	waitReceived(t, b, "mdb_discord_received_count", 20)
+	stepBridge(c, 30)
+	peaks = mumblePeaks(t, b, 20)
+	for _, p := range peaks {
+		if p < 7000 {
+			t.Fatalf("expected full audio, peaks %v", peaks)
+		}
+	}
+}
+
+func TestBridgePrioritySounds(t *testing.T) {
+	dir := t.TempDir()
+	var pcm []int16
+	for i := 0; i < 20; i++ {
+		pcm = append(pcm, constFrame(4000)...)
+	}
+	writeWAVFile(t, filepath.Join(dir, "beep.wav"), 48000, 1, pcm)
+	b := bridgetest.NewBridge(nil)
+	b.Priority = bridge.NewPrioritySpeakers("", "7", 0.25)
+	b.Soundboard = bridge.NewSoundboard(dir)
+	c := startVirtual(t, b)
+
+	// A registered Mumble user with priority speaks for 600ms
+	user := &gumble.User{Name: "bob", Session: 3, UserID: 7}
+	mc := make(chan *gumble.AudioPacket, 50)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: mc})
+	for i := 0; i < 30; i++ {
+		mc <- &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 8000, i*960, 960)}
+	}
+	defer close(mc)
+	waitReceived(t, b, "mdb_mumble_received_count", 30)
+	stepBridge(c, 5)
+
+	// Sounds are lowered like the other speakers
+	if _, _, err := b.PlaySound("beep", "mumble", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	stepBridge(c, 20)
+	for _, v := range activeFrames(t, b, 20) {
+		if v != 1000 {
+			t.Fatalf("expected the sound lowered to 1000, got %v", v)
+		}
+	}
+}
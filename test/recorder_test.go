@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+)
+
+// readWAV returns the samples of a mono 16 bit WAV file written by the recorder
+func readWAV(t *testing.T, path string) []int16 {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 44 || string(data[0:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " || string(data[36:40]) != "data" {
+		t.Fatalf("%v is not a wav file", path)
+	}
+	if riff := binary.LittleEndian.Uint32(data[4:]); int(riff) != len(data)-8 {
+		t.Errorf("%v riff size %v, file size %v", path, riff, len(data))
+	}
+	if rate := binary.LittleEndian.Uint32(data[24:]); rate != 48000 {
+		t.Errorf("%v sample rate %v", path, rate)
+	}
+	size := int(binary.LittleEndian.Uint32(data[40:]))
+	if size != len(data)-44 {
+		t.Fatalf("%v data size %v, file size %v", path, size, len(data))
+	}
+	samples := make([]int16, size/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[44+2*i:]))
+	}
+	return samples
+}
+
+func readManifest(t *testing.T, dir string) bridge.RecordingManifest {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bridge.RecordingManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func constFrame(v int16) []int16 {
+	f := make([]int16, 480)
+	for i := range f {
+		f[i] = v
+	}
+	return f
+}
+
+func TestRecorderTracks(t *testing.T) {
+	c := clock.NewVirtual(epoch)
+	r := bridge.NewRecorder(t.TempDir(), c, nil)
+
+	st, err := r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Recording || filepath.Base(st.Dir) != "session-"+epoch.Format("20060102-150405") {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if _, err := r.Start(); err != bridge.ErrRecording {
+		t.Errorf("second start returned %v", err)
+	}
+
+	r.Frame("mumble", "session:7", "bob", "bob", constFrame(1))
+	c.Advance(50 * time.Millisecond)
+	// The user of a Discord stream is known after the first frames
+	r.Frame("discord", "ssrc:1234", "", "", constFrame(2))
+	r.Frame("discord", "ssrc:1234", "u1", "alice", constFrame(3))
+	r.Frame("mumble", "session:7", "bob", "bob", constFrame(4))
+	// Gaps within the tolerance are bursts and not filled
+	c.Advance(60 * time.Millisecond)
+	r.Frame("mumble", "session:7", "bob", "bob", constFrame(5))
+	// Longer gaps keep the track aligned
+	c.Advance(500 * time.Millisecond)
+	r.Frame("discord", "ssrc:1234", "u1", "alice", constFrame(6))
+
+	m, err := r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Stop(); err != bridge.ErrNotRecording {
+		t.Errorf("second stop returned %v", err)
+	}
+	if r.Status().Recording {
+		t.Error("recording after stop")
+	}
+
+	written := readManifest(t, st.Dir)
+	if !written.Stopped.Equal(epoch.Add(610*time.Millisecond)) || written.SampleRate != 48000 || written.Format != "wav" {
+		t.Errorf("unexpected manifest %+v", written)
+	}
+	if len(m.Tracks) != 2 || len(written.Tracks) != 2 {
+		t.Fatalf("unexpected tracks %+v", written.Tracks)
+	}
+
+	expected := []bridge.RecordingTrack{
+		{File: "01-mumble-bob.wav", Kind: bridge.TrackUser, Side: "mumble", Stream: "session:7", User: "bob", Name: "bob", Samples: 3 * 480},
+		{File: "02-discord-ssrc_1234.wav", Kind: bridge.TrackUser, Side: "discord", Stream: "ssrc:1234", User: "u1", Name: "alice",
+			OffsetMS: 50, OffsetSamples: 2400, Samples: 570 * 48},
+	}
+	for i, e := range expected {
+		if written.Tracks[i] != e {
+			t.Errorf("track %v\n%+v, expected\n%+v", i, written.Tracks[i], e)
+		}
+	}
+
+	bob := readWAV(t, filepath.Join(st.Dir, expected[0].File))
+	if len(bob) != 3*480 || bob[0] != 1 || bob[480] != 4 || bob[960] != 5 {
+		t.Errorf("unexpected mumble track, %v samples", len(bob))
+	}
+	alice := readWAV(t, filepath.Join(st.Dir, expected[1].File))
+	if len(alice) != 570*48 || alice[0] != 2 || alice[480] != 3 || alice[960] != 0 {
+		t.Fatalf("unexpected discord track, %v samples", len(alice))
+	}
+	// The last frame starts 610ms into the session
+	if alice[(610-50)*48-1] != 0 || alice[(610-50)*48] != 6 {
+		t.Errorf("last discord frame is not aligned")
+	}
+}
+
+func TestRecorderDisabled(t *testing.T) {
+	var r *bridge.Recorder
+	r.Frame("mumble", "session:1", "bob", "bob", constFrame(1))
+	if _, err := r.Start(); err != bridge.ErrRecorderDisabled {
+		t.Errorf("start returned %v", err)
+	}
+	if _, err := r.Stop(); err != bridge.ErrRecorderDisabled {
+		t.Errorf("stop returned %v", err)
+	}
+
+	b := startTestBridge(t)
+	sender := &gumble.User{Name: "bob", Session: 9, Channel: &gumble.Channel{Name: "Root"}}
+	b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: sender, Message: "/record start"}})
+	msgs := b.Mumble.UserMessages(sender.Session)
+	if len(msgs) != 1 || msgs[0] != "Could not start recording: recording is not enabled" {
+		t.Errorf("unexpected replies %q", msgs)
+	}
+}
+
+func TestBridgeRecording(t *testing.T) {
+	dir := t.TempDir()
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.DiscordSpamChannel = bridgetest.TextChannelID
+	b.Recorder = bridge.NewRecorder(dir, nil, nil)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	// Started from Discord by a user in the voice channel, announced on both sides
+	b.Discord.SetVoiceState(bridgetest.GuildID, "u1", bridgetest.VoiceChannelID)
+	b.DiscordListener.MessageCreate(nil, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: bridgetest.TextChannelID,
+		Content:   "!mumble-discord record start",
+		Author:    &discordgo.User{ID: "u1", Username: "alice"},
+	}})
+	st := b.Recorder.Status()
+	if !st.Recording {
+		t.Fatal("not recording after the start command")
+	}
+	announcement := "Recording started by alice, audio on both sides of the bridge is being recorded"
+	msgs := b.Discord.Messages()
+	if len(msgs) != 2 || msgs[0].Content != announcement || msgs[1].Content != "Recording to "+filepath.Base(st.Dir) {
+		t.Errorf("unexpected discord messages %+v", msgs)
+	}
+	if mumble := b.Mumble.ChannelMessages(); len(mumble) != 1 || mumble[0] != announcement {
+		t.Errorf("unexpected mumble messages %q", mumble)
+	}
+
+	testDiscordToMumble(t, b)
+	testMumbleToDiscord(t, b)
+
+	// Stopped from Mumble
+	sender := &gumble.User{Name: "bob", Session: 9, Channel: &gumble.Channel{Name: "Root"}}
+	b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: sender, Message: "/record stop"}})
+	if b.Recorder.Status().Recording {
+		t.Fatal("recording after the stop command")
+	}
+	if mumble := b.Mumble.ChannelMessages(); mumble[len(mumble)-1] != "Recording stopped by bob" {
+		t.Errorf("unexpected mumble messages %q", mumble)
+	}
+
+	m := readManifest(t, st.Dir)
+	tracks := map[string]bridge.RecordingTrack{}
+	for _, tr := range m.Tracks {
+		tracks[tr.Stream] = tr
+		if samples := readWAV(t, filepath.Join(st.Dir, tr.File)); int64(len(samples)) != tr.Samples || tr.Samples == 0 {
+			t.Errorf("track %+v has %v samples", tr, len(samples))
+		}
+	}
+	if tr := tracks["ssrc:1234"]; tr.Side != "discord" || tr.User != "u1" || tr.Name != "alice" {
+		t.Errorf("unexpected discord track %+v", tr)
+	}
+	if tr := tracks["session:7"]; tr.Side != "mumble" || tr.Name != "bob" {
+		t.Errorf("unexpected mumble track %+v", tr)
+	}
+	if tr := tracks["to_mumble"]; tr.Kind != bridge.TrackMix || tr.Side != "mumble" {
+		t.Errorf("unexpected mix track %+v", tr)
+	}
+	if tr := tracks["to_discord"]; tr.Kind != bridge.TrackMix || tr.Side != "discord" || tr.OffsetMS < tracks["to_mumble"].OffsetMS {
+		t.Errorf("unexpected mix track %+v", tr)
+	}
+}
+
+func TestRecordingAPI(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.Recorder = bridge.NewRecorder(t.TempDir(), nil, nil)
+	srv := httptest.NewServer(b.APIHandler("secret"))
+	defer srv.Close()
+
+	do := func(method, path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := do("POST", "/recording/start", ""); code != http.StatusUnauthorized {
+		t.Errorf("start without token returned %v", code)
+	}
+	if code, _ := do("POST", "/recording/start", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("start with a wrong token returned %v", code)
+	}
+	if code, _ := do("GET", "/recording/start", "secret"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET start returned %v", code)
+	}
+	if code, body := do("POST", "/recording/start", "secret"); code != http.StatusOK || !strings.Contains(body, `"recording":true`) {
+		t.Errorf("start returned %v %v", code, body)
+	}
+	if code, _ := do("POST", "/recording/start", "secret"); code != http.StatusConflict {
+		t.Errorf("second start returned %v", code)
+	}
+	if code, body := do("GET", "/recording", "secret"); code != http.StatusOK || !strings.Contains(body, `"recording":true`) {
+		t.Errorf("status returned %v %v", code, body)
+	}
+	if code, body := do("POST", "/recording/stop", "secret"); code != http.StatusOK || !strings.Contains(body, `"tracks":[]`) {
+		t.Errorf("stop returned %v %v", code, body)
+	}
+	if code, _ := do("POST", "/recording/stop", "secret"); code != http.StatusConflict {
+		t.Errorf("second stop returned %v", code)
+	}
+
+	b.Recorder = nil
+	if code, _ := do("POST", "/recording/start", "secret"); code != http.StatusNotFound {
+		t.Errorf("start without recorder returned %v", code)
+	}
+}
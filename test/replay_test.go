@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+	"github.com/stieneee/mumble-discord-bridge/pkg/clock"
+)
+
+// channels splits interleaved stereo samples
+func channels(stereo []int16) (left, right []int16) {
+	for i := 0; i+1 < len(stereo); i += 2 {
+		left = append(left, stereo[i])
+		right = append(right, stereo[i+1])
+	}
+	return left, right
+}
+
+func TestReplayBufferClip(t *testing.T) {
+	dir := t.TempDir()
+	c := clock.NewVirtual(epoch)
+	rb := bridge.NewReplayBuffer(dir, time.Second, c)
+
+	rb.Frame("mumble", constFrame(1))
+	c.Advance(10 * time.Millisecond)
+	rb.Frame("discord", constFrame(2))
+	c.Advance(10 * time.Millisecond)
+
+	path, d, err := rb.Clip(30 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "clip-"+epoch.Format("20060102-150405")+".wav" || d != 30*time.Millisecond {
+		t.Errorf("clip %v of %v", path, d)
+	}
+	left, right := channels(readWAV(t, path))
+	if len(left) != 1440 {
+		t.Fatalf("clip of %v samples per channel", len(left))
+	}
+	// Frames within the gap tolerance follow each other, the clip ends with the latest frame of each mix
+	if left[479] != 0 || left[480] != 0 || left[959] != 0 || left[960] != 1 || left[1439] != 1 {
+		t.Errorf("unexpected left channel")
+	}
+	if right[959] != 0 || right[960] != 2 || right[1439] != 2 {
+		t.Errorf("unexpected right channel")
+	}
+	// Clips in the same second get a suffix
+	if path, _, err := rb.Clip(0); err != nil || !strings.HasSuffix(path, "-2.wav") {
+		t.Errorf("second clip %v, %v", path, err)
+	}
+
+	// After a long silence only the latest audio is kept
+	c.Advance(5 * time.Second)
+	rb.Frame("mumble", constFrame(3))
+	c.Advance(10 * time.Millisecond)
+	path, d, err = rb.Clip(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != time.Second {
+		t.Errorf("clip %v of %v", path, d)
+	}
+	left, right = channels(readWAV(t, path))
+	if len(left) != 48000 {
+		t.Fatalf("clip of %v samples per channel", len(left))
+	}
+	for i := range left {
+		expected := int16(0)
+		if i >= 48000-480 {
+			expected = 3
+		}
+		if left[i] != expected || right[i] != 0 {
+			t.Fatalf("unexpected sample %v: %v %v", i, left[i], right[i])
+		}
+	}
+
+	var disabled *bridge.ReplayBuffer
+	disabled.Frame("mumble", constFrame(1))
+	if _, _, err := disabled.Clip(0); err != bridge.ErrReplayDisabled {
+		t.Errorf("clip without buffer returned %v", err)
+	}
+}
+
+func TestBridgeClip(t *testing.T) {
+	dir := t.TempDir()
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.DiscordSpamChannel = bridgetest.TextChannelID
+	b.Replay = bridge.NewReplayBuffer(dir, 10*time.Second, nil)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	testDiscordToMumble(t, b)
+
+	sender := &gumble.User{Name: "bob", Session: 9, Channel: &gumble.Channel{Name: "Root"}}
+	send := func(msg string) {
+		b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: sender, Message: msg}})
+	}
+	send("/clip soon")
+	send("/clip 5")
+
+	replies := b.Mumble.UserMessages(sender.Session)
+	if len(replies) != 2 || replies[0] != "Usage: clip [seconds]" || !strings.HasPrefix(replies[1], "Saved clip-") {
+		t.Fatalf("unexpected replies %q", replies)
+	}
+	msgs := b.Discord.Messages()
+	if last := msgs[len(msgs)-1]; last.Content != "Clip of the last 5s saved by bob" {
+		t.Errorf("unexpected announcement %+v", last)
+	}
+
+	left, _ := channels(readWAV(t, filepath.Join(dir, strings.TrimPrefix(replies[1], "Saved "))))
+	if len(left) != 5*48000 {
+		t.Fatalf("clip of %v samples per channel", len(left))
+	}
+	if p := bridgetest.Peak(left); p < 2000 {
+		t.Errorf("clip peak %v, expected the tone sent to mumble", p)
+	}
+}
+
+func TestClipAPI(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	srv := httptest.NewServer(b.APIHandler(""))
+	defer srv.Close()
+
+	post := func(path string) (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := http.Post(srv.URL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	if code, _ := post("/clip"); code != http.StatusNotFound {
+		t.Errorf("clip without buffer returned %v", code)
+	}
+	b.Replay = bridge.NewReplayBuffer(t.TempDir(), 10*time.Second, nil)
+	if code, _ := post("/clip?seconds=-1"); code != http.StatusBadRequest {
+		t.Errorf("clip of negative seconds returned %v", code)
+	}
+	code, body := post("/clip?seconds=2")
+	if code != http.StatusOK || body["seconds"] != 2.0 || !strings.HasPrefix(filepath.Base(body["file"].(string)), "clip-") {
+		t.Errorf("clip returned %v %v", code, body)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/pkg/sdnotify"
+)
+
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	old, had := os.LookupEnv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", path)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv("NOTIFY_SOCKET", old)
+		} else {
+			os.Unsetenv("NOTIFY_SOCKET")
+		}
+	})
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	for _, state := range []string{sdnotify.Ready, sdnotify.Status("bridge connected"), sdnotify.Watchdog} {
+		sent, err := sdnotify.Notify(state)
+		if err != nil || !sent {
+			t.Fatal("notify failed", sent, err)
+		}
+		if got := readNotify(t, conn); got != state {
+			t.Errorf("expected %q got %q", state, got)
+		}
+	}
+}
+
+func TestSdNotifyNoSocket(t *testing.T) {
+	old, had := os.LookupEnv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	defer func() {
+		if had {
+			os.Setenv("NOTIFY_SOCKET", old)
+		}
+	}()
+
+	sent, err := sdnotify.Notify(sdnotify.Ready)
+	if sent || err != nil {
+		t.Error("expected no notification without a socket", sent, err)
+	}
+}
+
+func TestSdNotifyWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d, err := sdnotify.WatchdogInterval(); err != nil || d != 30*time.Second {
+		t.Error("unexpected watchdog interval", d, err)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d, err := sdnotify.WatchdogInterval(); err != nil || d != 0 {
+		t.Error("watchdog for another pid should be ignored", d, err)
+	}
+}
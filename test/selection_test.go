@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// mumbleSpeaker sends 20ms packets of a constant value from a new mumble user
+func mumbleSpeaker(b *bridgetest.Bridge, session uint32, value int16, packets int) {
+	registeredSpeaker(b, session, 0, value, packets)
+}
+
+// registeredSpeaker sends 20ms packets of a constant value from a new registered mumble user
+func registeredSpeaker(b *bridgetest.Bridge, session, userID uint32, value int16, packets int) {
+	user := &gumble.User{Name: "user", Session: session, UserID: userID}
+	c := make(chan *gumble.AudioPacket, packets)
+	b.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: c})
+	for i := 0; i < packets; i++ {
+		buf := make(gumble.AudioBuffer, 960)
+		for j := range buf {
+			buf[j] = value
+		}
+		c <- &gumble.AudioPacket{Sender: user, AudioBuffer: buf}
+	}
+	close(c)
+}
+
+// discordPeaks returns the peaks of the next n opus frames sent to discord
+func discordPeaks(t *testing.T, voice *bridgetest.Voice, n int) []int {
+	t.Helper()
+	dec, err := gopus.NewDecoder(48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peaks []int
+	timeout := time.After(bridgeTimeout)
+	for len(peaks) < n {
+		select {
+		case opus := <-voice.Sent:
+			pcm, err := dec.Decode(opus, 960, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peaks = append(peaks, bridgetest.Peak(pcm))
+		case <-timeout:
+			t.Fatalf("received %v opus frames on discord", len(peaks))
+		}
+	}
+	return peaks
+}
+
+func TestBridgeLoudestSpeakers(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.MixMaxSpeakers = 1
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	voice := b.Discord.Voice()
+
+	// Only the loudest of three speakers is mixed
+	mumbleSpeaker(b, 1, 500, 50)
+	mumbleSpeaker(b, 2, 3000, 50)
+	mumbleSpeaker(b, 3, 1000, 50)
+	peaks := discordPeaks(t, voice, 20)
+	for _, p := range peaks[2:] {
+		if p != 3000 {
+			t.Fatalf("expected only the loudest speaker, peaks %v", peaks)
+		}
+	}
+	if n := counterMetric(t, b, "mdb_mumble_unmixed_count"); n < 60 {
+		t.Errorf("%v unmixed frames", n)
+	}
+
+	// A speaker less than 3 dB louder does not take the place of the mixed speaker
+	mumbleSpeaker(b, 4, 3500, 10)
+	peaks = discordPeaks(t, voice, 8)
+	for _, p := range peaks {
+		if p != 3000 {
+			t.Fatalf("mixed speaker replaced, peaks %v", peaks)
+		}
+	}
+}
+
+func TestBridgeLoudestSpeakersPriority(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.MixMaxSpeakers = 1
+	b.Priority = bridge.NewPrioritySpeakers("", "7,8", 1)
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	voice := b.Discord.Voice()
+
+	// Both quiet priority speakers are mixed with the loudest of the others
+	registeredSpeaker(b, 1, 7, 500, 50)
+	registeredSpeaker(b, 2, 8, 600, 50)
+	mumbleSpeaker(b, 3, 3000, 50)
+	mumbleSpeaker(b, 4, 1000, 50)
+	peaks := discordPeaks(t, voice, 20)
+	for _, p := range peaks[2:] {
+		if p != 4100 {
+			t.Fatalf("expected both priority speakers and the loudest speaker, peaks %v", peaks)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+	"github.com/stieneee/mumble-discord-bridge/internal/sound"
+	"github.com/stieneee/mumble-discord-bridge/pkg/flac"
+	"github.com/stieneee/mumble-discord-bridge/pkg/wav"
+)
+
+// writeWAVFile writes interleaved samples as a 16 bit WAV file
+func writeWAVFile(t *testing.T, path string, rate, channels int, samples []int16) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := wav.NewWriter(f, rate, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSoundDecodeWAV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tone.wav")
+	stereo := make([]int16, 2*24000)
+	for i := 0; i < len(stereo); i += 2 {
+		stereo[i], stereo[i+1] = 1000, 3000
+	}
+	writeWAVFile(t, path, 24000, 2, stereo)
+
+	pcm, err := sound.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One second, downmixed and resampled to 48kHz
+	if len(pcm) != 48000 {
+		t.Fatalf("decoded %v samples", len(pcm))
+	}
+	for i, s := range pcm {
+		if s != 2000 {
+			t.Fatalf("sample %v is %v", i, s)
+		}
+	}
+
+	if _, err := sound.Decode(strings.NewReader("ID3 not a supported file")); err != sound.ErrFormat {
+		t.Errorf("unknown format returned %v", err)
+	}
+	if !sound.Supported("horn.FLAC") || sound.Supported("horn.mp3") {
+		t.Error("unexpected supported extensions")
+	}
+}
+
+// flacWriter writes big endian bit fields for hand built FLAC streams
+type flacWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (w *flacWriter) write(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> w.bits
+		}
+		w.bits = (w.bits + 1) % 8
+	}
+}
+
+func (w *flacWriter) signed(v int64, n int) {
+	w.write(uint64(v)&(1<<uint(n)-1), n)
+}
+
+func (w *flacWriter) rice(v int64, param uint) {
+	u := uint64(v<<1) ^ uint64(v>>63)
+	for q := u >> param; q > 0; q-- {
+		w.write(0, 1)
+	}
+	w.write(1, 1)
+	w.write(u, int(param))
+}
+
+func (w *flacWriter) align() {
+	w.bits = 0
+}
+
+func flacCRC8(b []byte) uint64 {
+	var c byte
+	for _, v := range b {
+		c ^= v
+		for i := 0; i < 8; i++ {
+			if c&0x80 != 0 {
+				c = c<<1 ^ 0x07
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return uint64(c)
+}
+
+func flacCRC16(b []byte) uint64 {
+	var c uint16
+	for _, v := range b {
+		c ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if c&0x8000 != 0 {
+				c = c<<1 ^ 0x8005
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return uint64(c)
+}
+
+// flacSubframe writes one subframe of s with bps bits per sample
+type flacSubframe func(w *flacWriter, s []int64, bps int)
+
+func flacConstant(w *flacWriter, s []int64, bps int) {
+	w.write(0, 1)
+	w.write(0, 6)
+	w.write(0, 1)
+	w.signed(s[0], bps)
+}
+
+// flacVerbatimWasted stores samples that are multiples of 4 with 2 wasted bits
+func flacVerbatimWasted(w *flacWriter, s []int64, bps int) {
+	w.write(0, 1)
+	w.write(1, 6)
+	w.write(1, 1)
+	w.write(0, 1) // unary 1, 2 wasted bits
+	w.write(1, 1)
+	for _, v := range s {
+		w.signed(v>>2, bps-2)
+	}
+}
+
+// flacFixed2 predicts with the second order fixed predictor and two Rice partitions
+func flacFixed2(w *flacWriter, s []int64, bps int) {
+	w.write(0, 1)
+	w.write(8+2, 6)
+	w.write(0, 1)
+	w.signed(s[0], bps)
+	w.signed(s[1], bps)
+	w.write(0, 2) // 4 bit Rice parameters
+	w.write(1, 4) // partition order 1
+	half := len(s) / 2
+	w.write(3, 4)
+	for i := 2; i < half; i++ {
+		w.rice(s[i]-(2*s[i-1]-s[i-2]), 3)
+	}
+	w.write(15, 4) // escaped partition
+	w.write(12, 5)
+	for i := half; i < len(s); i++ {
+		w.signed(s[i]-(2*s[i-1]-s[i-2]), 12)
+	}
+}
+
+// flacLPC1 predicts (3*s[i-1]) >> 2 with a 5 bit Rice parameter
+func flacLPC1(w *flacWriter, s []int64, bps int) {
+	w.write(0, 1)
+	w.write(32, 6)
+	w.write(0, 1)
+	w.signed(s[0], bps)
+	w.write(3-1, 4) // precision
+	w.signed(2, 5)  // shift
+	w.signed(3, 3)
+	w.write(1, 2) // 5 bit Rice parameters
+	w.write(0, 4)
+	w.write(6, 5)
+	for i := 1; i < len(s); i++ {
+		w.rice(s[i]-(3*s[i-1])>>2, 6)
+	}
+}
+
+// flacFrame writes a 16 bit 48kHz frame of two channels
+func flacFrame(w *flacWriter, number, chanCode int, a, b []int64, sa, sb flacSubframe) {
+	start := len(w.buf)
+	w.write(0x3ffe, 14)
+	w.write(0, 2)
+	w.write(7, 4) // 16 bit block size at the end of the header
+	w.write(10, 4)
+	w.write(uint64(chanCode), 4)
+	w.write(4, 3)
+	w.write(0, 1)
+	w.write(uint64(number), 8)
+	w.write(uint64(len(a)-1), 16)
+	w.write(flacCRC8(w.buf[start:]), 8)
+
+	bpsA, bpsB := 16, 16
+	switch chanCode {
+	case 8, 10:
+		bpsB++
+	case 9:
+		bpsA++
+	}
+	sa(w, a, bpsA)
+	sb(w, b, bpsB)
+	w.align()
+	w.write(flacCRC16(w.buf[start:]), 16)
+}
+
+func TestFLACDecode(t *testing.T) {
+	const n = 64
+	w := &flacWriter{}
+	w.buf = append(w.buf, "fLaC"...)
+	w.write(0x80, 8) // last block, STREAMINFO
+	w.write(34, 24)
+	w.write(n, 16)
+	w.write(n, 16)
+	w.write(0, 24)
+	w.write(0, 24)
+	w.write(48000, 20)
+	w.write(2-1, 3)
+	w.write(16-1, 5)
+	w.write(4*n, 36)
+	for i := 0; i < 16; i++ {
+		w.write(0, 8)
+	}
+
+	var left, right []int64
+	frame := func(l, r func(i int) int64) ([]int64, []int64) {
+		fl, fr := make([]int64, n), make([]int64, n)
+		for i := range fl {
+			fl[i], fr[i] = l(i), r(i)
+		}
+		left, right = append(left, fl...), append(right, fr...)
+		return fl, fr
+	}
+
+	// Independent channels, constant and verbatim with wasted bits
+	l, r := frame(func(i int) int64 { return -1234 }, func(i int) int64 { return int64(i*4 - 100) })
+	flacFrame(w, 0, 1, l, r, flacConstant, flacVerbatimWasted)
+
+	// Left and side, fixed predictor
+	l, r = frame(func(i int) int64 { return int64(i*i - 500) }, func(i int) int64 { return int64(i*i) - 30000 })
+	side := make([]int64, n)
+	for i := range side {
+		side[i] = l[i] - r[i]
+	}
+	flacFrame(w, 1, 8, l, side, flacFixed2, flacFixed2)
+
+	// Side and right, LPC
+	l, r = frame(func(i int) int64 { return int64(8000 - i*50) }, func(i int) int64 { return int64(-6000 + i*7) })
+	for i := range side {
+		side[i] = l[i] - r[i]
+	}
+	flacFrame(w, 2, 9, side, r, flacLPC1, flacLPC1)
+
+	// Mid and side with an odd side
+	l, r = frame(func(i int) int64 { return int64(i*3 + 1) }, func(i int) int64 { return int64(-i * 2) })
+	mid := make([]int64, n)
+	for i := range side {
+		mid[i], side[i] = (l[i]+r[i])>>1, l[i]-r[i]
+	}
+	flacFrame(w, 3, 10, mid, side, flacFixed2, flacLPC1)
+
+	samples, rate, channels, err := flac.Decode(bytes.NewReader(w.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 48000 || channels != 2 || len(samples) != 2*len(left) {
+		t.Fatalf("decoded %v samples of %v channels at %v", len(samples), channels, rate)
+	}
+	for i := range left {
+		if int64(samples[2*i]) != left[i] || int64(samples[2*i+1]) != right[i] {
+			t.Fatalf("sample %v is %v %v, expected %v %v", i, samples[2*i], samples[2*i+1], left[i], right[i])
+		}
+	}
+
+	// A flipped bit fails the frame checksum
+	broken := append([]byte(nil), w.buf...)
+	broken[len(broken)-20] ^= 0x10
+	if _, _, _, err := flac.Decode(bytes.NewReader(broken)); err == nil {
+		t.Error("expected an error for a corrupted frame")
+	}
+}
+
+// oggPage writes one Ogg page holding one packet
+func oggPage(buf *bytes.Buffer, flags byte, granule int64, seq uint32, packet []byte) {
+	var segments []byte
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+	page := make([]byte, 27, 27+len(segments)+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], 0x5eed)
+	binary.LittleEndian.PutUint32(page[18:], seq)
+	page[26] = byte(len(segments))
+	page = append(append(page, segments...), packet...)
+
+	var c uint32
+	for _, v := range page {
+		c ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(page[22:], c)
+	buf.Write(page)
+}
+
+// opusFile encodes frames of 20ms mono samples as an Ogg/Opus file
+func opusFile(t *testing.T, preSkip int, frames [][]int16, length int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8], head[9] = 1, 1
+	binary.LittleEndian.PutUint16(head[10:], uint16(preSkip))
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+	oggPage(&buf, 0x02, 0, 0, head)
+	oggPage(&buf, 0, 0, 1, append([]byte("OpusTags"), make([]byte, 8)...))
+
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range frames {
+		opus, err := enc.Encode(f, 960, 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags, granule := byte(0), int64((i+1)*960)
+		if i == len(frames)-1 {
+			flags, granule = 0x04, int64(preSkip+length)
+		}
+		oggPage(&buf, flags, granule, uint32(i+2), opus)
+	}
+	return buf.Bytes()
+}
+
+func TestSoundDecodeOpus(t *testing.T) {
+	var frames [][]int16
+	for i := 0; i < 3; i++ {
+		frames = append(frames, bridgetest.Tone(440, 8000, i*960, 960))
+	}
+	pcm, err := sound.Decode(bytes.NewReader(opusFile(t, 312, frames, 2000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pre-skip is dropped and the last page ends the audio
+	if len(pcm) != 2000 {
+		t.Fatalf("decoded %v samples", len(pcm))
+	}
+	if p := bridgetest.Peak(pcm); p < 6000 {
+		t.Errorf("decoded peak %v, expected the tone", p)
+	}
+
+	broken := opusFile(t, 312, frames, 2000)
+	broken[len(broken)-1] ^= 0xff
+	if _, err := sound.Decode(bytes.NewReader(broken)); err == nil {
+		t.Error("expected an error for a corrupted page")
+	}
+}
+
+func TestSoundboardQueue(t *testing.T) {
+	dir := t.TempDir()
+	writeWAVFile(t, filepath.Join(dir, "beep.wav"), 48000, 1, constFrame(1000))
+	writeWAVFile(t, filepath.Join(dir, "long.wav"), 48000, 1, make([]int16, 48000))
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a sound"), 0600)
+
+	sb := bridge.NewSoundboard(dir)
+	files, err := sb.Files()
+	if err != nil || len(files) != 2 || files[0] != "beep.wav" || files[1] != "long.wav" {
+		t.Fatalf("files %v, %v", files, err)
+	}
+	if _, _, err := sb.Play("../beep.wav", bridge.TargetBoth, 1, ""); err != bridge.ErrSoundNotFound {
+		t.Errorf("path outside the directory returned %v", err)
+	}
+	if _, _, err := sb.Play("beep", "everyone", 1, ""); err != bridge.ErrInvalidSound {
+		t.Errorf("invalid target returned %v", err)
+	}
+	if _, _, err := sb.Play("beep", "mumble", 3, ""); err != bridge.ErrInvalidSound {
+		t.Errorf("invalid volume returned %v", err)
+	}
+
+	item, position, err := sb.Play("long", "discord", 1, "bob")
+	if err != nil || position != 0 || item.File != "long.wav" || item.Seconds != 1 {
+		t.Fatalf("play returned %+v %v %v", item, position, err)
+	}
+	if _, position, err = sb.Play("beep", bridge.TargetBoth, 0.5, ""); err != nil || position != 1 {
+		t.Fatalf("queue returned %v %v", position, err)
+	}
+	if q := sb.Queue(); len(q) != 2 || q[0].By != "bob" || q[1].Volume != 0.5 {
+		t.Errorf("queue %+v", q)
+	}
+	if skipped, err := sb.Skip(); err != nil || skipped.File != "long.wav" {
+		t.Errorf("skip returned %+v %v", skipped, err)
+	}
+	if n := sb.Stop(); n != 1 {
+		t.Errorf("stop removed %v sounds", n)
+	}
+	if _, err := sb.Skip(); err != bridge.ErrNothingPlaying {
+		t.Errorf("skip of an empty queue returned %v", err)
+	}
+
+	var disabled *bridge.Soundboard
+	if _, _, err := disabled.Play("beep", bridge.TargetBoth, 1, ""); err != bridge.ErrSoundboardDisabled {
+		t.Errorf("play without soundboard returned %v", err)
+	}
+}
+
+func TestBridgeSoundboard(t *testing.T) {
+	dir := t.TempDir()
+	var tone []int16
+	for i := 0; i < 50; i++ {
+		tone = append(tone, bridgetest.Tone(440, 8000, i*960, 960)...)
+	}
+	writeWAVFile(t, filepath.Join(dir, "tone.wav"), 48000, 1, tone)
+
+	b := bridgetest.NewBridge(nil)
+	b.Soundboard = bridge.NewSoundboard(dir)
+	sender := &gumble.User{Name: "bob", Session: 9, Channel: &gumble.Channel{Name: "Root"}}
+	send := func(msg string) {
+		b.MumbleListener.MumbleTextMessage(&gumble.TextMessageEvent{TextMessage: gumble.TextMessage{Sender: sender, Message: msg}})
+	}
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+
+	send("/sound play tone both 50%")
+	send("/sound queue")
+	replies := b.Mumble.UserMessages(sender.Session)
+	if len(replies) != 2 || replies[0] != "Playing tone.wav (1s) to both" || replies[1] != "0. tone.wav (1s) to both" {
+		t.Fatalf("unexpected replies %q", replies)
+	}
+
+	// The sound is mixed into both sides at half its level
+	audio := b.Mumble.Client().Audio()
+	max := 0
+	timeout := time.After(bridgeTimeout)
+	for frames := 0; frames < 50; frames++ {
+		select {
+		case buf := <-audio:
+			if p := bridgetest.Peak(buf); p > max {
+				max = p
+			}
+		case <-timeout:
+			t.Fatalf("received %v frames on mumble", frames)
+		}
+	}
+	if max < 3500 || max > 4500 {
+		t.Errorf("mumble audio peak %v, expected the tone at half level", max)
+	}
+
+	dec, err := gopus.NewDecoder(48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voice := b.Discord.Voice()
+	max = 0
+	for frames := 0; frames < 10; frames++ {
+		select {
+		case opus := <-voice.Sent:
+			pcm, err := dec.Decode(opus, 960, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := bridgetest.Peak(pcm); p > max {
+				max = p
+			}
+		case <-timeout:
+			t.Fatalf("received %v opus frames on discord", frames)
+		}
+	}
+	if max < 3500 || max > 4500 {
+		t.Errorf("discord audio peak %v, expected the tone at half level", max)
+	}
+
+	// The finished sound leaves the queue
+	deadline := time.Now().Add(bridgeTimeout)
+	for len(b.Soundboard.Queue()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q := b.Soundboard.Queue(); len(q) != 0 {
+		t.Errorf("queue %+v after the sound ended", q)
+	}
+}
+
+func TestSoundboardAPI(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	srv := httptest.NewServer(b.APIHandler(""))
+	defer srv.Close()
+
+	request := func(method, path string) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	if code, _ := request(http.MethodGet, "/sounds"); code != http.StatusNotFound {
+		t.Errorf("sounds without soundboard returned %v", code)
+	}
+	dir := t.TempDir()
+	writeWAVFile(t, filepath.Join(dir, "beep.wav"), 48000, 1, constFrame(1000))
+	ioutil.WriteFile(filepath.Join(dir, "broken.wav"), []byte("RIFF...."), 0600)
+	b.Soundboard = bridge.NewSoundboard(dir)
+
+	code, body := request(http.MethodGet, "/sounds")
+	if code != http.StatusOK || len(body["files"].([]interface{})) != 2 || len(body["queue"].([]interface{})) != 0 {
+		t.Errorf("sounds returned %v %v", code, body)
+	}
+	if code, _ := request(http.MethodPost, "/sounds/play?file=beep"); code != http.StatusConflict {
+		t.Errorf("play while disconnected returned %v", code)
+	}
+
+	b.BridgeMutex.Lock()
+	b.Connected = true
+	b.BridgeMutex.Unlock()
+	if code, _ := request(http.MethodPost, "/sounds/play?file=missing"); code != http.StatusNotFound {
+		t.Errorf("play of a missing file returned %v", code)
+	}
+	if code, _ := request(http.MethodPost, "/sounds/play?file=beep&volume=loud"); code != http.StatusBadRequest {
+		t.Errorf("play with an invalid volume returned %v", code)
+	}
+	if code, _ := request(http.MethodPost, "/sounds/play?file=broken"); code == http.StatusOK {
+		t.Errorf("play of a broken file returned %v", code)
+	}
+	code, body = request(http.MethodPost, "/sounds/play?file=beep&to=mumble&volume=80")
+	if code != http.StatusOK || body["file"] != "beep.wav" || body["to"] != "mumble" || body["volume"] != 0.8 || body["position"] != 0.0 {
+		t.Errorf("play returned %v %v", code, body)
+	}
+	if code, body := request(http.MethodPost, "/sounds/stop"); code != http.StatusOK || body["stopped"] != 1.0 {
+		t.Errorf("stop returned %v %v", code, body)
+	}
+	if code, _ := request(http.MethodPost, "/sounds/skip"); code != http.StatusConflict {
+		t.Errorf("skip of an empty queue returned %v", code)
+	}
+	if code, _ := request(http.MethodGet, "/sounds/stop"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET stop returned %v", code)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stieneee/gopus"
+	"github.com/stieneee/gumble/gumble"
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// benchSpeakers is the number of users speaking on each side
+const benchSpeakers = 10
+
+// speakLoad sends 20ms packets from benchSpeakers users on both sides until stop is closed.
+// The packets are prepared up front so the load itself allocates little.
+func speakLoad(b *testing.B, br *bridgetest.Bridge, voice *bridgetest.Voice, stop <-chan struct{}) {
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Audio)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opus, err := enc.Encode(bridgetest.Tone(440, 1000, 0, 960), 960, 3840)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var mumble []chan *gumble.AudioPacket
+	var packets []*gumble.AudioPacket
+	for i := 0; i < benchSpeakers; i++ {
+		id := strconv.Itoa(i + 1)
+		br.Discord.AddUser("u"+id, "discord"+id)
+		br.Discord.SetVoiceState(bridgetest.GuildID, "u"+id, bridgetest.VoiceChannelID)
+		voice.Speak(uint32(1000+i), "u"+id)
+
+		user := &gumble.User{Name: "mumble" + id, Session: uint32(i + 1)}
+		c := make(chan *gumble.AudioPacket, 10)
+		br.MumbleStream.OnAudioStream(&gumble.AudioStreamEvent{User: user, C: c})
+		mumble = append(mumble, c)
+		packets = append(packets, &gumble.AudioPacket{Sender: user, AudioBuffer: bridgetest.Tone(440, 1000, 0, 960)})
+	}
+	voiceUpdate(br)
+
+	go func() {
+		defer func() {
+			for _, c := range mumble {
+				close(c)
+			}
+		}()
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := 0; ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for i := 0; i < benchSpeakers; i++ {
+				mumble[i] <- packets[i]
+				voice.Recv <- &discordgo.Packet{SSRC: uint32(1000 + i), Sequence: uint16(seq), Timestamp: uint32(seq * 960), Opus: opus}
+			}
+		}
+	}()
+}
+
+// BenchmarkBridgeSpeakers measures a bridge relaying benchSpeakers users on each side.
+// Every op is 10ms of wall time, the interesting results are the allocations and GC pauses per second.
+func BenchmarkBridgeSpeakers(b *testing.B) {
+	br := bridgetest.NewBridge(nil)
+	if !br.Start(bridgeTimeout) {
+		b.Fatal("bridge did not connect")
+	}
+	defer br.Stop()
+	voice := br.Discord.Voice()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		audio := br.Mumble.Client().Audio()
+		for {
+			select {
+			case <-voice.Sent:
+			case _, ok := <-audio:
+				if !ok {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	speakLoad(b, br, voice, stop)
+	// Let the streams and jitter buffers settle
+	time.Sleep(200 * time.Millisecond)
+
+	var before, after runtime.MemStats
+	b.ResetTimer()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	time.Sleep(time.Duration(b.N) * 10 * time.Millisecond)
+	elapsed := time.Since(start).Seconds()
+	runtime.ReadMemStats(&after)
+	b.StopTimer()
+
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/elapsed, "allocs/s")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/elapsed, "B/s")
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/elapsed, "gc/s")
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/elapsed, "gc-pause-ns/s")
+}
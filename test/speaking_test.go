@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge/bridgetest"
+)
+
+// checkHangover fails unless the frames are loud frames of the speakers followed by at least n frames of comfort noise
+func checkHangover(t *testing.T, frames []bridgetest.Frame, loud, n int) {
+	t.Helper()
+	var peaks []int
+	last := -1
+	for i, f := range frames {
+		p := bridgetest.Peak(f.PCM)
+		peaks = append(peaks, p)
+		if p == 3000 {
+			loud--
+			last = i
+		} else if p == 0 || p > 600 {
+			t.Fatalf("expected speech or comfort noise, peaks %v", peaks)
+		}
+	}
+	if loud != 0 || len(frames)-1-last < n {
+		t.Fatalf("unexpected speech or hangover, peaks %v", peaks)
+	}
+}
+
+func TestBridgeSpeakingHangover(t *testing.T) {
+	b := bridgetest.NewBridge(nil)
+	b.BridgeConfig.SpeakingHold = 300 * time.Millisecond
+	b.BridgeConfig.ComfortNoise = -40
+	if !b.Start(bridgeTimeout) {
+		t.Fatal("bridge did not connect")
+	}
+	t.Cleanup(b.Stop)
+	voice := b.Discord.Voice()
+	_, sets := voice.IsSpeaking()
+
+	// A pause shorter than the hangover keeps the speaking state, comfort noise fills the pause and the hangover
+	mumbleSpeaker(b, 1, 3000, 5)
+	discordPeaks(t, voice, 5)
+	mumbleSpeaker(b, 1, 3000, 5)
+	frames, err := voice.Capture(700 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHangover(t, frames, 5, 5)
+	if speaking, n := voice.IsSpeaking(); speaking || n != sets+2 {
+		t.Fatalf("speaking %v after %v speaking state changes", speaking, n-sets)
+	}
+	if n := counterMetric(t, b, "mdb_to_discord_speaking_toggles_per_minute"); n != 2 {
+		t.Errorf("%v speaking toggles", n)
+	}
+
+	// A short burst keeps the speaking state for the hold time
+	mumbleSpeaker(b, 1, 3000, 2)
+	frames, err = voice.Capture(700 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHangover(t, frames, 2, 13)
+	if n := counterMetric(t, b, "mdb_to_discord_speaking_toggles_per_minute"); n != 4 {
+		t.Errorf("%v speaking toggles", n)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stieneee/mumble-discord-bridge/internal/bridge"
+)
+
+func tone(amplitude int16) []int16 {
+	pcm := make([]int16, 480)
+	for i := range pcm {
+		if i%2 == 0 {
+			pcm[i] = amplitude
+		} else {
+			pcm[i] = -amplitude
+		}
+	}
+	return pcm
+}
+
+func TestUserStats(t *testing.T) {
+	s := bridge.NewUserStats()
+
+	for i := 0; i < 100; i++ {
+		s.Packet("discord", "1", "alice")
+		s.Frame("discord", "1", "alice", tone(1000), 10*time.Millisecond)
+	}
+	// silence is not speaking time
+	s.Frame("discord", "1", "alice", make([]int16, 480), 10*time.Millisecond)
+	s.Drop("discord", "1", "alice")
+	s.Frame("mumble", "bob", "bob", tone(2000), 10*time.Millisecond)
+
+	snap := s.Snapshot()
+	if len(snap) != 2 {
+		t.Fatal("expected two users", snap)
+	}
+	alice := snap[0]
+	if alice.Name != "alice" || alice.SpeakingTime != time.Second || alice.Packets != 100 || alice.Frames != 101 || alice.Dropped != 1 || alice.Peak != 1000 {
+		t.Errorf("unexpected stats %+v", alice)
+	}
+	if rms := alice.RMS(); rms < 999 || rms > 1001 {
+		t.Error("unexpected rms", rms)
+	}
+	if !strings.Contains(s.Summary(10, "\n"), "alice (discord) spoke 1s") {
+		t.Error("unexpected summary", s.Summary(10, "\n"))
+	}
+}
+
+func TestUserStatsRollup(t *testing.T) {
+	dir := t.TempDir()
+	s := bridge.NewUserStats()
+
+	// two rollups on the same day are merged
+	for i := 0; i < 2; i++ {
+		s.Frame("mumble", "bob", "bob", tone(2000), 10*time.Millisecond)
+		if err := s.Rollup(dir, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.Snapshot()) != 0 {
+		t.Error("rollup did not reset the counters")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "user-stats-*.json"))
+	if len(files) != 1 {
+		t.Fatal("expected one rollup file", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	var out struct {
+		Users []bridge.UserStat `json:"users"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Users) != 1 || out.Users[0].SpeakingTime != 20*time.Millisecond || out.Users[0].Frames != 2 {
+		t.Errorf("unexpected rollup %+v", out.Users)
+	}
+}
+
+func TestUserStatsRollupError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "user-stats-"+time.Now().Format("2006-01-02")+".json")
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := bridge.NewUserStats()
+
+	// a failed rollup keeps the statistics for the next one
+	s.Frame("mumble", "bob", "bob", tone(2000), 10*time.Millisecond)
+	if err := s.Rollup(dir, true); err == nil {
+		t.Fatal("expected an error for a corrupt rollup file")
+	}
+	s.Frame("mumble", "bob", "bob", tone(2000), 10*time.Millisecond)
+	if snap := s.Snapshot(); len(snap) != 1 || snap[0].Frames != 2 {
+		t.Fatalf("statistics lost by a failed rollup %+v", snap)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"users":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rollup(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	var out struct {
+		Users []bridge.UserStat `json:"users"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Users) != 1 || out.Users[0].Frames != 2 {
+		t.Errorf("unexpected rollup %+v", out.Users)
+	}
+}
+
+// userSeries returns the user label values of a metric family
+func userSeries(t *testing.T, m *bridge.Metrics, name string) []string {
+	t.Helper()
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "user" {
+					res = append(res, l.GetValue())
+				}
+			}
+		}
+	}
+	return res
+}
+
+func TestUserStatsMetrics(t *testing.T) {
+	m := bridge.NewMetrics("test")
+	s := bridge.NewUserStats()
+	s.EnableMetrics(m, 1)
+
+	s.Frame("discord", "1", "alice", tone(1000), 10*time.Millisecond)
+	s.Frame("discord", "1", "alicia", tone(1000), 10*time.Millisecond)
+	s.Frame("discord", "2", "carol", tone(1000), 10*time.Millisecond)
+
+	if got := userSeries(t, m, "mdb_user_speaking_seconds"); strings.Join(got, ",") != "1,other" {
+		t.Error("unexpected speaking series", got)
+	}
+	if got := userSeries(t, m, "mdb_user_peak_dbfs"); strings.Join(got, ",") != "1" {
+		t.Error("other should have no peak gauge", got)
+	}
+	if got := userSeries(t, m, "mdb_user_info"); len(got) != 1 {
+		t.Error("a renamed user should keep a single info series", got)
+	}
+
+	// the rollup starts a new day of labels
+	if err := s.Rollup(t.TempDir(), true); err != nil {
+		t.Fatal(err)
+	}
+	if got := userSeries(t, m, "mdb_user_speaking_seconds"); len(got) != 0 {
+		t.Error("series not reset by the rollup", got)
+	}
+	s.Frame("discord", "2", "carol", tone(1000), 10*time.Millisecond)
+	if got := userSeries(t, m, "mdb_user_speaking_seconds"); strings.Join(got, ",") != "2" {
+		t.Error("unexpected speaking series after the rollup", got)
+	}
+}
+
+func TestUserStatsNil(t *testing.T) {
+	var s *bridge.UserStats
+	s.Frame("discord", "1", "alice", tone(1000), 10*time.Millisecond)
+	if s.Rollup(t.TempDir(), true) != nil || s.Snapshot() != nil {
+		t.Error("nil stats should be a no-op")
+	}
+}